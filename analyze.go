@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Compression analysis: gopigz analyze [--json] [FILE]
+//
+// Compresses the input block by block without writing anything, and
+// reports how compressible each block is, as its byte entropy and the size
+// deflate got it down to, which regions of the input compress well, and a
+// histogram of the blocks by ratio. Every block is also compressed primed
+// with the end of the one before it; when that helps, the blocks share
+// content that larger blocks or a dictionary would find.
+
+// Number of regions the input is summarized in
+const ANALYZE_REGIONS = 16
+
+// Blocks compressing to more than this fraction of their size count as
+// incompressible
+const INCOMPRESSIBLE_RATIO = 0.95
+
+type blockAnalysis struct {
+	Index      int     `json:"index"`
+	Offset     int64   `json:"offset"`
+	Size       int     `json:"size"`
+	Compressed int     `json:"compressed"`
+	Primed     int     `json:"primed"` // compressed with the previous block as dictionary
+	Ratio      float64 `json:"ratio"`
+	Entropy    float64 `json:"entropy"` // bits per byte
+}
+
+type regionAnalysis struct {
+	Start   int64   `json:"start"`
+	End     int64   `json:"end"`
+	Ratio   float64 `json:"ratio"`
+	Entropy float64 `json:"entropy"`
+}
+
+type histogramBucket struct {
+	From   float64 `json:"from"`
+	To     float64 `json:"to"`
+	Blocks int     `json:"blocks"`
+}
+
+type analysis struct {
+	Path       string            `json:"path"`
+	Size       int64             `json:"size"`
+	Compressed int64             `json:"compressed"`
+	Ratio      float64           `json:"ratio"`
+	Entropy    float64           `json:"entropy"`
+	BlockSize  int               `json:"block_size"`
+	Blocks     []blockAnalysis   `json:"blocks"`
+	Regions    []regionAnalysis  `json:"regions"`
+	Histogram  []histogramBucket `json:"histogram"`
+	Hints      []string          `json:"hints"`
+}
+
+// entropy returns the Shannon entropy of the bytes of data, in bits per
+// byte.
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, c := range data {
+		counts[c]++
+	}
+	h := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(data))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// deflatedSize returns the size of data deflated at the default level,
+// primed with dict if not nil.
+func deflatedSize(data, dict []byte) int {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriterDict(&buf, flate.DefaultCompression, dict)
+	fw.Write(data)
+	fw.Close()
+	return buf.Len()
+}
+
+func ratio(compressed, size int64) float64 {
+	if size == 0 {
+		return 1
+	}
+	return float64(compressed) / float64(size)
+}
+
+// analyzeStream compresses input block by block with processes workers, at
+// least one.
+func analyzeStream(input io.Reader) *analysis {
+	blocks := read(input, nil)
+
+	type job struct {
+		b    *block
+		prev []byte
+	}
+	jobs := make(chan job)
+	go func() {
+		var prev []byte
+		for b := range blocks {
+			jobs <- job{b, prev}
+			if len(b.RawData) >= DICT_SIZE {
+				prev = b.RawData[len(b.RawData)-DICT_SIZE:]
+			} else {
+				prev = append(prev, b.RawData...)
+			}
+		}
+		close(jobs)
+	}()
+
+	var mu sync.Mutex
+	var results []blockAnalysis
+	workers := processes
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for p := 0; p < workers; p++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				data := j.b.RawData
+				r := blockAnalysis{
+					Index:      j.b.Index - 1,
+					Offset:     int64(j.b.Index-1) * int64(blockSize),
+					Size:       len(data),
+					Compressed: deflatedSize(data, nil),
+					Entropy:    entropy(data),
+				}
+				r.Primed = r.Compressed
+				if j.prev != nil {
+					r.Primed = deflatedSize(data, j.prev)
+				}
+				r.Ratio = ratio(int64(r.Compressed), int64(r.Size))
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+				blockDone()
+			}
+		}()
+	}
+	wg.Wait()
+
+	a := &analysis{BlockSize: blockSize, Blocks: make([]blockAnalysis, len(results))}
+	for _, r := range results {
+		a.Blocks[r.Index] = r
+	}
+	a.summarize()
+	return a
+}
+
+// summarize fills in the totals, regions, histogram and hints from the
+// blocks.
+func (a *analysis) summarize() {
+	var primed int64
+	bits := 0.0
+	incompressible := 0
+	for _, b := range a.Blocks {
+		a.Size += int64(b.Size)
+		a.Compressed += int64(b.Compressed)
+		primed += int64(b.Primed)
+		bits += b.Entropy * float64(b.Size)
+		if b.Size > 0 && b.Ratio > INCOMPRESSIBLE_RATIO {
+			incompressible++
+		}
+	}
+	a.Ratio = ratio(a.Compressed, a.Size)
+	if a.Size > 0 {
+		a.Entropy = bits / float64(a.Size)
+	}
+
+	n := len(a.Blocks)
+	regions := ANALYZE_REGIONS
+	if n < regions {
+		regions = n
+	}
+	for r := 0; r < regions; r++ {
+		first, last := r*n/regions, (r+1)*n/regions
+		var size, compressed int64
+		bits := 0.0
+		for _, b := range a.Blocks[first:last] {
+			size += int64(b.Size)
+			compressed += int64(b.Compressed)
+			bits += b.Entropy * float64(b.Size)
+		}
+		region := regionAnalysis{Start: a.Blocks[first].Offset, End: a.Blocks[first].Offset + size, Ratio: ratio(compressed, size)}
+		if size > 0 {
+			region.Entropy = bits / float64(size)
+		}
+		a.Regions = append(a.Regions, region)
+	}
+
+	for i := 0; i < 10; i++ {
+		a.Histogram = append(a.Histogram, histogramBucket{From: float64(i) / 10, To: float64(i+1) / 10})
+	}
+	for _, b := range a.Blocks {
+		i := int(b.Ratio * 10)
+		if i > 9 {
+			i = 9
+		}
+		a.Histogram[i].Blocks++
+	}
+
+	a.Hints = []string{}
+	if n > 0 && incompressible*2 >= n {
+		a.Hints = append(a.Hints, fmt.Sprintf("%d of %d blocks hardly compress: the data is likely already compressed or encrypted, and compressing it costs CPU for little gain", incompressible, n))
+	}
+	if a.Compressed > 0 && primed < a.Compressed*9/10 {
+		a.Hints = append(a.Hints, fmt.Sprintf("blocks share content: priming each with the one before saves %.0f%%, so larger blocks or a --dict trained with gopigz train would help", 100*(1-float64(primed)/float64(a.Compressed))))
+	}
+	if a.Size > 0 && a.Size < DICT_SIZE && a.Ratio > 0.5 {
+		a.Hints = append(a.Hints, "small input: a --dict trained with gopigz train on similar files would help")
+	}
+	if len(a.Regions) > 1 {
+		lo, hi := a.Regions[0].Ratio, a.Regions[0].Ratio
+		for _, r := range a.Regions {
+			lo, hi = math.Min(lo, r.Ratio), math.Max(hi, r.Ratio)
+		}
+		if hi-lo > 0.5 {
+			a.Hints = append(a.Hints, fmt.Sprintf("compressibility varies across the input, from %.0f%% to %.0f%% by region", 100*lo, 100*hi))
+		}
+	}
+}
+
+// runAnalyze implements the analyze subcommand.
+func runAnalyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	asJSON := fs.Bool("json", jsonOutput, "Print the report as JSON")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: gopigz analyze [--json] [FILE]")
+		os.Exit(1)
+	}
+
+	input, path := io.Reader(os.Stdin), "-"
+	if fs.NArg() == 1 {
+		path = fs.Arg(0)
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		input = f
+	}
+	a := analyzeStream(input)
+	a.Path = path
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(a, "", "  ")
+		fmt.Println(string(out))
+		os.Exit(0)
+	}
+	a.print(os.Stdout)
+	os.Exit(0)
+}
+
+// Width of the histogram bars
+const ANALYZE_BAR_WIDTH = 40
+
+func (a *analysis) print(w io.Writer) {
+	fmt.Fprintf(w, "%s: %s in %d blocks of %s\n", a.Path, formatSize(a.Size), len(a.Blocks), formatSize(int64(blockSize)))
+	fmt.Fprintf(w, "compressed:    %s (%.1f%%), entropy %.2f bits/byte\n", formatSize(a.Compressed), 100*a.Ratio, a.Entropy)
+
+	fmt.Fprintln(w, "regions:")
+	for _, r := range a.Regions {
+		fmt.Fprintf(w, "  %-19s %5.1f%%  entropy %.2f\n", formatSize(r.Start)+"-"+formatSize(r.End), 100*r.Ratio, r.Entropy)
+	}
+
+	fmt.Fprintln(w, "blocks by compressed size:")
+	most := 1
+	for _, h := range a.Histogram {
+		if h.Blocks > most {
+			most = h.Blocks
+		}
+	}
+	for _, h := range a.Histogram {
+		bar := strings.Repeat("#", (h.Blocks*ANALYZE_BAR_WIDTH+most-1)/most)
+		fmt.Fprintf(w, "  %3.0f-%3.0f%%  %-*s %d\n", 100*h.From, 100*h.To, ANALYZE_BAR_WIDTH, bar, h.Blocks)
+	}
+
+	if len(a.Hints) > 0 {
+		fmt.Fprintln(w, "hints:")
+		for _, h := range a.Hints {
+			fmt.Fprintln(w, "  -", h)
+		}
+	}
+}
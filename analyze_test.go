@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	random := make([]byte, 2*BLOCK_SIZE)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 2*BLOCK_SIZE/44)
+	data := append(append([]byte{}, text...), random...)
+
+	a := analyzeStream(bytes.NewReader(data))
+	if a.Size != int64(len(data)) || len(a.Blocks) != (len(data)+BLOCK_SIZE-1)/BLOCK_SIZE {
+		t.Fatalf("size %d, %d blocks", a.Size, len(a.Blocks))
+	}
+	first, last := a.Blocks[0], a.Blocks[len(a.Blocks)-1]
+	if first.Ratio > 0.1 || first.Entropy > 5 || last.Ratio < INCOMPRESSIBLE_RATIO || last.Entropy < 7.9 {
+		t.Errorf("first %+v, last %+v", first, last)
+	}
+	total := 0
+	for _, h := range a.Histogram {
+		total += h.Blocks
+	}
+	if total != len(a.Blocks) || a.Histogram[0].Blocks < 2 || a.Histogram[9].Blocks < 2 {
+		t.Errorf("histogram %+v", a.Histogram)
+	}
+	if len(a.Regions) != len(a.Blocks) || a.Regions[len(a.Regions)-1].End != a.Size {
+		t.Errorf("regions %+v", a.Regions)
+	}
+	if len(a.Hints) == 0 || !strings.Contains(strings.Join(a.Hints, "\n"), "hardly compress") {
+		t.Errorf("hints %q", a.Hints)
+	}
+
+	var out bytes.Buffer
+	a.print(&out)
+	if !strings.Contains(out.String(), "blocks by compressed size:") {
+		t.Errorf("report:\n%s", out.String())
+	}
+
+	empty := analyzeStream(bytes.NewReader(nil))
+	if empty.Size != 0 || len(empty.Histogram) != 10 {
+		t.Errorf("empty %+v", empty)
+	}
+
+	// -p 0 still analyzes with one worker
+	saved := processes
+	defer func() { processes = saved }()
+	processes = 0
+	if a := analyzeStream(bytes.NewReader(data)); a.Size != int64(len(data)) {
+		t.Errorf("-p 0: size %d", a.Size)
+	}
+}
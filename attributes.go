@@ -0,0 +1,28 @@
+package main
+
+import "os"
+
+// Output file attributes.
+//
+// A file compressed or decompressed in place gets the attributes of the one
+// it replaces, as with gzip: the owner and group when the process may set
+// them, the permission bits including setuid, setgid and sticky, and the
+// access and modification times, so that backups round-trip faithfully.
+// When decompressing, -N then gives it the time of the gzip header instead.
+// Outputs to standard output, --output or --tar are left as they are made.
+
+// copyAttributes gives the file at path the owner, mode and times of info.
+// An owner that cannot be set is left as is, like gzip does.
+func copyAttributes(path string, info os.FileInfo) error {
+	// chown clears setuid and setgid, so it goes first
+	if uid, gid, ok := fileOwner(info); ok {
+		if err := os.Chown(path, uid, gid); err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+	mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, accessTime(info), info.ModTime())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that compressing and decompressing a file keep its mode, times and,
+// as root, its owner
+func TestCopyAttributes(t *testing.T) {
+	defer func() { summary = runSummary{} }()
+	path := filepath.Join(t.TempDir(), "kept")
+	if err := ioutil.WriteFile(path, []byte("attributes\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	root := os.Geteuid() == 0
+	if root {
+		if err := os.Chown(path, 1234, 2345); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(path, 0751|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(path string) {
+		got, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Mode() != want.Mode() || !got.ModTime().Equal(modified) {
+			t.Errorf("%s: mode %v, time %v", path, got.Mode(), got.ModTime())
+		}
+		if uid, gid, _ := fileOwner(got); root && (uid != 1234 || gid != 2345) {
+			t.Errorf("%s: owner %d:%d", path, uid, gid)
+		}
+	}
+	compressFile(path)
+	check(path + ".gz")
+	decompressFile(path + ".gz")
+	check(path)
+}
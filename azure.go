@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Azure Blob Storage backend (az://ACCOUNT/CONTAINER/BLOB).
+//
+// Parts are staged as blocks and committed with a block list. Requests are
+// authorized with a shared access signature from AZURE_STORAGE_SAS_TOKEN.
+// Every block is sent with its Content-MD5, which the service verifies.
+
+// Blob service REST API version
+const AZURE_API_VERSION = "2020-10-02"
+
+func init() {
+	outputSchemes["az"] = openAzureOutput
+}
+
+type azureUpload struct {
+	blob string // URL of the blob, without the query
+	sas  string
+}
+
+func openAzureOutput(u *url.URL) (io.WriteCloser, error) {
+	sas := strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+	if sas == "" {
+		return nil, errors.New("az output needs AZURE_STORAGE_SAS_TOKEN")
+	}
+	endpoint := os.Getenv("AZURE_STORAGE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://" + u.Host + ".blob.core.windows.net"
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+	if !strings.Contains(path, "/") {
+		return nil, fmt.Errorf("%s: expected az://ACCOUNT/CONTAINER/BLOB", u.Redacted())
+	}
+	blob := strings.TrimSuffix(endpoint, "/") + "/" + uriEncode(path, false)
+	return newMultipartWriter(&azureUpload{blob: blob, sas: sas}), nil
+}
+
+func (a *azureUpload) do(query string, header http.Header, payload []byte) (http.Header, error) {
+	req, err := http.NewRequest("PUT", a.blob+"?"+query+"&"+a.sas, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Version", AZURE_API_VERSION)
+
+	// the SAS token is a credential: keep it out of messages
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if e, ok := err.(*url.Error); ok {
+			e.URL = a.blob
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse("PUT "+a.blob+"?"+query, resp); err != nil {
+		return nil, err
+	}
+	return resp.Header, nil
+}
+
+// blockID names part n. All IDs of a blob must have the same length.
+func blockID(n int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("part%08d", n)))
+}
+
+func (a *azureUpload) UploadPart(n int, data []byte, sum []byte) (string, error) {
+	id := blockID(n)
+	header := http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+	h, err := a.do("comp=block&blockid="+uriEncode(id, true), header, data)
+	if err != nil {
+		return "", err
+	}
+	if got := h.Get("Content-Md5"); got != "" && got != header.Get("Content-MD5") {
+		return "", fmt.Errorf("block %d: stored with checksum %s, sent %s", n, got, header.Get("Content-MD5"))
+	}
+	return id, nil
+}
+
+func (a *azureUpload) Complete(parts []string) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range parts {
+		body.WriteString("<Latest>" + id + "</Latest>")
+	}
+	body.WriteString("</BlockList>")
+
+	header := http.Header{}
+	header.Set("X-Ms-Blob-Content-Type", contentType())
+	_, err := a.do("comp=blocklist", header, body.Bytes())
+	return err
+}
+
+// Abort does nothing: blocks that are never committed are discarded by the
+// service after a week.
+func (a *azureUpload) Abort() error {
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// BLAKE3 block trees (--blake3, gopigz b3verify).
+//
+// With --blake3, compressing FILE also writes FILE.gz.b3 holding the BLAKE3
+// chaining value of every block of the input. A block of a power of two
+// bytes, as -b must then be, is a whole subtree of the input's BLAKE3 tree, so the values combine into the
+// BLAKE3 hash of the input, the one b3sum prints, which the file holds too.
+// Any block can then be checked on its own against the file, such as the
+// ones a range request decompressed:
+//
+//	gopigz -d --range 1048576-2097151 URL | gopigz b3verify --from 1048576 FILE.gz.b3
+//
+// and the file itself against the hash of the input.
+//
+// The file is B3_MAGIC, the block size and the input size as little-endian
+// uint64s, the hash of the input, and 32 bytes per block.
+
+// Parsing blake3 flag
+var blake3Tree bool
+
+const B3_SUFFIX = ".b3"
+
+var B3_MAGIC = []byte("GPZB3T1\n")
+
+func init() {
+	optionChecks = append(optionChecks, func() error {
+		if blake3Tree && blockSize&(blockSize-1) != 0 {
+			return errors.New("--blake3 needs a block size that is a power of two")
+		}
+		return nil
+	})
+}
+
+// block tree of the stream being written
+var b3Blocks []b3Output
+var b3Size int64
+
+// addToB3Tree records the subtree of block b.
+func addToB3Tree(b *block) {
+	b3Blocks = append(b3Blocks, b.b3)
+	b3Size += int64(len(b.RawData))
+}
+
+// b3BlockOutput hashes the data of block number index, counting from 0.
+func b3BlockOutput(data []byte, index int64, blockSize int64) b3Output {
+	return b3Subtree(data, uint64(index*blockSize/B3_CHUNK_LEN))
+}
+
+// b3TreeCV returns the chaining value of the subtree over the blocks of cvs.
+func b3TreeCV(cvs [][8]uint32) [8]uint32 {
+	if len(cvs) == 1 {
+		return cvs[0]
+	}
+	left := b3LeftLen(uint64(len(cvs)))
+	return b3Parent(b3TreeCV(cvs[:left]), b3TreeCV(cvs[left:])).chainingValue()
+}
+
+// b3Tree is the contents of a .b3 file.
+type b3Tree struct {
+	blockSize int64
+	size      int64
+	root      [32]byte
+	cvs       [][8]uint32
+}
+
+// b3RootOf returns the hash of an input of more than one block from the
+// chaining values of its blocks.
+func b3RootOf(cvs [][8]uint32) [32]byte {
+	left := b3LeftLen(uint64(len(cvs)))
+	return b3Parent(b3TreeCV(cvs[:left]), b3TreeCV(cvs[left:])).rootHash()
+}
+
+// writeB3Tree writes the tree of the stream just compressed to path.
+func writeB3Tree(path string) error {
+	var root [32]byte
+	cvs := make([][8]uint32, len(b3Blocks))
+	for i, o := range b3Blocks {
+		cvs[i] = o.chainingValue()
+	}
+	if len(b3Blocks) == 1 {
+		root = b3Blocks[0].rootHash()
+	} else {
+		root = b3RootOf(cvs)
+	}
+
+	buf := append([]byte(nil), B3_MAGIC...)
+	buf = appendUint64(buf, uint64(blockSize))
+	buf = appendUint64(buf, uint64(b3Size))
+	buf = append(buf, root[:]...)
+	for _, cv := range cvs {
+		for _, w := range cv {
+			buf = appendUint32(buf, w)
+		}
+	}
+	return ioutil.WriteFile(path, buf, 0644)
+}
+
+var errBadB3Tree = errors.New("not a valid BLAKE3 block tree")
+
+// readB3Tree reads a .b3 file and checks that its blocks add up to its
+// hash.
+func readB3Tree(path string) (*b3Tree, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	head := len(B3_MAGIC) + 16 + 32
+	if len(data) < head || !bytes.Equal(data[:len(B3_MAGIC)], B3_MAGIC) {
+		return nil, errBadB3Tree
+	}
+	le := binary.LittleEndian
+	t := &b3Tree{
+		blockSize: int64(le.Uint64(data[len(B3_MAGIC):])),
+		size:      int64(le.Uint64(data[len(B3_MAGIC)+8:])),
+	}
+	copy(t.root[:], data[head-32:head])
+	if t.blockSize <= 0 || t.blockSize%B3_CHUNK_LEN != 0 || t.size < 0 {
+		return nil, errBadB3Tree
+	}
+	blocks := (t.size + t.blockSize - 1) / t.blockSize
+	if blocks == 0 {
+		blocks = 1
+	}
+	if int64(len(data)-head) != 32*blocks {
+		return nil, errBadB3Tree
+	}
+	for p := data[head:]; len(p) > 0; p = p[32:] {
+		var cv [8]uint32
+		for i := range cv {
+			cv[i] = le.Uint32(p[4*i:])
+		}
+		t.cvs = append(t.cvs, cv)
+	}
+	// a single block is its own root, which only its data can show
+	if len(t.cvs) > 1 && b3RootOf(t.cvs) != t.root {
+		return nil, fmt.Errorf("%s: blocks do not match the hash of the input", path)
+	}
+	return t, nil
+}
+
+// verify checks the data of block index, and reports whether it matches.
+func (t *b3Tree) verify(index int64, data []byte) bool {
+	o := b3BlockOutput(data, index, t.blockSize)
+	if len(t.cvs) == 1 {
+		return o.rootHash() == t.root
+	}
+	return o.chainingValue() == t.cvs[index]
+}
+
+// runB3Verify implements the b3verify subcommand: the input, from FILE or
+// standard input, is checked block by block against a .b3 file.
+func runB3Verify(args []string) {
+	fs := flag.NewFlagSet("b3verify", flag.ExitOnError)
+	var from sizeFlag
+	fs.Var(&from, "from", "Offset in the uncompressed data where the input starts, a multiple of the block size")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fmt.Fprintln(os.Stderr, "usage: gopigz b3verify [--from OFFSET] TREE.b3 [FILE]")
+		os.Exit(1)
+	}
+	t, err := readB3Tree(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if int64(from)%t.blockSize != 0 || int64(from) > t.size {
+		log.Fatalf("--from %d is not at a block boundary within the input", from)
+	}
+
+	input := io.Reader(os.Stdin)
+	if fs.NArg() == 2 {
+		f, err := os.Open(fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	verified, failed := 0, 0
+	buf := make([]byte, t.blockSize)
+	for index := int64(from) / t.blockSize; index < int64(len(t.cvs)); index++ {
+		n, err := io.ReadFull(input, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			log.Fatal(err)
+		}
+		want := t.blockSize
+		if rest := t.size - index*t.blockSize; rest < want {
+			want = rest
+		}
+		if int64(n) < want {
+			// the input stops within this block, as a range may
+			if n > 0 || index == int64(from)/t.blockSize {
+				warnf("block %d: only %d of %d bytes, not verified", index, n, want)
+			}
+			break
+		}
+		if !t.verify(index, buf[:want]) {
+			log.Printf("block %d (bytes %d-%d): does not match", index, index*t.blockSize, index*t.blockSize+want-1)
+			setError()
+			failed++
+			continue
+		}
+		verified++
+	}
+	fmt.Fprintf(os.Stderr, "%d blocks verified, %d failed\n", verified, failed)
+	os.Exit(exitStatus)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+)
+
+// pattern returns the input of the BLAKE3 test vectors.
+func pattern(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestBLAKE3(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{nil, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{[]byte("abc"), "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{pattern(1023), "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+		{pattern(1025), "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{pattern(131073), "f837d4254d24ba3d50fe3743d46e4af6db5f5d6ab0469197d94e7ba1e906c4d8"},
+	}
+	for _, test := range tests {
+		got := blake3(test.data)
+		if hex.EncodeToString(got[:]) != test.want {
+			t.Errorf("blake3 of %d bytes = %x, want %s", len(test.data), got, test.want)
+		}
+	}
+}
+
+// Test that the block tree of a compressed stream adds up to the BLAKE3
+// hash of the input and verifies its blocks one by one
+func TestB3Tree(t *testing.T) {
+	const want = "6e5b7b875c97872da29e27c09ac8f4a3c2eca94e95f6eae2d2e87caf1cf22b2e"
+	path := filepath.Join(t.TempDir(), "data.b3")
+	for _, data := range [][]byte{pattern(400000), pattern(1000), nil} {
+		blake3Tree = true
+		err := compressStream(bytes.NewReader(data), &bytes.Buffer{})
+		blake3Tree = false
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeB3Tree(path); err != nil {
+			t.Fatal(err)
+		}
+		tree, err := readB3Tree(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root := blake3(data); tree.root != root {
+			t.Errorf("%d bytes: tree hash %x, want %x", len(data), tree.root, root)
+		}
+
+		for i := range tree.cvs {
+			block := data[i*BLOCK_SIZE:]
+			if len(block) > BLOCK_SIZE {
+				block = block[:BLOCK_SIZE]
+			}
+			if !tree.verify(int64(i), block) {
+				t.Errorf("%d bytes: block %d does not verify", len(data), i)
+			}
+			if len(block) > 0 {
+				bad := append([]byte(nil), block...)
+				bad[len(bad)/2] ^= 1
+				if tree.verify(int64(i), bad) {
+					t.Errorf("%d bytes: corrupted block %d verifies", len(data), i)
+				}
+			}
+		}
+	}
+	if got := blake3(pattern(400000)); hex.EncodeToString(got[:]) != want {
+		t.Errorf("blake3 = %x, want %s", got, want)
+	}
+}
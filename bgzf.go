@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"hash/crc32"
+	"io"
+)
+
+// BGZF output (--format bgzf, or --bgzf).
+//
+// The Blocked GNU Zip Format of SAMtools, which BAM, tabix-indexed VCF and
+// other bioinformatics files are stored in: a series of independent gzip
+// members of at most 64 KiB, each with its total size in a 'BC' FEXTRA
+// subfield so that readers can jump from one to the next, ending in an
+// empty member as an EOF marker. Every pipeline block is cut into members
+// of BGZF_BLOCK_SIZE bytes of input, compressed with no window from before
+// them, which costs a little ratio for random access; the block size is
+// rounded down to a whole number of members, except for --blake3, which
+// needs its own. The result is a valid
+// gzip file, suffixed .gz, that any gzip reader decompresses.
+
+// BGZF block header: a gzip header with FEXTRA and a 'BC' subfield holding
+// the total block size minus one
+const (
+	BGZF_HEADER_SIZE = 18
+	BGZF_SI1         = 'B'
+	BGZF_SI2         = 'C'
+
+	// Input per member, as bgzip takes it, so that even a stored member
+	// stays within BGZF_MAX_MEMBER
+	BGZF_BLOCK_SIZE = 0xff00
+	BGZF_MAX_MEMBER = 0x10000
+)
+
+// bgzfEOF is the empty member ending a BGZF file.
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, BGZF_SI1, BGZF_SI2, 2, 0, 0x1b, 0,
+	3, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+}
+
+func init() {
+	registerCodec("bgzf", &codec{
+		suffix:      ".gz",
+		contentType: "application/gzip",
+		newChecksum: newCRCCombiner,
+		header:      func() []byte { return nil },
+		block:       bgzfBlock,
+		trailer:     func(sum uint32) []byte { return bgzfEOF },
+		decompress: func(input io.Reader, output io.Writer) error {
+			return bgzfDecompress(bufio.NewReader(input), output)
+		},
+	})
+	flag.Var(bgzfFlag{}, "bgzf", "Write BGZF, blocked gzip for BAM, VCF and tabix (--format bgzf)")
+	optionChecks = append(optionChecks, func() error {
+		if format == "bgzf" && !blake3Tree && blockSize > BGZF_BLOCK_SIZE {
+			blockSize -= blockSize % BGZF_BLOCK_SIZE
+		}
+		return nil
+	})
+}
+
+// bgzfFlag is a boolean flag that selects the BGZF format.
+type bgzfFlag struct{}
+
+func (bgzfFlag) IsBoolFlag() bool { return true }
+func (bgzfFlag) String() string   { return "false" }
+func (bgzfFlag) Set(s string) error {
+	if s == "true" {
+		format = "bgzf"
+	}
+	return nil
+}
+
+// bgzfBlock compresses a block into BGZF members.
+func bgzfBlock(b *block) []byte {
+	var out []byte
+	for data := b.RawData; len(data) > 0; {
+		n := len(data)
+		if n > BGZF_BLOCK_SIZE {
+			n = BGZF_BLOCK_SIZE
+		}
+		out = appendBGZFMember(out, data[:n])
+		data = data[n:]
+	}
+	return out
+}
+
+// appendBGZFMember appends the member holding data to out.
+func appendBGZFMember(out, data []byte) []byte {
+	// a whole deflate stream, with nothing before it to refer to
+	deflated := deflateBlock(&block{RawData: data, LastBlock: true})
+	if BGZF_HEADER_SIZE+len(deflated)+TRAILER_SIZE > BGZF_MAX_MEMBER {
+		w := &lsbWriter{}
+		writeStoredBlocks(w, data, true)
+		deflated = w.out
+	}
+	size := BGZF_HEADER_SIZE + len(deflated) + TRAILER_SIZE
+
+	out = append(out, 0x1f, 0x8b, 8, FEXTRA, 0, 0, 0, 0, 0, OS_UNKNOWN, 6, 0, BGZF_SI1, BGZF_SI2, 2, 0)
+	out = appendUint16(out, uint16(size-1))
+	out = append(out, deflated...)
+	out = appendUint32(out, crc32.ChecksumIEEE(data))
+	return appendUint32(out, uint32(len(data)))
+}
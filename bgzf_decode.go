@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// Parallel BGZF decompression.
+//
+// A deflate stream cannot be inflated in parallel, since any byte may refer
+// back to the ones before, but the members of a BGZF file are independent
+// and each says how long it is. So when a gzip input starts with a BGZF
+// header, a reader cuts it into members by their BSIZE fields, -p workers
+// inflate them and check their CRC-32 and size, and the results are written
+// in order, at most as many members waiting as there are workers. Should a
+// member that is not BGZF follow, as in a BGZF file with plain gzip appended
+// by cat, the rest of the input is decompressed as ordinary gzip.
+
+// isBGZFHeader reports whether header starts a BGZF member: a gzip header
+// with FEXTRA only, whose extra field is the 'BC' subfield alone.
+func isBGZFHeader(header []byte) bool {
+	return len(header) >= BGZF_HEADER_SIZE && header[0] == 0x1f && header[1] == 0x8b &&
+		header[2] == 8 && header[3] == FEXTRA && binary.LittleEndian.Uint16(header[10:]) == 6 &&
+		header[12] == BGZF_SI1 && header[13] == BGZF_SI2 && binary.LittleEndian.Uint16(header[14:]) == 2
+}
+
+// bgzfDecompress inflates the gzip stream in r to output, the BGZF members
+// at its start in parallel.
+func bgzfDecompress(r *bufio.Reader, output io.Writer) error {
+	workers := processes
+	if workers < 1 {
+		workers = 1
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	type job struct {
+		member []byte
+		done   chan result
+	}
+	jobs := make(chan job)
+	order := make(chan chan result, workers)
+	stop := make(chan struct{})
+
+	// the reader ends at the end of the input, at a member that is not
+	// BGZF, or with the error of a truncated one
+	var readErr error
+	go func() {
+		defer close(order)
+		defer close(jobs)
+		for {
+			header, err := r.Peek(BGZF_HEADER_SIZE)
+			if len(header) == 0 && err == io.EOF || !isBGZFHeader(header) {
+				return
+			}
+			member := make([]byte, int(binary.LittleEndian.Uint16(header[16:]))+1)
+			if _, err := io.ReadFull(r, member); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				readErr = err
+				return
+			}
+			done := make(chan result, 1)
+			select {
+			case order <- done:
+			case <-stop:
+				return
+			}
+			jobs <- job{member, done}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for j := range jobs {
+				data, err := inflateBGZFMember(j.member)
+				j.done <- result{data, err}
+			}
+		}()
+	}
+
+	var err error
+	for done := range order {
+		res := <-done
+		if err == nil {
+			err = res.err
+			if err == nil {
+				_, err = output.Write(res.data)
+			}
+			if err != nil {
+				close(stop)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+
+	// whatever follows the BGZF members
+	if _, err := r.Peek(1); err == io.EOF {
+		return nil
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, gz); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// inflateBGZFMember returns the data of a whole BGZF member, checked against
+// its CRC-32 and size.
+func inflateBGZFMember(member []byte) ([]byte, error) {
+	if len(member) < BGZF_HEADER_SIZE+TRAILER_SIZE {
+		return nil, gzip.ErrHeader
+	}
+	trailer := member[len(member)-TRAILER_SIZE:]
+	size := binary.LittleEndian.Uint32(trailer[4:])
+	if size > 1<<16 {
+		return nil, gzip.ErrHeader
+	}
+	fr := flate.NewReader(bytes.NewReader(member[BGZF_HEADER_SIZE : len(member)-TRAILER_SIZE]))
+	data, err := ioutil.ReadAll(io.LimitReader(fr, int64(size)+1))
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if uint32(len(data)) != size || crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(trailer) {
+		return nil, gzip.ErrChecksum
+	}
+	return data, nil
+}
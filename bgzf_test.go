@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// Test that BGZF output is a series of members of at most 64 KiB with their
+// size in the 'BC' subfield, ending in the EOF marker, and reads back as
+// gzip
+func TestBGZF(t *testing.T) {
+	format = "bgzf"
+	defer func() { format = "gzip" }()
+
+	// compressible text, then random bytes that have to be stored
+	var data []byte
+	for i := 0; len(data) < 3*BLOCK_SIZE; i++ {
+		data = append(data, []byte("read 1234 mapped to chr7\n")...)
+	}
+	noise := make([]byte, 2*BGZF_BLOCK_SIZE+99)
+	rand.New(rand.NewSource(1)).Read(noise)
+	data = append(data, noise...)
+
+	for _, lvl := range []int{flate.DefaultCompression, flate.NoCompression} {
+		level = lvl
+		var out bytes.Buffer
+		if err := compressStream(bytes.NewReader(data), &out); err != nil {
+			t.Fatal(err)
+		}
+		stream := out.Bytes()
+		if !bytes.HasSuffix(stream, bgzfEOF) {
+			t.Fatalf("level %d: no EOF marker", lvl)
+		}
+
+		var total int
+		for rest := stream; len(rest) > 0; {
+			if len(rest) < BGZF_HEADER_SIZE || rest[3] != FEXTRA || rest[12] != BGZF_SI1 || rest[13] != BGZF_SI2 {
+				t.Fatalf("level %d: bad header at %d", lvl, len(stream)-len(rest))
+			}
+			size := int(binary.LittleEndian.Uint16(rest[16:])) + 1
+			isize := int(binary.LittleEndian.Uint32(rest[size-4:]))
+			if isize > BGZF_BLOCK_SIZE {
+				t.Errorf("level %d: member of %d bytes", lvl, isize)
+			}
+			total += isize
+			rest = rest[size:]
+		}
+		if total != len(data) {
+			t.Errorf("level %d: members hold %d bytes, want %d", lvl, total, len(data))
+		}
+
+		zr, err := gzip.NewReader(bytes.NewReader(stream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("level %d: gzip read %d bytes: %v", lvl, len(got), err)
+		}
+	}
+	level = flate.DefaultCompression
+}
+
+// Test that BGZF input is inflated by several workers in order, that plain
+// gzip after it is still read, and that damaged or cut members are errors
+func TestBGZFDecompress(t *testing.T) {
+	saved := processes
+	defer func() { processes = saved }()
+	processes = 4
+
+	data := make([]byte, 10*BGZF_BLOCK_SIZE+123)
+	for i := range data {
+		data[i] = byte(i / 1000 * 7)
+	}
+	format = "bgzf"
+	var out bytes.Buffer
+	err := compressStream(bytes.NewReader(data), &out)
+	format = "gzip"
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := out.Bytes()
+
+	var plain bytes.Buffer
+	zw := gzip.NewWriter(&plain)
+	zw.Write([]byte("appended\n"))
+	zw.Close()
+	mixed := append(append([]byte{}, stream...), plain.Bytes()...)
+
+	for _, test := range []struct {
+		in   []byte
+		want []byte
+	}{
+		{stream, data},
+		{mixed, append(append([]byte{}, data...), "appended\n"...)},
+	} {
+		var got bytes.Buffer
+		if err := decompressStream(bytes.NewReader(test.in), &got); err != nil || !bytes.Equal(got.Bytes(), test.want) {
+			t.Errorf("%d bytes in: %d out: %v", len(test.in), got.Len(), err)
+		}
+	}
+
+	damaged := append([]byte{}, stream...)
+	damaged[len(damaged)/2] ^= 0x40
+	if err := decompressStream(bytes.NewReader(damaged), ioutil.Discard); err == nil {
+		t.Errorf("damaged member: no error")
+	}
+	if err := decompressStream(bytes.NewReader(stream[:len(stream)/2]), ioutil.Discard); err == nil {
+		t.Errorf("cut member: no error")
+	}
+}
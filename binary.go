@@ -0,0 +1,57 @@
+package main
+
+import "encoding/binary"
+
+// Integer encodings shared by the formats and the sidecar files.
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v), byte(v>>8))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+// putVLI appends x in the xz variable-length integer encoding.
+func putVLI(buf []byte, x uint64) []byte {
+	for x >= 0x80 {
+		buf = append(buf, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(buf, byte(x))
+}
+
+// lsbWriter writes bits least significant first, as deflate and brotli
+// streams hold them.
+type lsbWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+// put writes the n low bits of v, n at most 56.
+func (w *lsbWriter) put(n uint, v uint64) {
+	w.acc |= (v & (1<<n - 1)) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+// align pads the last byte with zero bits.
+func (w *lsbWriter) align() {
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc, w.n = 0, 0
+	}
+}
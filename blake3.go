@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// BLAKE3, as much of it as the block tree needs (see b3tree.go): hashes of
+// whole inputs and chaining values of the subtrees over parts of them. The
+// input is split into 1 KiB chunks, hashed with their position in the
+// input, and pairs of chaining values are merged by parent nodes into a
+// binary tree whose left subtrees always hold a power of two chunks.
+
+const (
+	B3_CHUNK_LEN = 1024
+	B3_BLOCK_LEN = 64
+)
+
+// node flags
+const (
+	B3_CHUNK_START = 1 << 0
+	B3_CHUNK_END   = 1 << 1
+	B3_PARENT      = 1 << 2
+	B3_ROOT        = 1 << 3
+)
+
+var b3IV = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var b3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func b3G(s *[16]uint32, a, b, c, d int, x, y uint32) {
+	s[a] += s[b] + x
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + y
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+// b3Compress runs the compression function and returns the whole state.
+func b3Compress(cv [8]uint32, m [16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		b3IV[0], b3IV[1], b3IV[2], b3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	for round := 0; round < 7; round++ {
+		b3G(&s, 0, 4, 8, 12, m[0], m[1])
+		b3G(&s, 1, 5, 9, 13, m[2], m[3])
+		b3G(&s, 2, 6, 10, 14, m[4], m[5])
+		b3G(&s, 3, 7, 11, 15, m[6], m[7])
+		b3G(&s, 0, 5, 10, 15, m[8], m[9])
+		b3G(&s, 1, 6, 11, 12, m[10], m[11])
+		b3G(&s, 2, 7, 8, 13, m[12], m[13])
+		b3G(&s, 3, 4, 9, 14, m[14], m[15])
+		var p [16]uint32
+		for i := range p {
+			p[i] = m[b3Permutation[i]]
+		}
+		m = p
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+func b3Words(block []byte) [16]uint32 {
+	var buf [B3_BLOCK_LEN]byte
+	copy(buf[:], block)
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(buf[4*i:])
+	}
+	return m
+}
+
+// b3Output is the last compression of a node, kept unrun until it is known
+// whether the node is the root.
+type b3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+// chainingValue returns the value the node passes to its parent.
+func (o b3Output) chainingValue() [8]uint32 {
+	s := b3Compress(o.cv, o.block, o.counter, o.blockLen, o.flags)
+	var cv [8]uint32
+	copy(cv[:], s[:8])
+	return cv
+}
+
+// rootHash returns the 32-byte hash of the input when the node is the root.
+func (o b3Output) rootHash() [32]byte {
+	s := b3Compress(o.cv, o.block, 0, o.blockLen, o.flags|B3_ROOT)
+	var h [32]byte
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(h[4*i:], s[i])
+	}
+	return h
+}
+
+// b3Chunk hashes a chunk of at most B3_CHUNK_LEN bytes, the chunk number
+// counter of the input.
+func b3Chunk(data []byte, counter uint64) b3Output {
+	cv := b3IV
+	flags := uint32(B3_CHUNK_START)
+	for len(data) > B3_BLOCK_LEN {
+		s := b3Compress(cv, b3Words(data[:B3_BLOCK_LEN]), counter, B3_BLOCK_LEN, flags)
+		copy(cv[:], s[:8])
+		data = data[B3_BLOCK_LEN:]
+		flags = 0
+	}
+	return b3Output{cv, b3Words(data), counter, uint32(len(data)), flags | B3_CHUNK_END}
+}
+
+func b3Parent(left, right [8]uint32) b3Output {
+	var m [16]uint32
+	copy(m[:8], left[:])
+	copy(m[8:], right[:])
+	return b3Output{cv: b3IV, block: m, blockLen: B3_BLOCK_LEN, flags: B3_PARENT}
+}
+
+// b3Subtree hashes data starting at chunk number counter as a subtree of
+// the input's tree. data must be all of the input from there on, or a
+// power of two chunks.
+func b3Subtree(data []byte, counter uint64) b3Output {
+	if len(data) <= B3_CHUNK_LEN {
+		return b3Chunk(data, counter)
+	}
+	chunks := uint64(len(data)+B3_CHUNK_LEN-1) / B3_CHUNK_LEN
+	left := b3LeftLen(chunks)
+	return b3Parent(
+		b3Subtree(data[:left*B3_CHUNK_LEN], counter).chainingValue(),
+		b3Subtree(data[left*B3_CHUNK_LEN:], counter+left).chainingValue())
+}
+
+// b3LeftLen returns the number of leaves in the left subtree of a tree of n
+// leaves: the largest power of two below n.
+func b3LeftLen(n uint64) uint64 {
+	return 1 << (bits.Len64(n-1) - 1)
+}
+
+// blake3 returns the BLAKE3 hash of data.
+func blake3(data []byte) [32]byte {
+	return b3Subtree(data, 0).rootHash()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+// Block size (-b/--blocksize N, in KiB as in pigz).
+//
+// The input is cut into blocks of blockSize bytes, the unit of work of the
+// compress workers. Larger blocks leave fewer flush markers in the output
+// and compress slightly better, smaller ones spread a small input over more
+// workers and hold less memory in flight. A block is at least DICT_SIZE, so
+// that priming it with the block before fills the whole window.
+
+// Parsing blocksize flag
+var blockSize = BLOCK_SIZE
+
+// Bounds of -b: 32 KiB to 512 MiB
+const (
+	MIN_BLOCK_SIZE = DICT_SIZE
+	MAX_BLOCK_SIZE = 512 * 1024 * 1024
+)
+
+func init() {
+	flag.Var(blockSizeFlag{}, "blocksize", fmt.Sprintf("Compress blocks of N KiB (default %d)", BLOCK_SIZE/1024))
+	flag.Var(blockSizeFlag{}, "b", "Same as --blocksize")
+}
+
+// blockSizeFlag sets blockSize from a count of KiB.
+type blockSizeFlag struct{}
+
+func (blockSizeFlag) String() string { return strconv.Itoa(blockSize / 1024) }
+func (blockSizeFlag) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid block size %q", s)
+	}
+	if n < MIN_BLOCK_SIZE/1024 || n > MAX_BLOCK_SIZE/1024 {
+		return fmt.Errorf("block size must be from %d to %d KiB", MIN_BLOCK_SIZE/1024, MAX_BLOCK_SIZE/1024)
+	}
+	blockSize = n * 1024
+	return nil
+}
@@ -0,0 +1,493 @@
+//go:build !nobrotli
+
+package main
+
+import (
+	"compress/flate"
+	"errors"
+	"flag"
+	"math/bits"
+	"sort"
+
+	"github.com/aaron-seo/gopigz/m/pgzip"
+)
+
+// brotli output (--format brotli), following RFC 7932.
+//
+// Meta-blocks are bit-aligned like bzip2 blocks, but an empty metadata
+// meta-block pads the stream to a byte boundary, so every pipeline block is
+// compressed into meta-blocks each followed by one, and the pieces are
+// concatenated into a single stream: the header holds the window size and
+// the trailer the last, empty meta-block. Commands always give their
+// distance instead of reusing one of the last four, whose state would cross
+// blocks, and a single literal code is used, with no context modeling.
+// Unless -i is given, a block copies from the DICT_SIZE bytes before it, as
+// deflate blocks are primed. Matches are found in hash chains searched
+// deeper as --quality rises from 0 to 11, and lazily from
+// BROTLI_LAZY_QUALITY; -0 to -9 set the quality too. The static dictionary
+// is not used, and brotli streams cannot be decompressed. Build with -tags
+// nobrotli to leave it out.
+
+const (
+	BROTLI_DEFAULT_QUALITY = 11
+	BROTLI_MAX_QUALITY     = 11
+	BROTLI_LAZY_QUALITY    = 4
+	BROTLI_MIN_MATCH       = 4
+	BROTLI_HASH_LOG        = 17
+	BROTLI_MAX_MLEN        = 1 << 24
+	BROTLI_MAX_CODE_LEN    = 15
+	BROTLI_MIN_WINDOW      = 16
+	BROTLI_MAX_WINDOW      = 24
+	BROTLI_WINDOW_GAP      = 16 // the window holds 16 bytes less than 2^WBITS
+
+	// alphabet sizes, and the bits of a symbol in a simple prefix code
+	BROTLI_LITERALS      = 256
+	BROTLI_LITERAL_BITS  = 8
+	BROTLI_COMMANDS      = 704
+	BROTLI_COMMAND_BITS  = 10
+	BROTLI_DISTANCES     = 64 // with no direct distance codes or postfix bits
+	BROTLI_DISTANCE_BITS = 6
+)
+
+// hash chain depth by quality
+var brotliDepth = [BROTLI_MAX_QUALITY + 1]int{1, 2, 4, 6, 8, 12, 16, 24, 32, 64, 128, 256}
+
+// insert and copy length codes: base values and extra bits
+var (
+	brotliInsertBase  = []uint32{0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34, 50, 66, 98, 130, 194, 322, 578, 1090, 2114, 6210, 22594}
+	brotliInsertExtra = []uint{0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 12, 14, 24}
+	brotliCopyBase    = []uint32{2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22, 30, 38, 54, 70, 102, 134, 198, 326, 582, 1094, 2118}
+	brotliCopyExtra   = []uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 24}
+)
+
+// the order code length code lengths are written in, and the fixed code
+// they are written with, by length
+var (
+	brotliCodeLengthOrder = []int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	brotliLengthCodeBits  = []uint64{0, 7, 3, 2, 1, 15}
+	brotliLengthCodeLen   = []uint{2, 4, 3, 2, 2, 4}
+)
+
+// Parsing quality flag
+var brotliQualityFlag = -1
+
+func init() {
+	registerCodec("brotli", &codec{
+		suffix:      ".br",
+		contentType: "application/x-brotli",
+		newChecksum: newCRCCombiner,
+		header:      brotliStreamHeader,
+		block:       brotliBlock,
+		trailer: func(sum uint32) []byte {
+			return []byte{0x03} // ISLAST, ISLASTEMPTY
+		},
+	})
+	flag.IntVar(&brotliQualityFlag, "quality", -1, "brotli quality from 0 to 11; -1 takes the level, or 11 if none is given")
+	optionChecks = append(optionChecks, func() error {
+		if brotliQualityFlag >= 0 && format != "brotli" {
+			return errors.New("--quality is only supported with the brotli format")
+		}
+		if brotliQualityFlag > BROTLI_MAX_QUALITY {
+			return errors.New("--quality must be from 0 to 11")
+		}
+		return nil
+	})
+}
+
+// brotliQuality returns the quality of the streams written.
+func brotliQuality() int {
+	switch {
+	case brotliQualityFlag >= 0:
+		return brotliQualityFlag
+	case level == flate.DefaultCompression:
+		return BROTLI_DEFAULT_QUALITY
+	}
+	return level
+}
+
+// brotliWindowBits returns WBITS, large enough for a block and the
+// DICT_SIZE bytes before it if it can be.
+func brotliWindowBits() uint {
+	wbits := uint(BROTLI_MIN_WINDOW)
+	for wbits < BROTLI_MAX_WINDOW && 1<<wbits-BROTLI_WINDOW_GAP < blockSize+DICT_SIZE {
+		wbits++
+	}
+	return wbits
+}
+
+// brotliPad writes an empty metadata meta-block, which ends on a byte
+// boundary.
+func brotliPad(w *lsbWriter) {
+	w.put(1, 0) // ISLAST
+	w.put(2, 3) // MNIBBLES: metadata
+	w.put(1, 0) // reserved
+	w.put(2, 0) // MSKIPBYTES
+	w.align()
+}
+
+// brotliStreamHeader returns WBITS, padded to a byte.
+func brotliStreamHeader() []byte {
+	w := &lsbWriter{}
+	switch wbits := brotliWindowBits(); wbits {
+	case 16:
+		w.put(1, 0)
+	case 17:
+		w.put(7, 1)
+	default:
+		w.put(1, 1)
+		w.put(3, uint64(wbits-17))
+	}
+	brotliPad(w)
+	return w.out
+}
+
+// brotliMetaHeader writes ISLAST, clear, and MLEN.
+func brotliMetaHeader(w *lsbWriter, mlen int) {
+	w.put(1, 0)
+	nibbles := uint(4)
+	for (mlen-1)>>(4*nibbles) != 0 {
+		nibbles++
+	}
+	w.put(2, uint64(nibbles-4))
+	w.put(4*nibbles, uint64(mlen-1))
+}
+
+// brotliBlock compresses the data of a pipeline block into meta-blocks
+// ending on a byte boundary.
+func brotliBlock(b *block) []byte {
+	prefix := b.window
+	if independent {
+		prefix = nil
+	}
+	maxDist := 1<<brotliWindowBits() - BROTLI_WINDOW_GAP
+	var out []byte
+	for data := b.RawData; len(data) > 0; {
+		n := len(data)
+		if n > BROTLI_MAX_MLEN {
+			n = BROTLI_MAX_MLEN
+		}
+		out = append(out, brotliMetaBlock(data[:n], prefix, brotliQuality(), maxDist)...)
+		if !independent {
+			prefix = pgzip.AppendWindow(prefix, data[:n])
+		}
+		data = data[n:]
+	}
+	return out
+}
+
+// brotliCommand inserts literals, then copies bytes from distance back. The
+// last command of a meta-block may copy nothing.
+type brotliCommand struct {
+	insert, copy, distance int
+}
+
+// brotliMetaBlock compresses data, which may copy from prefix, into a
+// meta-block followed by padding, or stores it if that is no larger.
+func brotliMetaBlock(data, prefix []byte, quality, maxDist int) []byte {
+	commands, literals := brotliMatches(data, prefix, quality, maxDist)
+
+	litFreq := make([]int32, BROTLI_LITERALS)
+	for _, c := range literals {
+		litFreq[c]++
+	}
+	cmdFreq := make([]int32, BROTLI_COMMANDS)
+	distFreq := make([]int32, BROTLI_DISTANCES)
+	codes := make([]uint16, len(commands))
+	for i, c := range commands {
+		codes[i] = brotliCommandCode(c)
+		cmdFreq[codes[i]]++
+		if c.copy > 0 {
+			code, _, _ := brotliDistanceCode(c.distance)
+			distFreq[code]++
+		}
+	}
+
+	w := &lsbWriter{}
+	brotliMetaHeader(w, len(data))
+	w.put(1, 0) // ISUNCOMPRESSED
+	w.put(1, 0) // one literal block type
+	w.put(1, 0) // one command block type
+	w.put(1, 0) // one distance block type
+	w.put(2, 0) // NPOSTFIX
+	w.put(4, 0) // NDIRECT
+	w.put(2, 0) // literal context mode
+	w.put(1, 0) // one literal prefix code
+	w.put(1, 0) // one distance prefix code
+	litLen, litCode := brotliPrefixCode(w, litFreq, BROTLI_LITERAL_BITS)
+	cmdLen, cmdCode := brotliPrefixCode(w, cmdFreq, BROTLI_COMMAND_BITS)
+	distLen, distCode := brotliPrefixCode(w, distFreq, BROTLI_DISTANCE_BITS)
+
+	for i, c := range commands {
+		code := codes[i]
+		w.put(uint(cmdLen[code]), uint64(cmdCode[code]))
+		ic := brotliLengthCode(brotliInsertBase, c.insert)
+		w.put(brotliInsertExtra[ic], uint64(c.insert)-uint64(brotliInsertBase[ic]))
+		if c.copy > 0 {
+			cc := brotliLengthCode(brotliCopyBase, c.copy)
+			w.put(brotliCopyExtra[cc], uint64(c.copy)-uint64(brotliCopyBase[cc]))
+		}
+		for _, l := range literals[:c.insert] {
+			w.put(uint(litLen[l]), uint64(litCode[l]))
+		}
+		literals = literals[c.insert:]
+		if c.copy > 0 {
+			d, n, extra := brotliDistanceCode(c.distance)
+			w.put(uint(distLen[d]), uint64(distCode[d]))
+			w.put(n, extra)
+		}
+	}
+	brotliPad(w)
+	if len(w.out) < len(data) {
+		return w.out
+	}
+
+	w = &lsbWriter{}
+	brotliMetaHeader(w, len(data))
+	w.put(1, 1) // ISUNCOMPRESSED
+	w.align()
+	return append(w.out, data...)
+}
+
+// brotliLengthCode returns the insert or copy length code of n.
+func brotliLengthCode(base []uint32, n int) int {
+	code := len(base) - 1
+	for int(base[code]) > n {
+		code--
+	}
+	return code
+}
+
+// brotliCommandCode returns the insert-and-copy length code of c, among the
+// codes with an explicit distance. The last command copies nothing, with the
+// code of a copy of 2.
+func brotliCommandCode(c brotliCommand) uint16 {
+	ic := brotliLengthCode(brotliInsertBase, c.insert)
+	cc := 0
+	if c.copy > 0 {
+		cc = brotliLengthCode(brotliCopyBase, c.copy)
+	}
+	var base int
+	switch {
+	case ic < 8 && cc < 8:
+		base = 128
+	case ic < 8 && cc < 16:
+		base = 192
+	case ic < 16 && cc < 8:
+		base = 256
+	case ic < 16 && cc < 16:
+		base = 320
+	case ic < 8:
+		base = 384
+	case cc < 8:
+		base = 448
+	case ic < 16:
+		base = 512
+	case cc < 16:
+		base = 576
+	default:
+		base = 640
+	}
+	return uint16(base + (ic&7)<<3 + cc&7)
+}
+
+// brotliDistanceCode returns the distance code of distance, with no direct
+// codes or postfix bits, and its extra bits.
+func brotliDistanceCode(distance int) (int, uint, uint64) {
+	x := distance + 3
+	n := uint(bits.Len(uint(x)) - 2)
+	high := (x >> n) & 1
+	return 16 + 2*(int(n)-1) + high, n, uint64(x - (2+high)<<n)
+}
+
+// brotliPrefixCode writes the prefix code for the frequencies freq: simple
+// for up to four symbols, otherwise complex. It returns the code lengths and
+// the codes, bit-reversed for writing.
+func brotliPrefixCode(w *lsbWriter, freq []int32, symbolBits uint) ([]uint8, []uint16) {
+	var used []int
+	for s, f := range freq {
+		if f > 0 {
+			used = append(used, s)
+		}
+	}
+	if len(used) == 0 {
+		used = []int{0}
+	}
+
+	lengths := make([]uint8, len(freq))
+	if len(used) <= 4 {
+		// the most frequent first, which gets the short code of three
+		sort.SliceStable(used, func(i, j int) bool { return freq[used[i]] > freq[used[j]] })
+		w.put(2, 1) // HSKIP: simple
+		w.put(2, uint64(len(used)-1))
+		for i, s := range used {
+			w.put(symbolBits, uint64(s))
+			switch len(used) {
+			case 2:
+				lengths[s] = 1
+			case 3:
+				lengths[s] = 2
+				if i == 0 {
+					lengths[s] = 1
+				}
+			case 4:
+				lengths[s] = 2
+			}
+		}
+		if len(used) == 4 {
+			w.put(1, 0) // all codes of length 2
+		}
+	} else {
+		lengths = huffmanLengths(freq, BROTLI_MAX_CODE_LEN)
+		brotliWriteLengths(w, lengths)
+	}
+	return lengths, huffmanCodes(lengths)
+}
+
+// brotliWriteLengths writes the code lengths of a complex prefix code, up to
+// the last one that is not zero, with runs of zeros as repeat codes.
+func brotliWriteLengths(w *lsbWriter, lengths []uint8) {
+	last := len(lengths) - 1
+	for lengths[last] == 0 {
+		last--
+	}
+	type item struct {
+		symbol uint8
+		extra  uint64
+	}
+	var items []item
+	for i := 0; i <= last; {
+		if lengths[i] != 0 {
+			items = append(items, item{symbol: lengths[i]})
+			i++
+			continue
+		}
+		run := 0
+		for lengths[i+run] == 0 {
+			run++
+		}
+		i += run
+		for run >= 3 {
+			n := run
+			if n > 10 {
+				n = 10
+			}
+			items = append(items, item{17, uint64(n - 3)})
+			run -= n
+			// a repeat code right after another would extend it instead
+			if run >= 3 {
+				items = append(items, item{})
+				run--
+			}
+		}
+		for ; run > 0; run-- {
+			items = append(items, item{})
+		}
+	}
+
+	freq := make([]int32, 18)
+	for _, it := range items {
+		freq[it.symbol]++
+	}
+	clLengths := huffmanLengths(freq, 5)
+	nonzero := 0
+	for _, l := range clLengths {
+		if l > 0 {
+			nonzero++
+		}
+	}
+	// with one code length code, all are written and it takes no bits
+	end := len(brotliCodeLengthOrder)
+	if nonzero > 1 {
+		for clLengths[brotliCodeLengthOrder[end-1]] == 0 {
+			end--
+		}
+	}
+
+	w.put(2, 0) // HSKIP
+	for _, s := range brotliCodeLengthOrder[:end] {
+		l := clLengths[s]
+		w.put(brotliLengthCodeLen[l], brotliLengthCodeBits[l])
+	}
+	clCodes := huffmanCodes(clLengths)
+	for _, it := range items {
+		if nonzero > 1 {
+			w.put(uint(clLengths[it.symbol]), uint64(clCodes[it.symbol]))
+		}
+		if it.symbol == 17 {
+			w.put(3, it.extra)
+		}
+	}
+}
+
+func brotliHash(b []byte) uint32 {
+	return (uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24) * 2654435761 >> (32 - BROTLI_HASH_LOG)
+}
+
+// brotliMatches finds the commands of data, which may copy from prefix as
+// well, up to maxDist back. It returns them and the literals.
+func brotliMatches(data, prefix []byte, quality, maxDist int) ([]brotliCommand, []byte) {
+	buf := data
+	if len(prefix) > 0 {
+		buf = append(append(make([]byte, 0, len(prefix)+len(data)), prefix...), data...)
+	}
+	start := len(prefix)
+	head := make([]int32, 1<<BROTLI_HASH_LOG)
+	for i := range head {
+		head[i] = -1
+	}
+	chain := make([]int32, len(buf))
+	inserted := 0
+	insertUpTo := func(end int) {
+		for ; inserted < end && inserted+BROTLI_MIN_MATCH <= len(buf); inserted++ {
+			h := brotliHash(buf[inserted:])
+			chain[inserted] = head[h]
+			head[h] = int32(inserted)
+		}
+	}
+	insertUpTo(start)
+
+	depth := brotliDepth[quality]
+	find := func(i int) (int, int) {
+		bestLen, bestDist := 0, 0
+		if i+BROTLI_MIN_MATCH > len(buf) {
+			return 0, 0
+		}
+		for j, d := head[brotliHash(buf[i:])], 0; j >= 0 && d < depth && i-int(j) <= maxDist; j, d = chain[j], d+1 {
+			n := 0
+			for i+n < len(buf) && buf[int(j)+n] == buf[i+n] {
+				n++
+			}
+			if n > bestLen {
+				bestLen, bestDist = n, i-int(j)
+			}
+		}
+		return bestLen, bestDist
+	}
+
+	var commands []brotliCommand
+	literals := make([]byte, 0, len(data)/4)
+	anchor := start
+	for i := start; i+BROTLI_MIN_MATCH <= len(buf); {
+		insertUpTo(i)
+		n, d := find(i)
+		if n < BROTLI_MIN_MATCH {
+			i++
+			continue
+		}
+		if quality >= BROTLI_LAZY_QUALITY {
+			insertUpTo(i + 1)
+			if n2, d2 := find(i + 1); n2 > n+1 {
+				i, n, d = i+1, n2, d2
+			}
+		}
+		literals = append(literals, buf[anchor:i]...)
+		commands = append(commands, brotliCommand{i - anchor, n, d})
+		i += n
+		anchor = i
+	}
+	if anchor < len(buf) {
+		literals = append(literals, buf[anchor:]...)
+		commands = append(commands, brotliCommand{insert: len(buf) - anchor})
+	}
+	return commands, literals
+}
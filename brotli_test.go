@@ -0,0 +1,63 @@
+//go:build !nobrotli
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+func TestBrotliDistanceCode(t *testing.T) {
+	for _, test := range []struct {
+		distance int
+		code     int
+		n        uint
+		extra    uint64
+	}{
+		{1, 16, 1, 0},
+		{2, 16, 1, 1},
+		{3, 17, 1, 0},
+		{5, 18, 2, 0},
+		{32768, 42, 14, 32771 - 2<<14},
+	} {
+		code, n, extra := brotliDistanceCode(test.distance)
+		if code != test.code || n != test.n || extra != test.extra {
+			t.Errorf("distance %d: code %d, %d bits of %d, want %d, %d bits of %d",
+				test.distance, code, n, extra, test.code, test.n, test.extra)
+		}
+	}
+}
+
+func TestBrotliStream(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is needed to decompress brotli")
+	}
+	format = "brotli"
+	defer func() { format = "gzip"; independent = false; brotliQualityFlag = -1 }()
+
+	random := make([]byte, BLOCK_SIZE+100)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 8000)
+	data := append(append(append([]byte{}, text...), random...), text...)
+
+	for _, options := range []struct {
+		independent bool
+		quality     int
+	}{{false, -1}, {true, -1}, {false, 0}, {false, 5}} {
+		independent, brotliQualityFlag = options.independent, options.quality
+		for _, input := range [][]byte{data, []byte("a"), {}} {
+			var stream bytes.Buffer
+			if err := compressStream(bytes.NewReader(input), &stream); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command(node, "-e", "process.stdout.write(require('zlib').brotliDecompressSync(require('fs').readFileSync(0)))")
+			cmd.Stdin = bytes.NewReader(stream.Bytes())
+			if out, err := cmd.Output(); err != nil || !bytes.Equal(out, input) {
+				t.Errorf("%+v, %d bytes: node: %v", options, len(input), err)
+			}
+		}
+	}
+}
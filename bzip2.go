@@ -0,0 +1,472 @@
+//go:build !nobzip2
+
+package main
+
+import (
+	"compress/bzip2"
+	"compress/flate"
+	"io"
+)
+
+// bzip2 output (--format bzip2).
+//
+// bzip2 blocks are bit-aligned, so blocks compressed apart cannot simply be
+// concatenated into one stream. As pbzip2 does, every pipeline block is
+// written as a bzip2 stream of its own instead, which bzip2 -d and the other
+// readers decompress as one. Each is the usual pipeline: runs of 4 to 255
+// equal bytes shortened (RLE1), the Burrows-Wheeler transform, move-to-front
+// with runs of zeros in bijective base 2 (RUNA, RUNB), and up to six Huffman
+// tables chosen every 50 symbols. The level sets bzip2's block size in 100k
+// as in bzip2 -1 to -9, but a block holds at most one pipeline block, so -b
+// 900 is needed for the ratio of bzip2 -9. Build with -tags nobzip2 to leave
+// it out.
+
+const (
+	BZIP2_BLOCK_MAGIC   = 0x314159265359
+	BZIP2_EOS_MAGIC     = 0x177245385090
+	BZIP2_DEFAULT_LEVEL = 9
+	BZIP2_MAX_CODE_LEN  = 17
+	BZIP2_GROUP_SIZE    = 50
+	BZIP2_ITERATIONS    = 4
+	BZIP2_RUNA          = 0
+	BZIP2_RUNB          = 1
+	BZIP2_MAX_RUN       = 255
+)
+
+var bzip2CRCTable [256]uint32
+
+func init() {
+	// the CRC-32 polynomial, most significant bit first
+	for i := range bzip2CRCTable {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04c11db7
+			} else {
+				c <<= 1
+			}
+		}
+		bzip2CRCTable[i] = c
+	}
+
+	registerCodec("bzip2", &codec{
+		suffix:      ".bz2",
+		contentType: "application/x-bzip2",
+		newChecksum: newCRCCombiner,
+		header:      func() []byte { return nil },
+		block: func(b *block) []byte {
+			return bzip2Stream(b.RawData, bzip2Level())
+		},
+		trailer: func(sum uint32) []byte { return nil },
+		// the sort of every worker's block
+		memory: func() int64 { return 18 * int64(blockSize) * int64(compressWorkers()) },
+		decompress: func(input io.Reader, output io.Writer) error {
+			_, err := io.Copy(output, bzip2.NewReader(input))
+			return err
+		},
+	})
+}
+
+// bzip2Level returns the level, from 1 to 9, of the bzip2 streams written.
+func bzip2Level() int {
+	switch {
+	case level == flate.DefaultCompression:
+		return BZIP2_DEFAULT_LEVEL
+	case level < 1:
+		return 1
+	}
+	return level
+}
+
+// bzip2Bits writes bits most significant first.
+type bzip2Bits struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+func (w *bzip2Bits) put(bits uint, v uint64) {
+	w.acc = w.acc<<bits | v&(1<<bits-1)
+	w.n += bits
+	for w.n >= 8 {
+		w.n -= 8
+		w.out = append(w.out, byte(w.acc>>w.n))
+	}
+}
+
+func (w *bzip2Bits) flush() []byte {
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc<<(8-w.n)))
+		w.n = 0
+	}
+	return w.out
+}
+
+// bzip2Stream compresses data into a complete bzip2 stream.
+func bzip2Stream(data []byte, level int) []byte {
+	w := &bzip2Bits{out: []byte{'B', 'Z', 'h', byte('0' + level)}}
+	max := level*100000 - 19
+	var combined uint32
+	for len(data) > 0 {
+		rle, n := bzip2RLE(data, max)
+		sum := bzip2CRC(data[:n])
+		combined = (combined<<1 | combined>>31) ^ sum
+		bzip2Block(w, rle, sum)
+		data = data[n:]
+	}
+	w.put(48, BZIP2_EOS_MAGIC)
+	w.put(32, uint64(combined))
+	return w.flush()
+}
+
+// bzip2CRC returns the bzip2 CRC of data.
+func bzip2CRC(data []byte) uint32 {
+	crc := ^uint32(0)
+	for _, c := range data {
+		crc = crc<<8 ^ bzip2CRCTable[byte(crc>>24)^c]
+	}
+	return ^crc
+}
+
+// bzip2RLE shortens runs of 4 or more equal bytes at the start of data to 4
+// bytes and the count of the others, up to max bytes of output. It returns
+// the output and the number of bytes of data consumed.
+func bzip2RLE(data []byte, max int) ([]byte, int) {
+	size := len(data)
+	if size > max {
+		size = max
+	}
+	out := make([]byte, 0, size)
+	i := 0
+	for i < len(data) && len(out)+5 <= max {
+		c := data[i]
+		run := 1
+		for run < BZIP2_MAX_RUN && i+run < len(data) && data[i+run] == c {
+			run++
+		}
+		if run < 4 {
+			for j := 0; j < run; j++ {
+				out = append(out, c)
+			}
+		} else {
+			out = append(out, c, c, c, c, byte(run-4))
+		}
+		i += run
+	}
+	return out, i
+}
+
+// bzip2BWT returns the last column of the sorted rotations of s and the row
+// of s itself. The rotations are sorted by prefix doubling: after the round
+// for k, rank orders them by their first 2k bytes.
+func bzip2BWT(s []byte) ([]byte, int) {
+	n := len(s)
+	sa := make([]int32, n)
+	rank := make([]int32, n)
+	tmp := make([]int32, n)
+	count := make([]int32, n+1)
+
+	var bytes [257]int32
+	for _, c := range s {
+		bytes[int(c)+1]++
+	}
+	for c := 1; c < 257; c++ {
+		bytes[c] += bytes[c-1]
+	}
+	for i, c := range s {
+		sa[bytes[c]] = int32(i)
+		bytes[c]++
+	}
+	classes := int32(1)
+	for j := 1; j < n; j++ {
+		if s[sa[j]] != s[sa[j-1]] {
+			classes++
+		}
+		rank[sa[j]] = classes - 1
+	}
+
+	for k := 1; int(classes) < n && k < n; k <<= 1 {
+		// sorted by the second k bytes, then stably by the first
+		for j, i := range sa {
+			p := int(i) - k
+			if p < 0 {
+				p += n
+			}
+			tmp[j] = int32(p)
+		}
+		for c := range count[:classes+1] {
+			count[c] = 0
+		}
+		for _, p := range tmp {
+			count[rank[p]+1]++
+		}
+		for c := int32(1); c <= classes; c++ {
+			count[c] += count[c-1]
+		}
+		for _, p := range tmp {
+			sa[count[rank[p]]] = p
+			count[rank[p]]++
+		}
+
+		next := func(i int32) int32 {
+			if j := int(i) + k; j < n {
+				return rank[j]
+			}
+			return rank[int(i)+k-n]
+		}
+		tmp[sa[0]] = 0
+		classes = 1
+		for j := 1; j < n; j++ {
+			if rank[sa[j]] != rank[sa[j-1]] || next(sa[j]) != next(sa[j-1]) {
+				classes++
+			}
+			tmp[sa[j]] = classes - 1
+		}
+		rank, tmp = tmp, rank
+	}
+
+	last := make([]byte, n)
+	origPtr := 0
+	for j, i := range sa {
+		if i == 0 {
+			origPtr = j
+			last[j] = s[n-1]
+		} else {
+			last[j] = s[i-1]
+		}
+	}
+	return last, origPtr
+}
+
+// bzip2Block writes a block holding the RLE1 output rle, whose input has CRC
+// sum.
+func bzip2Block(w *bzip2Bits, rle []byte, sum uint32) {
+	last, origPtr := bzip2BWT(rle)
+
+	var inUse [256]bool
+	for _, c := range last {
+		inUse[c] = true
+	}
+	var seq [256]byte
+	var mtf []byte
+	for c := range inUse {
+		if inUse[c] {
+			seq[c] = byte(len(mtf))
+			mtf = append(mtf, byte(len(mtf)))
+		}
+	}
+	nInUse := len(mtf)
+	alphaSize := nInUse + 2
+
+	// move-to-front, with runs of zeros as RUNA and RUNB
+	symbols := make([]uint16, 0, len(last)+1)
+	freq := make([]int32, alphaSize)
+	zeros := 0
+	flushZeros := func() {
+		for zeros--; ; zeros = (zeros - 2) / 2 {
+			sym := uint16(BZIP2_RUNA + zeros&1)
+			symbols = append(symbols, sym)
+			freq[sym]++
+			if zeros < 2 {
+				break
+			}
+		}
+		zeros = 0
+	}
+	for _, c := range last {
+		s := seq[c]
+		if mtf[0] == s {
+			zeros++
+			continue
+		}
+		if zeros > 0 {
+			flushZeros()
+		}
+		j := 1
+		for mtf[j] != s {
+			j++
+		}
+		copy(mtf[1:j+1], mtf[:j])
+		mtf[0] = s
+		symbols = append(symbols, uint16(j+1))
+		freq[j+1]++
+	}
+	if zeros > 0 {
+		flushZeros()
+	}
+	symbols = append(symbols, uint16(nInUse+1))
+	freq[nInUse+1]++
+
+	lengths, selectors := bzip2Tables(symbols, freq, alphaSize)
+
+	w.put(48, BZIP2_BLOCK_MAGIC)
+	w.put(32, uint64(sum))
+	w.put(1, 0) // not randomized
+	w.put(24, uint64(origPtr))
+
+	// the bytes in use, in 16 ranges of 16
+	var ranges uint64
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				ranges |= 1 << (15 - i)
+			}
+		}
+	}
+	w.put(16, ranges)
+	for i := 0; i < 16; i++ {
+		if ranges&(1<<(15-i)) == 0 {
+			continue
+		}
+		var used uint64
+		for j := 0; j < 16; j++ {
+			if inUse[i*16+j] {
+				used |= 1 << (15 - j)
+			}
+		}
+		w.put(16, used)
+	}
+
+	w.put(3, uint64(len(lengths)))
+	w.put(15, uint64(len(selectors)))
+	order := []byte{0, 1, 2, 3, 4, 5}
+	for _, t := range selectors {
+		j := 0
+		for order[j] != t {
+			j++
+		}
+		copy(order[1:j+1], order[:j])
+		order[0] = t
+		w.put(uint(j+1), 1<<(j+1)-2) // j ones, then a zero
+	}
+
+	codes := make([][]uint32, len(lengths))
+	for t, l := range lengths {
+		curr := l[0]
+		w.put(5, uint64(curr))
+		for _, n := range l {
+			for ; curr < n; curr++ {
+				w.put(2, 2)
+			}
+			for ; curr > n; curr-- {
+				w.put(2, 3)
+			}
+			w.put(1, 0)
+		}
+		codes[t] = bzip2Codes(l)
+	}
+
+	for g, t := range selectors {
+		l, code := lengths[t], codes[t]
+		end := (g + 1) * BZIP2_GROUP_SIZE
+		if end > len(symbols) {
+			end = len(symbols)
+		}
+		for _, s := range symbols[g*BZIP2_GROUP_SIZE : end] {
+			w.put(uint(l[s]), uint64(code[s]))
+		}
+	}
+}
+
+// bzip2Tables returns the code lengths of the Huffman tables coding symbols,
+// and the table chosen for every group of BZIP2_GROUP_SIZE symbols, refined
+// over BZIP2_ITERATIONS as bzip2 does.
+func bzip2Tables(symbols []uint16, freq []int32, alphaSize int) ([][]uint8, []byte) {
+	var nGroups int
+	switch n := len(symbols); {
+	case n < 200:
+		nGroups = 2
+	case n < 600:
+		nGroups = 3
+	case n < 1200:
+		nGroups = 4
+	case n < 2400:
+		nGroups = 5
+	default:
+		nGroups = 6
+	}
+
+	// start with tables cheap for symbols of a slice of the frequencies each
+	lengths := make([][]uint8, nGroups)
+	remaining := int32(len(symbols))
+	gs := 0
+	for part := nGroups; part > 0; part-- {
+		target := remaining / int32(part)
+		ge := gs - 1
+		var sum int32
+		for sum < target && ge < alphaSize-1 {
+			ge++
+			sum += freq[ge]
+		}
+		if ge > gs && part != nGroups && part != 1 && (nGroups-part)%2 == 1 {
+			sum -= freq[ge]
+			ge--
+		}
+		l := make([]uint8, alphaSize)
+		for s := range l {
+			if s < gs || s > ge {
+				l[s] = 15
+			}
+		}
+		lengths[part-1] = l
+		gs = ge + 1
+		remaining -= sum
+	}
+
+	groups := (len(symbols) + BZIP2_GROUP_SIZE - 1) / BZIP2_GROUP_SIZE
+	selectors := make([]byte, groups)
+	for iter := 0; iter < BZIP2_ITERATIONS; iter++ {
+		counts := make([][]int32, nGroups)
+		for t := range counts {
+			counts[t] = make([]int32, alphaSize)
+		}
+		for g := range selectors {
+			end := (g + 1) * BZIP2_GROUP_SIZE
+			if end > len(symbols) {
+				end = len(symbols)
+			}
+			group := symbols[g*BZIP2_GROUP_SIZE : end]
+			best, bestCost := 0, -1
+			for t, l := range lengths {
+				cost := 0
+				for _, s := range group {
+					cost += int(l[s])
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = t, cost
+				}
+			}
+			selectors[g] = byte(best)
+			for _, s := range group {
+				counts[best][s]++
+			}
+		}
+		for t := range lengths {
+			// unused symbols get a code too
+			for s, n := range counts[t] {
+				if n == 0 {
+					counts[t][s] = 1
+				}
+			}
+			lengths[t] = huffmanLengths(counts[t], BZIP2_MAX_CODE_LEN)
+		}
+	}
+	return lengths, selectors
+}
+
+// bzip2Codes assigns canonical codes to the code lengths l: shorter codes
+// first, and symbols in order within a length.
+func bzip2Codes(l []uint8) []uint32 {
+	codes := make([]uint32, len(l))
+	code := uint32(0)
+	for n := uint8(1); n <= BZIP2_MAX_CODE_LEN; n++ {
+		for s, length := range l {
+			if length == n {
+				codes[s] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
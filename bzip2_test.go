@@ -0,0 +1,53 @@
+//go:build !nobzip2
+
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+func TestBzip2BWT(t *testing.T) {
+	for _, test := range []struct {
+		in, last string
+		origPtr  int
+	}{
+		{"banana", "nnbaaa", 3},
+		{"a", "a", 0},
+		{"mississippi", "pssmipissii", 4},
+	} {
+		last, origPtr := bzip2BWT([]byte(test.in))
+		if string(last) != test.last || origPtr != test.origPtr {
+			t.Errorf("%s: %s, %d; want %s, %d", test.in, last, origPtr, test.last, test.origPtr)
+		}
+	}
+}
+
+// Test that bzip2 streams decompress with compress/bzip2 and the reference
+// bzip2, across runs, bytes of every value and blocks split by the level
+func TestBzip2Stream(t *testing.T) {
+	random := make([]byte, 150000)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 5000)
+	runs := append(bytes.Repeat([]byte{'x'}, 1000), bytes.Repeat([]byte{'y'}, 259)...)
+
+	for _, data := range [][]byte{{}, {0}, random, text, runs} {
+		stream := bzip2Stream(data, 1)
+		got, err := ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(stream)))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: %v", len(data), err)
+		}
+
+		if path, err := exec.LookPath("bzip2"); err == nil {
+			cmd := exec.Command(path, "-dc")
+			cmd.Stdin = bytes.NewReader(stream)
+			if out, err := cmd.Output(); err != nil || !bytes.Equal(out, data) {
+				t.Errorf("%d bytes: bzip2: %v", len(data), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+
+	"github.com/aaron-seo/gopigz/m/pgzip"
+)
+
+// Checksum subcommands: gopigz crc32|adler32 [files...]
+//
+// The input is split into blocks by the read stage, every block is summed by
+// one of the workers, and the partial sums are combined in block order.
+
+// blockSum is the checksum of one block of the input, a job of the workers.
+type blockSum struct {
+	b      *block
+	update func([]byte) uint32
+	sum    uint32
+}
+
+func (s *blockSum) Run() { s.sum = s.update(s.b.RawData) }
+
+// runChecksum implements the crc32 and adler32 subcommands.
+func runChecksum(name string, paths []string) {
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	for _, path := range paths {
+		if path == "-" {
+			fmt.Printf("%08x  %s\n", parallelChecksum(name, os.Stdin), path)
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			log.Println(err)
+			setError()
+			continue
+		}
+		fmt.Printf("%08x  %s\n", parallelChecksum(name, f), path)
+		f.Close()
+	}
+	os.Exit(exitStatus)
+}
+
+// parallelChecksum computes the CRC-32 (IEEE) or Adler-32 of input using
+// processes workers, at least one, as pgzip.Ordered runs them.
+func parallelChecksum(name string, input io.Reader) uint32 {
+	update := crc32.ChecksumIEEE
+	combine := pgzip.CombineCRC32
+	sum := uint32(0)
+	if name == "adler32" {
+		update = adler32.Checksum
+		combine = adler32Combine
+		sum = 1
+	}
+
+	blocks := read(input, nil)
+	jobs := make(chan pgzip.Job)
+	go func() {
+		for b := range blocks {
+			jobs <- &blockSum{b: b, update: update}
+		}
+		close(jobs)
+	}()
+	for j := range pgzip.Ordered(jobs, processes, 0) {
+		s := j.(*blockSum)
+		sum = combine(sum, s.sum, int64(len(s.b.RawData)))
+		blockDone()
+	}
+	return sum
+}
+
+// crcCombiner is the CRC-32 of a stream being written. Like adlerCombiner,
+// every block is summed in the compress stage and the sums are combined in
+// the write stage, rather than all the input going through one hash in a
+// goroutine of its own.
+type crcCombiner struct {
+	sum uint32
+}
+
+func newCRCCombiner() hash.Hash32 {
+	return &crcCombiner{}
+}
+
+// add appends a block of n bytes with CRC-32 sum to the stream.
+func (c *crcCombiner) add(sum uint32, n int) {
+	c.sum = pgzip.CombineCRC32(c.sum, sum, int64(n))
+}
+
+func (c *crcCombiner) Write(p []byte) (int, error) {
+	c.add(crc32.ChecksumIEEE(p), len(p))
+	return len(p), nil
+}
+
+func (c *crcCombiner) Sum(b []byte) []byte {
+	return append(b, byte(c.sum>>24), byte(c.sum>>16), byte(c.sum>>8), byte(c.sum))
+}
+
+func (c *crcCombiner) Sum32() uint32  { return c.sum }
+func (c *crcCombiner) Reset()         { c.sum = 0 }
+func (c *crcCombiner) Size() int      { return crc32.Size }
+func (c *crcCombiner) BlockSize() int { return 1 }
+
+// combinedChecksum reports whether the checksum of the stream being written
+// is combined from the sums of its blocks.
+func combinedChecksum() bool {
+	switch checksum.(type) {
+	case *crcCombiner, *adlerCombiner:
+		return true
+	}
+	return false
+}
+
+// ADLER_BASE is the largest prime smaller than 65536
+const ADLER_BASE = 65521
+
+// adler32Combine returns the Adler-32 of the concatenation of two sequences
+// given their checksums and the length of the second one, as zlib's
+// adler32_combine does.
+func adler32Combine(adler1, adler2 uint32, len2 int64) uint32 {
+	if len2 < 0 {
+		return 0xFFFFFFFF
+	}
+
+	rem := uint32(len2 % ADLER_BASE)
+	sum1 := adler1 & 0xFFFF
+	sum2 := rem * sum1 % ADLER_BASE
+	sum1 += (adler2 & 0xFFFF) + ADLER_BASE - 1
+	sum2 += (adler1 >> 16) + (adler2 >> 16) + ADLER_BASE - rem
+	if sum1 >= ADLER_BASE {
+		sum1 -= ADLER_BASE
+	}
+	if sum1 >= ADLER_BASE {
+		sum1 -= ADLER_BASE
+	}
+	if sum2 >= ADLER_BASE<<1 {
+		sum2 -= ADLER_BASE << 1
+	}
+	if sum2 >= ADLER_BASE {
+		sum2 -= ADLER_BASE
+	}
+	return sum1 | sum2<<16
+}
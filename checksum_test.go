@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/adler32"
+	"hash/crc32"
+	"math/rand"
+	"testing"
+
+	"github.com/aaron-seo/gopigz/m/pgzip"
+)
+
+func TestChecksumCombine(t *testing.T) {
+	data := make([]byte, 3*BLOCK_SIZE+12345)
+	rand.Read(data)
+
+	for _, split := range []int{0, 1, 1000, BLOCK_SIZE, len(data)} {
+		a, b := data[:split], data[split:]
+
+		crc := pgzip.CombineCRC32(crc32.ChecksumIEEE(a), crc32.ChecksumIEEE(b), int64(len(b)))
+		if want := crc32.ChecksumIEEE(data); crc != want {
+			t.Errorf("split %d: CombineCRC32 = %08x, want %08x", split, crc, want)
+		}
+
+		adler := adler32Combine(adler32.Checksum(a), adler32.Checksum(b), int64(len(b)))
+		if want := adler32.Checksum(data); adler != want {
+			t.Errorf("split %d: adler32Combine = %08x, want %08x", split, adler, want)
+		}
+	}
+}
+
+func TestParallelChecksum(t *testing.T) {
+	data := make([]byte, 5*BLOCK_SIZE+7)
+	rand.Read(data)
+
+	if got, want := parallelChecksum("crc32", bytes.NewReader(data)), crc32.ChecksumIEEE(data); got != want {
+		t.Errorf("crc32 = %08x, want %08x", got, want)
+	}
+	if got, want := parallelChecksum("adler32", bytes.NewReader(data)), adler32.Checksum(data); got != want {
+		t.Errorf("adler32 = %08x, want %08x", got, want)
+	}
+
+	// -p 0 still sums with one worker
+	saved := processes
+	defer func() { processes = saved }()
+	processes = 0
+	if got, want := parallelChecksum("crc32", bytes.NewReader(data)), crc32.ChecksumIEEE(data); got != want {
+		t.Errorf("-p 0: crc32 = %08x, want %08x", got, want)
+	}
+}
+
+// Test that the CRC-32 of a stream written by several workers is combined
+// from its blocks into the trailer
+func TestCRCCombiner(t *testing.T) {
+	saved := processes
+	defer func() { processes = saved }()
+	processes = 4
+
+	data := make([]byte, 5*BLOCK_SIZE+7)
+	rand.Read(data)
+	var out bytes.Buffer
+	if err := compressStream(bytes.NewReader(data), &out); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := checksum.(*crcCombiner); !ok {
+		t.Fatalf("checksum is %T", checksum)
+	}
+	stream := out.Bytes()
+	if got, want := binary.LittleEndian.Uint32(stream[len(stream)-8:]), crc32.ChecksumIEEE(data); got != want {
+		t.Errorf("trailer CRC-32 %08x, want %08x", got, want)
+	}
+
+	c := newCRCCombiner()
+	c.Write(data[:1000])
+	c.Write(data[1000:])
+	want := crc32.NewIEEE()
+	want.Write(data)
+	if got := c.Sum(nil); !bytes.Equal(got, want.Sum(nil)) {
+		t.Errorf("sum %x, want %x", got, want.Sum(nil))
+	}
+}
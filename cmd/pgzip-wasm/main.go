@@ -0,0 +1,111 @@
+//go:build js && wasm
+
+// Command pgzip-wasm exposes the pgzip package to JavaScript, in browsers
+// and Node, as the global object pgzip:
+//
+//	pgzip.compressor(level)       an object with push(Uint8Array) and
+//	                              finish(), both returning the Uint8Array
+//	                              of compressed output ready so far
+//	pgzip.header()                the gzip header
+//	pgzip.compressBlock(data, level, last)
+//	                              a block of the deflate stream
+//	pgzip.trailer(crc, size)      the gzip trailer
+//	pgzip.crc32(data)             the CRC-32 of data
+//	pgzip.combineCRC32(crc1, crc2, len2)
+//
+// A wasm instance runs on one thread, so to compress in parallel pgzip.js
+// hands blocks to instances in Web Workers with compressBlock and joins
+// them with header, trailer and combineCRC32. Failures are returned as
+// Error objects rather than thrown.
+//
+// Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o pgzip.wasm ./cmd/pgzip-wasm
+package main
+
+import (
+	"hash/crc32"
+	"syscall/js"
+
+	"github.com/aaron-seo/gopigz/m/pgzip"
+)
+
+func main() {
+	js.Global().Set("pgzip", js.ValueOf(map[string]interface{}{
+		"compressor":    js.FuncOf(compressor),
+		"header":        js.FuncOf(header),
+		"compressBlock": js.FuncOf(compressBlock),
+		"trailer":       js.FuncOf(trailer),
+		"crc32":         js.FuncOf(checksum),
+		"combineCRC32":  js.FuncOf(combineCRC32),
+	}))
+	// keep the functions callable
+	select {}
+}
+
+// bytesOf copies a Uint8Array into Go memory.
+func bytesOf(v js.Value) []byte {
+	b := make([]byte, v.Get("length").Int())
+	js.CopyBytesToGo(b, v)
+	return b
+}
+
+// array copies b into a new Uint8Array.
+func array(b []byte) js.Value {
+	a := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(a, b)
+	return a
+}
+
+// jsError returns err as a JavaScript Error. A panic would stop the
+// program, so failures are returned and pgzip.js throws them.
+func jsError(err error) js.Value {
+	return js.Global().Get("Error").New(err.Error())
+}
+
+func compressor(this js.Value, args []js.Value) interface{} {
+	c, err := pgzip.NewCompressor(args[0].Int())
+	if err != nil {
+		return jsError(err)
+	}
+	return js.ValueOf(map[string]interface{}{
+		"push": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			out, err := c.Push(bytesOf(args[0]))
+			if err != nil {
+				return jsError(err)
+			}
+			return array(out)
+		}),
+		"finish": js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			out, err := c.Finish()
+			if err != nil {
+				return jsError(err)
+			}
+			return array(out)
+		}),
+	})
+}
+
+func header(this js.Value, args []js.Value) interface{} {
+	return array(pgzip.Header())
+}
+
+func compressBlock(this js.Value, args []js.Value) interface{} {
+	out, err := pgzip.CompressBlock(bytesOf(args[0]), args[1].Int(), args[2].Truthy())
+	if err != nil {
+		return jsError(err)
+	}
+	return array(out)
+}
+
+func trailer(this js.Value, args []js.Value) interface{} {
+	return array(pgzip.Trailer(uint32(args[0].Float()), int64(args[1].Float())))
+}
+
+func checksum(this js.Value, args []js.Value) interface{} {
+	return crc32.ChecksumIEEE(bytesOf(args[0]))
+}
+
+func combineCRC32(this js.Value, args []js.Value) interface{} {
+	return pgzip.CombineCRC32(uint32(args[0].Float()), uint32(args[1].Float()), int64(args[2].Float()))
+}
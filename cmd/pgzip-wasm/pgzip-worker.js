@@ -0,0 +1,23 @@
+// Worker for compressParallel in pgzip.js: compresses the blocks posted to
+// it and answers with the compressed block and the CRC-32 of the input.
+
+import "./wasm_exec.js";
+import { load } from "./pgzip.js";
+
+let ready;
+
+self.onmessage = async (e) => {
+	if (e.data.wasmURL) {
+		ready = load(e.data.wasmURL);
+		return;
+	}
+	await ready;
+	const { id, block, level, last } = e.data;
+	const out = globalThis.pgzip.compressBlock(block, level, last);
+	if (out instanceof Error) {
+		self.postMessage({ id, error: out.message });
+		return;
+	}
+	const crc = globalThis.pgzip.crc32(block);
+	self.postMessage({ id, out, crc, size: block.length }, [out.buffer]);
+};
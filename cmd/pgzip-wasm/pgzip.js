@@ -0,0 +1,118 @@
+// JavaScript side of pgzip-wasm: gzip compression for browsers and Node
+// with Web Streams, in parallel over Web Workers.
+//
+// wasm_exec.js from $(go env GOROOT)/lib/wasm must be loaded first, for the
+// Go class. Then
+//
+//	await load("pgzip.wasm");
+//	response.body.pipeThrough(compressionStream(6));
+//
+// compresses on the calling thread, and
+//
+//	const gz = await compressParallel(data, { workerURL: "pgzip-worker.js" });
+//
+// compresses a Uint8Array over navigator.hardwareConcurrency workers.
+
+const BLOCK_SIZE = 128 * 1024;
+
+let go;
+
+// load starts the wasm module at url, once.
+export async function load(url) {
+	if (go) {
+		return;
+	}
+	go = new Go();
+	const source = fetch(url);
+	const { instance } = await (WebAssembly.instantiateStreaming
+		? WebAssembly.instantiateStreaming(source, go.importObject)
+		: source.then((r) => r.arrayBuffer()).then((b) => WebAssembly.instantiate(b, go.importObject)));
+	// main registers globalThis.pgzip and then blocks, so do not wait
+	go.run(instance);
+}
+
+// check throws the Error objects the Go functions return on failure.
+function check(result) {
+	if (result instanceof Error) {
+		throw result;
+	}
+	return result;
+}
+
+// compressionStream returns a TransformStream from bytes to a gzip stream
+// at the given level, like CompressionStream("gzip").
+export function compressionStream(level = 6) {
+	let c;
+	return new TransformStream({
+		start() {
+			c = check(globalThis.pgzip.compressor(level));
+		},
+		transform(chunk, controller) {
+			const out = check(c.push(chunk));
+			if (out.length > 0) {
+				controller.enqueue(out);
+			}
+		},
+		flush(controller) {
+			controller.enqueue(check(c.finish()));
+		},
+	});
+}
+
+// compressParallel compresses data, a Uint8Array, into a gzip stream with
+// blocks spread over workers running pgzip-worker.js.
+export async function compressParallel(data, options = {}) {
+	const level = options.level ?? 6;
+	const count = options.workers ?? navigator.hardwareConcurrency ?? 4;
+	const workers = [];
+	for (let i = 0; i < count; i++) {
+		const w = new Worker(options.workerURL, { type: "module" });
+		w.postMessage({ wasmURL: options.wasmURL ?? "pgzip.wasm" });
+		workers.push(w);
+	}
+	try {
+		const jobs = [];
+		for (let start = 0, i = 0; start < data.length || i === 0; start += BLOCK_SIZE, i++) {
+			const block = data.subarray(start, start + BLOCK_SIZE);
+			const last = start + BLOCK_SIZE >= data.length;
+			jobs.push(run(workers[i % count], i, block, level, last));
+		}
+		const blocks = await Promise.all(jobs);
+
+		const parts = [check(globalThis.pgzip.header())];
+		let crc = 0;
+		for (const b of blocks) {
+			parts.push(b.out);
+			crc = globalThis.pgzip.combineCRC32(crc, b.crc, b.size);
+		}
+		parts.push(check(globalThis.pgzip.trailer(crc, data.length)));
+		return concat(parts);
+	} finally {
+		workers.forEach((w) => w.terminate());
+	}
+}
+
+// run has worker w compress block number id.
+function run(w, id, block, level, last) {
+	return new Promise((resolve, reject) => {
+		const done = (e) => {
+			if (e.data.id !== id) {
+				return;
+			}
+			w.removeEventListener("message", done);
+			e.data.error ? reject(new Error(e.data.error)) : resolve(e.data);
+		};
+		w.addEventListener("message", done);
+		w.postMessage({ id, block, level, last });
+	});
+}
+
+function concat(parts) {
+	const out = new Uint8Array(parts.reduce((n, p) => n + p.length, 0));
+	let n = 0;
+	for (const p of parts) {
+		out.set(p, n);
+		n += p.length;
+	}
+	return out;
+}
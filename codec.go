@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/aaron-seo/gopigz/m/pgzip"
+)
+
+// Optional formats.
+//
+// gzip and zlib are built into the pipeline. The other formats are codecs
+// that register themselves from init functions, the larger ones in files
+// with build tags, so that a minimal binary for embedded use can leave the
+// heavyweight ones out: building with -tags
+// noxz,nozstd,nobzip2,nolz4,nobrotli,nozip,nozopfli gives a gopigz with
+// gzip, zlib and raw deflate only, and no -11. Asking such a binary for a
+// format it lacks, or for -11, is reported as such. The codecs are
+// registered with pgzip, as pgzip.Codecs that compress at the options given
+// on the command line, so there is the one registry.
+
+// codec holds the hooks the pipeline calls for a registered format. Hooks
+// that a format does not need are nil.
+type codec struct {
+	suffix      string
+	contentType string
+
+	// newChecksum returns the checksum of the uncompressed data that is
+	// passed to trailer.
+	newChecksum func() hash.Hash32
+	// start resets the state of the stream about to be compressed.
+	start  func()
+	header func() []byte
+	// block compresses a block. Blocks are compressed in parallel unless
+	// sequential reports true, in which case block is called in block
+	// order from a single goroutine.
+	block      func(b *block) []byte
+	sequential func() bool
+	// wrote is called by the write stage for every block, in order.
+	wrote   func(b *block)
+	trailer func(sum uint32) []byte
+
+	// memory estimates the memory compressing needs beyond the pipeline's
+	// blocks.
+	memory func() int64
+	// dictionary is set if the format takes --dict.
+	dictionary bool
+	// loadDictionary parses a dictionary file in the format's own layout,
+	// returning the content, or the data itself if it is raw.
+	loadDictionary func(data []byte) ([]byte, error)
+	// trainedDictionary formats the content of a dictionary made by the
+	// train subcommand.
+	trainedDictionary func(content []byte) []byte
+
+	// stores is set if the format is a container that can hold the input
+	// uncompressed, as --min-ratio has it for files not worth compressing
+	// while storeInput is set.
+	stores bool
+
+	// decompress is nil if the format cannot be decompressed.
+	decompress func(input io.Reader, output io.Writer) error
+}
+
+// Formats gopigz knows, whether compiled in or not
+var knownFormats = []string{"gzip", "zlib", "deflate", "bgzf", "xz", "zstd", "bzip2", "lz4", "brotli", "zip"}
+
+// optionChecks validate codec-specific options once the flags are parsed.
+var optionChecks []func() error
+
+func registerCodec(name string, c *codec) {
+	pgzip.RegisterCodec(name, c)
+}
+
+// lookupCodec returns the codec of format, or nil for gzip, zlib and the
+// formats not compiled in.
+func lookupCodec(format string) *codec {
+	c, _ := pgzip.LookupCodec(format)
+	registered, _ := c.(*codec)
+	return registered
+}
+
+func (c *codec) Header() []byte { return c.header() }
+
+// NewBlockWriter returns the codec's compressor. The level is that of the
+// command line, which the codec reads with the other options.
+func (c *codec) NewBlockWriter(int) (pgzip.BlockWriter, error) { return codecBlockWriter{c}, nil }
+
+func (c *codec) NewChecksum() hash.Hash32 { return c.newChecksum() }
+
+func (c *codec) Trailer(sum uint32, size int64) []byte { return c.trailer(sum) }
+
+// codecBlockWriter compresses the blocks of a pgzip pipeline with a codec.
+type codecBlockWriter struct{ c *codec }
+
+func (w codecBlockWriter) CompressBlock(b *pgzip.Block) []byte {
+	return w.c.block(&block{Index: b.Index, RawData: b.Data, window: b.Window, LastBlock: b.Last})
+}
+
+// checkFormat reports whether format can be used with this binary.
+func checkFormat(format string) error {
+	if format == "gzip" || format == "zlib" || lookupCodec(format) != nil {
+		return nil
+	}
+	for _, known := range knownFormats {
+		if format == known {
+			return fmt.Errorf("format %q is not compiled into this binary", format)
+		}
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// availableFormats lists the formats compiled in, and those of them that
+// can be decompressed.
+func availableFormats() (all, decompressible []string) {
+	all = []string{"gzip", "zlib"}
+	decompressible = []string{"gzip", "zlib"}
+	for _, name := range pgzip.Codecs() {
+		c := lookupCodec(name)
+		if c == nil {
+			continue
+		}
+		all = append(all, name)
+		if c.decompress != nil {
+			decompressible = append(decompressible, name)
+		}
+	}
+	return all, decompressible
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aaron-seo/gopigz/m/pgzip"
+)
+
+// Test that formats left out of the build are told apart from unknown ones
+func TestCheckFormat(t *testing.T) {
+	if err := checkFormat("gzip"); err != nil {
+		t.Error(err)
+	}
+	if err := checkFormat("lz5"); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("lz5: %v", err)
+	}
+
+	// a format gopigz knows of that is left out of this build
+	saved := knownFormats
+	defer func() { knownFormats = saved }()
+	knownFormats = append(append([]string{}, saved...), "lz5")
+	if err := checkFormat("lz5"); err == nil || !strings.Contains(err.Error(), "not compiled") {
+		t.Errorf("lz5: %v", err)
+	}
+	if all, _ := availableFormats(); strings.Contains(strings.Join(all, " "), "lz5") {
+		t.Errorf("formats %v", all)
+	}
+}
+
+// Test that the codecs compiled in are those of the pgzip registry, and
+// compress through it as they do in the pipeline
+func TestCodecRegistry(t *testing.T) {
+	defer func() { format = "gzip" }()
+	c, ok := pgzip.LookupCodec("deflate")
+	if !ok || lookupCodec("deflate") == nil || lookupCodec("gzip") != nil {
+		t.Fatalf("deflate: %v, gzip: %v", ok, lookupCodec("gzip") != nil)
+	}
+	format = "deflate"
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 10000)
+	var out bytes.Buffer
+	z, err := pgzip.NewWriterCodec(&out, c, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.Write(data)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(flate.NewReader(&out))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes: %v", len(got), err)
+	}
+}
+
+// Test that -11 in a binary built without zopfli is reported as left out
+func TestZopfliLeftOut(t *testing.T) {
+	saved := zopfliEncoder
+	defer func() { zopfliEncoder, level = saved, flate.DefaultCompression }()
+	zopfliEncoder, level = nil, ZOPFLI_LEVEL
+	var err error
+	for _, check := range optionChecks {
+		if err = check(); err != nil {
+			break
+		}
+	}
+	if err == nil || !strings.Contains(err.Error(), "not compiled") {
+		t.Errorf("-11: %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+// Header comments (--comment).
+//
+// --comment TEXT is written in the FCOMMENT field of every gzip header, in
+// ISO 8859-1 like the name, to tag archives with a build ID or where they
+// came from. gzip ignores it when decompressing; gopigz --list -v shows it.
+
+// Parsing comment flag
+var headerComment string
+
+func init() {
+	flag.StringVar(&headerComment, "comment", "", "Store a comment in gzip headers")
+	optionChecks = append(optionChecks, func() error {
+		if headerComment != "" && format != "gzip" {
+			return errors.New("--comment is only supported with the gzip format")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Test that --comment is stored in the header in ISO 8859-1 and listed
+func TestHeaderComment(t *testing.T) {
+	headerComment = "build 42, café ☕"
+	defer func() { headerComment = "" }()
+
+	var out bytes.Buffer
+	if err := compressStream(bytes.NewReader([]byte("tagged\n")), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("build 42, caf\xe9 ?\x00")) {
+		t.Errorf("header % x", out.Bytes()[:32])
+	}
+	l, err := listGzip(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.comment != "build 42, café ?" || l.uncompressed != 7 {
+		t.Errorf("got %+v", l)
+	}
+}
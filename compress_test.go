@@ -3,11 +3,15 @@ package main
 import (
 	"bytes"
 	"compress/flate"
+	"flag"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"reflect"
 	"testing"
+
+	"github.com/aaron-seo/gopigz/m/pgzip"
 )
 
 // Test compressing a single buffer of data
@@ -53,6 +57,138 @@ func TestCompressSingle(t *testing.T) {
 	}
 }
 
-// TODO Test compressing multiple blocks of data
+// Test that blocks compressed by several workers come out in order
 func TestCompressMultiple(t *testing.T) {
+	saved := processes
+	processes = 4
+	defer func() { processes = saved }()
+
+	const n = 50
+	in := make(chan *block)
+	go func() {
+		for i := 1; i <= n; i++ {
+			// blocks of very different sizes finish out of order
+			data := make([]byte, (i%7)*BLOCK_SIZE/7+1)
+			rand.Read(data)
+			in <- &block{Index: i, LastBlock: i == n, RawData: data}
+		}
+		close(in)
+	}()
+
+	next := 1
+	for b := range compress(in) {
+		if b.Index != next {
+			t.Fatalf("got block %d, want %d", b.Index, next)
+		}
+		got, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(b.CompressedData)))
+		if err != io.ErrUnexpectedEOF && err != nil || !bytes.Equal(got, b.RawData) {
+			t.Errorf("block %d: %v", b.Index, err)
+		}
+		next++
+	}
+	if next != n+1 {
+		t.Errorf("got %d blocks, want %d", next-1, n)
+	}
+}
+
+// Test that the level flags reach the flate writers of the pipeline
+func TestCompressLevel(t *testing.T) {
+	defer func() { level = flate.DefaultCompression }()
+
+	data := bytes.Repeat([]byte("levels 0 to 9, fast and best\n"), BLOCK_SIZE/10)
+	sizes := make(map[string]int)
+	for _, name := range []string{"0", "huffman", "fast", "best"} {
+		if err := flag.Set(name, "true"); err != nil {
+			t.Fatal(err)
+		}
+		compressed := deflateBlock(&block{Index: 2, LastBlock: true, RawData: data})
+		sizes[name] = len(compressed)
+		got, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("-%s: %v", name, err)
+		}
+	}
+	if sizes["0"] <= len(data) || sizes["huffman"] >= sizes["0"] || sizes["fast"] >= sizes["huffman"] || sizes["best"] > sizes["fast"] {
+		t.Errorf("sizes %v", sizes)
+	}
+	if level != flate.BestCompression {
+		t.Errorf("level %d after --best", level)
+	}
+}
+
+// Test that blocks are primed with the input before them, and that with -i
+// every one inflates on its own
+func TestIndependentBlocks(t *testing.T) {
+	first := make([]byte, BLOCK_SIZE)
+	rand.Read(first)
+	// the second block repeats the end of the first
+	second := append([]byte{}, first[BLOCK_SIZE-DICT_SIZE/2:]...)
+	b := &block{Index: 2, LastBlock: true, RawData: second, window: pgzip.AppendWindow(nil, first)}
+
+	primed := deflateBlock(b)
+	independent = true
+	defer func() { independent = false }()
+	alone := deflateBlock(b)
+	if len(primed) > len(alone)/10 {
+		t.Errorf("primed block is %d bytes, %d alone", len(primed), len(alone))
+	}
+
+	got, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(alone)))
+	if err != nil || !bytes.Equal(got, second) {
+		t.Errorf("independent block: %v", err)
+	}
+	got, err = ioutil.ReadAll(flate.NewReaderDict(bytes.NewReader(primed), b.window))
+	if err != nil || !bytes.Equal(got, second) {
+		t.Errorf("primed block: %v", err)
+	}
+}
+
+// Test that -b sets the size of the blocks read, within its bounds
+func TestBlockSize(t *testing.T) {
+	defer func() { blockSize = BLOCK_SIZE }()
+
+	for _, bad := range []string{"x", "16", "1048576"} {
+		if err := flag.Set("b", bad); err == nil {
+			t.Errorf("-b %s accepted", bad)
+		}
+	}
+	if err := flag.Set("blocksize", "32"); err != nil || blockSize != 32*1024 {
+		t.Fatalf("--blocksize 32: %d, %v", blockSize, err)
+	}
+
+	data := make([]byte, 100*1024)
+	rand.Read(data)
+	var sizes []int
+	for b := range read(bytes.NewReader(data), nil) {
+		sizes = append(sizes, len(b.RawData))
+		blockDone()
+	}
+	if !reflect.DeepEqual(sizes, []int{32768, 32768, 32768, 4096}) {
+		t.Errorf("block sizes %v", sizes)
+	}
+}
+
+// Test that the pgzip library writes what the pipeline does: past the
+// header, the streams of the same input are the same
+func TestLibraryPipeline(t *testing.T) {
+	data := make([]byte, 5*BLOCK_SIZE+1234)
+	rng := rand.New(rand.NewSource(5))
+	for i := range data {
+		data[i] = "abcdefgh"[rng.Intn(8)]
+	}
+	var out, lib bytes.Buffer
+	if err := compressStream(bytes.NewReader(data), &out); err != nil {
+		t.Fatal(err)
+	}
+	z, err := pgzip.NewWriterLevel(&lib, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.Write(data)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes()[10:], lib.Bytes()[10:]) {
+		t.Errorf("pipeline wrote %d bytes, library %d", out.Len(), lib.Len())
+	}
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Named profiles (--profile NAME).
+//
+// The config file holds sets of option values under a name, so that many
+// jobs can share the same settings without repeating long command lines:
+//
+//	{
+//		"profiles": {
+//			"archive":  {"keep": true, "min-ratio": 5},
+//			"fastlogs": {"keep": false, "format": "gzip"}
+//		}
+//	}
+//
+// Settings use the long option names. Options given on the command line take
+// precedence over the profile.
+
+// Parsing config and profile flags
+var configPath string
+var profileName string
+
+type config struct {
+	Profiles map[string]map[string]interface{} `json:"profiles"`
+	Daemon   *daemonConfig                     `json:"daemon"`
+}
+
+// defaultConfigPath returns the config file used when --config is not given.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gopigz", "config.json")
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &c, nil
+}
+
+// optionAliases maps the names of options defined in optional files, such
+// as --zip, to the option they stand in for; those files fill it in from
+// their init functions, so optionOf need not name their types.
+var optionAliases = make(map[string]string)
+
+// optionOf returns what the option f sets, so that options setting the same
+// variable compare equal: the name of the option it stands in for, as -9,
+// --fast and --huffman do for --level, or else its Value, which the short
+// and long names of an option share.
+func optionOf(f *flag.Flag) interface{} {
+	switch f.Value.(type) {
+	case levelFlag:
+		return "level"
+	case skipIfLargerFlag:
+		return "min-ratio"
+	case bgzfFlag, rawFlag:
+		return "format"
+	case quietFlag, verboseFlag:
+		return "verbose"
+	case nameFlag:
+		return "name"
+	}
+	if option, ok := optionAliases[f.Name]; ok {
+		return option
+	}
+	switch f.Name {
+	case "level", "min-ratio", "format":
+		return f.Name
+	case "codec":
+		return "format"
+	}
+	return f.Value
+}
+
+// applyProfile sets the options of the named profile that were not given on
+// the command line. An option counts as given if any of the options setting
+// the same variable was used: its short or long name, or an alias such as
+// -9 for --level.
+func applyProfile(c *config, name string) error {
+	settings, ok := c.Profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+
+	given := make(map[interface{}]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[optionOf(f)] = true
+	})
+	isGiven := func(f *flag.Flag) bool {
+		return given[optionOf(f)]
+	}
+
+	// apply in a fixed order, so that settings touching the same value
+	// (like skip-if-larger and min-ratio) behave the same on every run
+	names := make([]string, 0, len(settings))
+	for option := range settings {
+		names = append(names, option)
+	}
+	sort.Strings(names)
+
+	for _, option := range names {
+		f := flag.Lookup(option)
+		if f == nil {
+			return fmt.Errorf("profile %q: unknown option %q", name, option)
+		}
+		if isGiven(f) {
+			continue
+		}
+		if err := flag.Set(option, fmt.Sprint(settings[option])); err != nil {
+			return fmt.Errorf("profile %q: %s: %v", name, option, err)
+		}
+	}
+	return nil
+}
+
+// configFile returns the config file in use.
+func configFile() string {
+	if configPath != "" {
+		return configPath
+	}
+	return defaultConfigPath()
+}
+
+// setupProfile loads the config file and applies --profile, if given.
+func setupProfile() error {
+	if profileName == "" {
+		return nil
+	}
+	c, err := loadConfig(configFile())
+	if err != nil {
+		return err
+	}
+	return applyProfile(c, profileName)
+}
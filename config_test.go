@@ -0,0 +1,55 @@
+package main
+
+import (
+	"compress/flate"
+	"flag"
+	"testing"
+)
+
+// Test that a profile fills in options not given on the command line,
+// including ones given by their short name
+func TestApplyProfile(t *testing.T) {
+	defer func() { keep, recursive, minRatio = false, false, -1 }()
+
+	c := &config{Profiles: map[string]map[string]interface{}{
+		"archive": {"keep": true, "recursive": true, "min-ratio": 5},
+		"broken":  {"no-such-option": 1},
+	}}
+
+	flag.Set("r", "false")
+	if err := applyProfile(c, "archive"); err != nil {
+		t.Fatal(err)
+	}
+	if !keep || minRatio != 5 {
+		t.Errorf("profile not applied: keep=%v min-ratio=%v", keep, minRatio)
+	}
+	if recursive {
+		t.Errorf("profile overrode -r given on the command line")
+	}
+
+	if err := applyProfile(c, "missing"); err == nil {
+		t.Errorf("unknown profile accepted")
+	}
+	if err := applyProfile(c, "broken"); err == nil {
+		t.Errorf("unknown option accepted")
+	}
+}
+
+// Test that an alias given on the command line beats the profile setting
+// the same variable under another name
+func TestApplyProfileAlias(t *testing.T) {
+	defer func() { level, minRatio, format = flate.DefaultCompression, -1, "gzip" }()
+
+	c := &config{Profiles: map[string]map[string]interface{}{
+		"fast": {"level": 1, "min-ratio": 5, "format": "zstd"},
+	}}
+	flag.Set("9", "true")
+	flag.Set("skip-if-larger", "true")
+	flag.Set("codec", "zlib")
+	if err := applyProfile(c, "fast"); err != nil {
+		t.Fatal(err)
+	}
+	if level != 9 || minRatio != 0 || format != "zlib" {
+		t.Errorf("profile overrode the command line: level=%d min-ratio=%v format=%s", level, minRatio, format)
+	}
+}
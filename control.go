@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Daemon control socket and the ctl subcommand.
+//
+// Clients connect to the daemon's unix socket and exchange one JSON object
+// per line: a controlRequest, answered by a controlResponse.
+//
+//	gopigz ctl [--socket PATH] status|jobs|pause|resume|reload|shutdown
+//	gopigz ctl [--socket PATH] loglevel error|info|debug
+
+type controlRequest struct {
+	Cmd   string `json:"cmd"`
+	Level string `json:"level,omitempty"`
+}
+
+type daemonStatus struct {
+	Dirs     []string   `json:"dirs"`
+	Uptime   float64    `json:"uptime_seconds"`
+	Paused   bool       `json:"paused"`
+	Stopping bool       `json:"stopping"`
+	LogLevel string     `json:"log_level"`
+	Queued   int        `json:"queued"`
+	Stats    runSummary `json:"stats"`
+}
+
+type controlResponse struct {
+	OK     bool          `json:"ok"`
+	Error  string        `json:"error,omitempty"`
+	Status *daemonStatus `json:"status,omitempty"`
+	Jobs   []job         `json:"jobs,omitempty"`
+}
+
+// defaultSocket is gopigz.sock in $XDG_RUNTIME_DIR or, without one, in a
+// directory of the user's own under the temporary directory, so that other
+// users cannot take its place.
+func defaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "gopigz.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("gopigz-%d", os.Getuid()), "gopigz.sock")
+}
+
+// makeSocketDir makes dir, the directory of the default socket, for the
+// user alone, and refuses one that is a link, is owned by someone else or
+// that others can write to.
+func makeSocketDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if uid, _, ok := fileOwner(info); ok && uid != os.Getuid() {
+		return fmt.Errorf("%s is owned by another user", dir)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by other users", dir)
+	}
+	return nil
+}
+
+// serveControl answers control connections until l is closed.
+func serveControl(l net.Listener, d *daemon) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			scanner := bufio.NewScanner(c)
+			enc := json.NewEncoder(c)
+			for scanner.Scan() {
+				var req controlRequest
+				if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+					enc.Encode(controlResponse{Error: err.Error()})
+					continue
+				}
+				enc.Encode(d.control(req))
+			}
+		}()
+	}
+}
+
+// control carries out one request.
+func (d *daemon) control(req controlRequest) controlResponse {
+	if req.Cmd == "reload" {
+		if err := d.reload(); err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+		d.poke()
+		return controlResponse{OK: true}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch req.Cmd {
+	case "status":
+		return controlResponse{OK: true, Status: &daemonStatus{
+			Dirs:     d.dirs,
+			Uptime:   time.Since(d.started).Seconds(),
+			Paused:   d.paused,
+			Stopping: d.stopping,
+			LogLevel: d.logLevel,
+			Queued:   d.queued,
+			Stats:    d.stats,
+		}}
+	case "jobs":
+		resp := controlResponse{OK: true, Jobs: []job{}}
+		if d.current != nil {
+			resp.Jobs = append(resp.Jobs, *d.current)
+		}
+		return resp
+	case "loglevel":
+		if err := d.setLogLevel(req.Level); err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+	case "pause":
+		d.paused = true
+	case "resume":
+		d.paused = false
+		d.poke()
+	case "shutdown":
+		d.stopping = true
+		d.poke()
+	default:
+		return controlResponse{Error: fmt.Sprintf("unknown command %q", req.Cmd)}
+	}
+	return controlResponse{OK: true}
+}
+
+// sendControl sends req to the daemon listening on socket.
+func sendControl(socket string, req controlRequest) (controlResponse, error) {
+	var resp controlResponse
+	c, err := net.Dial("unix", socket)
+	if err != nil {
+		return resp, err
+	}
+	defer c.Close()
+	if err := json.NewEncoder(c).Encode(req); err != nil {
+		return resp, err
+	}
+	err = json.NewDecoder(c).Decode(&resp)
+	return resp, err
+}
+
+// runCtl implements the ctl subcommand, printing the daemon's response.
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := fs.String("socket", defaultSocket(), "Control socket of the daemon")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gopigz ctl [--socket PATH] status|jobs|pause|resume|reload|shutdown|loglevel LEVEL")
+		os.Exit(1)
+	}
+
+	req := controlRequest{Cmd: fs.Arg(0), Level: fs.Arg(1)}
+	resp, err := sendControl(*socket, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	out, _ := json.MarshalIndent(resp, "", "  ")
+	fmt.Println(string(out))
+	if !resp.OK {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// CPU features the codecs and checksums benefit from, as /proc/cpuinfo
+// names them on x86 and arm
+var usefulCPUFeatures = map[string]bool{
+	"sse4_2": true, "pclmulqdq": true, "avx2": true, "bmi2": true, "aes": true,
+	"crc32": true, "pmull": true, "asimd": true,
+}
+
+// cpuFeatures lists the useful features /proc/cpuinfo reports for the first
+// CPU.
+func cpuFeatures() []string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		key, value := s.Text(), ""
+		if i := strings.IndexByte(key, ':'); i >= 0 {
+			key, value = strings.TrimSpace(key[:i]), key[i+1:]
+		}
+		if key != "flags" && key != "Features" {
+			continue
+		}
+		var features []string
+		for _, name := range strings.Fields(value) {
+			if usefulCPUFeatures[name] {
+				features = append(features, name)
+			}
+		}
+		return features
+	}
+	return nil
+}
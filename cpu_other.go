@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// cpuFeatures is not implemented on this platform.
+func cpuFeatures() []string {
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Encryption after compression (--encrypt aes:KEYFILE, --decrypt
+// aes:KEYFILE).
+//
+// Backups usually get compressed and then encrypted by a second tool. With
+// --encrypt the compressed stream goes through AES-256-GCM as the last
+// stage of the pipeline instead, and --decrypt undoes it before
+// decompressing, so one streaming pass does both. KEYFILE holds 32 random
+// bytes, raw or as 64 hex digits:
+//
+//	head -c 32 /dev/urandom > backup.key
+//	gopigz --encrypt aes:backup.key data        # writes data.gz.enc
+//	gopigz -d --decrypt aes:backup.key data.gz.enc
+//
+// The output is ENC_MAGIC, a random salt, and the stream cut into segments
+// of ENC_SEGMENT bytes, each sealed on its own, as age does with its
+// payload. Every file is sealed with its own key, the HMAC-SHA256 of the
+// salt under KEYFILE's, and segment nonces count up from zero with the last
+// one marked, so segments cannot be reordered, dropped or cut off unnoticed.
+// age recipients need X25519 and ChaCha20-Poly1305, which are not in the
+// standard library, so only key files are supported.
+
+// Parsing encrypt and decrypt flags
+var encryptSpec string
+var decryptSpec string
+
+// keys from --encrypt and --decrypt, nil unless given
+var encryptKey []byte
+var decryptKey []byte
+
+const (
+	ENC_SUFFIX  = ".enc"
+	ENC_SALT    = 32
+	ENC_SEGMENT = 64 * 1024
+	ENC_KEY     = 32
+)
+
+var ENC_MAGIC = []byte("GPZAES1\n")
+
+var errBadEncryption = errors.New("not encrypted with this key, or corrupted")
+
+func init() {
+	optionChecks = append(optionChecks, func() error {
+		if encryptSpec != "" && decompress {
+			return errors.New("--encrypt is for compressing, use --decrypt with -d")
+		}
+		if decryptSpec != "" && !decompress {
+			return errors.New("--decrypt is only used with -d")
+		}
+		var err error
+		if encryptSpec != "" {
+			if encryptKey, err = loadKey(encryptSpec); err != nil {
+				return err
+			}
+		}
+		if decryptSpec != "" {
+			if decryptKey, err = loadKey(decryptSpec); err != nil {
+				return err
+			}
+		}
+		if (encryptKey != nil || decryptKey != nil) && (mux || memberInterval() > 0 || rangeSpec != "") {
+			return errors.New("--encrypt and --decrypt cannot be combined with --mux, --member-every or --range")
+		}
+		return nil
+	})
+}
+
+// loadKey reads the key named by an --encrypt or --decrypt argument.
+func loadKey(spec string) ([]byte, error) {
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("%q: expected aes:KEYFILE", spec)
+	}
+	scheme, path := spec[:i], spec[i+1:]
+	switch scheme {
+	case "aes":
+	case "age":
+		return nil, errors.New("age recipients are not supported, use aes:KEYFILE")
+	default:
+		return nil, fmt.Errorf("unknown encryption %q, expected aes:KEYFILE", scheme)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == ENC_KEY {
+		return data, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ENC_KEY {
+		return nil, fmt.Errorf("%s: a key must be %d bytes, raw or in hex", path, ENC_KEY)
+	}
+	return key, nil
+}
+
+// encSuffix returns the suffix added to the names of encrypted files.
+func encSuffix() string {
+	if encryptKey != nil || decryptKey != nil {
+		return ENC_SUFFIX
+	}
+	return ""
+}
+
+// fileCipher returns the cipher of the file with the given salt.
+func fileCipher(key, salt []byte) cipher.AEAD {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	block, _ := aes.NewCipher(mac.Sum(nil))
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// segmentNonce returns the nonce of segment n: its number, big-endian, and
+// a last byte of 1 for the last segment.
+func segmentNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter seals everything written to it. Close seals the last
+// segment; it does not close the underlying writer.
+type encryptWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	n    uint64
+	err  error
+}
+
+func newEncryptWriter(w io.Writer, key []byte) (*encryptWriter, error) {
+	salt := make([]byte, ENC_SALT)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(append([]byte(nil), ENC_MAGIC...), salt...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: fileCipher(key, salt), buf: make([]byte, 0, ENC_SEGMENT)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if e.err != nil {
+			return written, e.err
+		}
+		// a full segment is only sealed once more data shows it is not
+		// the last
+		if len(e.buf) == ENC_SEGMENT {
+			e.seal(false)
+			continue
+		}
+		c := copy(e.buf[len(e.buf):ENC_SEGMENT], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		written += c
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) seal(last bool) {
+	sealed := e.aead.Seal(nil, segmentNonce(e.n, last), e.buf, nil)
+	e.n++
+	e.buf = e.buf[:0]
+	_, e.err = e.w.Write(sealed)
+}
+
+func (e *encryptWriter) Close() error {
+	if e.err == nil {
+		e.seal(true)
+	}
+	return e.err
+}
+
+// decryptReader opens a stream sealed by encryptWriter.
+type decryptReader struct {
+	r    *bufio.Reader
+	key  []byte
+	aead cipher.AEAD // nil until the header is read
+	seg  []byte      // the sealed segment being read
+	out  []byte      // opened data not yet returned
+	n    uint64
+	done bool
+}
+
+func newDecryptReader(r io.Reader, key []byte) *decryptReader {
+	return &decryptReader{r: bufio.NewReader(r), key: key}
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// next opens the next segment.
+func (d *decryptReader) next() error {
+	if d.aead == nil {
+		header := make([]byte, len(ENC_MAGIC)+ENC_SALT)
+		if _, err := io.ReadFull(d.r, header); err != nil || !bytes.Equal(header[:len(ENC_MAGIC)], ENC_MAGIC) {
+			return errors.New("not an encrypted stream")
+		}
+		d.aead = fileCipher(d.key, header[len(ENC_MAGIC):])
+		d.seg = make([]byte, ENC_SEGMENT+d.aead.Overhead())
+	}
+
+	n, err := io.ReadFull(d.r, d.seg)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	last := n < len(d.seg)
+	if !last {
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+	opened, err := d.aead.Open(d.seg[:0], segmentNonce(d.n, last), d.seg[:n], nil)
+	if err != nil {
+		return errBadEncryption
+	}
+	d.n++
+	d.out = opened
+	d.done = last
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// Test that encrypted streams round-trip, and that tampering, truncation
+// and the wrong key are caught
+func TestEncryption(t *testing.T) {
+	key := make([]byte, ENC_KEY)
+	rand.Read(key)
+	other := append([]byte(nil), key...)
+	other[0] ^= 1
+
+	for _, size := range []int{0, 1000, ENC_SEGMENT, 2*ENC_SEGMENT + 1} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		var sealed bytes.Buffer
+		e, err := newEncryptWriter(&sealed, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Write(plain[:size/3])
+		e.Write(plain[size/3:])
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		open := func(data, key []byte) ([]byte, error) {
+			var out bytes.Buffer
+			_, err := out.ReadFrom(newDecryptReader(bytes.NewReader(data), key))
+			return out.Bytes(), err
+		}
+		got, err := open(sealed.Bytes(), key)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: opened %d bytes, %v", size, len(got), err)
+		}
+		if _, err := open(sealed.Bytes(), other); err == nil {
+			t.Errorf("%d bytes: opened with the wrong key", size)
+		}
+		tampered := append([]byte(nil), sealed.Bytes()...)
+		tampered[len(tampered)-1] ^= 1
+		if _, err := open(tampered, key); err == nil {
+			t.Errorf("%d bytes: tampered stream opened", size)
+		}
+		// cut off after the first segment
+		header := len(ENC_MAGIC) + ENC_SALT
+		if cut := header + ENC_SEGMENT + 16; sealed.Len() > cut {
+			if _, err := open(sealed.Bytes()[:cut], key); err == nil {
+				t.Errorf("%d bytes: truncated stream opened", size)
+			}
+		}
+	}
+}
+
+// Test that --encrypt and --decrypt wrap the pipeline
+func TestEncryptedStream(t *testing.T) {
+	key := make([]byte, ENC_KEY)
+	rand.Read(key)
+	data := bytes.Repeat([]byte("secret and compressible\n"), 20000)
+
+	encryptKey = key
+	var sealed bytes.Buffer
+	err := compressStream(bytes.NewReader(data), &sealed)
+	encryptKey = nil
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed.Bytes(), ENC_MAGIC) || sealed.Len() > len(data)/10 {
+		t.Errorf("output is not compressed and encrypted: %d bytes", sealed.Len())
+	}
+
+	decryptKey = key
+	defer func() { decryptKey = nil }()
+	var got bytes.Buffer
+	if err := decompressStream(&sealed, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("decrypted output differs from input")
+	}
+}
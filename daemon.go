@@ -0,0 +1,403 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Daemon mode: gopigz [options] daemon [--socket PATH] [--interval D] DIRS...
+//
+// The daemon watches directories by scanning them every interval and
+// compresses the files that appear in them, with the options given before
+// the subcommand, as -r would. Files modified during the last interval are
+// left for the next scan, since they may still be being written. A control
+// socket lets operators inspect and steer it (see control.go).
+//
+// The "daemon" section of the config file can set the directories, the
+// file name patterns to compress, the interval, the log level and option
+// values for the jobs:
+//
+//	"daemon": {
+//		"dirs": ["/var/log/app"],
+//		"patterns": ["*.log", "*.csv"],
+//		"interval": "30s",
+//		"log_level": "info",
+//		"options": {"keep": true, "min-ratio": 5}
+//	}
+//
+// SIGHUP or the reload control command rereads it. A valid new config
+// applies from the next job on; the job in progress is not interrupted.
+
+type daemonConfig struct {
+	Dirs     []string               `json:"dirs"`
+	Patterns []string               `json:"patterns"`
+	Interval string                 `json:"interval"`
+	LogLevel string                 `json:"log_level"`
+	Options  map[string]interface{} `json:"options"`
+}
+
+// Log levels of the daemon. Errors are logged at every level, warnings
+// from info on and pipeline messages only at debug, as with -q, no option
+// and -v -v.
+var LOG_LEVELS = []string{"error", "info", "debug"}
+
+// job is a file being compressed by the daemon.
+type job struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Started time.Time `json:"started"`
+}
+
+type daemon struct {
+	mu       sync.Mutex
+	dirs     []string
+	fixed    bool // dirs given on the command line, not from the config
+	patterns []string
+	interval time.Duration
+	started  time.Time
+	logLevel string
+	paused   bool
+	stopping bool
+	current  *job
+	queued   int
+	stats    runSummary // copy of summary as of the last finished job
+
+	wake chan struct{} // interrupts the wait between scans
+
+	pending  *daemonConfig     // reloaded config, applied before the next job
+	options  map[string]string // option values set from the config
+	baseline map[string]string // their values before that
+}
+
+func newDaemon(dirs []string, interval time.Duration) *daemon {
+	d := &daemon{
+		dirs:     dirs,
+		interval: interval,
+		started:  time.Now(),
+		fixed:    len(dirs) > 0,
+		wake:     make(chan struct{}, 1),
+		options:  make(map[string]string),
+		baseline: make(map[string]string),
+	}
+	d.setLogLevel("info")
+	return d
+}
+
+// setLogLevel switches the log level. d.mu must be held or d not shared yet.
+func (d *daemon) setLogLevel(level string) error {
+	if !validLogLevel(level) {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	d.logLevel = level
+	switch level {
+	case "error":
+		setVerbosity(VERBOSITY_QUIET)
+	case "info":
+		setVerbosity(VERBOSITY_NORMAL)
+	case "debug":
+		setVerbosity(VERBOSITY_DEBUG)
+	}
+	return nil
+}
+
+// logf prints a daemon message if level is enabled.
+func (d *daemon) logf(level, format string, args ...interface{}) {
+	d.mu.Lock()
+	current := d.logLevel
+	d.mu.Unlock()
+	for _, l := range LOG_LEVELS {
+		if l == level {
+			fmt.Fprintf(os.Stderr, "%s %s: %s\n", time.Now().Format(time.RFC3339), level, fmt.Sprintf(format, args...))
+		}
+		if l == current {
+			return
+		}
+	}
+}
+
+// poke wakes the daemon up if it is waiting for the next scan.
+func (d *daemon) poke() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// checkConfig validates a daemon config and returns its interval, or 0 if
+// it has none.
+func checkConfig(c *daemonConfig) (time.Duration, error) {
+	var interval time.Duration
+	if c.Interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(c.Interval); err != nil || interval <= 0 {
+			return 0, fmt.Errorf("daemon: invalid interval %q", c.Interval)
+		}
+	}
+	if c.LogLevel != "" && !validLogLevel(c.LogLevel) {
+		return 0, fmt.Errorf("daemon: unknown log level %q", c.LogLevel)
+	}
+	for _, p := range c.Patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return 0, fmt.Errorf("daemon: pattern %q: %v", p, err)
+		}
+	}
+	for name := range c.Options {
+		if flag.Lookup(name) == nil {
+			return 0, fmt.Errorf("daemon: unknown option %q", name)
+		}
+	}
+	for _, dir := range c.Dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return 0, fmt.Errorf("daemon: %s is not a directory", dir)
+		}
+	}
+	return interval, nil
+}
+
+func validLogLevel(level string) bool {
+	for _, l := range LOG_LEVELS {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// reload rereads the config file. If the daemon section is valid, it is
+// applied before the next job.
+func (d *daemon) reload() error {
+	c, err := loadConfig(configFile())
+	if err != nil {
+		return err
+	}
+	if c.Daemon == nil {
+		c.Daemon = &daemonConfig{}
+	}
+	if _, err := checkConfig(c.Daemon); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.pending = c.Daemon
+	d.mu.Unlock()
+	return nil
+}
+
+// applyPending switches to a reloaded config. It runs between jobs, on the
+// goroutine running them, so option changes never affect a job midway.
+func (d *daemon) applyPending() {
+	d.mu.Lock()
+	c := d.pending
+	d.pending = nil
+	d.mu.Unlock()
+	if c == nil {
+		return
+	}
+	interval, err := checkConfig(c)
+	if err != nil {
+		d.logf("error", "%v", err)
+		return
+	}
+
+	// options the new config no longer sets go back to their old values
+	for name := range d.options {
+		if _, ok := c.Options[name]; !ok {
+			flag.Set(name, d.baseline[name])
+			delete(d.options, name)
+		}
+	}
+	for name, v := range c.Options {
+		value := fmt.Sprint(v)
+		if _, ok := d.options[name]; !ok {
+			d.baseline[name] = flag.Lookup(name).Value.String()
+		}
+		if err := flag.Set(name, value); err != nil {
+			d.logf("error", "daemon: option %s: %v", name, err)
+			continue
+		}
+		d.options[name] = value
+	}
+
+	d.mu.Lock()
+	if !d.fixed && len(c.Dirs) > 0 {
+		d.dirs = c.Dirs
+	}
+	d.patterns = c.Patterns
+	if interval > 0 {
+		d.interval = interval
+	}
+	if c.LogLevel != "" {
+		d.setLogLevel(c.LogLevel)
+	}
+	d.mu.Unlock()
+	d.logf("info", "configuration loaded")
+}
+
+// matches reports whether path is one of the files to compress.
+func (d *daemon) matches(path string) bool {
+	if len(d.patterns) == 0 {
+		return true
+	}
+	for _, p := range d.patterns {
+		if ok, _ := filepath.Match(p, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// run scans until shutdown is requested. A job in progress is always
+// finished first.
+func (d *daemon) run() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		d.applyPending()
+		d.mu.Lock()
+		stopping, paused, interval := d.stopping, d.paused, d.interval
+		d.mu.Unlock()
+		if stopping {
+			return
+		}
+		if !paused {
+			d.scan()
+		}
+		select {
+		case <-d.wake:
+		case <-hup:
+			if err := d.reload(); err != nil {
+				d.logf("error", "reload: %v", err)
+			}
+		case <-time.After(interval):
+		}
+	}
+}
+
+// scan compresses the settled files found in the watched directories.
+func (d *daemon) scan() {
+	d.mu.Lock()
+	settled := time.Now().Add(-d.interval)
+	dirs := d.dirs
+	d.mu.Unlock()
+
+	var files []string
+	roots := make(map[string]string)
+	for _, dir := range dirs {
+		for entry := range walkTree(dir) {
+			if entry.err != nil {
+				d.logf("error", "%v", entry.err)
+				continue
+			}
+			if skipInRecursion(entry.path) || !d.matches(entry.path) {
+				continue
+			}
+			if info, err := os.Lstat(entry.path); err == nil && info.ModTime().Before(settled) {
+				files = append(files, entry.path)
+				roots[entry.path] = dir
+			}
+		}
+	}
+
+	for i, path := range files {
+		d.applyPending()
+		d.mu.Lock()
+		if d.stopping || d.paused {
+			d.queued = 0
+			d.mu.Unlock()
+			return
+		}
+		var size int64
+		if info, err := os.Lstat(path); err == nil {
+			size = info.Size()
+		}
+		d.current = &job{Path: path, Size: size, Started: time.Now()}
+		d.queued = len(files) - i - 1
+		d.mu.Unlock()
+
+		before := summary
+		mirrorRoot = roots[path]
+		processFile(path, true)
+		switch {
+		case summary.Failed > before.Failed:
+			d.logf("error", "%s: compression failed", path)
+		case summary.Processed > before.Processed:
+			d.logf("info", "%s: compressed %d -> %d bytes", path,
+				summary.BytesIn-before.BytesIn, summary.BytesOut-before.BytesOut)
+		}
+
+		d.mu.Lock()
+		d.current = nil
+		d.stats = summary
+		d.mu.Unlock()
+	}
+	d.mu.Lock()
+	d.queued = 0
+	d.mu.Unlock()
+}
+
+// runDaemon implements the daemon subcommand.
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	socket := fs.String("socket", defaultSocket(), "Listen for control commands on this unix socket")
+	interval := fs.Duration("interval", 10*time.Second, "Scan the directories this often")
+	fs.Parse(args)
+	for _, dir := range fs.Args() {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			log.Fatalf("daemon: %s is not a directory", dir)
+		}
+	}
+
+	d := newDaemon(fs.Args(), *interval)
+	if _, err := os.Stat(configFile()); err == nil {
+		if err := d.reload(); err != nil {
+			log.Fatal(err)
+		}
+		d.applyPending()
+	}
+	if len(d.dirs) == 0 {
+		log.Fatal("daemon: no directories to watch")
+	}
+
+	if *socket == defaultSocket() {
+		if err := makeSocketDir(filepath.Dir(*socket)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	l, err := listenControl(*socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go serveControl(l, d)
+
+	d.logf("info", "watching %s every %v, control socket %s", strings.Join(d.dirs, ", "), d.interval, *socket)
+	d.run()
+
+	l.Close()
+	os.Remove(*socket)
+	d.logf("info", "shut down")
+	printSummary()
+	os.Exit(0)
+}
+
+// listenControl listens on the unix socket at path, replacing a socket left
+// behind by a daemon that is no longer running.
+func listenControl(path string) (net.Listener, error) {
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%s: another daemon is listening", path)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
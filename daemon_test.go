@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test a daemon scan and its control commands over the socket
+func TestDaemonControl(t *testing.T) {
+	defer setVerbosity(VERBOSITY_NORMAL)
+	defer func() { summary = runSummary{} }()
+
+	dir := t.TempDir()
+	old := filepath.Join(dir, "settled.log")
+	fresh := filepath.Join(dir, "fresh.log")
+	ioutil.WriteFile(old, []byte("old log data\n"), 0644)
+	ioutil.WriteFile(fresh, []byte("still being written\n"), 0644)
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(old, past, past)
+
+	d := newDaemon([]string{dir}, time.Minute)
+	d.scan()
+	if _, err := os.Stat(old + ".gz"); err != nil {
+		t.Errorf("settled file was not compressed: %v", err)
+	}
+	if _, err := os.Stat(fresh + ".gz"); !os.IsNotExist(err) {
+		t.Errorf("recently modified file was compressed")
+	}
+
+	socket := filepath.Join(dir, "ctl.sock")
+	l, err := listenControl(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveControl(l, d)
+
+	if _, err := listenControl(socket); err == nil {
+		t.Errorf("second daemon allowed on the same socket")
+	}
+
+	for _, req := range []controlRequest{{Cmd: "pause"}, {Cmd: "loglevel", Level: "debug"}} {
+		if resp, err := sendControl(socket, req); err != nil || !resp.OK {
+			t.Errorf("%s: %+v, %v", req.Cmd, resp, err)
+		}
+	}
+	resp, err := sendControl(socket, controlRequest{Cmd: "status"})
+	if err != nil || resp.Status == nil {
+		t.Fatalf("status: %+v, %v", resp, err)
+	}
+	if !resp.Status.Paused || resp.Status.LogLevel != "debug" || resp.Status.Stats.Processed != 1 {
+		t.Errorf("status %+v", *resp.Status)
+	}
+	if resp, _ := sendControl(socket, controlRequest{Cmd: "bogus"}); resp.OK {
+		t.Errorf("unknown command accepted")
+	}
+
+	sendControl(socket, controlRequest{Cmd: "shutdown"})
+	done := make(chan struct{})
+	go func() { d.run(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("daemon did not shut down")
+	}
+}
+
+// Test reloading the daemon section of the config file between jobs
+func TestDaemonReload(t *testing.T) {
+	defer setVerbosity(VERBOSITY_NORMAL)
+	defer func() { summary, configPath, keep = runSummary{}, "", false }()
+
+	dir := t.TempDir()
+	configPath = filepath.Join(dir, "config.json")
+	watched := filepath.Join(dir, "watched")
+	os.Mkdir(watched, 0755)
+	past := time.Now().Add(-time.Hour)
+	for _, name := range []string{"a.log", "b.csv"} {
+		path := filepath.Join(watched, name)
+		ioutil.WriteFile(path, []byte("data\n"), 0644)
+		os.Chtimes(path, past, past)
+	}
+
+	ioutil.WriteFile(configPath, []byte(`{"daemon": {"dirs": ["`+watched+`"], "patterns": ["*.log"], "interval": "1h", "options": {"keep": true}}}`), 0644)
+	d := newDaemon(nil, time.Minute)
+	if err := d.reload(); err != nil {
+		t.Fatal(err)
+	}
+	d.applyPending()
+	if !keep || d.interval != time.Hour || len(d.dirs) != 1 {
+		t.Fatalf("config not applied: keep=%v interval=%v dirs=%v", keep, d.interval, d.dirs)
+	}
+	d.scan()
+	if _, err := os.Stat(filepath.Join(watched, "a.log.gz")); err != nil {
+		t.Errorf("matching file not compressed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(watched, "a.log")); err != nil {
+		t.Errorf("original removed despite keep from the config")
+	}
+	if _, err := os.Stat(filepath.Join(watched, "b.csv.gz")); !os.IsNotExist(err) {
+		t.Errorf("file not matching the patterns compressed")
+	}
+
+	// an invalid config is rejected and the old one stays in force
+	ioutil.WriteFile(configPath, []byte(`{"daemon": {"interval": "soon"}}`), 0644)
+	if err := d.reload(); err == nil {
+		t.Errorf("invalid config accepted")
+	}
+
+	// options dropped from the config return to their old values
+	ioutil.WriteFile(configPath, []byte(`{"daemon": {"log_level": "error"}}`), 0644)
+	if err := d.reload(); err != nil {
+		t.Fatal(err)
+	}
+	d.applyPending()
+	if keep || d.logLevel != "error" || d.patterns != nil {
+		t.Errorf("reload not applied: keep=%v level=%s patterns=%v", keep, d.logLevel, d.patterns)
+	}
+}
+
+// Test that the reason a job failed is logged even at the error level,
+// while warnings are not
+func TestDaemonLogLevel(t *testing.T) {
+	defer setVerbosity(VERBOSITY_NORMAL)
+	defer func() { summary, exitStatus = runSummary{}, 0 }()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(path, []byte("log data\n"), 0644)
+	// a stale output that cannot be replaced
+	os.MkdirAll(filepath.Join(path+".gz", "sub"), 0755)
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(path+".gz", past.Add(-time.Hour), past.Add(-time.Hour))
+	os.Chtimes(path, past, past)
+
+	d := newDaemon([]string{dir}, time.Minute)
+	d.setLogLevel("error")
+	warnf("a warning")
+	d.scan()
+	if !strings.Contains(logged.String(), path+".gz") || strings.Contains(logged.String(), "a warning") {
+		t.Errorf("logged %q", logged.String())
+	}
+}
+
+// Test that the directory of the default socket is the user's alone
+func TestSocketDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "gopigz")
+	if err := makeSocketDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(dir); info == nil || info.Mode().Perm() != 0700 {
+		t.Errorf("socket directory mode %v", info.Mode())
+	}
+	if err := makeSocketDir(dir); err != nil {
+		t.Errorf("existing socket directory refused: %v", err)
+	}
+
+	os.Chmod(dir, 0777)
+	if err := makeSocketDir(dir); err == nil {
+		t.Errorf("world-writable socket directory accepted")
+	}
+	link := filepath.Join(filepath.Dir(dir), "link")
+	os.Symlink(dir, link)
+	if err := makeSocketDir(link); err == nil {
+		t.Errorf("symbolic link accepted as socket directory")
+	}
+
+	saved := os.Getenv("XDG_RUNTIME_DIR")
+	defer os.Setenv("XDG_RUNTIME_DIR", saved)
+	os.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if got := defaultSocket(); got != "/run/user/1000/gopigz.sock" {
+		t.Errorf("default socket %s", got)
+	}
+	os.Unsetenv("XDG_RUNTIME_DIR")
+	if got := defaultSocket(); filepath.Dir(filepath.Dir(got)) != os.TempDir() {
+		t.Errorf("default socket %s", got)
+	}
+}
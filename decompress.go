@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Parsing decompress and keep-broken flags
+var decompress bool
+var keepBroken bool
+
+// decompressStream inflates input to output. When output is a regular file
+// and the gzip header carries a hole map, the holes are recreated; BGZF
+// input and streams marked as made of the independent blocks of -i are
+// inflated in parallel.
+func decompressStream(input io.Reader, output io.Writer) error {
+	headerTime = time.Time{}
+	if decryptKey != nil {
+		input = newDecryptReader(input, decryptKey)
+	}
+	switch format {
+	case "zlib":
+		r, err := newZlibReader(input, dictionary)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(output, r); err != nil {
+			return err
+		}
+		return r.Close()
+	}
+	if c := lookupCodec(format); c != nil {
+		if c.decompress == nil {
+			return fmt.Errorf("%s decompression is not supported", format)
+		}
+		return c.decompress(input, output)
+	}
+
+	br := bufio.NewReader(input)
+	if header, _ := br.Peek(BGZF_HEADER_SIZE); isBGZFHeader(header) {
+		return bgzfDecompress(br, output)
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return err
+	}
+	headerTime = gz.ModTime
+
+	if f, ok := outputFile(output); ok {
+		if data := findSubfield(gz.Header.Extra, SPARSE_SI1, SPARSE_SI2); data != nil {
+			m, err := decodeSparseMap(data)
+			if err != nil {
+				return err
+			}
+			if w := newSparseWriter(f, m); w != nil {
+				if _, err := io.Copy(w, gz); err != nil {
+					return err
+				}
+				if err := w.Close(); err != nil {
+					return err
+				}
+				return gz.Close()
+			}
+		}
+	}
+	if size := independentBlockSize(gz.Header.Extra); size > 0 && processes > 1 {
+		return inflateIndependent(br, output, size)
+	}
+
+	if _, err := io.Copy(output, gz); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// newSparseWriter returns a sparseWriter for f, or nil if f is not a regular
+// file positioned at its start.
+func newSparseWriter(f *os.File, m *sparseMap) *sparseWriter {
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	if offset, err := f.Seek(0, io.SeekCurrent); err != nil || offset != 0 {
+		return nil
+	}
+	return &sparseWriter{f: f, m: m}
+}
+
+// decompressFile decompresses path, which must end in suffix(), into the
+// name without the suffix, or its place under --output-dir, and, unless --keep is given, removes path.
+func decompressFile(path string) {
+	if !strings.HasSuffix(path, suffix()) || len(path) == len(suffix()) {
+		warnf("%s: unknown suffix -- ignored", path)
+		countSkipped(path)
+		return
+	}
+	outPath := mirrorPath(strings.TrimSuffix(path, suffix()))
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		log.Println(err)
+		setError()
+		countFailed(path, err)
+		return
+	}
+	if !checkLinks(path, info) {
+		countSkipped(path)
+		return
+	}
+
+	acquireFds(2)
+	defer releaseFds(2)
+	in, err := openInput(path)
+	if err != nil {
+		log.Println(err)
+		setError()
+		countFailed(path, err)
+		return
+	}
+	defer in.Close()
+
+	out, err := createOutput(outPath)
+	if err != nil {
+		log.Println(err)
+		setError()
+		countFailed(path, err)
+		return
+	}
+	startProgress(path, info.Size())
+	w, finish := outputWriter(out)
+	err = decompressStream(progressReader{inputReader(in)}, w)
+	if ferr := finish(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		out.Close()
+		countFailed(path, err)
+		if keepBroken {
+			// Whatever inflated before the error is still in outPath.
+			log.Printf("%s: %v -- WARNING: keeping partial output %s", path, err, outPath)
+			setBroken()
+			return
+		}
+		log.Printf("%s: %v", path, err)
+		os.Remove(outPath)
+		setError()
+		return
+	}
+	written, err := out.Stat()
+	if err == nil {
+		err = closeOutput(out)
+	} else {
+		out.Close()
+	}
+	if err == nil {
+		err = copyAttributes(outPath, info)
+	}
+	if err == nil {
+		err = restoreHeaderTime(outPath)
+	}
+	if err != nil {
+		log.Println(err)
+		os.Remove(outPath)
+		setError()
+		countFailed(path, err)
+		return
+	}
+	countProcessed(path, info.Size(), written.Size())
+
+	if !keepInputs() {
+		if err := os.Remove(path); err != nil {
+			log.Println(err)
+			setError()
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeGzipFile(t *testing.T, path string, data []byte) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that a corrupt member is cleaned up by default and kept, with its
+// own exit status, under --keep-broken
+func TestDecompressKeepBroken(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.gz")
+	data := bytes.Repeat([]byte("recover me\n"), 1000)
+	writeGzipFile(t, path, data)
+
+	// flip a bit in the CRC32 of the trailer
+	gz, _ := ioutil.ReadFile(path)
+	gz[len(gz)-8] ^= 0x01
+	ioutil.WriteFile(path, gz, 0644)
+
+	exitStatus = 0
+	decompressFile(path)
+	if exitStatus != 1 {
+		t.Errorf("exit status %d, want 1", exitStatus)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data")); !os.IsNotExist(err) {
+		t.Errorf("partial output was not removed")
+	}
+
+	keepBroken = true
+	defer func() { keepBroken = false }()
+	exitStatus = 0
+	decompressFile(path)
+	if exitStatus != EXIT_BROKEN {
+		t.Errorf("exit status %d, want %d", exitStatus, EXIT_BROKEN)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("partial output differs from the readable data")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("input was removed after a failed decompression")
+	}
+}
+
+// Test that gopigz output round-trips through -d, and that a wrong CRC-32 or
+// ISIZE in the trailer is an error
+func TestDecompressTrailer(t *testing.T) {
+	data := bytes.Repeat([]byte("round trip\n"), 3*BLOCK_SIZE/11+7)
+	var gz bytes.Buffer
+	if err := compressStream(bytes.NewReader(data), &gz); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := decompressStream(bytes.NewReader(gz.Bytes()), &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("round trip: %v", err)
+	}
+
+	for _, offset := range []int{8, 4} { // CRC-32, then ISIZE
+		corrupt := append([]byte{}, gz.Bytes()...)
+		corrupt[len(corrupt)-offset] ^= 0x01
+		if err := decompressStream(bytes.NewReader(corrupt), ioutil.Discard); err == nil {
+			t.Errorf("trailer byte -%d flipped: no error", offset)
+		}
+	}
+}
+
+// Test that concatenated members, as cat a.gz b.gz makes, decompress to
+// the concatenation of their data, to a file as well, and that a damaged
+// later member is still an error
+func TestDecompressMembers(t *testing.T) {
+	var stream bytes.Buffer
+	var want []byte
+	for _, part := range []string{"rotated yesterday\n", "", "rotated today\n"} {
+		zw := gzip.NewWriter(&stream)
+		zw.Write([]byte(part))
+		zw.Close()
+		want = append(want, part...)
+	}
+
+	var out bytes.Buffer
+	if err := decompressStream(bytes.NewReader(stream.Bytes()), &out); err != nil || !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got %q: %v", out.Bytes(), err)
+	}
+
+	path := filepath.Join(t.TempDir(), "logs")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decompressStream(bytes.NewReader(stream.Bytes()), f)
+	f.Close()
+	if got, _ := ioutil.ReadFile(path); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("to a file: %q: %v", got, err)
+	}
+
+	corrupt := append([]byte{}, stream.Bytes()...)
+	corrupt[len(corrupt)-8] ^= 0x01
+	if err := decompressStream(bytes.NewReader(corrupt), ioutil.Discard); err == nil {
+		t.Errorf("damaged last member: no error")
+	}
+}
+
+// Test that streams with and without -i decompress with -p to the same
+// data, members after them included, that only -i streams say their blocks
+// are independent, that a piece cut inside a deflate block or past its
+// bounds is refused, a stream falsely marked independent still inflating
+// in order, and that damage is still an error
+func TestInflateIndependent(t *testing.T) {
+	saved := processes
+	defer func() { processes, independent, extraFields = saved, false, nil }()
+	processes = 4
+
+	data := make([]byte, 3<<20)
+	rng := rand.New(rand.NewSource(1))
+	for i := range data {
+		data[i] = "abcdefgh"[rng.Intn(8)]
+	}
+	var plain bytes.Buffer
+	zw := gzip.NewWriter(&plain)
+	zw.Write([]byte("appended\n"))
+	zw.Close()
+
+	for _, independent = range []bool{true, false} {
+		var out bytes.Buffer
+		if err := compressStream(bytes.NewReader(data), &out); err != nil {
+			t.Fatal(err)
+		}
+		stream := out.Bytes()
+		if zr, err := gzip.NewReader(bytes.NewReader(stream)); err != nil || (independentBlockSize(zr.Header.Extra) == BLOCK_SIZE) != independent {
+			t.Errorf("-i=%v: header extra %q: %v", independent, zr.Header.Extra, err)
+		}
+		mixed := append(append([]byte{}, stream...), plain.Bytes()...)
+		for _, test := range []struct {
+			in   []byte
+			want []byte
+		}{
+			{stream, data},
+			{mixed, append(append([]byte{}, data...), "appended\n"...)},
+		} {
+			var got bytes.Buffer
+			if err := decompressStream(bytes.NewReader(test.in), &got); err != nil || !bytes.Equal(got.Bytes(), test.want) {
+				t.Errorf("-i=%v: %d bytes in: %d out: %v", independent, len(test.in), got.Len(), err)
+			}
+		}
+
+		damaged := append([]byte{}, stream...)
+		damaged[len(damaged)-6] ^= 0x01
+		if err := decompressStream(bytes.NewReader(damaged), ioutil.Discard); err != gzip.ErrChecksum {
+			t.Errorf("-i=%v: damaged size: %v", independent, err)
+		}
+		if err := decompressStream(bytes.NewReader(stream[:len(stream)/2]), ioutil.Discard); err != io.ErrUnexpectedEOF {
+			t.Errorf("-i=%v: cut: %v", independent, err)
+		}
+	}
+
+	var out bytes.Buffer
+	independent = true
+	compressStream(bytes.NewReader(data), &out)
+	markers, compressed, inflated := pieceBounds(BLOCK_SIZE)
+	// after the header and the 8 bytes of the IB subfield
+	piece, err := readPiece(bufio.NewReader(bytes.NewReader(out.Bytes()[20:])), markers, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := inflatePiece(piece, inflated); p.err != nil || p.final {
+		t.Errorf("whole piece: %v", p.err)
+	}
+	if p := inflatePiece(piece[:len(piece)-100], inflated); p.err == nil {
+		t.Errorf("piece cut inside a block: %d bytes", len(p.data))
+	}
+	if p := inflatePiece(piece, BLOCK_SIZE); p.err != errPieceTooLong {
+		t.Errorf("piece past its bounds: %v", p.err)
+	}
+	noise := make([]byte, 2*compressed)
+	rng.Read(noise)
+	if _, err := readPiece(bufio.NewReader(bytes.NewReader(noise)), markers, compressed); err != errPieceTooLong {
+		t.Errorf("piece without markers: %v", err)
+	}
+
+	// a stream without -i, one piece of it, claiming independent blocks
+	independent = false
+	extraFields = subfieldList(independentSubfield(BLOCK_SIZE))
+	out.Reset()
+	compressStream(bytes.NewReader(data), &out)
+	var got bytes.Buffer
+	if err := decompressStream(bytes.NewReader(out.Bytes()), &got); err != nil || !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("falsely marked: %d bytes: %v", got.Len(), err)
+	}
+}
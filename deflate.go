@@ -0,0 +1,250 @@
+package main
+
+import "math/bits"
+
+// A deflate (RFC 1951) block writer for the strategies compress/flate lacks.
+//
+// The strategy turns a pipeline block into literals and matches, and
+// deflateTokens writes them as dynamic Huffman blocks of
+// DEFLATE_BLOCK_TOKENS, or as stored blocks if those are smaller. A block that does not end the stream ends in
+// an empty stored block, the sync flush flate.Writer.Flush writes, so the
+// output of the blocks can be concatenated just as that of flate's.
+
+const (
+	DEFLATE_MIN_MATCH    = 3
+	DEFLATE_MAX_MATCH    = 258
+	DEFLATE_MAX_STORED   = 65535
+	DEFLATE_END_OF_BLOCK = 256
+	DEFLATE_LITLENS      = 286
+	DEFLATE_DISTANCES    = 30
+	DEFLATE_CODELENS     = 19
+	DEFLATE_MAX_CLEN     = 7 // longest code of the code length code
+
+	// Tokens per dynamic block, as zlib's default memLevel gives, so that
+	// the codes follow changes in the data
+	DEFLATE_BLOCK_TOKENS = 16384
+)
+
+// the order the code length code lengths are written in
+var deflateCodeLengthOrder = []int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+// deflateToken is a literal when length is 0, else a match.
+type deflateToken struct {
+	length   uint16
+	distance uint16
+	literal  byte
+}
+
+// deflateLengthCode returns the length code of a match length, and its
+// extra bits.
+func deflateLengthCode(length int) (int, uint, uint64) {
+	x := length - DEFLATE_MIN_MATCH
+	switch {
+	case x < 8:
+		return 257 + x, 0, 0
+	case length == DEFLATE_MAX_MATCH:
+		return 285, 0, 0
+	}
+	n := uint(bits.Len(uint(x)) - 1)
+	return 257 + 4*int(n-1) + (x>>(n-2))&3, n - 2, uint64(x & (1<<(n-2) - 1))
+}
+
+// deflateDistanceCode returns the distance code of a distance, and its
+// extra bits.
+func deflateDistanceCode(distance int) (int, uint, uint64) {
+	x := distance - 1
+	if x < 4 {
+		return x, 0, 0
+	}
+	n := uint(bits.Len(uint(x)) - 1)
+	return 2*int(n) + (x>>(n-1))&1, n - 1, uint64(x & (1<<(n-1) - 1))
+}
+
+// deflateTokens returns the deflate data of a block of data as tokens,
+// ending the stream if final is set and in a sync flush if not.
+func deflateTokens(data []byte, tokens []deflateToken, final bool) []byte {
+	w := &lsbWriter{}
+	for len(tokens) > DEFLATE_BLOCK_TOKENS {
+		writeDynamicBlock(w, tokens[:DEFLATE_BLOCK_TOKENS], false)
+		tokens = tokens[DEFLATE_BLOCK_TOKENS:]
+	}
+	writeDynamicBlock(w, tokens, final)
+	if size := len(data) + 5*(len(data)/DEFLATE_MAX_STORED+1); len(w.out) > size {
+		w = &lsbWriter{}
+		writeStoredBlocks(w, data, final)
+	}
+	if !final {
+		writeStoredBlocks(w, nil, false)
+	}
+	w.align()
+	return w.out
+}
+
+// writeStoredBlocks writes data in stored blocks, the last final if final
+// is set. Empty data makes one empty block.
+func writeStoredBlocks(w *lsbWriter, data []byte, final bool) {
+	for {
+		n := len(data)
+		if n > DEFLATE_MAX_STORED {
+			n = DEFLATE_MAX_STORED
+		}
+		last := final && n == len(data)
+		if last {
+			w.put(1, 1)
+		} else {
+			w.put(1, 0)
+		}
+		w.put(2, 0) // stored
+		w.align()
+		w.out = appendUint16(w.out, uint16(n))
+		w.out = appendUint16(w.out, ^uint16(n))
+		w.out = append(w.out, data[:n]...)
+		data = data[n:]
+		if len(data) == 0 {
+			return
+		}
+	}
+}
+
+// writeDynamicBlock writes tokens as a block with dynamic Huffman codes.
+func writeDynamicBlock(w *lsbWriter, tokens []deflateToken, final bool) {
+	litFreq := make([]int32, DEFLATE_LITLENS)
+	distFreq := make([]int32, DEFLATE_DISTANCES)
+	for _, t := range tokens {
+		if t.length == 0 {
+			litFreq[t.literal]++
+			continue
+		}
+		code, _, _ := deflateLengthCode(int(t.length))
+		litFreq[code]++
+		code, _, _ = deflateDistanceCode(int(t.distance))
+		distFreq[code]++
+	}
+	litFreq[DEFLATE_END_OF_BLOCK] = 1
+	litLen := huffmanLengths(litFreq, HUFFMAN_MAX_CODE_LEN)
+	distLen := huffmanLengths(distFreq, HUFFMAN_MAX_CODE_LEN)
+	// a block without matches still describes one distance code
+	if countCodes(distLen) == 0 {
+		distLen[0] = 1
+	}
+
+	hlit := len(litLen)
+	for litLen[hlit-1] == 0 {
+		hlit--
+	}
+	hdist := len(distLen)
+	for distLen[hdist-1] == 0 {
+		hdist--
+	}
+	lengths := append(append([]uint8{}, litLen[:hlit]...), distLen[:hdist]...)
+
+	// the code lengths, with runs as repeat codes 16, 17 and 18
+	type item struct {
+		symbol uint8
+		extra  uint64
+	}
+	var items []item
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+		if l == 0 {
+			for run >= 11 {
+				n := run
+				if n > 138 {
+					n = 138
+				}
+				items = append(items, item{18, uint64(n - 11)})
+				run -= n
+			}
+			if run >= 3 {
+				items = append(items, item{17, uint64(run - 3)})
+				run = 0
+			}
+		} else {
+			items = append(items, item{symbol: l})
+			run--
+			for run >= 3 {
+				n := run
+				if n > 6 {
+					n = 6
+				}
+				items = append(items, item{16, uint64(n - 3)})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			items = append(items, item{symbol: l})
+		}
+	}
+	clFreq := make([]int32, DEFLATE_CODELENS)
+	for _, it := range items {
+		clFreq[it.symbol]++
+	}
+	// the code length code must be complete, so it needs two symbols
+	clLen := huffmanLengths(clFreq, DEFLATE_MAX_CLEN)
+	if countCodes(clLen) < 2 {
+		clFreq[0]++
+		clFreq[1]++
+		clLen = huffmanLengths(clFreq, DEFLATE_MAX_CLEN)
+	}
+	clCode := huffmanCodes(clLen)
+	hclen := len(deflateCodeLengthOrder)
+	for hclen > 4 && clLen[deflateCodeLengthOrder[hclen-1]] == 0 {
+		hclen--
+	}
+
+	if final {
+		w.put(1, 1)
+	} else {
+		w.put(1, 0)
+	}
+	w.put(2, 2) // dynamic Huffman codes
+	w.put(5, uint64(hlit-257))
+	w.put(5, uint64(hdist-1))
+	w.put(4, uint64(hclen-4))
+	for _, s := range deflateCodeLengthOrder[:hclen] {
+		w.put(3, uint64(clLen[s]))
+	}
+	for _, it := range items {
+		w.put(uint(clLen[it.symbol]), uint64(clCode[it.symbol]))
+		switch it.symbol {
+		case 16:
+			w.put(2, it.extra)
+		case 17:
+			w.put(3, it.extra)
+		case 18:
+			w.put(7, it.extra)
+		}
+	}
+
+	litCode := huffmanCodes(litLen)
+	distCode := huffmanCodes(distLen)
+	for _, t := range tokens {
+		if t.length == 0 {
+			w.put(uint(litLen[t.literal]), uint64(litCode[t.literal]))
+			continue
+		}
+		code, n, extra := deflateLengthCode(int(t.length))
+		w.put(uint(litLen[code]), uint64(litCode[code]))
+		w.put(n, extra)
+		code, n, extra = deflateDistanceCode(int(t.distance))
+		w.put(uint(distLen[code]), uint64(distCode[code]))
+		w.put(n, extra)
+	}
+	w.put(uint(litLen[DEFLATE_END_OF_BLOCK]), uint64(litCode[DEFLATE_END_OF_BLOCK]))
+}
+
+// countCodes returns how many symbols have a code.
+func countCodes(lengths []uint8) int {
+	n := 0
+	for _, l := range lengths {
+		if l != 0 {
+			n++
+		}
+	}
+	return n
+}
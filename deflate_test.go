@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestDeflateCodes(t *testing.T) {
+	for _, test := range []struct {
+		length, code int
+		n            uint
+		extra        uint64
+	}{
+		{3, 257, 0, 0}, {10, 264, 0, 0}, {11, 265, 1, 0}, {12, 265, 1, 1},
+		{19, 269, 2, 0}, {227, 284, 5, 0}, {257, 284, 5, 30}, {258, 285, 0, 0},
+	} {
+		code, n, extra := deflateLengthCode(test.length)
+		if code != test.code || n != test.n || extra != test.extra {
+			t.Errorf("length %d: code %d, %d bits of %d", test.length, code, n, extra)
+		}
+	}
+	for _, test := range []struct {
+		distance, code int
+		n              uint
+		extra          uint64
+	}{
+		{1, 0, 0, 0}, {4, 3, 0, 0}, {5, 4, 1, 0}, {7, 5, 1, 0},
+		{24577, 29, 13, 0}, {32768, 29, 13, 8191},
+	} {
+		code, n, extra := deflateDistanceCode(test.distance)
+		if code != test.code || n != test.n || extra != test.extra {
+			t.Errorf("distance %d: code %d, %d bits of %d", test.distance, code, n, extra)
+		}
+	}
+}
+
+// Test that pieces written from tokens inflate as one stream, whether they
+// hold matches, only literals or nothing, and fall back to stored blocks
+func TestDeflateTokens(t *testing.T) {
+	random := make([]byte, 3*DEFLATE_BLOCK_TOKENS)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("abcabcabd"), 5000)
+	var textTokens []deflateToken
+	for i := 0; i < len(text); i++ {
+		if i >= 9 && i+9 <= len(text) {
+			textTokens = append(textTokens, deflateToken{length: 9, distance: 9})
+			i += 8
+			continue
+		}
+		textTokens = append(textTokens, deflateToken{literal: text[i]})
+	}
+	literals := func(data []byte) []deflateToken {
+		var tokens []deflateToken
+		for _, c := range data {
+			tokens = append(tokens, deflateToken{literal: c})
+		}
+		return tokens
+	}
+
+	pieces := [][]byte{text, random, []byte("x"), nil}
+	var stream, want []byte
+	stream = append(stream, deflateTokens(text, textTokens, false)...)
+	stream = append(stream, deflateTokens(random, literals(random), false)...)
+	stream = append(stream, deflateTokens([]byte("x"), literals([]byte("x")), false)...)
+	stream = append(stream, deflateTokens(nil, nil, true)...)
+	for _, p := range pieces {
+		want = append(want, p...)
+	}
+	got, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(stream)))
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("inflated %d bytes of %d: %v", len(got), len(want), err)
+	}
+	if len(stream) > len(want)/2+len(random)+100 {
+		t.Errorf("%d bytes from %d", len(stream), len(want))
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+// Deterministic output (--deterministic).
+//
+// Content-addressed stores and build caches key on the compressed bytes, so
+// the same input must compress to the same output on any machine and with
+// any -p. The pipeline already cuts blocks every blockSize bytes, primes
+// them with the dictionary or the input before them and flushes every block
+// the same way, whatever the number of workers. What remains is left out or
+// ordered under --deterministic:
+//
+//   - gzip headers carry no time, and 255 (unknown) instead of the OS byte
+//     of the platform unless --os is given
+//   - sparse inputs are read whole, since the map of their holes in the
+//     header depends on how the file was written, not on its content
+//   - zip entries carry 1980-01-01 and mode 0644 instead of the input's
+//   - --mux sends every stream whole and in the order of the arguments,
+//     instead of interleaving frames as they are ready
+
+// Parsing deterministic flag
+var deterministic bool
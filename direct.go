@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// Direct I/O (--direct).
+//
+// Compressing a large archive through the page cache evicts everything else
+// from it, such as the working set of a database on the same machine. With
+// --direct, input and output files are opened with O_DIRECT and moved in
+// DIRECT_BUFFER chunks through buffers aligned to DIRECT_ALIGN, as the
+// kernel requires. The last, partial chunk of an output is padded to the
+// alignment and the file truncated back afterwards. Sparse inputs are read
+// in full, and holes are not recreated, since both seek around the file.
+
+// Parsing direct flag
+var directIO bool
+
+const (
+	DIRECT_ALIGN  = 4096        // logical block size O_DIRECT transfers are aligned to
+	DIRECT_BUFFER = 1024 * 1024 // 1 MiB
+)
+
+var errDirectUnsupported = errors.New("--direct is not supported on this platform")
+
+// alignedBuffer returns n bytes starting at a DIRECT_ALIGN boundary.
+func alignedBuffer(n int) []byte {
+	buf := make([]byte, n+DIRECT_ALIGN)
+	skip := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % DIRECT_ALIGN); rem != 0 {
+		skip = DIRECT_ALIGN - rem
+	}
+	return buf[skip : skip+n]
+}
+
+// openInput opens a file to compress or decompress, with O_DIRECT under
+// --direct.
+func openInput(path string) (*os.File, error) {
+	if directIO {
+		return os.OpenFile(path, os.O_RDONLY|O_DIRECT, 0)
+	}
+	return os.Open(path)
+}
+
+// inputReader returns the reader the pipeline should read f through.
+func inputReader(f *os.File) io.Reader {
+	if directIO {
+		return &directReader{f: f, buf: alignedBuffer(DIRECT_BUFFER)}
+	}
+	return f
+}
+
+// outputWriter returns the writer the pipeline should write f through, and
+// the function that finishes writing it.
+func outputWriter(f *os.File) (io.Writer, func() error) {
+	if directIO {
+		w := &directWriter{f: f, buf: alignedBuffer(DIRECT_BUFFER)}
+		return w, w.Close
+	}
+	return f, func() error { return nil }
+}
+
+// directReader reads a file opened with O_DIRECT in aligned chunks.
+type directReader struct {
+	f    *os.File
+	buf  []byte
+	r, w int // unread data is buf[r:w]
+	err  error
+}
+
+func (d *directReader) Read(p []byte) (int, error) {
+	if d.r == d.w {
+		if d.err != nil {
+			return 0, d.err
+		}
+		// only the last read of the file may come up short, so the file
+		// offset stays aligned
+		d.r = 0
+		d.w, d.err = io.ReadFull(d.f, d.buf)
+		if d.err == io.ErrUnexpectedEOF {
+			d.err = io.EOF
+		}
+		if d.w == 0 {
+			return 0, d.err
+		}
+	}
+	n := copy(p, d.buf[d.r:d.w])
+	d.r += n
+	return n, nil
+}
+
+// directWriter writes to a file opened with O_DIRECT in aligned chunks.
+type directWriter struct {
+	f    *os.File
+	buf  []byte
+	n    int   // buffered bytes
+	size int64 // bytes written
+}
+
+func (d *directWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		c := copy(d.buf[d.n:], p)
+		d.n += c
+		p = p[c:]
+		if d.n == len(d.buf) {
+			if _, err := d.f.Write(d.buf); err != nil {
+				return written, err
+			}
+			d.size += int64(d.n)
+			d.n = 0
+		}
+		written += c
+	}
+	return written, nil
+}
+
+// Close writes out the buffered tail, padded with zeros to the alignment,
+// and cuts the padding off again. It does not close the file.
+func (d *directWriter) Close() error {
+	if d.n == 0 {
+		return nil
+	}
+	padded := (d.n + DIRECT_ALIGN - 1) / DIRECT_ALIGN * DIRECT_ALIGN
+	for i := d.n; i < padded; i++ {
+		d.buf[i] = 0
+	}
+	if _, err := d.f.Write(d.buf[:padded]); err != nil {
+		return err
+	}
+	d.size += int64(d.n)
+	d.n = 0
+	return d.f.Truncate(d.size)
+}
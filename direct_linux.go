@@ -0,0 +1,6 @@
+package main
+
+import "syscall"
+
+// open(2) flag bypassing the page cache
+const O_DIRECT = syscall.O_DIRECT
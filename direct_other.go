@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+// O_DIRECT is not available on this platform; --direct is refused.
+const O_DIRECT = 0
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Extra header subfields (--extra).
+//
+// --extra ID:DATA adds a subfield to the FEXTRA field of every gzip header,
+// ID being the two letters of RFC 1952's SI1 and SI2 and DATA its contents,
+// so that application metadata such as original sizes or build IDs travels
+// with the file. gzip and other decompressors skip subfields they do not
+// know. The flag may be repeated; the subfields are written in the order
+// given, before the hole map of sparse files, which is left out when it no
+// longer fits in the field.
+
+// Parsing extra flag: the subfields, encoded
+var extraFields subfieldList
+
+// MAX_EXTRA_SIZE is the largest FEXTRA field, its length being 16 bits
+const MAX_EXTRA_SIZE = 0xFFFF
+
+func init() {
+	flag.Var(&extraFields, "extra", "Add an ID:DATA subfield to gzip headers, ID being two letters (repeatable)")
+	optionChecks = append(optionChecks, func() error {
+		if len(extraFields) > 0 && format != "gzip" {
+			return errors.New("--extra is only supported with the gzip format")
+		}
+		return nil
+	})
+}
+
+// subfieldList collects repeated --extra flags.
+type subfieldList []byte
+
+func (l *subfieldList) String() string {
+	var fields []string
+	for extra := []byte(*l); len(extra) >= 4; {
+		n := 4 + int(binary.LittleEndian.Uint16(extra[2:4]))
+		fields = append(fields, fmt.Sprintf("%s:%s", extra[:2], extra[4:n]))
+		extra = extra[n:]
+	}
+	return strings.Join(fields, ", ")
+}
+
+func (l *subfieldList) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i != 2 || s[1] == 0 {
+		return fmt.Errorf("subfield %q is not in ID:DATA form with a two-letter ID", s)
+	}
+	if len(*l)+len(s)+1 > MAX_EXTRA_SIZE {
+		return fmt.Errorf("subfield %s does not fit in the header", s[:2])
+	}
+	*l = appendSubfield(*l, s[0], s[1], []byte(s[3:]))
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+// Test that --extra subfields are written in order and parsed back
+func TestExtraFields(t *testing.T) {
+	defer func() { extraFields = nil }()
+	for _, s := range []string{"BI:build 7", "Sz:"} {
+		if err := extraFields.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, bad := range []string{"B:x", "BIG:x", "nocolon"} {
+		if err := extraFields.Set(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	if got := extraFields.String(); got != "BI:build 7, Sz:" {
+		t.Errorf("String() = %q", got)
+	}
+
+	var out bytes.Buffer
+	if err := compressStream(bytes.NewReader([]byte("tagged\n")), &out); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("BI\x07\x00build 7Sz\x00\x00"); !bytes.Equal(zr.Extra, want) {
+		t.Errorf("extra %q", zr.Extra)
+	}
+	if data := findSubfield(zr.Extra, 'B', 'I'); string(data) != "build 7" {
+		t.Errorf("subfield BI = %q", data)
+	}
+}
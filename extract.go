@@ -0,0 +1,330 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Tar extraction (-x, --extract).
+//
+// gopigz -x ARCHIVES... decompresses each archive, or standard input, and
+// unpacks the tar stream inside into the current directory or --output-dir,
+// the counterpart of --tar. The stream is recognized by the checksum of its
+// first header, so that a compressed file that is not an archive is
+// reported instead of unpacked as garbage. Modes and times are restored,
+// and owners when running as root; those of directories once all their
+// entries are in. Entries leading out of the target directory, by their
+// name or through a symbolic link unpacked before, are refused, and so is a
+// directory entry landing on a symbolic link, which -f replaces. Attributes
+// are only restored on the very file or directory unpacked, never through
+// a link put in its place since. Existing files are kept unless -f is
+// given. -x implies -d, so -d -x is the same as -x. The archives are kept.
+
+// Parsing extract flags
+var extractTar bool
+
+var errNotTar = errors.New("not a tar archive")
+
+func init() {
+	flag.Var(extractFlag{}, "extract", "Decompress and unpack tar archives into the current directory or --output-dir")
+	flag.Var(extractFlag{}, "x", "Same as --extract")
+}
+
+// extractFlag is a boolean flag that selects extraction, which decompresses.
+type extractFlag struct{}
+
+func (extractFlag) IsBoolFlag() bool { return true }
+func (extractFlag) String() string   { return "false" }
+func (extractFlag) Set(s string) error {
+	if s == "true" {
+		extractTar, decompress = true, true
+	}
+	return nil
+}
+
+// runExtract implements -x over the archives in paths, or standard input.
+func runExtract(paths []string) {
+	if tarMode {
+		log.Fatal("--tar and -x cannot be combined")
+	}
+	dest := outputDir
+	if dest == "" {
+		dest = "."
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(paths) == 0 {
+		if _, err := extractStream(os.Stdin, dest); err != nil {
+			log.Println(err)
+			setError()
+		}
+	}
+	for _, path := range paths {
+		f, err := openInput(path)
+		if err != nil {
+			log.Println(err)
+			setError()
+			countFailed(path, err)
+			continue
+		}
+		var size int64
+		if info, err := f.Stat(); err == nil {
+			size = info.Size()
+		}
+		startProgress(path, size)
+		n, err := extractStream(progressReader{inputReader(f)}, dest)
+		f.Close()
+		if err != nil {
+			log.Printf("%s: %v", path, err)
+			setError()
+			countFailed(path, err)
+			continue
+		}
+		countProcessed(path, size, n)
+	}
+	if len(paths) > 1 {
+		printSummary()
+	}
+	exitRun()
+}
+
+// extractStream decompresses input and unpacks the archive in it under
+// dest, returning the bytes of file data unpacked. Entries that cannot be
+// unpacked are reported and skipped.
+func extractStream(input io.Reader, dest string) (int64, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(decompressStream(input, pw))
+	}()
+	defer pr.Close()
+
+	r := bufio.NewReader(pr)
+	head, err := r.Peek(tarBlock)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == nil && !isTarHeader(head) {
+		return 0, errNotTar
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := unpackTar(tar.NewReader(r), dest)
+	if err != nil {
+		return n, err
+	}
+	// the rest of the stream is read for its checksum
+	_, err = io.Copy(ioutil.Discard, r)
+	return n, err
+}
+
+// isTarHeader reports whether block is a tar header, by its checksum: the
+// sum of its bytes with the checksum field taken as spaces.
+func isTarHeader(block []byte) bool {
+	field := strings.Trim(string(block[148:156]), " \x00")
+	want, err := strconv.ParseInt(field, 8, 64)
+	if err != nil {
+		return false
+	}
+	sum := int64(0)
+	for i, c := range block[:tarBlock] {
+		if i >= 148 && i < 156 {
+			c = ' '
+		}
+		sum += int64(c)
+	}
+	return sum == want
+}
+
+// unpackTar writes the entries of tr under dest, returning the bytes of
+// file data written.
+func unpackTar(tr *tar.Reader, dest string) (int64, error) {
+	var written int64
+	// directories are restored once their contents are in
+	type dirEntry struct {
+		h    *tar.Header
+		path string
+		info os.FileInfo
+	}
+	var dirs []dirEntry
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+		path, err := tarTarget(dest, h.Name)
+		if err != nil {
+			log.Printf("%s: %v -- skipped", h.Name, err)
+			setError()
+			continue
+		}
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			var info os.FileInfo
+			if info, err = makeDir(path); err == nil {
+				dirs = append(dirs, dirEntry{h, path, info})
+			}
+		case tar.TypeReg, '\x00':
+			var n int64
+			n, err = unpackFile(tr, h, path)
+			written += n
+		case tar.TypeSymlink:
+			if err = prepareEntry(path); err == nil {
+				err = os.Symlink(h.Linkname, path)
+			}
+			if err == nil && os.Geteuid() == 0 {
+				err = os.Lchown(path, h.Uid, h.Gid)
+			}
+		case tar.TypeLink:
+			var target string
+			if target, err = tarTarget(dest, h.Linkname); err == nil {
+				if err = prepareEntry(path); err == nil {
+					err = os.Link(target, path)
+				}
+			}
+		default:
+			warnf("%s: unsupported entry type %q -- skipped", h.Name, h.Typeflag)
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			setError()
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := restoreAttributes(dirs[i].path, dirs[i].h, dirs[i].info); err != nil {
+			log.Println(err)
+			setError()
+		}
+	}
+	return written, nil
+}
+
+// unpackFile writes the data of the regular file entry h to path.
+func unpackFile(tr *tar.Reader, h *tar.Header, path string) (int64, error) {
+	if err := prepareEntry(path); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, tr)
+	info, serr := f.Stat()
+	if err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = restoreAttributes(path, h, info)
+	}
+	return n, err
+}
+
+// makeDir makes the directory entry path, which may exist as a directory,
+// and returns it as it was made. A symbolic link in its place is refused,
+// or removed with -f, rather than followed.
+func makeDir(path string) (os.FileInfo, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if !force {
+			return nil, fmt.Errorf("%s is a symbolic link -- use -f to replace it", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s already exists and is not a directory", path)
+	}
+	return info, nil
+}
+
+// prepareEntry makes the directory an entry goes in and, with -f, removes a
+// file in its way.
+func prepareEntry(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(path); err == nil {
+		if !force {
+			return fmt.Errorf("%s already exists -- use -f to overwrite", path)
+		}
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// restoreAttributes gives path the owner, mode and times of h, as long as
+// it is still the file or directory info describes and not a link.
+func restoreAttributes(path string, h *tar.Header, info os.FileInfo) error {
+	current, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if current.Mode()&os.ModeSymlink != 0 || !os.SameFile(info, current) {
+		return fmt.Errorf("%s was replaced while unpacking -- attributes not restored", path)
+	}
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(path, h.Uid, h.Gid); err != nil {
+			return err
+		}
+	}
+	mode := h.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	atime := h.AccessTime
+	if atime.IsZero() {
+		atime = h.ModTime
+	}
+	return os.Chtimes(path, atime, h.ModTime)
+}
+
+// tarTarget returns where the entry name goes under dest. A leading / is
+// dropped, as tar does; names leading out of dest, or through a symbolic
+// link under it, are errors.
+func tarTarget(dest, name string) (string, error) {
+	rel := strings.TrimLeft(filepath.Clean(filepath.FromSlash(name)), string(filepath.Separator))
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("path leads outside the target directory")
+	}
+	if rel == "" {
+		rel = "."
+	}
+	dir := dest
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", errors.New("path leads through a symbolic link")
+		}
+	}
+	return filepath.Join(dest, rel), nil
+}
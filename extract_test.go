@@ -0,0 +1,179 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that an archive written by --tar unpacks to the same tree, with modes
+// and times
+func TestExtract(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "tree")
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 5000)
+	path := filepath.Join(root, "sub", "data.txt")
+	ioutil.WriteFile(path, data, 0640)
+	os.Symlink("sub/data.txt", filepath.Join(root, "link"))
+	modified := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	os.Chtimes(path, modified, modified)
+	os.Chtimes(filepath.Join(root, "sub"), modified, modified)
+
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(writeTar(pw, []string{root}, nil)) }()
+	var archive bytes.Buffer
+	if err := compressStream(pr, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "dest")
+	n, err := extractStream(bytes.NewReader(archive.Bytes()), dest)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("unpacked %d bytes: %v", n, err)
+	}
+	base := filepath.Join(dest, filepath.FromSlash(tarEntryName(root)))
+	got, err := ioutil.ReadFile(filepath.Join(base, "sub", "data.txt"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("data.txt: %d bytes: %v", len(got), err)
+	}
+	for _, name := range []string{filepath.Join("sub", "data.txt"), "sub"} {
+		info, err := os.Stat(filepath.Join(base, name))
+		if err != nil || !info.ModTime().Equal(modified) {
+			t.Errorf("%s: %v", name, err)
+		} else if name == "sub" && info.Mode().Perm() != 0755 || name != "sub" && info.Mode().Perm() != 0640 {
+			t.Errorf("%s: mode %v", name, info.Mode())
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(base, "link")); err != nil || link != "sub/data.txt" {
+		t.Errorf("link to %q: %v", link, err)
+	}
+
+	// unpacking again keeps the files
+	if _, err := extractStream(bytes.NewReader(archive.Bytes()), dest); err != nil {
+		t.Fatal(err)
+	}
+	exitStatus = 0
+
+	var plain bytes.Buffer
+	compressStream(bytes.NewReader(data), &plain)
+	if _, err := extractStream(&plain, dest); err != errNotTar {
+		t.Errorf("plain data: %v", err)
+	}
+}
+
+// Test that a directory entry over a symbolic link unpacked before it is
+// refused, leaving what the link points to alone, and that -f replaces the
+// link with the directory
+func TestExtractDirOverLink(t *testing.T) {
+	defer func() { force, exitStatus = false, 0 }()
+	dir := t.TempDir()
+	outside := filepath.Join(dir, "outside")
+	os.Mkdir(outside, 0700)
+	modified := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	os.Chtimes(outside, modified, modified)
+
+	var plain bytes.Buffer
+	tw := tar.NewWriter(&plain)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "d", Linkname: outside, Mode: 0777})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "d/", Mode: 0777, ModTime: time.Unix(0, 0)})
+	tw.Close()
+	var archive bytes.Buffer
+	if err := compressStream(&plain, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "dest")
+	if _, err := extractStream(bytes.NewReader(archive.Bytes()), dest); err != nil {
+		t.Fatal(err)
+	}
+	if exitStatus == 0 {
+		t.Errorf("directory over a link not reported")
+	}
+	info, err := os.Stat(outside)
+	if err != nil || info.Mode().Perm() != 0700 || !info.ModTime().Equal(modified) {
+		t.Errorf("outside: %v %v: %v", info.Mode(), info.ModTime(), err)
+	}
+
+	force = true
+	if _, err := extractStream(bytes.NewReader(archive.Bytes()), filepath.Join(dir, "forced")); err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Lstat(filepath.Join(dir, "forced", "d"))
+	if err != nil || !info.IsDir() || info.Mode().Perm() != 0777 {
+		t.Errorf("forced d: %v: %v", info.Mode(), err)
+	}
+	if info, err := os.Stat(outside); err != nil || info.Mode().Perm() != 0700 || !info.ModTime().Equal(modified) {
+		t.Errorf("outside after -f: %v: %v", info.Mode(), err)
+	}
+}
+
+func TestTarTarget(t *testing.T) {
+	dest := t.TempDir()
+	os.Symlink(os.TempDir(), filepath.Join(dest, "out"))
+	for name, ok := range map[string]bool{
+		"a/b":         true,
+		"/abs":        true,
+		"a/../b":      true,
+		"../escape":   false,
+		"a/../../up":  false,
+		"out":         true,
+		"out/through": false,
+	} {
+		if _, err := tarTarget(dest, name); (err == nil) != ok {
+			t.Errorf("tarTarget(%q): %v", name, err)
+		}
+	}
+}
+
+// Test that gopigz -d -x ARCHIVE unpacks it, run in a child process since
+// -x exits when done
+func TestExtractCommand(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "tree")
+	os.Mkdir(root, 0755)
+	data := []byte("unpacked by -d -x\n")
+	ioutil.WriteFile(filepath.Join(root, "data.txt"), data, 0644)
+
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(writeTar(pw, []string{root}, nil)) }()
+	var archive bytes.Buffer
+	if err := compressStream(pr, &archive); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	os.Mkdir(dest, 0755)
+	ioutil.WriteFile(filepath.Join(dest, "archive.tgz"), archive.Bytes(), 0644)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExtractHelper$")
+	cmd.Dir = dest
+	cmd.Env = append(os.Environ(), "GOPIGZ_EXTRACT_HELPER=-d -x archive.tgz")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gopigz -d -x: %v: %s", err, out)
+	}
+	base := filepath.Join(dest, filepath.FromSlash(tarEntryName(root)))
+	if got, err := ioutil.ReadFile(filepath.Join(base, "data.txt")); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("data.txt: %q: %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "archive.tgz")); err != nil {
+		t.Errorf("archive not kept: %v", err)
+	}
+}
+
+// TestExtractHelper runs gopigz with the arguments in
+// GOPIGZ_EXTRACT_HELPER, for TestExtractCommand.
+func TestExtractHelper(t *testing.T) {
+	args := os.Getenv("GOPIGZ_EXTRACT_HELPER")
+	if args == "" {
+		t.Skip("helper process for TestExtractCommand")
+	}
+	os.Args = append([]string{"gopigz"}, strings.Fields(args)...)
+	main()
+}
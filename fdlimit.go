@@ -0,0 +1,66 @@
+package main
+
+import "sync"
+
+// Open file budget.
+//
+// A process may only hold RLIMIT_NOFILE descriptors at a time. File
+// pipelines and mux streams share a budget of that many minus FD_RESERVE,
+// taking descriptors from it before opening anything and giving them back
+// once closed, so a recursion over a huge tree queues for descriptors
+// instead of failing with "too many open files" partway through. Directory
+// walkers hold theirs for the whole walk, and get at most half the budget.
+// The soft limit is raised to the hard one first.
+
+// Descriptors left outside the budget: standard streams, the state
+// database, progress and control sockets, network outputs
+const FD_RESERVE = 32
+
+// Limit assumed when the system does not tell
+const OPEN_FILE_DEFAULT = 1024
+
+// Smallest budget, so a low limit still lets one file through at a time
+const MIN_FD_BUDGET = 4
+
+var fds struct {
+	once  sync.Once
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int
+	used  int
+}
+
+func initFds() {
+	fds.cond = sync.NewCond(&fds.mu)
+	fds.limit = openFileLimit() - FD_RESERVE
+	if fds.limit < MIN_FD_BUDGET {
+		fds.limit = MIN_FD_BUDGET
+	}
+}
+
+// fdBudget returns the number of descriptors the budget holds.
+func fdBudget() int {
+	fds.once.Do(initFds)
+	return fds.limit
+}
+
+// acquireFds waits until n descriptors may be opened. Every call must be
+// paired with releaseFds(n). More than the budget is granted when nothing
+// else is open.
+func acquireFds(n int) {
+	fds.once.Do(initFds)
+	fds.mu.Lock()
+	defer fds.mu.Unlock()
+	for fds.used > 0 && fds.used+n > fds.limit {
+		fds.cond.Wait()
+	}
+	fds.used += n
+}
+
+// releaseFds returns n descriptors taken by acquireFds.
+func releaseFds(n int) {
+	fds.mu.Lock()
+	defer fds.mu.Unlock()
+	fds.used -= n
+	fds.cond.Broadcast()
+}
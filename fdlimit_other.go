@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// openFileLimit returns the number of files gopigz keeps open at most where
+// there is no RLIMIT_NOFILE.
+func openFileLimit() int {
+	return OPEN_FILE_DEFAULT
+}
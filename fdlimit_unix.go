@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// openFileLimit raises the soft RLIMIT_NOFILE to the hard limit and returns
+// it.
+func openFileLimit() int {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return OPEN_FILE_DEFAULT
+	}
+	if lim.Cur < lim.Max {
+		raised := lim
+		raised.Cur = raised.Max
+		if syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised) == nil {
+			lim = raised
+		}
+	}
+	if lim.Cur > 1<<20 {
+		return 1 << 20
+	}
+	return int(lim.Cur)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Parsing keep, force, retry-changed, lock and min-ratio flags
+var keep bool
+var force bool
+var retryChanged int
+var lockInputs bool
+var minRatio float64
+
+// Parsing suffix flag: replaces the format's suffix when not empty
+var customSuffix string
+
+// the file being compressed, for formats that record its name, time or
+// mode; nil for standard input
+var inputInfo os.FileInfo
+
+// inputCRC is the CRC-32 of the input of the stream being written, kept for
+// --state and --min-ratio whatever the format.
+var inputCRC uint32
+
+// storeInput is the first compression of a file that --min-ratio found not
+// worth keeping, while the file is written again uncompressed in a
+// container format that can hold it so. The format may need its CRC-32 and
+// size before the data.
+var storeInput *fileResult
+
+// keepInputCRC reports whether inputCRC is needed.
+func keepInputCRC() bool {
+	return state != nil || minRatio >= 0
+}
+
+// errLocked is returned by lockShared when a writer holds an exclusive lock
+var errLocked = errors.New("file is locked by another process")
+
+// exitStatus follows gzip: 0 on success, 1 on error, 2 on warning. 3 means
+// a decompression failed and its partial output was kept (--keep-broken).
+var exitStatus int
+
+const EXIT_BROKEN = 3
+
+func setError() {
+	exitStatus = 1
+}
+
+func setWarning() {
+	if exitStatus == 0 {
+		exitStatus = 2
+	}
+}
+
+func setBroken() {
+	if exitStatus != 1 {
+		exitStatus = EXIT_BROKEN
+	}
+}
+
+// Parsing output-dir flag
+var outputDir string
+
+// mirrorRoot is the directory argument being processed. With --output-dir,
+// the files under it go to the same place under outputDir.
+var mirrorRoot string
+
+// mirrorPath returns where the output named name goes: in the same
+// directory without --output-dir, else at the same place relative to
+// outputDir as name is to mirrorRoot.
+func mirrorPath(name string) string {
+	if outputDir == "" {
+		return name
+	}
+	rel, err := filepath.Rel(mirrorRoot, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(name)
+	}
+	return filepath.Join(outputDir, rel)
+}
+
+// keepInputs reports whether inputs stay after processing: with --keep, and
+// with --output-dir, which leaves the source tree untouched.
+func keepInputs() bool {
+	return keep || outputDir != ""
+}
+
+// closeOutput closes a finished output. When the input is removed next, the
+// output is synced first: the removal may otherwise reach the disk before the
+// data does, and a crash in between would lose both.
+func closeOutput(out *os.File) error {
+	if !keepInputs() {
+		if err := out.Sync(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// createOutput creates outPath, making the directories leading to it under
+// --output-dir. An existing file is only replaced with --force, or when it
+// is a stale output found compressing a directory.
+func createOutput(outPath string) (*os.File, error) {
+	if outputDir != "" {
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return nil, err
+		}
+	}
+	mode := os.O_WRONLY
+	if mmapOutputs {
+		// a shared writable mapping needs read access too
+		mode = os.O_RDWR
+	}
+	if directIO {
+		mode |= O_DIRECT
+	}
+	if force || replaceStale && staleOutput(outPath) {
+		if err := os.Remove(outPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(outPath, mode|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%s already exists -- use -f to overwrite", outPath)
+	}
+	return f, err
+}
+
+// suffix returns the file name suffix for the selected output format, or the
+// one given with -S.
+func suffix() string {
+	if customSuffix != "" {
+		return customSuffix + encSuffix()
+	}
+	if c := lookupCodec(format); c != nil {
+		return c.suffix + encSuffix()
+	}
+	if format == "zlib" {
+		return ".zz" + encSuffix()
+	}
+	return ".gz" + encSuffix()
+}
+
+// compressFile compresses path into path+suffix(), or its place under
+// --output-dir, and, unless --keep is given, removes path once the output is
+// written, synced and closed. The input is stat'ed before and after
+// compressing; if it changed in the meantime the archive may be torn, so the
+// original is never removed and, with --retry-changed, compression is redone.
+func compressFile(path string) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		log.Println(err)
+		setError()
+		countFailed(path, err)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		warnf("%s is not a regular file -- ignored", path)
+		countSkipped(path)
+		return
+	}
+	if !force && strings.HasSuffix(path, suffix()) {
+		warnf("%s already has %s suffix -- unchanged", path, suffix())
+		countIgnored(path)
+		return
+	}
+	if !checkLinks(path, info) {
+		countSkipped(path)
+		return
+	}
+
+	outPath := mirrorPath(path) + suffix()
+	for attempt := 0; ; attempt++ {
+		result, err := compressFileOnce(path, outPath)
+		if err == nil && !result.changed && !worthKeeping(result) && canStore() {
+			result, err = storeFile(path, outPath, result)
+		}
+		if err == errLocked {
+			warnf("%s: %v -- skipped", path, err)
+			countSkipped(path)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			setError()
+			countFailed(path, err)
+			return
+		}
+		if !result.changed {
+			if result.stored {
+				warnf("%s: not worth compressing -- stored uncompressed", path)
+			} else if !worthKeeping(result) {
+				warnf("%s: compressed to %d bytes from %d -- skipped, left unchanged", path, result.outSize, result.inSize)
+				removeOutput(outPath)
+				countSkipped(path)
+				return
+			}
+			if state != nil {
+				recordState(path, result)
+			}
+			countProcessed(path, result.inSize, result.outSize)
+			break
+		}
+
+		if attempt < retryChanged {
+			log.Printf("%s: file changed while compressing -- retrying", path)
+			removeOutput(outPath)
+			continue
+		}
+		warnf("%s: file changed while compressing -- not removing original", path)
+		countProcessed(path, result.inSize, result.outSize)
+		return
+	}
+
+	if !keepInputs() {
+		if err := os.Remove(path); err != nil {
+			log.Println(err)
+			setError()
+		}
+	}
+}
+
+// fileResult describes one completed compression of a file.
+type fileResult struct {
+	changed bool // input modified or replaced while it was being read
+	inSize  int64
+	outSize int64
+	modTime time.Time
+	sum     uint32 // CRC-32 of the input, with --state and --min-ratio
+	stored  bool   // held uncompressed in a container format
+}
+
+// compressFileOnce writes the compressed form of path to outPath. A
+// partially written output is removed on error.
+func compressFileOnce(path, outPath string) (result fileResult, err error) {
+	acquireFds(2)
+	defer releaseFds(2)
+	in, err := openInput(path)
+	if err != nil {
+		return result, err
+	}
+	defer in.Close()
+
+	// The lock is released when in is closed.
+	if lockInputs {
+		if err := lockShared(in); err != nil {
+			return result, err
+		}
+	}
+
+	before, err := in.Stat()
+	if err != nil {
+		return result, err
+	}
+	inputInfo = before
+	defer func() { inputInfo = nil }()
+	startProgress(path, before.Size())
+
+	out, err := createOutput(outPath)
+	if err != nil {
+		return result, err
+	}
+	w, finish := outputWriter(out)
+	if mmapOutputs {
+		if m, err := newMmapWriter(out, before.Size()); err != nil {
+			log.Printf("%s: %v -- writing without mmap", outPath, err)
+		} else {
+			w, finish = m, m.Close
+		}
+	}
+	err = compressStream(inputReader(in), w)
+	if ferr := finish(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(outPath)
+		return result, err
+	}
+	result.sum = inputCRC
+	written, err := out.Stat()
+	if err == nil {
+		err = closeOutput(out)
+	} else {
+		out.Close()
+	}
+	if err == nil {
+		err = copyAttributes(outPath, before)
+	}
+	if err == nil && memberIndex != nil {
+		err = writeGzi(outPath + GZI_SUFFIX)
+	}
+	if err == nil && blake3Tree {
+		err = writeB3Tree(outPath + B3_SUFFIX)
+	}
+	if err == nil && writeIndexFile {
+		err = writeIndex(outPath + INDEX_SUFFIX)
+	}
+	if err != nil {
+		removeOutput(outPath)
+		return result, err
+	}
+
+	after, err := in.Stat()
+	if err != nil {
+		return result, err
+	}
+	result.inSize = after.Size()
+	result.outSize = written.Size()
+	result.modTime = after.ModTime()
+
+	current, err := os.Stat(path)
+	if err != nil {
+		// removed or renamed away while we were reading it
+		result.changed = true
+		return result, nil
+	}
+	result.changed = fileChanged(before, after) || !os.SameFile(after, current)
+	return result, nil
+}
+
+// worthKeeping applies --min-ratio: the output must save at least minRatio
+// percent of the input size. A negative minRatio keeps every output.
+func worthKeeping(result fileResult) bool {
+	if minRatio < 0 {
+		return true
+	}
+	saved := float64(result.inSize - result.outSize)
+	return saved > 0 && saved >= float64(result.inSize)*minRatio/100
+}
+
+// canStore reports whether the output format is a container that can hold
+// the input uncompressed.
+func canStore() bool {
+	c := lookupCodec(format)
+	return c != nil && c.stores
+}
+
+// storeFile writes path to outPath again, uncompressed, after its first
+// compression saved too little for --min-ratio. It reports the file as
+// changed if its size or CRC-32 differ from first's.
+func storeFile(path, outPath string, first fileResult) (fileResult, error) {
+	removeOutput(outPath)
+	storeInput = &first
+	defer func() { storeInput = nil }()
+	result, err := compressFileOnce(path, outPath)
+	result.stored = true
+	if result.inSize != first.inSize || result.sum != first.sum {
+		result.changed = true
+	}
+	return result, err
+}
+
+// checkLinks refuses, like gzip, to replace a file that has other hard links
+// unless --keep or --force is given: removing this name would leave the data
+// duplicated under the other names.
+func checkLinks(path string, info os.FileInfo) bool {
+	if keepInputs() || force {
+		return true
+	}
+	if n := linkCount(info); n > 1 {
+		others := "links"
+		if n == 2 {
+			others = "link"
+		}
+		warnf("%s has %d other %s -- unchanged", path, n-1, others)
+		return false
+	}
+	return true
+}
+
+func fileChanged(before, after os.FileInfo) bool {
+	return before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime())
+}
+
+// removeOutput removes a compressed output and its member index, if any.
+func removeOutput(outPath string) {
+	os.Remove(outPath)
+	os.Remove(outPath + GZI_SUFFIX)
+	os.Remove(outPath + B3_SUFFIX)
+	os.Remove(outPath + INDEX_SUFFIX)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test compressing a named file into path.gz and removing the original
+func TestCompressFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.txt")
+	data := bytes.Repeat([]byte("hello, gopigz\n"), 10000)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exitStatus = 0
+	compressFile(path)
+	if exitStatus != 0 {
+		t.Fatalf("exit status %d", exitStatus)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("original was not removed")
+	}
+
+	f, err := os.Open(path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("decompressed output differs from input")
+	}
+}
+
+func TestFileChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.txt")
+	if err := ioutil.WriteFile(path, []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.Stat(path)
+
+	if err := ioutil.WriteFile(path, []byte("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := before.ModTime().Add(time.Second)
+	os.Chtimes(path, later, later)
+	after, _ := os.Stat(path)
+
+	if fileChanged(before, before) {
+		t.Errorf("unchanged file reported as changed")
+	}
+	if !fileChanged(before, after) {
+		t.Errorf("modified file not reported as changed")
+	}
+}
+
+// Test that a file with other hard links is left alone unless forced
+func TestCompressFileHardLinks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.txt")
+	if err := ioutil.WriteFile(path, []byte("linked"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(path, filepath.Join(dir, "other.txt")); err != nil {
+		t.Skip("hard links not supported:", err)
+	}
+	info, _ := os.Stat(path)
+	if linkCount(info) != 2 {
+		t.Skip("link counts not supported")
+	}
+
+	exitStatus = 0
+	compressFile(path)
+	if exitStatus != 2 {
+		t.Errorf("exit status %d, want 2", exitStatus)
+	}
+	if _, err := os.Stat(path + ".gz"); !os.IsNotExist(err) {
+		t.Errorf("file with other links was compressed")
+	}
+
+	force = true
+	defer func() { force = false }()
+	exitStatus = 0
+	compressFile(path)
+	if _, err := os.Stat(path + ".gz"); err != nil {
+		t.Errorf("file was not compressed with --force: %v", err)
+	}
+}
+
+func TestWorthKeeping(t *testing.T) {
+	defer func() { minRatio = -1 }()
+	tests := []struct {
+		minRatio float64
+		in, out  int64
+		want     bool
+	}{
+		{-1, 100, 150, true},
+		{0, 100, 150, false},
+		{0, 100, 100, false},
+		{0, 100, 99, true},
+		{10, 100, 91, false},
+		{10, 100, 90, true},
+	}
+	for _, test := range tests {
+		minRatio = test.minRatio
+		if got := worthKeeping(fileResult{inSize: test.in, outSize: test.out}); got != test.want {
+			t.Errorf("minRatio %v, %d -> %d: got %v, want %v", test.minRatio, test.in, test.out, got, test.want)
+		}
+	}
+}
+
+// Test that a file --min-ratio finds not worth compressing is left alone and
+// reported as skipped, quietly with -q
+func TestMinRatioSkip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "random.bin")
+	data := make([]byte, BLOCK_SIZE+100)
+	rand.Read(data)
+	ioutil.WriteFile(path, data, 0644)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	minRatio = 0
+	setVerbosity(VERBOSITY_QUIET)
+	defer func() { minRatio, exitStatus, summary = -1, 0, runSummary{} }()
+	defer setVerbosity(VERBOSITY_NORMAL)
+
+	exitStatus, summary = 0, runSummary{}
+	compressFile(path)
+	if exitStatus != 2 || summary.Skipped != 1 {
+		t.Errorf("exit status %d, %d skipped", exitStatus, summary.Skipped)
+	}
+	if logged.Len() != 0 {
+		t.Errorf("logged %q with -q", logged.String())
+	}
+	if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, data) {
+		t.Errorf("original changed")
+	}
+	if _, err := os.Stat(path + ".gz"); !os.IsNotExist(err) {
+		t.Errorf("output kept")
+	}
+}
+
+// Test that a mapped output grows past its estimate and is cut to size
+func TestMmapWriter(t *testing.T) {
+	f, err := os.OpenFile(filepath.Join(t.TempDir(), "out"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := newMmapWriter(f, 0)
+	if err == errMmapUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("mapped output\n"), 20000)
+	for i := 0; i < len(data); i += 10000 {
+		end := i + 10000
+		if end > len(data) {
+			end = len(data)
+		}
+		w.Write(data[i:end])
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("file holds %d bytes, want the %d written", len(got), len(data))
+	}
+}
+
+// Test compressing and decompressing files with O_DIRECT
+func TestDirectIO(t *testing.T) {
+	if O_DIRECT == 0 {
+		t.Skip(errDirectUnsupported)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.txt")
+	// not a multiple of the alignment, nor of the buffer
+	data := bytes.Repeat([]byte("straight to disk\n"), 100000)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	directIO = true
+	defer func() { directIO = false }()
+	// not every file system takes O_DIRECT
+	if f, err := openInput(path); err != nil {
+		t.Skip(err)
+	} else {
+		f.Close()
+	}
+	exitStatus = 0
+	compressFile(path)
+	decompressFile(path + ".gz")
+	if exitStatus != 0 {
+		t.Fatalf("exit status %d", exitStatus)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("round trip gave %d bytes, want %d", len(got), len(data))
+	}
+}
+
+// Test that existing outputs and files with the suffix are left alone
+// unless -f is given
+func TestForce(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.txt")
+	ioutil.WriteFile(path, []byte("force me\n"), 0644)
+	ioutil.WriteFile(path+".gz", []byte("existing"), 0644)
+
+	exitStatus = 0
+	compressFile(path)
+	if existing, _ := ioutil.ReadFile(path + ".gz"); exitStatus != 1 || string(existing) != "existing" {
+		t.Errorf("exit status %d, output %q", exitStatus, existing)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("original removed: %v", err)
+	}
+
+	exitStatus = 0
+	compressFile(path + ".gz")
+	if _, err := os.Stat(path + ".gz.gz"); exitStatus != 2 || !os.IsNotExist(err) {
+		t.Errorf("compressed a .gz file: exit status %d", exitStatus)
+	}
+
+	force = true
+	defer func() { force = false }()
+	exitStatus = 0
+	compressFile(path)
+	if exitStatus != 0 {
+		t.Fatalf("exit status %d with -f", exitStatus)
+	}
+	f, err := os.Open(path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(r); string(got) != "force me\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// Test that -S names compressed files and is recognized when decompressing
+func TestCustomSuffix(t *testing.T) {
+	customSuffix = ".gzip"
+	defer func() { customSuffix = "" }()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.txt")
+	ioutil.WriteFile(path, []byte("custom suffix\n"), 0644)
+
+	exitStatus = 0
+	compressFile(path)
+	if _, err := os.Stat(path + ".gzip"); err != nil || exitStatus != 0 {
+		t.Fatalf("exit status %d, %v", exitStatus, err)
+	}
+	decompressFile(path + ".gzip")
+	if got, err := ioutil.ReadFile(path); err != nil || string(got) != "custom suffix\n" || exitStatus != 0 {
+		t.Errorf("got %q, %v, exit status %d", got, err, exitStatus)
+	}
+}
+
+// Test that a mapped input compresses to the same stream as one read, with
+// rsyncable cuts too
+func TestMappedInput(t *testing.T) {
+	saved := processes
+	defer func() { processes, mmapInputs, rsyncable = saved, false, false }()
+	processes = 4
+
+	path := filepath.Join(t.TempDir(), "input")
+	var data bytes.Buffer
+	for i := 0; data.Len() < 5*BLOCK_SIZE; i++ {
+		fmt.Fprintf(&data, "line %d\n", i*i)
+	}
+	if err := ioutil.WriteFile(path, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if m, err := mapInput(f); err == errMmapUnsupported {
+		t.Skip(err)
+	} else if err != nil || m == nil {
+		t.Fatalf("not mapped: %v", err)
+	} else {
+		m.Close()
+	}
+
+	for _, rsyncable = range []bool{false, true} {
+		var streams [2][]byte
+		for i, mapped := range []bool{false, true} {
+			mmapInputs = mapped
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := compressStream(f, &out); err != nil {
+				t.Fatal(err)
+			}
+			streams[i] = out.Bytes()
+		}
+		if !bytes.Equal(streams[0], streams[1]) {
+			t.Errorf("rsyncable %v: mapped input compressed to %d bytes, read to %d", rsyncable, len(streams[1]), len(streams[0]))
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(streams[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, data.Bytes()) {
+			t.Errorf("rsyncable %v: read %d bytes: %v", rsyncable, len(got), err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build aix || solaris
+
+package main
+
+import "os"
+
+// flockShared does nothing where there is no flock(2): the fcntl(2) lock
+// is all there is.
+func flockShared(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build unix && !aix && !solaris
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// flockShared takes a non-blocking shared flock(2) on f.
+func flockShared(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
@@ -0,0 +1,485 @@
+//go:build !nozstd
+
+package main
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// Entropy coding of zstd (RFC 8878 section 4): finite state entropy tables
+// for the sequences, Huffman tables for the literals, and the backward bit
+// streams both are read from.
+
+var errZstdCorrupt = errors.New("zstd: corrupt input")
+
+// bitWriter writes a bit stream that is read back to front: bits are
+// appended from the least significant end, and closing adds the end mark.
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) addBits(value uint64, n uint) {
+	w.acc |= (value & (1<<n - 1)) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) close() []byte {
+	w.addBits(1, 1)
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
+
+// reverseBits reads a stream written by bitWriter, last bit first. Reading
+// past the start yields zeros; overflow tells whether that happened.
+type reverseBits struct {
+	data []byte // padded with 8 zero bytes
+	pos  int    // bits not read yet
+}
+
+func newReverseBits(b []byte) (*reverseBits, error) {
+	if len(b) == 0 || b[len(b)-1] == 0 {
+		return nil, errZstdCorrupt
+	}
+	data := make([]byte, len(b)+8)
+	copy(data, b)
+	pos := 8*(len(b)-1) + bits.Len8(b[len(b)-1]) - 1
+	return &reverseBits{data: data, pos: pos}, nil
+}
+
+// peek returns the n bits below bit position at, at most 56 of them.
+func (r *reverseBits) peek(at int, n uint) uint64 {
+	start := at - int(n)
+	if start < 0 {
+		if at <= 0 {
+			return 0
+		}
+		return r.peek(at, uint(at)) << uint(-start)
+	}
+	i := start >> 3
+	v := uint64(r.data[i]) | uint64(r.data[i+1])<<8 | uint64(r.data[i+2])<<16 | uint64(r.data[i+3])<<24 |
+		uint64(r.data[i+4])<<32 | uint64(r.data[i+5])<<40 | uint64(r.data[i+6])<<48 | uint64(r.data[i+7])<<56
+	return v >> uint(start&7) & (1<<n - 1)
+}
+
+func (r *reverseBits) read(n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	v := r.peek(r.pos, n)
+	r.pos -= int(n)
+	return v
+}
+
+func (r *reverseBits) overflow() bool {
+	return r.pos < 0
+}
+
+// fseTable is an FSE decoding table.
+type fseTable struct {
+	log    uint
+	symbol []uint8
+	nbits  []uint8
+	base   []uint16
+}
+
+// spreadSymbols lays the symbols of a normalized distribution out over a
+// table of 1<<log states, as both FSE coders do.
+func spreadSymbols(norm []int16, log uint) []uint8 {
+	size := 1 << log
+	table := make([]uint8, size)
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			table[high] = uint8(s)
+			high--
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			table[pos] = uint8(s)
+			pos = (pos + step) & (size - 1)
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+	return table
+}
+
+func newFSETable(norm []int16, log uint) *fseTable {
+	size := 1 << log
+	t := &fseTable{
+		log:    log,
+		symbol: spreadSymbols(norm, log),
+		nbits:  make([]uint8, size),
+		base:   make([]uint16, size),
+	}
+	next := make([]int, len(norm))
+	for s, n := range norm {
+		next[s] = int(n)
+		if n == -1 {
+			next[s] = 1
+		}
+	}
+	for u := 0; u < size; u++ {
+		s := t.symbol[u]
+		x := next[s]
+		next[s]++
+		nb := log - uint(bits.Len(uint(x))-1)
+		t.nbits[u] = uint8(nb)
+		t.base[u] = uint16(x<<nb - size)
+	}
+	return t
+}
+
+// rleTable returns a table that always decodes symbol.
+func rleTable(symbol uint8) *fseTable {
+	return &fseTable{symbol: []uint8{symbol}, nbits: []uint8{0}, base: []uint16{0}}
+}
+
+// fseEncoder encodes symbols with the same normalized distribution.
+type fseEncoder struct {
+	log         uint
+	states      []uint16
+	deltaNbBits []uint32
+	deltaFind   []int32
+}
+
+func newFSEEncoder(norm []int16, log uint) *fseEncoder {
+	size := 1 << log
+	spread := spreadSymbols(norm, log)
+	e := &fseEncoder{
+		log:         log,
+		states:      make([]uint16, size),
+		deltaNbBits: make([]uint32, len(norm)),
+		deltaFind:   make([]int32, len(norm)),
+	}
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			n = 1
+		}
+		cumul[s+1] = cumul[s] + int(n)
+	}
+	for u, s := range spread {
+		e.states[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+	total := 0
+	for s, n := range norm {
+		switch {
+		case n == 0:
+		case n == -1 || n == 1:
+			e.deltaNbBits[s] = uint32(log<<16) - uint32(size)
+			e.deltaFind[s] = int32(total - 1)
+			total++
+		default:
+			maxBits := log - uint(bits.Len(uint(n-1))-1)
+			e.deltaNbBits[s] = uint32(maxBits<<16) - uint32(int(n)<<maxBits)
+			e.deltaFind[s] = int32(total - int(n))
+			total += int(n)
+		}
+	}
+	return e
+}
+
+// fseState is the state of an fseEncoder while it encodes a stream.
+type fseState struct {
+	e     *fseEncoder
+	value uint32
+}
+
+// init starts the state with the last symbol of the stream.
+func (st *fseState) init(e *fseEncoder, symbol uint8) {
+	st.e = e
+	nb := (e.deltaNbBits[symbol] + 1<<15) >> 16
+	v := nb<<16 - e.deltaNbBits[symbol]
+	st.value = uint32(e.states[int32(v>>nb)+e.deltaFind[symbol]])
+}
+
+func (st *fseState) encode(w *bitWriter, symbol uint8) {
+	nb := (st.value + st.e.deltaNbBits[symbol]) >> 16
+	w.addBits(uint64(st.value), uint(nb))
+	st.value = uint32(st.e.states[int32(st.value>>nb)+st.e.deltaFind[symbol]])
+}
+
+func (st *fseState) flush(w *bitWriter) {
+	w.addBits(uint64(st.value), st.e.log)
+}
+
+// readFSETable reads a table description of at most maxLog accuracy for the
+// symbols up to maxSymbol. It returns the distribution, its accuracy log
+// and the bytes used.
+func readFSETable(b []byte, maxSymbol int, maxLog uint) ([]int16, uint, int, error) {
+	pos := 0 // in bits
+	get := func(n uint) uint32 {
+		var v uint32
+		for i := uint(0); i < n; i++ {
+			byteIdx := (pos + int(i)) >> 3
+			if byteIdx < len(b) && b[byteIdx]>>uint((pos+int(i))&7)&1 != 0 {
+				v |= 1 << i
+			}
+		}
+		return v
+	}
+	if len(b) == 0 {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	log := uint(get(4)) + 5
+	pos += 4
+	if log > maxLog {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	norm := make([]int16, maxSymbol+1)
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbits := log + 1
+	symbol := 0
+	previous0 := false
+	for remaining > 1 && symbol <= maxSymbol {
+		if previous0 {
+			n0 := symbol
+			for get(2) == 3 {
+				n0 += 3
+				pos += 2
+			}
+			n0 += int(get(2))
+			pos += 2
+			if n0 > maxSymbol+1 {
+				return nil, 0, 0, errZstdCorrupt
+			}
+			symbol = n0
+			if symbol > maxSymbol {
+				break
+			}
+		}
+		max := 2*threshold - 1 - remaining
+		var count int
+		if v := int(get(nbits - 1)); v < max {
+			count = v
+			pos += int(nbits) - 1
+		} else {
+			count = int(get(nbits))
+			if count >= threshold {
+				count -= max
+			}
+			pos += int(nbits)
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		norm[symbol] = int16(count)
+		symbol++
+		previous0 = count == 0
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+	used := (pos + 7) >> 3
+	if remaining != 1 || used > len(b) {
+		return nil, 0, 0, errZstdCorrupt
+	}
+	return norm, log, used, nil
+}
+
+// writeFSETable appends the description of a normalized distribution.
+func writeFSETable(out []byte, norm []int16, log uint) []byte {
+	var w bitWriter
+	w.out = out
+	w.addBits(uint64(log-5), 4)
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbits := log + 1
+	previous0 := false
+	for symbol := 0; symbol < len(norm) && remaining > 1; {
+		if previous0 {
+			start := symbol
+			for norm[symbol] == 0 {
+				symbol++
+			}
+			for symbol >= start+3 {
+				start += 3
+				w.addBits(3, 2)
+			}
+			w.addBits(uint64(symbol-start), 2)
+		}
+		count := int(norm[symbol])
+		symbol++
+		max := 2*threshold - 1 - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++
+		if count >= threshold {
+			count += max
+		}
+		if count < max {
+			w.addBits(uint64(count), nbits-1)
+		} else {
+			w.addBits(uint64(count), nbits)
+		}
+		previous0 = count == 1
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
+
+// Huffman coding of literals
+
+const HUF_MAX_BITS = 11
+
+type huffTable struct {
+	log    uint
+	symbol []uint8
+	nbits  []uint8
+}
+
+// readHuffTable reads a Huffman tree description and returns the table and
+// the bytes used.
+func readHuffTable(b []byte) (*huffTable, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	header := int(b[0])
+	var weights []uint8
+	used := 1
+	if header >= 128 {
+		n := header - 127
+		used += (n + 1) / 2
+		if used > len(b) {
+			return nil, 0, errZstdCorrupt
+		}
+		for i := 0; i < n; i++ {
+			w := b[1+i/2]
+			if i%2 == 0 {
+				w >>= 4
+			}
+			weights = append(weights, w&15)
+		}
+	} else {
+		used += header
+		if used > len(b) {
+			return nil, 0, errZstdCorrupt
+		}
+		var err error
+		if weights, err = readHuffWeights(b[1:used]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// the weight of the last symbol is implied by the others
+	total := 0
+	for _, w := range weights {
+		if w > HUF_MAX_BITS {
+			return nil, 0, errZstdCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 || len(weights) > 255 {
+		return nil, 0, errZstdCorrupt
+	}
+	log := uint(bits.Len(uint(total)))
+	rest := 1<<log - total
+	if log > HUF_MAX_BITS || rest&(rest-1) != 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	weights = append(weights, uint8(bits.Len(uint(rest))))
+
+	t := &huffTable{log: log, symbol: make([]uint8, 1<<log), nbits: make([]uint8, 1<<log)}
+	var start [HUF_MAX_BITS + 2]int
+	for _, w := range weights {
+		if w > 0 {
+			start[w] += 1 << (w - 1)
+		}
+	}
+	next := 0
+	for w := 1; w <= int(log); w++ {
+		n := start[w]
+		start[w] = next
+		next += n
+	}
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		n := 1 << (w - 1)
+		for u := start[w]; u < start[w]+n; u++ {
+			t.symbol[u] = uint8(s)
+			t.nbits[u] = uint8(log + 1 - uint(w))
+		}
+		start[w] += n
+	}
+	return t, used, nil
+}
+
+// readHuffWeights decodes FSE compressed Huffman weights: two states share
+// one table and take turns until the stream runs out.
+func readHuffWeights(b []byte) ([]uint8, error) {
+	norm, log, n, err := readFSETable(b, 255, 6)
+	if err != nil {
+		return nil, err
+	}
+	t := newFSETable(norm, log)
+	r, err := newReverseBits(b[n:])
+	if err != nil {
+		return nil, err
+	}
+	states := [2]uint{uint(r.read(log)), uint(r.read(log))}
+	var weights []uint8
+	for i := 0; ; i ^= 1 {
+		st := states[i]
+		weights = append(weights, t.symbol[st])
+		states[i] = uint(t.base[st]) + uint(r.read(uint(t.nbits[st])))
+		if r.overflow() {
+			weights = append(weights, t.symbol[states[i^1]])
+			break
+		}
+		if len(weights) > 255 {
+			return nil, errZstdCorrupt
+		}
+	}
+	return weights, nil
+}
+
+// decodeStream decodes n literals from one Huffman coded stream.
+func (t *huffTable) decodeStream(out, b []byte, n int) ([]byte, error) {
+	r, err := newReverseBits(b)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		v := r.peek(r.pos, t.log)
+		out = append(out, t.symbol[v])
+		r.pos -= int(t.nbits[v])
+	}
+	if r.pos != 0 {
+		return nil, errZstdCorrupt
+	}
+	return out, nil
+}
@@ -1,3 +1,3 @@
 module github.com/aaron-seo/gopigz/m
 
-go 1.17
+go 1.19
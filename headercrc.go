@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"hash/crc32"
+)
+
+// Header CRC (--header-crc).
+//
+// --header-crc sets FHCRC and ends every gzip header in the low 16 bits of
+// its CRC-32, so that a damaged name, comment or subfield is caught before
+// any data is inflated. compress/gzip checks it when present, which covers
+// -d, -t and --list.
+
+// Parsing header-crc flag
+var headerCRC bool
+
+func init() {
+	flag.BoolVar(&headerCRC, "header-crc", false, "End gzip headers in a CRC16 of the header (FHCRC)")
+	optionChecks = append(optionChecks, func() error {
+		if headerCRC && format != "gzip" {
+			return errors.New("--header-crc is only supported with the gzip format")
+		}
+		return nil
+	})
+}
+
+// appendHeaderCRC sets FHCRC in header and appends its CRC16, with
+// --header-crc.
+func appendHeaderCRC(header []byte) []byte {
+	if !headerCRC {
+		return header
+	}
+	header[3] |= FHCRC
+	sum := crc32.ChecksumIEEE(header)
+	return append(header, byte(sum), byte(sum>>8))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+// Test that --header-crc headers read back, and that a damaged one is
+// refused
+func TestHeaderCRC(t *testing.T) {
+	headerCRC, headerComment = true, "checked"
+	defer func() { headerCRC, headerComment = false, "" }()
+
+	var out bytes.Buffer
+	if err := compressStream(bytes.NewReader([]byte("guarded\n")), &out); err != nil {
+		t.Fatal(err)
+	}
+	stream := out.Bytes()
+	if stream[3]&FHCRC == 0 {
+		t.Fatalf("flags %#x", stream[3])
+	}
+	if zr, err := gzip.NewReader(bytes.NewReader(stream)); err != nil || zr.Comment != "checked" {
+		t.Fatalf("reading: %v", err)
+	}
+
+	damaged := append([]byte{}, stream...)
+	damaged[bytes.Index(damaged, []byte("checked"))] = 'C'
+	if _, err := gzip.NewReader(bytes.NewReader(damaged)); err != gzip.ErrHeader {
+		t.Errorf("damaged header: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import "math/bits"
+
+// Longest code huffmanCodes assigns, that of deflate and brotli
+const HUFFMAN_MAX_CODE_LEN = 15
+
+// huffmanLengths returns Huffman code lengths of at most maxLen for the
+// frequencies freq. Symbols of frequency 0 get no code, and a lone symbol a
+// code of length 1. When a code is too long, the frequencies are flattened
+// and the code built again, as bzip2 does.
+func huffmanLengths(freq []int32, maxLen int) []uint8 {
+	var used []int
+	for s, f := range freq {
+		if f > 0 {
+			used = append(used, s)
+		}
+	}
+	lengths := make([]uint8, len(freq))
+	n := len(used)
+	if n == 1 {
+		lengths[used[0]] = 1
+	}
+	if n < 2 {
+		return lengths
+	}
+
+	weight := make([]int64, 2*n)
+	for i, s := range used {
+		weight[i] = int64(freq[s])
+	}
+	parent := make([]int, 2*n)
+	live := make([]bool, 2*n)
+	for {
+		// join the two lightest live nodes until one is left
+		for i := range live {
+			live[i] = i < n
+		}
+		for nodes := n; nodes < 2*n-1; nodes++ {
+			a, b := -1, -1
+			for i := 0; i < nodes; i++ {
+				if !live[i] {
+					continue
+				}
+				if a < 0 || weight[i] < weight[a] {
+					a, b = i, a
+				} else if b < 0 || weight[i] < weight[b] {
+					b = i
+				}
+			}
+			live[a], live[b] = false, false
+			weight[nodes] = weight[a] + weight[b]
+			parent[a], parent[b] = nodes, nodes
+			live[nodes] = true
+		}
+
+		longest := 0
+		for i, s := range used {
+			depth := 0
+			for j := i; j != 2*n-2; j = parent[j] {
+				depth++
+			}
+			lengths[s] = uint8(depth)
+			if depth > longest {
+				longest = depth
+			}
+		}
+		if longest <= maxLen {
+			return lengths
+		}
+		for i := 0; i < n; i++ {
+			weight[i] = 1 + weight[i]/2
+		}
+	}
+}
+
+// huffmanCodes assigns canonical codes to the code lengths, at most
+// HUFFMAN_MAX_CODE_LEN, bit-reversed so that lsbWriter writes them first bit
+// first.
+func huffmanCodes(lengths []uint8) []uint16 {
+	var count [HUFFMAN_MAX_CODE_LEN + 1]int
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [HUFFMAN_MAX_CODE_LEN + 1]int
+	code := 0
+	for l := 1; l <= HUFFMAN_MAX_CODE_LEN; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for s, l := range lengths {
+		if l > 0 {
+			codes[s] = bits.Reverse16(uint16(next[l])) >> (16 - l)
+			next[l]++
+		}
+	}
+	return codes
+}
@@ -0,0 +1,17 @@
+package main
+
+// Independent blocks (-i/--independent).
+//
+// Like pigz, every deflate block but the first is primed with the last
+// DICT_SIZE bytes of the input before it, so matches can reach back across
+// block boundaries as they would in a single stream. The workers still run
+// in parallel, since the input is at hand when a block is read. With -i the
+// blocks are compressed from an empty window instead, each ending in a flush
+// marker (00 00 ff ff) after which nothing refers back, so a damaged block
+// only loses itself: a reader can find the next marker and inflate on from
+// there, or hand blocks to several inflaters at once. gzip headers then
+// carry an IB subfield with the block size, so that gopigz -d knows it may.
+// The ratio is slightly worse.
+
+// Parsing independent flag
+var independent bool
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"github.com/aaron-seo/gopigz/m/pgzip"
+)
+
+// Parallel decompression of independent blocks.
+//
+// The blocks of -i output each end in a flush marker (00 00 ff ff) and refer
+// to nothing before them, and their gzip headers say so with an IB subfield
+// holding the block size. Only such streams are inflated in parallel, the
+// others as ever. After the header a reader cuts the deflate stream at the
+// first marker past INFLATE_CHUNK bytes, or after as many markers as blocks
+// fit in PIECE_DATA, -p workers inflate the pieces from an empty window, and
+// the results are written in order, at most as many pieces waiting as there
+// are workers. No piece holds more than two blocks' worth of compressed
+// data beyond INFLATE_CHUNK, nor inflates to more than its blocks can hold,
+// so memory stays within a few pieces per worker whatever the input.
+//
+// A piece is only taken if it inflates cleanly and within those bounds: a
+// marker that is just compressed data leaves its piece ending inside a
+// deflate block, and to tell that from the end of a block every piece is
+// followed by an empty final block, which must end it exactly. At the first
+// piece that fails, the rest of the member is inflated in order with the
+// window of what came before, as it would have been without -p. The CRC-32
+// and size in the trailer are checked as ever, and any members after the
+// first are decompressed as ordinary gzip.
+
+// FEXTRA subfield ID marking independent blocks
+const (
+	INDEPENDENT_SI1 = 'I'
+	INDEPENDENT_SI2 = 'B'
+)
+
+const (
+	// compressed bytes to a piece, at least
+	INFLATE_CHUNK = 1 << 17
+
+	// inflated bytes to a piece, at most, unless a block alone holds more
+	PIECE_DATA = 1 << 22
+
+	// largest block inflated in parallel; streams of larger blocks are
+	// inflated in order, to keep the pieces in flight small
+	MAX_PIECE_BLOCK = 1 << 24
+)
+
+// errPieceTooLong reports a piece past its bounds.
+var errPieceTooLong = errors.New("piece exceeds its bounds")
+
+// flushMarker ends the empty stored block of a flush.
+var flushMarker = []byte{0x00, 0x00, 0xff, 0xff}
+
+// emptyFinalBlock is a final fixed Huffman block holding only its end code.
+var emptyFinalBlock = []byte{0x03, 0x00}
+
+// inflatedPiece is the result of inflating a piece of a deflate stream.
+type inflatedPiece struct {
+	raw   []byte // the compressed piece
+	data  []byte
+	crc   uint32
+	final bool   // the piece holds the end of the deflate stream
+	tail  []byte // what follows that end in the piece
+	err   error
+}
+
+// independentSubfield returns the IB subfield for the gzip headers of
+// blocks of size bytes.
+func independentSubfield(size int) []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, uint32(size))
+	return appendSubfield(nil, INDEPENDENT_SI1, INDEPENDENT_SI2, data)
+}
+
+// independentBlockSize returns the block size recorded in the IB subfield
+// of extra, or 0 if there is none or it is not one inflated in parallel.
+func independentBlockSize(extra []byte) int {
+	data := findSubfield(extra, INDEPENDENT_SI1, INDEPENDENT_SI2)
+	if len(data) != 4 {
+		return 0
+	}
+	size := binary.LittleEndian.Uint32(data)
+	if size < MIN_BLOCK_SIZE || size > MAX_PIECE_BLOCK {
+		return 0
+	}
+	return int(size)
+}
+
+// pieceBounds returns the most flush markers, compressed bytes and
+// inflated bytes to a piece of blocks of blockSize bytes.
+func pieceBounds(blockSize int) (markers, compressed, inflated int) {
+	markers = PIECE_DATA / blockSize
+	if markers < 1 {
+		markers = 1
+	}
+	// a block compresses to little more than its size when stored, and the
+	// last piece holds the final block past its markers
+	return markers, INFLATE_CHUNK + 2*blockSize + 1024, (markers + 1) * blockSize
+}
+
+// inflateIndependent inflates the deflate stream and trailer of a gzip
+// member in r, whose header has been read and says its blocks are of
+// blockSize bytes and independent, to output, then any members after it.
+func inflateIndependent(r *bufio.Reader, output io.Writer, blockSize int) error {
+	workers := processes
+	if workers < 1 {
+		workers = 1
+	}
+	markers, compressed, inflated := pieceBounds(blockSize)
+	type job struct {
+		piece []byte
+		err   error
+		done  chan inflatedPiece
+	}
+	jobs := make(chan job)
+	order := make(chan chan inflatedPiece, workers)
+	stop := make(chan struct{})
+
+	// the reader ends at the end of the input, on an error, or when told to
+	// stop, leaving a piece it read but did not hand out in leftover
+	var readErr error
+	var leftover []byte
+	go func() {
+		defer close(order)
+		defer close(jobs)
+		for {
+			piece, err := readPiece(r, markers, compressed)
+			if err != nil && err != io.EOF && err != errPieceTooLong {
+				readErr = err
+				return
+			}
+			if len(piece) == 0 {
+				return
+			}
+			done := make(chan inflatedPiece, 1)
+			select {
+			case order <- done:
+			case <-stop:
+				leftover = piece
+				return
+			}
+			jobs <- job{piece, err, done}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for j := range jobs {
+				if j.err == errPieceTooLong {
+					j.done <- inflatedPiece{raw: j.piece, err: j.err}
+					continue
+				}
+				j.done <- inflatePiece(j.piece, inflated)
+			}
+		}()
+	}
+
+	// pieces are written until one fails or holds the end of the stream;
+	// those after it are kept to go on from in order
+	var crc uint32
+	var size int64
+	var window, rest []byte
+	var stopped, finished bool
+	var err error
+	for done := range order {
+		p := <-done
+		if stopped {
+			rest = append(rest, p.raw...)
+			continue
+		}
+		if p.err != nil {
+			rest = append(rest, p.raw...)
+		} else if _, err = output.Write(p.data); err == nil {
+			crc = pgzip.CombineCRC32(crc, p.crc, int64(len(p.data)))
+			size += int64(len(p.data))
+			window = pgzip.AppendWindow(window, p.data)
+			finished = p.final
+			rest = append(rest, p.tail...)
+		}
+		if p.err != nil || p.final || err != nil {
+			stopped = true
+			close(stop)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+
+	in := bufio.NewReader(io.MultiReader(bytes.NewReader(rest), bytes.NewReader(leftover), r))
+	if !finished {
+		fr := flate.NewReaderDict(in, window)
+		h := crc32.NewIEEE()
+		n, err := io.Copy(io.MultiWriter(output, h), fr)
+		if err != nil {
+			return err
+		}
+		crc = pgzip.CombineCRC32(crc, h.Sum32(), n)
+		size += n
+	}
+
+	trailer := make([]byte, TRAILER_SIZE)
+	if _, err := io.ReadFull(in, trailer); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if binary.LittleEndian.Uint32(trailer) != crc || binary.LittleEndian.Uint32(trailer[4:]) != uint32(size) {
+		return gzip.ErrChecksum
+	}
+
+	// whatever follows the member
+	if _, err := in.Peek(1); err == io.EOF {
+		return nil
+	}
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, gz); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readPiece reads from r to the first flush marker past INFLATE_CHUNK
+// bytes or to the markers'th, whichever comes first, or to the end of the
+// input with io.EOF. Past compressed bytes without a marker it returns
+// what it read with errPieceTooLong.
+func readPiece(r *bufio.Reader, markers, compressed int) ([]byte, error) {
+	var piece []byte
+	seen := 0
+	for {
+		line, err := r.ReadSlice(flushMarker[len(flushMarker)-1])
+		piece = append(piece, line...)
+		if err == bufio.ErrBufferFull {
+			err = nil
+		}
+		if err != nil {
+			return piece, err
+		}
+		if bytes.HasSuffix(piece, flushMarker) {
+			seen++
+			if len(piece) >= INFLATE_CHUNK || seen >= markers {
+				return piece, nil
+			}
+		}
+		if len(piece) > compressed {
+			return piece, errPieceTooLong
+		}
+	}
+}
+
+// inflatePiece inflates piece from an empty window, to at most inflated
+// bytes. It must end in the empty final block appended to it, at a block
+// boundary, unless the deflate stream ends within it.
+func inflatePiece(piece []byte, inflated int) inflatedPiece {
+	p := inflatedPiece{raw: piece}
+	input := append(append(make([]byte, 0, len(piece)+len(emptyFinalBlock)), piece...), emptyFinalBlock...)
+	br := bytes.NewReader(input)
+	p.data, p.err = ioutil.ReadAll(io.LimitReader(flate.NewReader(br), int64(inflated)+1))
+	switch left := br.Len(); {
+	case p.err != nil:
+	case len(p.data) > inflated:
+		p.err = errPieceTooLong
+	case left == 0:
+	case left >= len(emptyFinalBlock):
+		p.final = true
+		p.tail = piece[len(piece)-(left-len(emptyFinalBlock)):]
+	default:
+		p.err = io.ErrUnexpectedEOF
+	}
+	p.crc = crc32.ChecksumIEEE(p.data)
+	return p
+}
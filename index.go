@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"flag"
+	"io/ioutil"
+)
+
+// Random-access index (--index).
+//
+// Every block of the pipeline ends in a sync flush, on a byte boundary with
+// no deflate block open, so inflating can start at any block given the
+// window of input before it, as zlib's zran.c does. --index writes such
+// access points next to the compressed file, every INDEX_SPAN bytes of input
+// or so, in NAME.gz.idx:
+//
+//	magic "GPZIDX01"
+//	uint64 uncompressed size
+//	uint64 number of access points, then for each:
+//	  uint64 compressed offset of the point in the gzip file
+//	  uint64 uncompressed offset
+//	  uint32 length of the window, then the window as raw deflate
+//
+// all little-endian. The first point is right after the gzip header. The
+// window is the data the block refers back to: up to DICT_SIZE bytes of
+// input before it, the --dict dictionary for the first block, and nothing
+// with -i. pgzip.SeekableReader reads the index.
+
+const (
+	INDEX_SUFFIX = ".idx"
+	INDEX_MAGIC  = "GPZIDX01"
+
+	// input between access points, rounded up to whole blocks
+	INDEX_SPAN = 1 << 20
+)
+
+// Parsing index flag
+var writeIndexFile bool
+
+func init() {
+	flag.BoolVar(&writeIndexFile, "index", false, "Write an index of access points next to compressed files (.idx), for seeking into them")
+	optionChecks = append(optionChecks, func() error {
+		switch {
+		case !writeIndexFile:
+		case format != "gzip":
+			return errors.New("--index is only supported with the gzip format")
+		case memberInterval() > 0 || encryptKey != nil:
+			return errors.New("--index cannot be combined with --member-every or --encrypt")
+		case toStdout || outputTarget != "":
+			return errors.New("--index is written next to compressed files, not with -c or --output")
+		}
+		return nil
+	})
+}
+
+// accessPoint is where inflating can start.
+type accessPoint struct {
+	compressed   int64
+	uncompressed int64
+	window       []byte // raw deflate
+}
+
+// index state of the stream being written
+var accessPoints []accessPoint
+var indexSize int64
+
+// addToIndex records an access point at block b if it is due, before b is
+// written, and accounts for b.
+func addToIndex(b *block) {
+	if len(accessPoints) == 0 || indexSize-accessPoints[len(accessPoints)-1].uncompressed >= INDEX_SPAN {
+		accessPoints = append(accessPoints, accessPoint{outOffset, indexSize, deflateWindow(blockDictionary(b))})
+	}
+	outOffset += int64(len(b.CompressedData))
+	indexSize += int64(len(b.RawData))
+}
+
+// deflateWindow returns window as raw deflate.
+func deflateWindow(window []byte) []byte {
+	if len(window) > DICT_SIZE {
+		window = window[len(window)-DICT_SIZE:]
+	}
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write(window)
+	fw.Close()
+	return buf.Bytes()
+}
+
+// writeIndex writes the access points of the stream to path.
+func writeIndex(path string) error {
+	buf := []byte(INDEX_MAGIC)
+	buf = appendUint64(buf, uint64(indexSize))
+	buf = appendUint64(buf, uint64(len(accessPoints)))
+	for _, p := range accessPoints {
+		buf = appendUint64(buf, uint64(p.compressed))
+		buf = appendUint64(buf, uint64(p.uncompressed))
+		buf = appendUint32(buf, uint32(len(p.window)))
+		buf = append(buf, p.window...)
+	}
+	return ioutil.WriteFile(path, buf, 0644)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Test that inflating from every access point of the index, with its
+// window, gives the input from its offset on
+func TestIndex(t *testing.T) {
+	writeIndexFile = true
+	defer func() { writeIndexFile = false; summary = runSummary{} }()
+
+	var text bytes.Buffer
+	for i := 0; text.Len() < 3*INDEX_SPAN; i++ {
+		fmt.Fprintf(&text, "record %d: %x\n", i, i*i)
+	}
+	data := text.Bytes()
+	path := filepath.Join(t.TempDir(), "records")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	compressFile(path)
+	gz, err := ioutil.ReadFile(path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ioutil.ReadFile(path + ".gz" + INDEX_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	le := binary.LittleEndian
+	if string(idx[:8]) != INDEX_MAGIC || le.Uint64(idx[8:]) != uint64(len(data)) {
+		t.Fatalf("index header %q", idx[:24])
+	}
+	points := int(le.Uint64(idx[16:]))
+	if points < 3 {
+		t.Errorf("%d access points", points)
+	}
+	rest := idx[24:]
+	for i := 0; i < points; i++ {
+		compressed, uncompressed := le.Uint64(rest), le.Uint64(rest[8:])
+		n := le.Uint32(rest[16:])
+		window, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(rest[20 : 20+n])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[20+n:]
+
+		fr := flate.NewReaderDict(bytes.NewReader(gz[compressed:]), window)
+		want := data[uncompressed:]
+		if len(want) > 1000 {
+			want = want[:1000]
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(fr, got); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("point %d at %d/%d: %q, %v", i, compressed, uncompressed, got[:20], err)
+		}
+	}
+	if len(rest) != 0 {
+		t.Errorf("%d bytes after the access points", len(rest))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// Capabilities report: gopigz info [--json]
+//
+// Prints what this binary can do on this machine, for support requests and
+// for automation deciding which options to pass.
+
+type capabilities struct {
+	Version     string   `json:"version"`
+	GoVersion   string   `json:"go_version"`
+	Platform    string   `json:"platform"`
+	CPUs        int      `json:"cpus"`
+	CPUFeatures []string `json:"cpu_features"`
+	Processes   int      `json:"processes"`
+	BlockSize   int      `json:"block_size"`
+	Memory      int64    `json:"memory"`       // estimated need with the options given
+	MemoryLimit int64    `json:"memory_limit"` // --memory, 0 if unlimited
+	Formats     []string `json:"formats"`
+	Decompress  []string `json:"decompress_formats"`
+	Checksums   []string `json:"checksums"`
+	Outputs     []string `json:"outputs"`
+	Features    []string `json:"features"`
+}
+
+func getCapabilities() capabilities {
+	c := capabilities{
+		Version:     "(devel)",
+		GoVersion:   runtime.Version(),
+		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+		CPUs:        runtime.NumCPU(),
+		CPUFeatures: cpuFeatures(),
+		Processes:   processes,
+		BlockSize:   blockSize,
+		Memory:      compressMemory(),
+		MemoryLimit: int64(memoryLimit),
+		Checksums:   []string{"crc32", "adler32", "blake3"},
+	}
+	c.Formats, c.Decompress = availableFormats()
+	if lookupCodec("zstd") != nil {
+		c.Checksums = append(c.Checksums, "xxh64")
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		c.Version = bi.Main.Version
+	}
+	if c.CPUFeatures == nil {
+		c.CPUFeatures = []string{}
+	}
+
+	c.Outputs = []string{"file"}
+	for scheme := range outputSchemes {
+		c.Outputs = append(c.Outputs, scheme)
+	}
+	sort.Strings(c.Outputs[1:])
+
+	c.Features = []string{}
+	for _, f := range []struct {
+		name string
+		have bool
+	}{
+		{"direct", O_DIRECT != 0},
+		{"job-control", HAVE_JOB_CONTROL},
+		{"lock", HAVE_LOCK},
+		{"mmap", HAVE_MMAP},
+		{"sparse", HAVE_SPARSE},
+	} {
+		if f.have {
+			c.Features = append(c.Features, f.name)
+		}
+	}
+	return c
+}
+
+// runInfo implements the info subcommand.
+func runInfo(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", jsonOutput, "Print the report as JSON")
+	fs.Parse(args)
+
+	c := getCapabilities()
+	if *asJSON {
+		out, _ := json.MarshalIndent(c, "", "  ")
+		fmt.Println(string(out))
+		os.Exit(0)
+	}
+
+	limit := "unlimited"
+	if c.MemoryLimit > 0 {
+		limit = formatSize(c.MemoryLimit)
+	}
+	fmt.Printf("gopigz %s, %s, %s\n", c.Version, c.GoVersion, c.Platform)
+	for _, line := range [][2]string{
+		{"cpus", fmt.Sprint(c.CPUs)},
+		{"cpu features", list(c.CPUFeatures)},
+		{"processes", fmt.Sprint(c.Processes)},
+		{"block size", formatSize(int64(c.BlockSize))},
+		{"memory", fmt.Sprintf("about %s per stream, --memory %s", formatSize(c.Memory), limit)},
+		{"formats", fmt.Sprintf("%s (decompress %s)", list(c.Formats), list(c.Decompress))},
+		{"checksums", list(c.Checksums)},
+		{"outputs", list(c.Outputs)},
+		{"features", list(c.Features)},
+	} {
+		fmt.Printf("%-14s%s\n", line[0]+":", line[1])
+	}
+	os.Exit(0)
+}
+
+func list(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, " ")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	c := getCapabilities()
+	if c.CPUs < 1 || c.BlockSize != BLOCK_SIZE || c.Memory <= 0 {
+		t.Errorf("got %+v", c)
+	}
+	has := func(items []string, want string) bool {
+		for _, item := range items {
+			if item == want {
+				return true
+			}
+		}
+		return false
+	}
+	if !has(c.Formats, "gzip") || has(c.Decompress, "xz") || has(c.Formats, "zstd") != (lookupCodec("zstd") != nil) {
+		t.Errorf("formats %v, decompress %v", c.Formats, c.Decompress)
+	}
+	if c.Outputs[0] != "file" || !has(c.Outputs, "https") || !has(c.Outputs, "s3") {
+		t.Errorf("outputs %v", c.Outputs)
+	}
+
+	// lists are never null in JSON
+	b, _ := json.Marshal(c)
+	var fields map[string]interface{}
+	json.Unmarshal(b, &fields)
+	for _, key := range []string{"cpu_features", "features", "outputs"} {
+		if _, ok := fields[key].([]interface{}); !ok {
+			t.Errorf("%s is %v", key, fields[key])
+		}
+	}
+}
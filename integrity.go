@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Integrity testing (-t/--test): every input is decompressed in full, its
+// checksums and sizes verified and the output thrown away, and a line
+// saying OK or why it is corrupt is printed for each.
+
+// Parsing test flag
+var testIntegrity bool
+
+func init() {
+	flag.BoolVar(&testIntegrity, "test", false, "Check the integrity of compressed inputs without writing any output")
+	flag.BoolVar(&testIntegrity, "t", false, "Check the integrity of compressed inputs without writing any output")
+}
+
+// runTest implements --test.
+func runTest(paths []string) {
+	if len(paths) == 0 {
+		reportIntegrity("-", decompressStream(os.Stdin, ioutil.Discard))
+	}
+	for _, path := range paths {
+		testFile(path)
+	}
+	os.Exit(exitStatus)
+}
+
+// testFile decompresses path and reports whether it is intact.
+func testFile(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Println(err)
+		setError()
+		return
+	}
+	defer f.Close()
+	reportIntegrity(path, decompressStream(f, ioutil.Discard))
+}
+
+func reportIntegrity(path string, err error) {
+	if err != nil {
+		fmt.Printf("%s: corrupt: %v\n", path, err)
+		setError()
+		return
+	}
+	fmt.Printf("%s: OK\n", path)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testOutput runs testFile on path and returns what it printed.
+func testOutput(t *testing.T, path string) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	testFile(path)
+	os.Stdout = saved
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	r.Close()
+	return string(out)
+}
+
+// Test that --test passes an intact file and reports a corrupt one with an
+// error exit status, without writing any output
+func TestIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.gz")
+	writeGzipFile(t, path, bytes.Repeat([]byte("check me\n"), 10000))
+	defer func() { exitStatus = 0 }()
+
+	exitStatus = 0
+	if out := testOutput(t, path); out != path+": OK\n" {
+		t.Errorf("intact file: printed %q", out)
+	}
+	if exitStatus != 0 {
+		t.Errorf("intact file: exit status %d, want 0", exitStatus)
+	}
+
+	gz, _ := ioutil.ReadFile(path)
+	// flip a bit in the CRC32 of the trailer
+	badCRC := append([]byte{}, gz...)
+	badCRC[len(badCRC)-8] ^= 0x01
+	for _, corrupt := range []struct {
+		name string
+		data []byte
+	}{
+		{"bad CRC", badCRC},
+		{"truncated", gz[:len(gz)/2]},
+	} {
+		ioutil.WriteFile(path, corrupt.data, 0644)
+		exitStatus = 0
+		if out := testOutput(t, path); !strings.HasPrefix(out, path+": corrupt: ") {
+			t.Errorf("%s: printed %q", corrupt.name, out)
+		}
+		if exitStatus != 1 {
+			t.Errorf("%s: exit status %d, want 1", corrupt.name, exitStatus)
+		}
+	}
+
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files left in the directory, want 1", len(entries))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"compress/flate"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+// Compression level: -0 to -9, --fast (-1), --best (-9) or --level N.
+//
+// The level goes to every flate writer in the pipeline and to the FLEVEL of
+// zlib headers. xz and zstd map it to the depth of their match finders.
+// --huffman (-H, as in pigz) selects flate.HuffmanOnly instead, which skips
+// match finding and only entropy codes the literals, and -11 the exhaustive
+// encoder of zopfli.go; both are for deflate output only.
+
+// Parsing level flags
+var level = flate.DefaultCompression
+
+// ZOPFLI_LEVEL is the level of the exhaustive deflate encoder, -11
+const ZOPFLI_LEVEL = 11
+
+// zopfliEncoder compresses a block at -11; zopfli.go sets it, and it is nil
+// in binaries built without it.
+var zopfliEncoder func(b *block, dict []byte) []byte
+
+// XZ_DEFAULT_LEVEL is the xz level when none is given, as in xz itself
+const XZ_DEFAULT_LEVEL = 6
+
+func init() {
+	flag.IntVar(&level, "level", flate.DefaultCompression, "Compression level from 0 (store) to 9 (best); -1 is the default, 6")
+	for n := flate.NoCompression; n <= flate.BestCompression; n++ {
+		flag.Var(levelFlag(n), strconv.Itoa(n), fmt.Sprintf("Compress at level %d", n))
+	}
+	flag.Var(levelFlag(flate.BestSpeed), "fast", "Compress faster (-1)")
+	flag.Var(levelFlag(flate.BestCompression), "best", "Compress better (-9)")
+	flag.Var(levelFlag(flate.HuffmanOnly), "huffman", "Use Huffman coding only, with no match finding (deflate formats)")
+	flag.Var(levelFlag(flate.HuffmanOnly), "H", "Same as --huffman")
+	flag.Var(levelFlag(ZOPFLI_LEVEL), "11", "Compress exhaustively, much slower than -9 (deflate formats)")
+	optionChecks = append(optionChecks, func() error {
+		if level == flate.HuffmanOnly || level == ZOPFLI_LEVEL {
+			if !deflateFormat() {
+				name := "--huffman"
+				if level == ZOPFLI_LEVEL {
+					name = "-11"
+				}
+				return fmt.Errorf("%s is not supported with the %s format", name, format)
+			}
+			if level == ZOPFLI_LEVEL && zopfliEncoder == nil {
+				return errors.New("-11 is not compiled into this binary")
+			}
+			return nil
+		}
+		if level < flate.DefaultCompression || level > flate.BestCompression {
+			return fmt.Errorf("invalid compression level %d", level)
+		}
+		return nil
+	})
+}
+
+// deflateFormat reports whether the format writes deflate data with the
+// flate writers.
+func deflateFormat() bool {
+	switch format {
+	case "gzip", "zlib", "deflate", "bgzf", "zip":
+		return true
+	}
+	return false
+}
+
+// levelFlag is a boolean flag that sets level to its value.
+type levelFlag int
+
+func (levelFlag) IsBoolFlag() bool { return true }
+func (levelFlag) String() string   { return "false" }
+func (l levelFlag) Set(s string) error {
+	if s == "true" {
+		level = int(l)
+	}
+	return nil
+}
+
+// xzLevel returns the level for the xz encoder.
+func xzLevel() int {
+	if level == flate.DefaultCompression {
+		return XZ_DEFAULT_LEVEL
+	}
+	return level
+}
+
+// gzipXFL returns the XFL byte of gzip headers, as zlib's deflate sets it:
+// 2 for the slowest levels, 4 for the fastest and the simpler strategies.
+func gzipXFL() byte {
+	switch {
+	case level >= flate.BestCompression:
+		return 2
+	case level == flate.HuffmanOnly || rleStrategy || level >= 0 && level < 2:
+		return 4
+	}
+	return 0
+}
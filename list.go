@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// Listing (-l/--list): the compressed and uncompressed size, ratio and name
+// of every gzip file given, in gzip -l's columns. The name is the one stored
+// in the header, as gzip -lN shows it, or else the file name without its
+// suffix. With -v, the comment stored in the header follows.
+//
+// gzip takes the size from the last trailer, which is wrong for files of
+// several members. Every member is inflated here instead, which takes as
+// long as decompressing but gives the sum of their sizes, and finds broken
+// files on the way.
+
+// Parsing list flag
+var listContents bool
+
+func init() {
+	flag.BoolVar(&listContents, "list", false, "List the compressed and uncompressed size, ratio and name of gzip files")
+	flag.BoolVar(&listContents, "l", false, "List the compressed and uncompressed size, ratio and name of gzip files")
+}
+
+// gzipListing describes one gzip file.
+type gzipListing struct {
+	compressed   int64
+	uncompressed int64
+	members      int
+	name         string // from the first header, if stored
+	comment      string // likewise
+}
+
+// runList implements --list.
+func runList(paths []string) {
+	fmt.Printf("%19s %19s %6s %s\n", "compressed", "uncompressed", "ratio", "uncompressed_name")
+	var total gzipListing
+	listed := 0
+	list := func(r io.Reader, name string) {
+		l, err := listGzip(r)
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			setError()
+			return
+		}
+		if l.name != "" {
+			name = l.name
+		}
+		printListing(l, name)
+		total.compressed += l.compressed
+		total.uncompressed += l.uncompressed
+		listed++
+	}
+
+	if len(paths) == 0 {
+		list(os.Stdin, "stdout")
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Println(err)
+			setError()
+			continue
+		}
+		list(f, strings.TrimSuffix(path, suffix()))
+		f.Close()
+	}
+	if listed > 1 {
+		printListing(&total, "(totals)")
+	}
+	os.Exit(exitStatus)
+}
+
+func printListing(l *gzipListing, name string) {
+	ratio := 0.0
+	if l.uncompressed > 0 {
+		ratio = 100 * float64(l.uncompressed-l.compressed) / float64(l.uncompressed)
+	}
+	fmt.Printf("%19d %19d %5.1f%% %s\n", l.compressed, l.uncompressed, ratio, name)
+	if l.comment != "" && currentVerbosity() >= VERBOSITY_VERBOSE {
+		fmt.Printf("%19s %s\n", "comment:", l.comment)
+	}
+}
+
+// listGzip reads the members of the gzip stream in r, checking their CRC-32
+// and size.
+func listGzip(r io.Reader) (*gzipListing, error) {
+	in := &countingReader{r: bufio.NewReader(r)}
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	l := &gzipListing{name: zr.Name, comment: zr.Comment}
+	for {
+		zr.Multistream(false)
+		n, err := io.Copy(ioutil.Discard, zr)
+		if err != nil {
+			return nil, err
+		}
+		l.uncompressed += n
+		l.members++
+		if err := zr.Reset(in); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	l.compressed = in.n
+	return l, nil
+}
+
+// countingReader counts the bytes read through it. It is an io.ByteReader
+// so that the gzip reader takes no more than it needs.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+// Test that the sizes of all members are summed, and the stored name found
+func TestListGzip(t *testing.T) {
+	var stream bytes.Buffer
+	for i, name := range []string{"first", ""} {
+		zw := gzip.NewWriter(&stream)
+		zw.Name = name
+		zw.Write(bytes.Repeat([]byte("member\n"), 1000*(i+1)))
+		zw.Close()
+	}
+
+	l, err := listGzip(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.compressed != int64(stream.Len()) || l.uncompressed != 7*3000 || l.members != 2 || l.name != "first" {
+		t.Errorf("got %+v", l)
+	}
+
+	corrupt := append([]byte{}, stream.Bytes()...)
+	corrupt[len(corrupt)-1] ^= 1
+	if _, err := listGzip(bytes.NewReader(corrupt)); err == nil {
+		t.Errorf("corrupt size not reported")
+	}
+}
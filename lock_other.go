@@ -0,0 +1,24 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+const HAVE_LOCK = false
+
+func init() {
+	optionChecks = append(optionChecks, func() error {
+		if lockInputs {
+			return errors.New("--lock is not supported on this platform")
+		}
+		return nil
+	})
+}
+
+// lockShared is never called where advisory locks are not available.
+func lockShared(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Advisory locks are available (gopigz info)
+const HAVE_LOCK = true
+
+// lockShared takes a non-blocking shared flock(2) and a read lock with
+// fcntl(2) F_SETLK on the whole of f, since a writer may hold either kind.
+// It returns errLocked if another process holds an exclusive lock of
+// either kind.
+func lockShared(f *os.File) error {
+	if err := flockShared(f); err != nil {
+		return err
+	}
+	lock := syscall.Flock_t{Type: syscall.F_RDLCK, Whence: io.SeekStart}
+	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return errLocked
+	}
+	return err
+}
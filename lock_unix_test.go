@@ -0,0 +1,94 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Test that with --lock a file a writer holds an exclusive flock or fcntl
+// lock on is skipped and left untouched, with -c too, and that it is
+// compressed once the lock is gone
+func TestLockedInput(t *testing.T) {
+	defer func() { lockInputs, exitStatus = false, 0 }()
+	lockInputs = true
+	dir := t.TempDir()
+	path := filepath.Join(dir, "log.txt")
+	data := []byte("still being written\n")
+
+	check := func(how string, locked bool) {
+		t.Helper()
+		os.Remove(path + ".gz")
+		exitStatus = 0
+		compressFile(path)
+		_, gzErr := os.Stat(path + ".gz")
+		got, err := ioutil.ReadFile(path)
+		if locked && (exitStatus != 2 || err != nil || string(got) != string(data) || !os.IsNotExist(gzErr)) {
+			t.Errorf("%s: status %d, input %q: %v, output: %v", how, exitStatus, got, err, gzErr)
+		}
+		if !locked && (exitStatus != 0 || gzErr != nil) {
+			t.Errorf("%s: status %d, output: %v", how, exitStatus, gzErr)
+		}
+	}
+
+	ioutil.WriteFile(path, data, 0644)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		t.Skip(err)
+	}
+	check("flock", true)
+	var out bytes.Buffer
+	exitStatus = 0
+	writeInput(path, &outputSink{w: &out}, compressStream)
+	if exitStatus != 2 || out.Len() != 0 {
+		t.Errorf("-c: status %d, wrote %d bytes", exitStatus, out.Len())
+	}
+	f.Close()
+	check("unlocked", false)
+	ioutil.WriteFile(path, data, 0644)
+
+	// fcntl locks are per process, so another one holds it
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelper$")
+	cmd.Env = append(os.Environ(), "GOPIGZ_LOCK_HELPER="+path)
+	stdin, _ := cmd.StdinPipe()
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "locked\n" {
+		t.Fatalf("helper: %q, %v", line, err)
+	}
+	check("fcntl", true)
+}
+
+// TestLockHelper holds a write lock with fcntl on the file named in
+// GOPIGZ_LOCK_HELPER until its standard input ends.
+func TestLockHelper(t *testing.T) {
+	path := os.Getenv("GOPIGZ_LOCK_HELPER")
+	if path == "" {
+		t.Skip("run by TestLockedInput")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock); err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout.WriteString("locked\n")
+	ioutil.ReadAll(os.Stdin)
+}
@@ -0,0 +1,391 @@
+//go:build !nolz4
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/aaron-seo/gopigz/m/pgzip"
+)
+
+// lz4 frame output (--format lz4), following the lz4 frame format
+// (https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md).
+//
+// Every pipeline block is cut into lz4 blocks of at most the frame's block
+// maximum, the smallest of 64K, 256K, 1M and 4M that holds blockSize, so
+// most pipeline blocks are one lz4 block. Unless -i is given, blocks are
+// linked: a block may copy from the DICT_SIZE bytes of input before it, as
+// the blocks of deflate are primed. Matches are found greedily with a single
+// hash table, skipping faster through data that does not match, as the
+// reference lz4 does; the level is ignored. The frame ends with the XXH32 of
+// the content, and --block-checksum adds the XXH32 of every block. Build
+// with -tags nolz4 to leave it out.
+
+const (
+	LZ4_MAGIC          = 0x184D2204
+	LZ4_SKIPPABLE      = 0x184D2A50 // to 0x184D2A5F
+	LZ4_VERSION        = 1 << 6
+	LZ4_INDEPENDENT    = 1 << 5
+	LZ4_BLOCK_CHECKSUM = 1 << 4
+	LZ4_CONTENT_SIZE   = 1 << 3
+	LZ4_CONTENT_SUM    = 1 << 2
+	LZ4_DICT_ID        = 1 << 0
+	LZ4_UNCOMPRESSED   = 1 << 31
+	LZ4_MIN_MATCH      = 4
+	LZ4_LAST_LITERALS  = 5  // a block ends with at least that many literals
+	LZ4_MF_LIMIT       = 12 // and no match starts closer to its end
+	LZ4_MAX_OFFSET     = 65535
+	LZ4_HASH_LOG       = 16
+	LZ4_SKIP_TRIGGER   = 6 // misses before the search step grows
+)
+
+// Parsing block-checksum flag
+var lz4BlockChecksum bool
+
+func init() {
+	registerCodec("lz4", &codec{
+		suffix:      ".lz4",
+		contentType: "application/x-lz4",
+		newChecksum: func() hash.Hash32 { return newXXH32() },
+		header:      lz4FrameHeader,
+		block:       lz4Blocks,
+		trailer: func(sum uint32) []byte {
+			return appendUint32(appendUint32(nil, 0), sum)
+		},
+		decompress: lz4Decompress,
+	})
+	flag.BoolVar(&lz4BlockChecksum, "block-checksum", false, "Add the XXH32 of every block to lz4 frames")
+	optionChecks = append(optionChecks, func() error {
+		if lz4BlockChecksum && format != "lz4" {
+			return errors.New("--block-checksum is only supported with the lz4 format")
+		}
+		return nil
+	})
+}
+
+// lz4BlockMax returns the block maximum size code of the frame and the
+// size.
+func lz4BlockMax() (byte, int) {
+	code, size := byte(4), 64*1024
+	for size < blockSize && code < 7 {
+		code, size = code+1, size*4
+	}
+	return code, size
+}
+
+// lz4FrameHeader returns the magic number and the frame descriptor.
+func lz4FrameHeader() []byte {
+	flg := byte(LZ4_VERSION | LZ4_CONTENT_SUM)
+	if independent {
+		flg |= LZ4_INDEPENDENT
+	}
+	if lz4BlockChecksum {
+		flg |= LZ4_BLOCK_CHECKSUM
+	}
+	code, _ := lz4BlockMax()
+	descriptor := []byte{flg, code << 4}
+	header := appendUint32(nil, LZ4_MAGIC)
+	header = append(header, descriptor...)
+	return append(header, byte(xxh32Sum(descriptor)>>8))
+}
+
+// lz4Blocks compresses the data of a pipeline block into lz4 blocks.
+func lz4Blocks(b *block) []byte {
+	_, max := lz4BlockMax()
+	prefix := b.window
+	if independent {
+		prefix = nil
+	}
+	var out []byte
+	for data := b.RawData; len(data) > 0; {
+		n := len(data)
+		if n > max {
+			n = max
+		}
+		compressed := lz4Block(data[:n], prefix)
+		if len(compressed) < n {
+			out = appendUint32(out, uint32(len(compressed)))
+		} else {
+			compressed = data[:n]
+			out = appendUint32(out, uint32(n)|LZ4_UNCOMPRESSED)
+		}
+		out = append(out, compressed...)
+		if lz4BlockChecksum {
+			out = appendUint32(out, xxh32Sum(compressed))
+		}
+		if !independent {
+			prefix = pgzip.AppendWindow(prefix, data[:n])
+		}
+		data = data[n:]
+	}
+	return out
+}
+
+func lz4Hash(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b) * 2654435761 >> (32 - LZ4_HASH_LOG)
+}
+
+// lz4Block compresses data into the sequences of an lz4 block, which may
+// copy from prefix as well.
+func lz4Block(data, prefix []byte) []byte {
+	buf := data
+	if len(prefix) > 0 {
+		buf = append(append(make([]byte, 0, len(prefix)+len(data)), prefix...), data...)
+	}
+	start := len(prefix)
+	var table [1 << LZ4_HASH_LOG]int32
+	for i := range table {
+		table[i] = -1
+	}
+	for i := 0; i+4 <= start; i++ {
+		table[lz4Hash(buf[i:])] = int32(i)
+	}
+
+	out := make([]byte, 0, len(data)/2)
+	anchor := start
+	matchEnd := len(buf) - LZ4_LAST_LITERALS
+	misses := 0
+	for i := start; i+LZ4_MF_LIMIT <= len(buf); {
+		h := lz4Hash(buf[i:])
+		j := int(table[h])
+		table[h] = int32(i)
+		if j < 0 || i-j > LZ4_MAX_OFFSET || binary.LittleEndian.Uint32(buf[j:]) != binary.LittleEndian.Uint32(buf[i:]) {
+			misses++
+			i += 1 + misses>>LZ4_SKIP_TRIGGER
+			continue
+		}
+		misses = 0
+
+		// extend backwards over the pending literals, then forwards
+		for i > anchor && j > 0 && buf[i-1] == buf[j-1] {
+			i, j = i-1, j-1
+		}
+		n := LZ4_MIN_MATCH
+		for i+n < matchEnd && buf[j+n] == buf[i+n] {
+			n++
+		}
+		out = lz4Sequence(out, buf[anchor:i], i-j, n)
+		for k := i + 1; k < i+n && k+4 <= len(buf); k += 2 {
+			table[lz4Hash(buf[k:])] = int32(k)
+		}
+		i += n
+		anchor = i
+	}
+	return lz4Sequence(out, buf[anchor:], 0, 0)
+}
+
+// lz4Sequence appends a sequence of literals and a match of n bytes at
+// offset; the last sequence of a block has literals only.
+func lz4Sequence(out, literals []byte, offset, n int) []byte {
+	token := len(literals) << 4
+	if len(literals) > 15 {
+		token = 15 << 4
+	}
+	m := n - LZ4_MIN_MATCH
+	if n > 0 {
+		if m > 15 {
+			token |= 15
+		} else {
+			token |= m
+		}
+	}
+	out = append(out, byte(token))
+	out = lz4Length(out, len(literals))
+	out = append(out, literals...)
+	if n == 0 {
+		return out
+	}
+	out = append(out, byte(offset), byte(offset>>8))
+	return lz4Length(out, m)
+}
+
+// lz4Length appends the bytes that follow a length of 15 or more in a token.
+func lz4Length(out []byte, n int) []byte {
+	if n < 15 {
+		return out
+	}
+	for n -= 15; n >= 255; n -= 255 {
+		out = append(out, 255)
+	}
+	return append(out, byte(n))
+}
+
+var errLz4Format = errors.New("lz4: corrupt frame")
+
+// lz4Decompress decodes the lz4 frames of input, skipping skippable frames.
+func lz4Decompress(input io.Reader, output io.Writer) error {
+	r := bufio.NewReader(input)
+	le := binary.LittleEndian
+	word := make([]byte, 4)
+	for frames := 0; ; frames++ {
+		if _, err := io.ReadFull(r, word); err != nil {
+			if err == io.EOF && frames > 0 {
+				return nil
+			}
+			return errLz4Format
+		}
+		if magic := le.Uint32(word); magic&0xfffffff0 == LZ4_SKIPPABLE {
+			if _, err := io.ReadFull(r, word); err != nil {
+				return errLz4Format
+			}
+			if _, err := io.CopyN(ioutil.Discard, r, int64(le.Uint32(word))); err != nil {
+				return errLz4Format
+			}
+			continue
+		} else if magic != LZ4_MAGIC {
+			return errLz4Format
+		}
+		if err := lz4Frame(r, output); err != nil {
+			return err
+		}
+	}
+}
+
+// lz4Frame decodes a frame after its magic number.
+func lz4Frame(r *bufio.Reader, output io.Writer) error {
+	le := binary.LittleEndian
+	descriptor := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, descriptor); err != nil {
+		return errLz4Format
+	}
+	flg, bd := descriptor[0], descriptor[1]
+	if flg&0xc0 != LZ4_VERSION {
+		return fmt.Errorf("lz4: unsupported version %d", flg>>6)
+	}
+	if flg&LZ4_DICT_ID != 0 {
+		return errors.New("lz4: frames with a dictionary are not supported")
+	}
+	if flg&LZ4_CONTENT_SIZE != 0 {
+		size := make([]byte, 8)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return errLz4Format
+		}
+		descriptor = append(descriptor, size...)
+	}
+	code := bd >> 4 & 7
+	if code < 4 {
+		return errLz4Format
+	}
+	max := 1 << (8 + 2*code)
+	hc, err := r.ReadByte()
+	if err != nil || hc != byte(xxh32Sum(descriptor)>>8) {
+		return errors.New("lz4: frame descriptor checksum error")
+	}
+
+	sum := newXXH32()
+	word := make([]byte, 4)
+	var history []byte
+	for {
+		if _, err := io.ReadFull(r, word); err != nil {
+			return errLz4Format
+		}
+		size := le.Uint32(word)
+		if size == 0 {
+			break
+		}
+		raw := size&LZ4_UNCOMPRESSED != 0
+		size &^= LZ4_UNCOMPRESSED
+		if int(size) > max {
+			return errLz4Format
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return errLz4Format
+		}
+		if flg&LZ4_BLOCK_CHECKSUM != 0 {
+			if _, err := io.ReadFull(r, word); err != nil {
+				return errLz4Format
+			}
+			if le.Uint32(word) != xxh32Sum(data) {
+				return errors.New("lz4: block checksum error")
+			}
+		}
+
+		if flg&LZ4_INDEPENDENT != 0 {
+			history = history[:0]
+		} else if len(history) > LZ4_MAX_OFFSET {
+			history = append(history[:0], history[len(history)-LZ4_MAX_OFFSET:]...)
+		}
+		start := len(history)
+		if raw {
+			history = append(history, data...)
+		} else if history, err = lz4DecodeBlock(history, data, max); err != nil {
+			return err
+		}
+		sum.Write(history[start:])
+		if _, err := output.Write(history[start:]); err != nil {
+			return err
+		}
+	}
+
+	if flg&LZ4_CONTENT_SUM != 0 {
+		if _, err := io.ReadFull(r, word); err != nil {
+			return errLz4Format
+		}
+		if le.Uint32(word) != sum.Sum32() {
+			return errors.New("lz4: content checksum error")
+		}
+	}
+	return nil
+}
+
+// lz4DecodeBlock appends the decoded block src, of at most max bytes, to
+// dst, which holds the data the block may copy from.
+func lz4DecodeBlock(dst, src []byte, max int) ([]byte, error) {
+	limit := len(dst) + max
+	length := func(i, n int) (int, int, error) {
+		if n < 15 {
+			return i, n, nil
+		}
+		for {
+			if i >= len(src) {
+				return i, 0, errLz4Format
+			}
+			c := src[i]
+			i++
+			n += int(c)
+			if c != 255 {
+				return i, n, nil
+			}
+		}
+	}
+
+	for i := 0; ; {
+		if i >= len(src) {
+			return nil, errLz4Format
+		}
+		token := src[i]
+		var n int
+		var err error
+		i, n, err = length(i+1, int(token>>4))
+		if err != nil || i+n > len(src) || len(dst)+n > limit {
+			return nil, errLz4Format
+		}
+		dst = append(dst, src[i:i+n]...)
+		i += n
+		if i == len(src) {
+			return dst, nil
+		}
+
+		if i+2 > len(src) {
+			return nil, errLz4Format
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i, n, err = length(i+2, int(token&15))
+		n += LZ4_MIN_MATCH
+		if err != nil || offset == 0 || offset > len(dst) || len(dst)+n > limit {
+			return nil, errLz4Format
+		}
+		from := len(dst) - offset
+		for k := 0; k < n; k++ {
+			dst = append(dst, dst[from+k])
+		}
+	}
+}
@@ -0,0 +1,77 @@
+//go:build !nolz4
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+func TestXXH32(t *testing.T) {
+	for _, test := range []struct {
+		data string
+		want uint32
+	}{
+		{"", 0x02CC5D05},
+		{"a", 0x550D7456},
+		{"abc", 0x32D153FF},
+		{"Nobody inspects the spammish repetition", 0xE2293B2F},
+	} {
+		h := newXXH32()
+		// split writes must not change the result
+		for i := 0; i < len(test.data); i += 7 {
+			end := i + 7
+			if end > len(test.data) {
+				end = len(test.data)
+			}
+			h.Write([]byte(test.data[i:end]))
+		}
+		if got := h.Sum32(); got != test.want {
+			t.Errorf("xxh32(%q) = %x, want %x", test.data, got, test.want)
+		}
+	}
+}
+
+// Test that lz4 frames round-trip, linked or not and with block checksums,
+// decode with the reference lz4, and that corruption is caught
+func TestLz4Frame(t *testing.T) {
+	format = "lz4"
+	defer func() { format = "gzip"; independent = false; lz4BlockChecksum = false }()
+
+	random := make([]byte, BLOCK_SIZE+100)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 8000)
+	data := append(append(append([]byte{}, text...), random...), text...)
+
+	for _, options := range []struct{ independent, checksum bool }{{false, false}, {true, false}, {false, true}} {
+		independent, lz4BlockChecksum = options.independent, options.checksum
+		for _, input := range [][]byte{data, {}} {
+			var frame bytes.Buffer
+			if err := compressStream(bytes.NewReader(input), &frame); err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			if err := lz4Decompress(bytes.NewReader(frame.Bytes()), &got); err != nil || !bytes.Equal(got.Bytes(), input) {
+				t.Errorf("%+v, %d bytes: %v", options, len(input), err)
+			}
+
+			if lz4, err := exec.LookPath("lz4"); err == nil {
+				cmd := exec.Command(lz4, "-dc")
+				cmd.Stdin = bytes.NewReader(frame.Bytes())
+				if out, err := cmd.Output(); err != nil || !bytes.Equal(out, input) {
+					t.Errorf("%+v, %d bytes: lz4: %v", options, len(input), err)
+				}
+			}
+
+			if len(input) > 0 {
+				corrupt := append([]byte{}, frame.Bytes()...)
+				corrupt[frame.Len()/2] ^= 0x10
+				if err := lz4Decompress(bytes.NewReader(corrupt), &bytes.Buffer{}); err == nil {
+					t.Errorf("%+v: corrupt frame decoded", options)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,484 @@
+//go:build !noxz
+
+package main
+
+// LZMA/LZMA2 encoder backing the xz output format.
+//
+// Only the subset of LZMA needed to produce valid, reasonably compact streams
+// is implemented: literals (plain and matched), new matches found with a hash
+// chain over the block, and rep0 matches. Properties are fixed at the xz
+// defaults of lc=3, lp=0, pb=2.
+
+const (
+	lzmaLC = 3
+	lzmaLP = 0
+	lzmaPB = 2
+
+	lzmaNumStates         = 12
+	lzmaMatchMinLen       = 2
+	lzmaMatchMaxLen       = 273
+	lzmaNumLenToPosStates = 4
+	lzmaNumAlignBits      = 4
+	lzmaEndPosModelIndex  = 14
+	lzmaNumFullDistances  = 1 << (lzmaEndPosModelIndex >> 1)
+	lzmaProbInit          = 1 << 10
+
+	// LZMA2 chunk limits
+	lzma2MaxUncompressed = 1 << 21
+	lzma2MaxCompressed   = 1 << 16
+
+	lzmaHashBits = 16
+)
+
+// lzmaProps is the lc/lp/pb properties byte written in LZMA2 chunk headers.
+const lzmaProps = (lzmaPB*5+lzmaLP)*9 + lzmaLC
+
+// rangeEncoder is the binary arithmetic coder used by LZMA.
+type rangeEncoder struct {
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+	out       []byte
+}
+
+func (e *rangeEncoder) reset() {
+	e.low = 0
+	e.rng = 0xFFFFFFFF
+	e.cache = 0
+	e.cacheSize = 1
+	e.out = e.out[:0]
+}
+
+// pending returns an upper bound on the bytes the encoder has produced so far.
+func (e *rangeEncoder) pending() int {
+	return len(e.out) + e.cacheSize + 4
+}
+
+func (e *rangeEncoder) shiftLow() {
+	if uint32(e.low) < 0xFF000000 || e.low>>32 != 0 {
+		carry := byte(e.low >> 32)
+		temp := e.cache
+		for {
+			e.out = append(e.out, temp+carry)
+			temp = 0xFF
+			e.cacheSize--
+			if e.cacheSize == 0 {
+				break
+			}
+		}
+		e.cache = byte(uint32(e.low) >> 24)
+	}
+	e.cacheSize++
+	e.low = uint64(uint32(e.low) << 8)
+}
+
+func (e *rangeEncoder) encodeBit(prob *uint16, bit uint32) {
+	bound := (e.rng >> 11) * uint32(*prob)
+	if bit == 0 {
+		e.rng = bound
+		*prob += (1<<11 - *prob) >> 5
+	} else {
+		e.low += uint64(bound)
+		e.rng -= bound
+		*prob -= *prob >> 5
+	}
+	for e.rng < 1<<24 {
+		e.rng <<= 8
+		e.shiftLow()
+	}
+}
+
+func (e *rangeEncoder) encodeDirect(value uint32, numBits uint) {
+	for i := numBits; i > 0; i-- {
+		e.rng >>= 1
+		if (value>>(i-1))&1 == 1 {
+			e.low += uint64(e.rng)
+		}
+		for e.rng < 1<<24 {
+			e.rng <<= 8
+			e.shiftLow()
+		}
+	}
+}
+
+func (e *rangeEncoder) encodeTree(probs []uint16, numBits uint, symbol uint32) {
+	m := uint32(1)
+	for i := numBits; i > 0; i-- {
+		bit := (symbol >> (i - 1)) & 1
+		e.encodeBit(&probs[m], bit)
+		m = m<<1 | bit
+	}
+}
+
+func (e *rangeEncoder) encodeReverseTree(probs []uint16, numBits uint, symbol uint32) {
+	m := uint32(1)
+	for i := uint(0); i < numBits; i++ {
+		bit := symbol & 1
+		symbol >>= 1
+		e.encodeBit(&probs[m], bit)
+		m = m<<1 | bit
+	}
+}
+
+func (e *rangeEncoder) flush() {
+	for i := 0; i < 5; i++ {
+		e.shiftLow()
+	}
+}
+
+type lzmaLenEncoder struct {
+	choice  uint16
+	choice2 uint16
+	low     [1 << lzmaPB][8]uint16
+	mid     [1 << lzmaPB][8]uint16
+	high    [256]uint16
+}
+
+func (l *lzmaLenEncoder) reset() {
+	l.choice = lzmaProbInit
+	l.choice2 = lzmaProbInit
+	for i := range l.low {
+		resetProbs(l.low[i][:])
+		resetProbs(l.mid[i][:])
+	}
+	resetProbs(l.high[:])
+}
+
+// encode writes length-lzmaMatchMinLen.
+func (l *lzmaLenEncoder) encode(rc *rangeEncoder, length uint32, posState uint32) {
+	switch {
+	case length < 8:
+		rc.encodeBit(&l.choice, 0)
+		rc.encodeTree(l.low[posState][:], 3, length)
+	case length < 16:
+		rc.encodeBit(&l.choice, 1)
+		rc.encodeBit(&l.choice2, 0)
+		rc.encodeTree(l.mid[posState][:], 3, length-8)
+	default:
+		rc.encodeBit(&l.choice, 1)
+		rc.encodeBit(&l.choice2, 1)
+		rc.encodeTree(l.high[:], 8, length-16)
+	}
+}
+
+func resetProbs(probs []uint16) {
+	for i := range probs {
+		probs[i] = lzmaProbInit
+	}
+}
+
+// lzmaEncoder holds the adaptive model and match finder for a single block.
+type lzmaEncoder struct {
+	rc rangeEncoder
+
+	state uint32
+	reps  [4]uint32
+
+	isMatch     [lzmaNumStates][1 << lzmaPB]uint16
+	isRep       [lzmaNumStates]uint16
+	isRepG0     [lzmaNumStates]uint16
+	isRep0Long  [lzmaNumStates][1 << lzmaPB]uint16
+	posSlot     [lzmaNumLenToPosStates][1 << 6]uint16
+	posEncoders [lzmaNumFullDistances - lzmaEndPosModelIndex + 1]uint16
+	align       [1 << lzmaNumAlignBits]uint16
+	literal     [0x300 << (lzmaLC + lzmaLP)]uint16
+	lenEnc      lzmaLenEncoder
+	repLenEnc   lzmaLenEncoder
+
+	// hash chain match finder over the block being encoded
+	data     []byte
+	head     []int32
+	prev     []int32
+	inserted int
+	depth    int
+	niceLen  int
+}
+
+func newLZMAEncoder(data []byte, level int) *lzmaEncoder {
+	e := &lzmaEncoder{
+		data: data,
+		head: make([]int32, 1<<lzmaHashBits),
+		prev: make([]int32, len(data)),
+	}
+	for i := range e.head {
+		e.head[i] = -1
+	}
+	e.depth, e.niceLen = lzmaMatchParams(level)
+	e.resetState()
+	return e
+}
+
+// lzmaMatchParams maps a compression level to hash chain depth and the match
+// length at which searching stops early.
+func lzmaMatchParams(level int) (depth, niceLen int) {
+	switch {
+	case level <= 1:
+		return 4, 16
+	case level <= 3:
+		return 8, 32
+	case level <= 6:
+		return 32, 64
+	default:
+		return 128, lzmaMatchMaxLen
+	}
+}
+
+func (e *lzmaEncoder) resetState() {
+	e.state = 0
+	e.reps = [4]uint32{}
+	for i := range e.isMatch {
+		resetProbs(e.isMatch[i][:])
+		resetProbs(e.isRep0Long[i][:])
+	}
+	resetProbs(e.isRep[:])
+	resetProbs(e.isRepG0[:])
+	for i := range e.posSlot {
+		resetProbs(e.posSlot[i][:])
+	}
+	resetProbs(e.posEncoders[:])
+	resetProbs(e.align[:])
+	resetProbs(e.literal[:])
+	e.lenEnc.reset()
+	e.repLenEnc.reset()
+}
+
+func lzmaHash(b []byte) uint32 {
+	return (uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])) * 2654435761 >> (32 - lzmaHashBits)
+}
+
+// insertUpTo adds every position before pos to the hash chains.
+func (e *lzmaEncoder) insertUpTo(pos int) {
+	for ; e.inserted < pos; e.inserted++ {
+		if e.inserted+3 > len(e.data) {
+			continue
+		}
+		h := lzmaHash(e.data[e.inserted:])
+		e.prev[e.inserted] = e.head[h]
+		e.head[h] = int32(e.inserted)
+	}
+}
+
+func (e *lzmaEncoder) matchLen(a, b, max int) int {
+	n := 0
+	for n < max && e.data[a+n] == e.data[b+n] {
+		n++
+	}
+	return n
+}
+
+// findMatch returns the longest match for pos found in the hash chains.
+func (e *lzmaEncoder) findMatch(pos, maxLen int) (length, dist int) {
+	if maxLen < 3 {
+		return 0, 0
+	}
+	cand := e.head[lzmaHash(e.data[pos:])]
+	for depth := e.depth; cand >= 0 && depth > 0; depth-- {
+		c := int(cand)
+		if length == 0 || e.data[c+length] == e.data[pos+length] {
+			if n := e.matchLen(c, pos, maxLen); n > length {
+				length, dist = n, pos-c
+				if n >= e.niceLen || n == maxLen {
+					break
+				}
+			}
+		}
+		cand = e.prev[c]
+	}
+	return length, dist
+}
+
+// encodeNext encodes the symbol at pos, never extending past limit, and
+// returns the number of bytes consumed.
+func (e *lzmaEncoder) encodeNext(pos, limit int) int {
+	e.insertUpTo(pos)
+	posState := uint32(pos) & (1<<lzmaPB - 1)
+
+	maxLen := limit - pos
+	if maxLen > lzmaMatchMaxLen {
+		maxLen = lzmaMatchMaxLen
+	}
+
+	if maxLen >= lzmaMatchMinLen {
+		repLen := 0
+		if rep := pos - int(e.reps[0]) - 1; rep >= 0 {
+			repLen = e.matchLen(rep, pos, maxLen)
+		}
+		length, dist := e.findMatch(pos, maxLen)
+
+		if repLen >= lzmaMatchMinLen && repLen+1 >= length {
+			e.encodeRep0(uint32(repLen), posState)
+			return repLen
+		}
+		if length > 3 || (length == 3 && dist < 1<<12) {
+			e.encodeMatch(uint32(dist-1), uint32(length), posState)
+			return length
+		}
+	}
+
+	e.encodeLiteral(pos, posState)
+	return 1
+}
+
+func (e *lzmaEncoder) encodeLiteral(pos int, posState uint32) {
+	e.rc.encodeBit(&e.isMatch[e.state][posState], 0)
+
+	var prevByte byte
+	if pos > 0 {
+		prevByte = e.data[pos-1]
+	}
+	probs := e.literal[0x300*uint32(prevByte>>(8-lzmaLC)):]
+	symbol := uint32(e.data[pos]) | 0x100
+
+	if e.state < 7 {
+		e.rc.encodeTree(probs, 8, uint32(e.data[pos]))
+	} else {
+		matchByte := uint32(e.data[pos-int(e.reps[0])-1])
+		offs := uint32(0x100)
+		for symbol < 0x10000 {
+			matchByte <<= 1
+			e.rc.encodeBit(&probs[offs+(matchByte&offs)+(symbol>>8)], (symbol>>7)&1)
+			symbol <<= 1
+			offs &= ^(matchByte ^ symbol)
+		}
+	}
+
+	switch {
+	case e.state < 4:
+		e.state = 0
+	case e.state < 10:
+		e.state -= 3
+	default:
+		e.state -= 6
+	}
+}
+
+func (e *lzmaEncoder) encodeMatch(dist, length, posState uint32) {
+	e.rc.encodeBit(&e.isMatch[e.state][posState], 1)
+	e.rc.encodeBit(&e.isRep[e.state], 0)
+	e.lenEnc.encode(&e.rc, length-lzmaMatchMinLen, posState)
+
+	lenState := length - lzmaMatchMinLen
+	if lenState >= lzmaNumLenToPosStates {
+		lenState = lzmaNumLenToPosStates - 1
+	}
+
+	slot := lzmaPosSlot(dist)
+	e.rc.encodeTree(e.posSlot[lenState][:], 6, slot)
+	if slot >= 4 {
+		footerBits := uint(slot>>1) - 1
+		base := (2 | slot&1) << footerBits
+		reduced := dist - base
+		if slot < lzmaEndPosModelIndex {
+			// The reference encoder indexes this tree from base-slot-1 with
+			// the node index starting at 1; posEncoders has one extra slot so
+			// that offset stays in range.
+			e.rc.encodeReverseTree(e.posEncoders[base-slot:], footerBits, reduced)
+		} else {
+			e.rc.encodeDirect(reduced>>lzmaNumAlignBits, footerBits-lzmaNumAlignBits)
+			e.rc.encodeReverseTree(e.align[:], lzmaNumAlignBits, reduced&(1<<lzmaNumAlignBits-1))
+		}
+	}
+
+	e.reps = [4]uint32{dist, e.reps[0], e.reps[1], e.reps[2]}
+	if e.state < 7 {
+		e.state = 7
+	} else {
+		e.state = 10
+	}
+}
+
+func (e *lzmaEncoder) encodeRep0(length, posState uint32) {
+	e.rc.encodeBit(&e.isMatch[e.state][posState], 1)
+	e.rc.encodeBit(&e.isRep[e.state], 1)
+	e.rc.encodeBit(&e.isRepG0[e.state], 0)
+	e.rc.encodeBit(&e.isRep0Long[e.state][posState], 1)
+	e.repLenEnc.encode(&e.rc, length-lzmaMatchMinLen, posState)
+
+	if e.state < 7 {
+		e.state = 8
+	} else {
+		e.state = 11
+	}
+}
+
+func lzmaPosSlot(dist uint32) uint32 {
+	if dist < 4 {
+		return dist
+	}
+	n := uint32(31)
+	for dist>>n == 0 {
+		n--
+	}
+	return n<<1 | (dist>>(n-1))&1
+}
+
+// lzma2Encode compresses data as a complete LZMA2 stream, including the end
+// marker. The dictionary is reset at the start so the result can be decoded
+// independently of any other block.
+func lzma2Encode(data []byte, level int) []byte {
+	e := newLZMAEncoder(data, level)
+
+	var out []byte
+	needDictReset, needProps, needStateReset := true, true, true
+
+	for pos := 0; pos < len(data); {
+		start := pos
+		limit := start + lzma2MaxUncompressed
+		if limit > len(data) {
+			limit = len(data)
+		}
+
+		e.rc.reset()
+		if needStateReset {
+			e.resetState()
+		}
+		for pos < limit && e.rc.pending() < lzma2MaxCompressed-64 {
+			pos += e.encodeNext(pos, limit)
+		}
+		e.rc.flush()
+
+		uncompressed := pos - start
+		compressed := e.rc.out
+		if len(compressed) > lzma2MaxCompressed || len(compressed) >= uncompressed {
+			// Not worth it: store the data in uncompressed chunks. The model
+			// was updated while trying, so the next LZMA chunk resets it.
+			for s := start; s < pos; s += lzma2MaxCompressed {
+				end := s + lzma2MaxCompressed
+				if end > pos {
+					end = pos
+				}
+				control := byte(0x02)
+				if needDictReset {
+					control = 0x01
+					needDictReset = false
+				}
+				out = append(out, control, byte((end-s-1)>>8), byte(end-s-1))
+				out = append(out, data[s:end]...)
+			}
+			needStateReset = true
+			continue
+		}
+
+		control := byte(0x80)
+		switch {
+		case needDictReset:
+			control |= 3 << 5
+		case needProps:
+			control |= 2 << 5
+		case needStateReset:
+			control |= 1 << 5
+		}
+		control |= byte((uncompressed - 1) >> 16)
+		out = append(out, control,
+			byte((uncompressed-1)>>8), byte(uncompressed-1),
+			byte((len(compressed)-1)>>8), byte(len(compressed)-1))
+		if needProps {
+			out = append(out, lzmaProps)
+		}
+		out = append(out, compressed...)
+		needDictReset, needProps, needStateReset = false, false, false
+	}
+
+	return append(out, 0x00)
+}
@@ -2,45 +2,132 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"compress/flate"
 	"encoding/binary"
 	"flag"
 	"hash"
+	"hash/adler32"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
 	"strconv"
-	"sync"
+	"strings"
+
+	"github.com/aaron-seo/gopigz/m/pgzip"
 )
 
 // Declaration of global constants
 const (
-	BLOCK_SIZE   = 128 * 1024 // 128 KiB
+	BLOCK_SIZE   = 128 * 1024 // 128 KiB, the default -b
 	DICT_SIZE    = 32 * 1024  // 32 KiB
 	TRAILER_SIZE = 8
 	SUM_SIZE     = 8 // 8 bytes
 )
 
+// gzip header flags
+const (
+	FHCRC    = 1 << 1
+	FEXTRA   = 1 << 2
+	FNAME    = 1 << 3
+	FCOMMENT = 1 << 4
+)
+
 // Parsing processes flag
 var processes int
 
+// Parsing format flag
+var format string
+
+// Parsing dict flag
+var dictPath string
+var dictionary []byte
+
 func init() {
 	var (
 		defaultProcesses = runtime.NumCPU()
+		defaultWalkers   = 4
 		usage            = "Specify number of goroutines to use for compression"
 	)
 	flag.IntVar(&processes, "processes", defaultProcesses, usage)
 	flag.IntVar(&processes, "p", defaultProcesses, usage)
+
+	flag.StringVar(&format, "format", "gzip", "Specify output format (gzip, zlib, deflate, bgzf, xz, zstd, bzip2, lz4, brotli, zip)")
+	flag.StringVar(&format, "codec", "gzip", "Same as --format")
+	flag.BoolVar(&independent, "independent", false, "Compress blocks independently, for damage recovery and parallel decompression")
+	flag.BoolVar(&independent, "i", false, "Compress blocks independently, for damage recovery and parallel decompression")
+	flag.BoolVar(&deterministic, "deterministic", false, "Produce the same compressed bytes for the same input whatever -p and the timing")
+	flag.BoolVar(&blake3Tree, "blake3", false, "Write the BLAKE3 hash of every block of the input next to compressed files (.b3), for gopigz b3verify")
+	flag.StringVar(&encryptSpec, "encrypt", "", "Encrypt the compressed output with AES-256-GCM: aes:KEYFILE")
+	flag.StringVar(&decryptSpec, "decrypt", "", "Decrypt the input before decompressing: aes:KEYFILE")
+	flag.Var(&memberEvery, "member-every", "Start a new gzip member every SIZE bytes of input (e.g. 16M) and write an index of them")
+	flag.StringVar(&dictPath, "dict", "", "Specify a preset dictionary file (zlib, deflate and zstd formats)")
+	flag.Var(&memoryLimit, "memory", "Hold compression to SIZE of memory, refusing if a block does not fit; with -d, the largest zstd window accepted (default 128M)")
+
+	flag.StringVar(&customSuffix, "suffix", "", "Use this suffix for compressed files instead of the format's (.gz, .zz, .deflate, .xz, .zst, .bz2, .lz4, .br, .zip)")
+	flag.StringVar(&customSuffix, "S", "", "Use this suffix for compressed files instead of the format's (.gz, .zz, .deflate, .xz, .zst, .bz2, .lz4, .br, .zip)")
+	flag.BoolVar(&decompress, "decompress", false, "Decompress")
+	flag.BoolVar(&decompress, "d", false, "Decompress")
+	flag.BoolVar(&mux, "mux", false, "Compress the files into one multiplexed stream on standard output, or with -d split one up")
+	flag.StringVar(&rangeSpec, "range", "", "With -d and an http(s) URL, decompress only uncompressed bytes START-END")
+	flag.BoolVar(&keepBroken, "keep-broken", false, "Keep partial output when decompression fails")
+	flag.BoolVar(&keep, "keep", false, "Keep (don't delete) input files")
+	flag.BoolVar(&keep, "k", false, "Keep (don't delete) input files")
+	flag.BoolVar(&force, "force", false, "Overwrite outputs, compress files with multiple links or a compressed suffix, and write to a terminal")
+	flag.BoolVar(&force, "f", false, "Overwrite outputs, compress files with multiple links or a compressed suffix, and write to a terminal")
+	flag.IntVar(&retryChanged, "retry-changed", 0, "Recompress files that change while being compressed up to N times")
+	flag.BoolVar(&mmapOutputs, "mmap", false, "Write compressed files through a memory mapping instead of write calls")
+	flag.BoolVar(&mmapInputs, "mmap-input", false, "Compress regular files from a memory mapping instead of read calls")
+	flag.BoolVar(&directIO, "direct", false, "Read and write files with O_DIRECT, bypassing the page cache")
+	flag.BoolVar(&lockInputs, "lock", false, "Hold a shared advisory lock on each input while compressing it")
+	flag.StringVar(&outputDir, "output-dir", "", "Write outputs to the same places under this directory instead of next to the inputs, keeping the inputs")
+	flag.BoolVar(&recursive, "recursive", false, "Compress or decompress the contents of directories")
+	flag.BoolVar(&recursive, "r", false, "Compress or decompress the contents of directories")
+	flag.IntVar(&walkers, "walkers", defaultWalkers, "Specify number of goroutines scanning directories in -r")
+	flag.StringVar(&skipExtensions, "skip-ext", DEFAULT_SKIP_EXTENSIONS, "Comma-separated extensions that -r leaves uncompressed")
+	flag.BoolVar(&compressAnyway, "compress-anyway", false, "Compress files in -r even if their extension is in --skip-ext")
+	flag.StringVar(&outputTarget, "output", "", "Write to this file or URL (http, https, s3, gs, az, ssh, sftp) instead of standard output, keeping the inputs")
+	flag.BoolVar(&toStdout, "stdout", false, "Write to standard output, keeping the inputs; several compressed files form a multi-member stream")
+	flag.BoolVar(&toStdout, "c", false, "Write to standard output, keeping the inputs; several compressed files form a multi-member stream")
+	flag.StringVar(&outputMethod, "method", "PUT", "HTTP method for uploads to an --output URL (PUT or POST)")
+	flag.Var(&outputHeaders, "header", "Add a \"Name: value\" header to uploads (repeatable)")
+	flag.Var((*retriesFlag)(&retries), "retries", "Retry failed transfers to network outputs up to `N` times, with exponential backoff; HTTP PUT, ssh and sftp uploads need --spool")
+	flag.BoolVar(&spoolUploads, "spool", false, "Keep a copy of HTTP PUT, ssh and sftp uploads in $TMPDIR, so that --retries can send them again")
+	flag.StringVar(&outputUser, "user", "", "Authenticate uploads with HTTP basic auth as name:password")
+	flag.StringVar(&configPath, "config", "", "Read profiles from this file instead of the user config directory")
+	flag.StringVar(&profileName, "profile", "", "Apply the settings of a named profile from the config file")
+	flag.BoolVar(&showProgress, "progress", false, "Show the progress of each file on standard error")
+	flag.DurationVar(&progressInterval, "progress-interval", PROGRESS_INTERVAL, "Print a progress line this often when standard error is not a terminal or CI is set")
+	flag.IntVar(&progressFd, "progress-fd", 0, "Write JSON progress events to this file descriptor")
+	flag.BoolVar(&statsLine, "stats-line", false, "End every run with a key=value throughput line on standard error")
+	flag.BoolVar(&jsonOutput, "json", false, "Print the end-of-run summary as JSON")
+	flag.StringVar(&statePath, "state", "", "Remember compressed files in this database and skip them in later runs unless they changed")
+	flag.Float64Var(&minRatio, "min-ratio", -1, "Leave files unchanged unless compression saves at least this percentage; with --zip, store them uncompressed")
+	flag.Var(skipIfLargerFlag{}, "skip-if-larger", "Leave files unchanged, or store them with --zip, if compression does not make them smaller (--min-ratio 0)")
+}
+
+// skipIfLargerFlag is a boolean flag that sets minRatio to 0.
+type skipIfLargerFlag struct{}
+
+func (skipIfLargerFlag) IsBoolFlag() bool { return true }
+func (skipIfLargerFlag) String() string   { return "false" }
+func (skipIfLargerFlag) Set(s string) error {
+	if s == "true" {
+		minRatio = 0
+	}
+	return nil
 }
 
 // checksum globals
 var checksum hash.Hash32
 var checksumChan chan []byte
+var checksumDone chan struct{}
 var nTotalBytes uint32
 
+// gzip FEXTRA field for the stream being written
+var headerExtra []byte
+
 // This implementation of concurrent compression utilizes the pipelined,
 // fan-out, fan-in concurrency pattern as described in
 // https://go.dev/blog/pipelines
@@ -50,77 +137,356 @@ var nTotalBytes uint32
 // (3) Write stage
 func main() {
 	flag.Parse()
+	if err := setupProfile(); err != nil {
+		log.Fatal(err)
+	}
+	openProgress()
+	openDisplay()
+	watchJobControl()
+
+	switch flag.Arg(0) {
+	case "crc32", "adler32":
+		runChecksum(flag.Arg(0), flag.Args()[1:])
+	case "daemon":
+		runDaemon(flag.Args()[1:])
+	case "ctl":
+		runCtl(flag.Args()[1:])
+	case "train":
+		runTrain(flag.Args()[1:])
+	case "info":
+		runInfo(flag.Args()[1:])
+	case "send":
+		runSend(flag.Args()[1:])
+	case "recv":
+		runRecv(flag.Args()[1:])
+	case "rezip":
+		runRezip(flag.Args()[1:])
+	case "analyze":
+		runAnalyze(flag.Args()[1:])
+	case "b3verify":
+		runB3Verify(flag.Args()[1:])
+	}
 
-	// Checksum (CRC32-IEEE polynomial)
-	checksumChan = make(chan []byte)
-	go func() {
-		checksum = crc32.NewIEEE()
-		for data := range checksumChan {
-			checksum.Write(data)
-			log.Println("wrote checksum")
+	if err := checkFormat(format); err != nil {
+		log.Fatal(err)
+	}
+
+	if dictPath != "" {
+		if c := lookupCodec(format); format != "zlib" && (c == nil || !c.dictionary) {
+			log.Fatalf("--dict is not supported with the %s format", format)
 		}
-		close(checksumChan)
-	}()
+		data, err := ioutil.ReadFile(dictPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the file may be laid out as a dictionary of any codec compiled in
+		dictionary = data
+		for _, name := range pgzip.Codecs() {
+			if c := lookupCodec(name); c != nil && c.loadDictionary != nil {
+				if dictionary, err = c.loadDictionary(dictionary); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+
+	for _, check := range optionChecks {
+		if err := check(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if directIO {
+		if O_DIRECT == 0 {
+			log.Fatal(errDirectUnsupported)
+		}
+		if mmapOutputs || mmapInputs {
+			log.Fatal("--direct and --mmap or --mmap-input cannot be combined")
+		}
+	}
+	if strings.ContainsAny(customSuffix, `/\`) {
+		log.Fatalf("invalid suffix %q", customSuffix)
+	}
+	if listContents {
+		runList(flag.Args())
+	}
+	if testIntegrity {
+		runTest(flag.Args())
+	}
+	if !decompress {
+		if err := checkMemory(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	r := read()
+	if mux {
+		runMux(flag.Args())
+	}
 
-	c := compress(r)
+	if extractTar {
+		runExtract(flag.Args())
+	}
+
+	if tarMode {
+		runTar(flag.Args())
+	}
+
+	if decompress && rangeSpec != "" {
+		runRanges(flag.Args())
+	}
+
+	if toStdout {
+		if outputTarget != "" {
+			log.Fatal("-c and --output cannot be combined")
+		}
+		if !decompress && !force && isTerminal(os.Stdout) {
+			log.Fatal("compressed data not written to a terminal -- use -f to force")
+		}
+		outputTarget = STDOUT_TARGET
+	}
+	if outputTarget != "" {
+		writeToOutput(flag.Args())
+		exitRun()
+	}
 
-	//writeHeader()
-	for output := range c {
-		write(output)
+	// Checksum (CRC32-IEEE polynomial, or Adler-32 for zlib)
+	if decompress {
+		if flag.NArg() == 0 {
+			in, out, count := countStreams(os.Stdin, os.Stdout)
+			if err := decompressStream(in, out); err != nil {
+				exitIfBrokenPipe(err)
+				log.Fatal(err)
+			}
+			count()
+		}
+		for _, path := range flag.Args() {
+			processPath(path)
+		}
+		if flag.NArg() > 1 || recursive {
+			printSummary()
+		}
+		exitRun()
 	}
-	writeTrailer()
 
-	/*
-		compressOutbounds := make([]<-chan *block, processes)
-		for p := 0; p < processes; p++ {
-			compressOutbounds[p] = compress(r)
+	if statePath != "" {
+		if err := loadState(); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		for c := range mergeSlice(compressOutbounds) {
-			write(c)
+	if flag.NArg() == 0 {
+		if !force && isTerminal(os.Stdout) {
+			log.Fatal("compressed data not written to a terminal -- use -f to force")
+		}
+		in, out, count := countStreams(os.Stdin, os.Stdout)
+		if err := compressStream(in, out); err != nil {
+			exitIfBrokenPipe(err)
+			log.Fatal(err)
 		}
-	*/
+		count()
+	}
+	for _, path := range flag.Args() {
+		processPath(path)
+	}
+	saveStateOrWarn()
+	if flag.NArg() > 1 || recursive {
+		printSummary()
+	}
+	exitRun()
 }
 
-// Read stage
-func read() <-chan *block {
-	out := make(chan *block)
+// compressStream runs the pipeline over a single input, writing one complete
+// compressed stream to output.
+func compressStream(input io.Reader, output io.Writer) error {
+	// encryption is the last stage, after the write stage
+	var sealer *encryptWriter
+	if encryptKey != nil {
+		var err error
+		if sealer, err = newEncryptWriter(output, encryptKey); err != nil {
+			return err
+		}
+		output = sealer
+	}
 
-	go func() {
-		// Start reading input from Stdin in byte array buffers with BLOCK_SIZE
-		inputBuffer := make([]byte, BLOCK_SIZE, BLOCK_SIZE)
+	// Checksum (CRC32-IEEE polynomial, Adler-32 for zlib, or the codec's)
+	streamCodec := lookupCodec(format)
+	switch {
+	case streamCodec != nil:
+		checksum = streamCodec.newChecksum()
+	case format == "zlib":
+		checksum = newAdlerCombiner()
+	default:
+		checksum = newCRCCombiner()
+	}
+	nTotalBytes, inputCRC = 0, 0
+	headerExtra = append([]byte(nil), extraFields...)
+	if format == "gzip" && independent && len(headerExtra)+8 <= MAX_EXTRA_SIZE {
+		headerExtra = append(headerExtra, independentSubfield(blockSize)...)
+	}
+	resetMembers()
+	b3Blocks, b3Size = nil, 0
+	accessPoints, indexSize = nil, 0
+	if streamCodec != nil && streamCodec.start != nil {
+		streamCodec.start()
+	}
+
+	// Skip reading the holes of sparse inputs and record where they are.
+	// Members are cut at input offsets, so they need the holes.
+	if f, ok := input.(*os.File); ok && format == "gzip" && memberInterval() == 0 && !deterministic {
+		var m *sparseMap
+		if input, m = openSparse(f); m != nil {
+			if data := m.encode(); len(headerExtra)+4+len(data) <= MAX_EXTRA_SIZE {
+				headerExtra = appendSubfield(headerExtra, SPARSE_SI1, SPARSE_SI2, data)
+			}
+		}
+	}
+	if f, ok := input.(*os.File); ok && mmapInputs {
+		m, err := mapInput(f)
+		if err != nil {
+			log.Printf("%s: %v -- reading without mmap", f.Name(), err)
+		} else if m != nil {
+			defer m.Close()
+			input = m
+		}
+	}
+
+	// CRC-32 and Adler-32 are combined in the write stage instead
+	checksumDone = make(chan struct{})
+	if combinedChecksum() {
+		close(checksumDone)
+	} else {
+		checksumChan = make(chan []byte)
+		go func() {
+			for data := range checksumChan {
+				checksum.Write(data)
+				debugln("wrote checksum")
+			}
+			close(checksumDone)
+		}()
+	}
+
+	// a failed write stops the read stage, and the blocks in flight drain
+	stop := make(chan struct{})
+	r := read(input, stop)
+
+	c := compress(r)
 
-		var numBlocks int
+	w := bufio.NewWriter(output)
+	writeHeader(w)
+	var err error
+	var prev *block // written, its input the window of the block after it
+	for b := range c {
+		if err == nil {
+			if err = write(w, b); err != nil {
+				close(stop)
+			}
+		}
+		blockDone()
+		releaseBlock(prev)
+		prev = b
+	}
+	releaseBlock(prev)
+	<-checksumDone
+	checksumChan = nil
+	if err != nil {
+		return err
+	}
+	writeTrailer(w)
 
-		reader := bufio.NewReader(os.Stdin)
-		numBytes, err := reader.Read(inputBuffer)
-		for err != io.EOF {
-			numBytes, err = reader.Read(inputBuffer)
+	if err := w.Flush(); err != nil || sealer == nil {
+		return err
+	}
+	return sealer.Close()
+}
+
+// Read stage. Reading ends early once stop, if not nil, is closed.
+func read(input io.Reader, stop <-chan struct{}) <-chan *block {
+	out := make(chan *block, queueDepth)
 
-			// check if readBuffer is the last block in the buffer
-			isLastBlock := false
-			_, err = reader.Peek(1)
-			if err == bufio.ErrNegativeCount {
-				isLastBlock = true
+	go func() {
+		reader := bufio.NewReader(input)
+		mapped, _ := input.(*mappedInput)
+
+		// Start reading input in byte array buffers of blockSize.
+		// Every block gets its own buffer from the pool since it is still in
+		// flight in the later stages while the next one is being read. A
+		// mapped input needs none: its blocks are slices of the mapping.
+		var carry []byte  // read past the rsync point ending the last block
+		var window []byte // the end of the input so far
+		limit := blocksInFlight()
+		for numBlocks := 1; ; numBlocks++ {
+			pausePoint(limit)
+			if stopped(stop) {
+				debugln("read stopped")
+				blockDone()
+				break
+			}
+			var inputBuffer []byte
+			var numBytes int
+			var isLastBlock bool
+			if mapped != nil {
+				inputBuffer = mapped.next(blockSize)
+				numBytes = len(inputBuffer)
+				isLastBlock = mapped.pos == len(mapped.data)
+			} else {
+				inputBuffer = getBuffer(blockSize)
+				held := copy(inputBuffer, carry)
+				var err error
+				numBytes, err = io.ReadFull(reader, inputBuffer[held:])
+				if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+					log.Fatal(err)
+				}
+				numBytes += held
+
+				// check if readBuffer is the last block in the buffer
+				isLastBlock = err != nil
+				if !isLastBlock {
+					if _, err := reader.Peek(1); err == io.EOF {
+						isLastBlock = true
+					}
+				}
 			}
 
-			numBlocks++
+			carry = nil
+			if rsyncable {
+				if cut := rsyncCut(inputBuffer[:numBytes]); cut < numBytes {
+					if mapped != nil {
+						mapped.pos -= numBytes - cut
+					} else {
+						carry = append(carry, inputBuffer[cut:numBytes]...)
+					}
+					numBytes = cut
+					isLastBlock = false
+				}
+			}
 
 			b := block{
 				Index:     numBlocks,
 				LastBlock: isLastBlock,
-				RawData:   inputBuffer,
+				RawData:   inputBuffer[:numBytes],
 				nRawBytes: numBytes,
+				window:    window,
+			}
+			if mapped == nil {
+				b.pooled = [][]byte{inputBuffer}
 			}
+			window = pgzip.AppendWindow(window, b.RawData)
 
 			// checksum
-			checksumChan <- inputBuffer
+			if checksumChan != nil {
+				checksumChan <- b.RawData
+			}
 			nTotalBytes += uint32(numBytes)
+			advanceProgress(int64(numBytes))
 
-			log.Println("read block#" + strconv.Itoa(b.Index))
+			debugln("read block#" + strconv.Itoa(b.Index))
 			out <- &b
+
+			if isLastBlock {
+				break
+			}
+		}
+		if checksumChan != nil {
+			close(checksumChan)
 		}
 		close(out)
 	}()
@@ -128,113 +494,231 @@ func read() <-chan *block {
 	return out
 }
 
-// Compress stage
-func compress(in <-chan *block) <-chan *block {
-	out := make(chan *block)
+// stopped reports whether stop is closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
 
+// Compress stage. Blocks are compressed by compressWorkers goroutines of
+// pgzip.Ordered, the pipeline of the library, and come out in the order
+// they went in, at most as many waiting for the ones before them as there
+// are workers.
+func compress(in <-chan *block) <-chan *block {
+	jobs := make(chan pgzip.Job)
 	go func() {
-
 		for b := range in {
-			var buffer bytes.Buffer
+			jobs <- b
+		}
+		close(jobs)
+	}()
 
-			flateWriter, err := flate.NewWriter(&buffer, flate.DefaultCompression)
-			if err != nil {
-				log.Fatal(err)
-			}
+	out := make(chan *block, queueDepth)
+	go func() {
+		for j := range pgzip.Ordered(jobs, compressWorkers(), 0) {
+			out <- j.(*block)
+		}
+		close(out)
+	}()
+	return out
+}
 
-			n, err := io.Copy(flateWriter, bytes.NewReader(b.RawData))
-			if err != nil {
-				log.Fatal(err)
-			}
+// Run compresses b, as a job of the compress stage.
+func (b *block) Run() {
+	compressBlock(b)
+	debugln("compressed block#" + strconv.Itoa(b.Index))
+}
 
-			if !b.LastBlock {
-				if err := flateWriter.Flush(); err != nil {
-					log.Fatal(err)
-				}
-			}
+// compressWorkers returns the number of goroutines compressing blocks: -p,
+// or one for codecs that need their blocks in order.
+func compressWorkers() int {
+	if c := lookupCodec(format); c != nil && c.sequential != nil && c.sequential() {
+		return 1
+	}
+	if processes < 1 {
+		return 1
+	}
+	return processes
+}
 
-			if err := flateWriter.Close(); err != nil {
-				log.Fatal(err)
-			}
+// compressBlock fills in the compressed data of b, and what the write stage
+// needs to know of it.
+func compressBlock(b *block) {
+	switch checksum.(type) {
+	case *crcCombiner:
+		b.sum = crc32.ChecksumIEEE(b.RawData)
+	case *adlerCombiner:
+		b.sum = adler32.Checksum(b.RawData)
+	}
+	if keepInputCRC() {
+		if _, ok := checksum.(*crcCombiner); ok {
+			b.crc = b.sum
+		} else {
+			b.crc = crc32.ChecksumIEEE(b.RawData)
+		}
+	}
+	if interval := memberInterval(); interval > 0 {
+		b.memberEnd = int64(b.Index)*int64(blockSize)%interval == 0
+		b.memberStart = int64(b.Index-1)*int64(blockSize)%interval == 0
+	}
+	if blake3Tree {
+		b.b3 = b3BlockOutput(b.RawData, int64(b.Index-1), int64(blockSize))
+	}
+	if c := lookupCodec(format); c != nil {
+		b.CompressedData = c.block(b)
+	} else {
+		b.CompressedData = deflateBlock(b)
+	}
+	b.nCompressedBytes = len(b.CompressedData)
+}
 
-			b.CompressedData = buffer.Bytes()
-			b.nCompressedBytes = int(n)
+// deflateBlock compresses a block into a piece of a deflate stream. Every
+// block but the last ends on a byte boundary with a sync flush, so the pieces
+// can be concatenated into a single stream. The first block is primed with
+// the preset dictionary, if any, and the others with the input before them
+// unless -i is given. With --member-every, the last block of every member
+// ends the stream too, and the next starts from an empty window.
+func deflateBlock(b *block) []byte {
+	dict := blockDictionary(b)
+	switch {
+	case rleStrategy:
+		return rleBlock(b, dict)
+	case level == ZOPFLI_LEVEL:
+		return zopfliEncoder(b, dict)
+	}
 
-			out <- b
-			log.Println("compressed block#" + strconv.Itoa(b.Index))
-		}
-		close(out)
-	}()
+	// room for incompressible data in stored blocks
+	out := getBuffer(len(b.RawData) + len(b.RawData)>>8 + 64)
+	b.pooled = append(b.pooled, out)
+	data, err := pgzip.DeflateBlock(out[:0], b.RawData, dict, level, b.LastBlock || b.memberEnd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return data
+}
 
-	return out
+// blockDictionary returns the data a deflate block may refer back to: the
+// preset dictionary for the first block, else the input before it unless
+// -i is given or it starts a member.
+func blockDictionary(b *block) []byte {
+	switch {
+	case b.Index == 1:
+		return dictionary
+	case !independent && !b.memberStart:
+		return b.window
+	}
+	return nil
 }
 
-func writeHeader() {
-	w := bufio.NewWriter(os.Stdout)
+func writeHeader(w *bufio.Writer) {
+	if c := lookupCodec(format); c != nil {
+		w.Write(c.header())
+		debugln("wrote header")
+		return
+	}
+	if format == "zlib" {
+		w.Write(zlibHeader(level, dictionary))
+		debugln("wrote header")
+		return
+	}
 
 	headerBytes := make([]byte, 10)
 	headerBytes[0] = 0x1f
 	headerBytes[1] = 0x8b
 	headerBytes[2] = 0x08
 	headerBytes[3] = 0x00
-	headerBytes[4] = 0x00
-	headerBytes[5] = 0x00
-	headerBytes[6] = 0x00
-	headerBytes[7] = 0x00
-	headerBytes[8] = 0x00
-	headerBytes[9] = 0x03
+	binary.LittleEndian.PutUint32(headerBytes[4:8], headerMtime())
+	headerBytes[8] = gzipXFL()
+	headerBytes[9] = gzipOS()
+
+	if len(headerExtra) > 0 {
+		headerBytes[3] |= FEXTRA
+		xlen := make([]byte, 2)
+		binary.LittleEndian.PutUint16(xlen, uint16(len(headerExtra)))
+		headerBytes = append(headerBytes, xlen...)
+		headerBytes = append(headerBytes, headerExtra...)
+	}
+	if name := headerName(); name != nil {
+		headerBytes[3] |= FNAME
+		headerBytes = append(headerBytes, name...)
+	}
+	if headerComment != "" {
+		headerBytes[3] |= FCOMMENT
+		headerBytes = append(headerBytes, latin1Field(headerComment)...)
+	}
+	headerBytes = appendHeaderCRC(headerBytes)
 
 	w.Write(headerBytes)
-	log.Println("wrote header")
+	outOffset += int64(len(headerBytes))
+	debugln("wrote header")
+}
+
+// appendSubfield appends an FEXTRA subfield with ID si1, si2 to extra.
+func appendSubfield(extra []byte, si1, si2 byte, data []byte) []byte {
+	extra = append(extra, si1, si2, byte(len(data)), byte(len(data)>>8))
+	return append(extra, data...)
 }
 
-func writeTrailer() {
-	w := bufio.NewWriter(os.Stdout)
+func writeTrailer(w *bufio.Writer) {
+	if c := lookupCodec(format); c != nil {
+		w.Write(c.trailer(checksum.Sum32()))
+		debugln("wrote trailer")
+		return
+	}
+	if format == "zlib" {
+		w.Write(zlibTrailer(checksum.Sum32()))
+		debugln("wrote trailer")
+		return
+	}
 
+	// a member's trailer is written while the read stage still counts the
+	// input, so it only takes what the write stage keeps
+	var sum, size uint32
+	if memberIndex != nil {
+		sum, size = memberSum, uint32(memberSize)
+	} else {
+		sum, size = checksum.Sum32(), nTotalBytes
+	}
 	trailerBuf := make([]byte, TRAILER_SIZE)
 	le := binary.LittleEndian
-	le.PutUint32(trailerBuf[:4], checksum.Sum32())
-	le.PutUint32(trailerBuf[4:8], nTotalBytes)
+	le.PutUint32(trailerBuf[:4], sum)
+	le.PutUint32(trailerBuf[4:8], size)
 	w.Write(trailerBuf)
-	log.Println("wrote trailer")
-
-	w.Flush()
+	debugln("wrote trailer")
 }
 
 // Write stage
-func write(b *block) {
-	w := bufio.NewWriter(os.Stdout)
-	w.Write(b.CompressedData)
-
-	log.Println("wrote block#" + strconv.Itoa(b.Index))
-}
-
-// mergeList fans-in slice of results from the compress goroutines into the write stage
-func mergeSlice(compressOutbounds []<-chan *block) <-chan *block {
-	log.Println("merging")
-
-	var wg sync.WaitGroup
-	out := make(chan *block)
-
-	wg.Add(len(compressOutbounds))
-	for i := 0; i < len(compressOutbounds); i++ {
-		go func() {
-			for b := range compressOutbounds[i] {
-				out <- b
-			}
-			wg.Done()
-		}()
+func write(w *bufio.Writer, b *block) error {
+	if writeIndexFile {
+		addToIndex(b)
+	}
+	if _, err := w.Write(b.CompressedData); err != nil {
+		return err
+	}
+	if c := lookupCodec(format); c != nil && c.wrote != nil {
+		c.wrote(b)
+	}
+	switch c := checksum.(type) {
+	case *crcCombiner:
+		c.add(b.sum, len(b.RawData))
+	case *adlerCombiner:
+		c.add(b.sum, len(b.RawData))
+	}
+	if keepInputCRC() {
+		inputCRC = pgzip.CombineCRC32(inputCRC, b.crc, int64(len(b.RawData)))
+	}
+	if memberIndex != nil {
+		addToMember(w, b)
+	}
+	if blake3Tree {
+		addToB3Tree(b)
 	}
 
-	go func() {
-		wg.Wait()
-		close(out)
-	}()
-
-	return out
-}
-
-func merge(cs ...<-chan *block) <-chan *block {
+	debugln("wrote block#" + strconv.Itoa(b.Index))
 	return nil
 }
 
@@ -246,4 +730,22 @@ type block struct {
 	nRawBytes        int
 	nCompressedBytes int
 	Err              error
+
+	// set by the compress stage for the codec's write stage hook
+	meta interface{}
+
+	// set by the compress stage
+	sum         uint32 // CRC-32 of RawData, Adler-32 for zlib, if combined
+	crc         uint32 // CRC-32 of RawData, with --state and --min-ratio
+	memberEnd   bool   // last block of a gzip member
+	memberStart bool   // first block of a gzip member
+
+	// set by the read stage: the end of the input before the block
+	window []byte
+
+	// set by the compress stage with --blake3
+	b3 b3Output
+
+	// buffers from the pool the block owns, given back by the write stage
+	pooled [][]byte
 }
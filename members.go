@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/aaron-seo/gopigz/m/pgzip"
+)
+
+// Member-per-interval output (--member-every SIZE).
+//
+// The gzip output is split into independent members, a new one starting
+// every SIZE bytes of input (rounded up to whole blocks). A reader can then
+// start decompressing at any member, so an HTTP server or CDN can answer a
+// range request by inflating only the members covering it. The offsets of
+// the members are written next to the output in the bgzip .gzi format,
+// which -d --range reads.
+
+// Parsing member-every flag
+var memberEvery sizeFlag
+
+const GZI_SUFFIX = ".gzi"
+
+// sizeFlag is a byte count with an optional K, M or G (binary) suffix.
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeFlag) Set(v string) error {
+	n, err := parseSize(v)
+	if err != nil {
+		return err
+	}
+	*s = sizeFlag(n)
+	return nil
+}
+
+func parseSize(v string) (int64, error) {
+	if v == "" {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	shift := uint(0)
+	switch strings.ToUpper(v[len(v)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	digits := v
+	if shift > 0 {
+		digits = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)>>shift {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return n << shift, nil
+}
+
+// memberInterval returns the number of input bytes per member, or 0 if the
+// output is a single member.
+func memberInterval() int64 {
+	if memberEvery <= 0 || format != "gzip" {
+		return 0
+	}
+	blocks := (int64(memberEvery) + int64(blockSize) - 1) / int64(blockSize)
+	return blocks * int64(blockSize)
+}
+
+// member state of the stream being written
+var memberSum uint32
+var memberSize int64
+var outOffset int64
+var memberIndex []memberOffset
+
+func resetMembers() {
+	memberSum, memberSize, outOffset = 0, 0, 0
+	memberIndex = nil
+	if memberInterval() > 0 {
+		memberIndex = []memberOffset{{0, 0}}
+	}
+}
+
+// addToMember accounts for block b in the current member and, if b ends it
+// but not the stream, closes it and starts the next one.
+func addToMember(w *bufio.Writer, b *block) {
+	memberSum = pgzip.CombineCRC32(memberSum, b.sum, int64(len(b.RawData)))
+	memberSize += int64(len(b.RawData))
+	outOffset += int64(len(b.CompressedData))
+	if !b.memberEnd || b.LastBlock {
+		return
+	}
+
+	uncompressed := memberIndex[len(memberIndex)-1].uncompressed + memberSize
+	writeTrailer(w)
+	outOffset += TRAILER_SIZE
+	memberSum, memberSize = 0, 0
+
+	memberIndex = append(memberIndex, memberOffset{outOffset, uncompressed})
+	writeHeader(w)
+}
+
+// writeGzi writes memberIndex to path in the bgzip .gzi format: the number
+// of entries and the compressed and uncompressed offset of every member but
+// the first, as little-endian uint64s.
+func writeGzi(path string) error {
+	buf := make([]byte, 0, 8+16*len(memberIndex))
+	buf = appendUint64(buf, uint64(len(memberIndex)-1))
+	for _, m := range memberIndex[1:] {
+		buf = appendUint64(buf, uint64(m.compressed))
+		buf = appendUint64(buf, uint64(m.uncompressed))
+	}
+	return ioutil.WriteFile(path, buf, 0644)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"4096", 4096, true},
+		{"16M", 16 << 20, true},
+		{"2k", 2048, true},
+		{"1G", 1 << 30, true},
+		{"", 0, false},
+		{"M", 0, false},
+		{"-1K", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseSize(test.s)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseSize(%q) = %d, %v", test.s, got, err)
+		}
+	}
+}
+
+// Test that every indexed member can be decompressed on its own, locally
+// and through a range request
+func TestMemberEvery(t *testing.T) {
+	memberEvery = 300 * 1024 // rounded up to 3 blocks
+	defer func() { memberEvery = 0 }()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data")
+	var data []byte
+	for i := 0; len(data) < 1000000; i++ {
+		data = append(data, byte(i%251), byte(i%13))
+	}
+	ioutil.WriteFile(path, data, 0644)
+
+	keep = true
+	defer func() { keep = false }()
+	compressFile(path)
+
+	gz, err := ioutil.ReadFile(path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path + ".gz.gzi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := readGzi(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 3 || index[1].uncompressed != 3*BLOCK_SIZE {
+		t.Fatalf("index %v", index)
+	}
+	for i, m := range index {
+		r, err := gzip.NewReader(bytes.NewReader(gz[m.compressed:]))
+		if err != nil {
+			t.Fatalf("member %d: %v", i, err)
+		}
+		r.Multistream(false)
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("member %d: %v", i, err)
+		}
+		if !bytes.Equal(got, data[m.uncompressed:m.uncompressed+int64(len(got))]) {
+			t.Errorf("member %d differs from the input", i)
+		}
+	}
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+	var out bytes.Buffer
+	if err := decompressRange(srv.URL+"/data.gz", 500000, 500099, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data[500000:500100]) {
+		t.Errorf("range request returned the wrong data")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import "fmt"
+
+// Memory accounting (--memory SIZE).
+//
+// Most of the memory gopigz uses goes to the blocks in flight and to the
+// match finders' windows. The windows are fixed by the options, so before
+// compressing they are estimated and compared with --memory along with a
+// single block, and a --long window too large for the machine is refused up
+// front instead of ending in the OOM killer. The blocks in flight are then
+// held to what is left: the read stage waits for blocks to be written
+// before reading more, so a fast input and a slow output cannot fill memory
+// between them. When decompressing, --memory is the largest zstd window
+// accepted.
+
+// Parsing memory flag
+var memoryLimit sizeFlag
+
+// Blocks held by the pipeline at a time besides the compress stage's, raw
+// and compressed: one being read, one being written and one being summed.
+// Every compress worker holds one more, as many can wait to be written, and
+// --queue-depth more on either side of the compress stage.
+const PIPELINE_BLOCKS = 3
+
+// compressMemory estimates the memory compression needs with the options
+// given.
+func compressMemory() int64 {
+	return int64(PIPELINE_BLOCKS+2*compressWorkers()+2*queueDepth)*blockMemory() + fixedMemory()
+}
+
+// blockMemory returns the memory a block in flight holds, raw and
+// compressed.
+func blockMemory() int64 {
+	return 2 * int64(blockSize)
+}
+
+// fixedMemory estimates the memory compression needs besides the blocks.
+func fixedMemory() int64 {
+	need := int64(len(dictionary))
+	if c := lookupCodec(format); c != nil && c.memory != nil {
+		need += c.memory()
+	}
+	return need
+}
+
+// checkMemory fails if compressing a block at a time would need more than
+// --memory.
+func checkMemory() error {
+	if memoryLimit <= 0 {
+		return nil
+	}
+	if need := fixedMemory() + blockMemory(); need > int64(memoryLimit) {
+		return fmt.Errorf("compression needs at least %s of memory, more than --memory %s",
+			formatSize(need), formatSize(int64(memoryLimit)))
+	}
+	return nil
+}
+
+// blocksInFlight returns how many blocks the pipeline may hold under
+// --memory, at least one, or 0 for no limit.
+func blocksInFlight() int {
+	if memoryLimit <= 0 {
+		return 0
+	}
+	n := (int64(memoryLimit) - fixedMemory()) / blockMemory()
+	if n < 1 {
+		return 1
+	}
+	return int(n)
+}
+
+// formatSize prints n bytes with a binary unit.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dG", n>>30)
+	case n >= 1<<20:
+		return fmt.Sprintf("%.0fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.0fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d", n)
+}
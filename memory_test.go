@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// slowWriter takes its time over every write and records the most blocks
+// in flight it saw.
+type slowWriter struct {
+	bytes.Buffer
+	most int
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	pauseMu.Lock()
+	if inFlight > w.most {
+		w.most = inFlight
+	}
+	pauseMu.Unlock()
+	return w.Buffer.Write(p)
+}
+
+// Test that --memory holds the blocks in flight to what fits, however slow
+// the output, and that the stream is whole
+func TestMemoryLimit(t *testing.T) {
+	saved := processes
+	defer func() { processes, memoryLimit = saved, 0 }()
+	processes = 4
+
+	if blocksInFlight() != 0 {
+		t.Errorf("%d blocks in flight with no --memory", blocksInFlight())
+	}
+	memoryLimit = sizeFlag(3 * blockMemory())
+	if n := blocksInFlight(); n != 3 {
+		t.Errorf("%d blocks in flight in %d bytes", n, memoryLimit)
+	}
+	memoryLimit = 1
+	if err := checkMemory(); err == nil {
+		t.Errorf("a block fit in 1 byte")
+	}
+
+	memoryLimit = sizeFlag(2 * blockMemory())
+	data := make([]byte, 20*BLOCK_SIZE)
+	rand.New(rand.NewSource(3)).Read(data)
+	out := &slowWriter{}
+	if err := compressStream(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.most > 2 {
+		t.Errorf("%d blocks in flight, limit 2", out.most)
+	}
+	zr, err := gzip.NewReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes: %v", len(got), err)
+	}
+}
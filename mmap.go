@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Memory-mapped output (--mmap).
+//
+// The compressed size of a file is close to its input size at most, so the
+// output file can be sized up front and mapped, and the write stage copies
+// compressed blocks straight into the page cache without a write(2) per
+// block. Should the estimate fall short, the file is extended and mapped
+// again; on close it is truncated to what was written. Where mapping is not
+// supported, or fails, the output is written as usual.
+//
+// The mapped file is sized with ftruncate, which reserves no disk space: if
+// the disk fills up while the pages are flushed the process gets SIGBUS
+// instead of a write error, so --mmap is best kept to outputs with room.
+//
+// Memory-mapped input (--mmap-input).
+//
+// A regular file given to compress can be mapped instead of read: the read
+// stage then cuts blocks straight out of the mapping, and the workers
+// compress from the page cache with no read(2) per block and no copy into
+// a buffer of the pipeline. The mapping is made after the holes of a sparse
+// file are looked for, which need the file read around them, so sparse
+// files are read as usual. A file cut short while it is mapped gets the
+// process SIGBUS, so --mmap-input is best kept to files nothing else
+// writes; --lock helps with cooperating writers.
+
+// Parsing mmap flags
+var mmapOutputs bool
+var mmapInputs bool
+
+// Slack added to the input size when sizing the mapping, for headers,
+// trailers and stored blocks
+const MMAP_SLACK = 64 * 1024
+
+var errMmapUnsupported = errors.New("memory mapping is not supported on this platform")
+
+// mmapWriter writes into a memory mapping of a file.
+type mmapWriter struct {
+	f    *os.File
+	data []byte // the mapping
+	n    int    // bytes written
+}
+
+// newMmapWriter maps f, sized for the compressed form of inSize bytes. f
+// must be open for reading and writing.
+func newMmapWriter(f *os.File, inSize int64) (*mmapWriter, error) {
+	w := &mmapWriter{f: f}
+	size := inSize + inSize/64 + MMAP_SLACK
+	if int64(int(size)) != size {
+		return nil, errors.New("output too large to map")
+	}
+	if err := w.grow(int(size)); err != nil {
+		f.Truncate(0)
+		return nil, err
+	}
+	return w, nil
+}
+
+// grow extends the file to size bytes and maps it again.
+func (w *mmapWriter) grow(size int) error {
+	if w.data != nil {
+		if err := munmap(w.data); err != nil {
+			return err
+		}
+		w.data = nil
+	}
+	if err := w.f.Truncate(int64(size)); err != nil {
+		return err
+	}
+	data, err := mmap(w.f, size)
+	if err != nil {
+		return err
+	}
+	w.data = data
+	return nil
+}
+
+func (w *mmapWriter) Write(p []byte) (int, error) {
+	if w.n+len(p) > len(w.data) {
+		size := 2 * len(w.data)
+		if size < w.n+len(p) {
+			size = w.n + len(p)
+		}
+		if err := w.grow(size); err != nil {
+			return 0, err
+		}
+	}
+	copy(w.data[w.n:], p)
+	w.n += len(p)
+	return len(p), nil
+}
+
+// Close unmaps the file and cuts it to the data written. It does not close
+// the file.
+func (w *mmapWriter) Close() error {
+	if w.data != nil {
+		if err := munmap(w.data); err != nil {
+			return err
+		}
+		w.data = nil
+	}
+	return w.f.Truncate(int64(w.n))
+}
+
+// mappedInput is a file mapped for reading, read by the read stage without
+// copying.
+type mappedInput struct {
+	data []byte // the mapping
+	pos  int    // bytes handed out
+}
+
+// mapInput maps the regular file f from its start, or returns nil and why
+// not. An empty file is not mapped.
+func mapInput(f *os.File) (*mappedInput, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return nil, nil
+	}
+	if int64(int(info.Size())) != info.Size() {
+		return nil, errors.New("input too large to map")
+	}
+	if offset, err := f.Seek(0, io.SeekCurrent); err != nil || offset != 0 {
+		return nil, nil
+	}
+	data, err := mmapRead(f, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	return &mappedInput{data: data}, nil
+}
+
+// next returns the next n bytes of the mapping or what is left of it.
+func (m *mappedInput) next(n int) []byte {
+	if n > len(m.data)-m.pos {
+		n = len(m.data) - m.pos
+	}
+	data := m.data[m.pos : m.pos+n]
+	m.pos += n
+	return data
+}
+
+// Read copies from the mapping, for readers other than the read stage.
+func (m *mappedInput) Read(p []byte) (int, error) {
+	if m.pos == len(m.data) {
+		return 0, io.EOF
+	}
+	return copy(p, m.next(len(p))), nil
+}
+
+// Close unmaps the file. Nothing may use the data read after.
+func (m *mappedInput) Close() error {
+	data := m.data
+	m.data, m.pos = nil, 0
+	return munmap(data)
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+const HAVE_MMAP = false
+
+// mmap is not supported on this platform; outputs are written as usual.
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+// mmapRead is not supported on this platform; inputs are read as usual.
+func mmapRead(f *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Multiplexed streams (--mux).
+//
+// gopigz --mux FILES... compresses several files at once and interleaves
+// them over standard output as frames; gopigz -d --mux reads such a pipe and
+// writes each file back out. One ssh connection can so carry many concurrent
+// transfers:
+//
+//	gopigz --mux a b c | ssh host 'cd dest && gopigz -d --mux'
+//
+// The stream starts with MUX_MAGIC. Every frame is a type byte, the stream
+// ID and the payload length as uvarints, and the payload. A stream is opened
+// with its name, carries gzip data and ends with a close frame, or an error
+// frame holding the sender's error message.
+
+// Parsing mux flag
+var mux bool
+
+var MUX_MAGIC = []byte("GPZMUX1\n")
+
+// Frame types
+const (
+	MUX_OPEN  = 'O'
+	MUX_DATA  = 'D'
+	MUX_CLOSE = 'C'
+	MUX_ERROR = 'E'
+)
+
+// Largest payload sent in one frame, and accepted in one
+const (
+	MUX_FRAME_SIZE = 64 * 1024
+	MUX_MAX_FRAME  = 1024 * 1024
+)
+
+// muxWriter writes frames from concurrent streams to one output.
+type muxWriter struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	err error
+}
+
+func (m *muxWriter) frame(typ byte, id uint64, payload []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	var head [1 + 2*binary.MaxVarintLen64]byte
+	head[0] = typ
+	n := 1 + binary.PutUvarint(head[1:], id)
+	n += binary.PutUvarint(head[n:], uint64(len(payload)))
+	if _, m.err = m.w.Write(head[:n]); m.err == nil {
+		_, m.err = m.w.Write(payload)
+	}
+	return m.err
+}
+
+// copy writes frames prepared elsewhere.
+func (m *muxWriter) copy(frames []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		_, m.err = m.w.Write(frames)
+	}
+	return m.err
+}
+
+// muxStream sends everything written to it as data frames of one stream.
+type muxStream struct {
+	m  *muxWriter
+	id uint64
+	n  int64
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	s.n += int64(len(p))
+	for i := 0; i < len(p); i += MUX_FRAME_SIZE {
+		end := i + MUX_FRAME_SIZE
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := s.m.frame(MUX_DATA, s.id, p[i:end]); err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+// muxSend compresses paths concurrently, processes at a time, at the level
+// given into one multiplexed stream on output. Frames are sent as they are
+// ready, unless --deterministic is given: then every stream is held in
+// memory until the ones before it are sent, so that the output does not
+// depend on timing.
+func muxSend(paths []string, output io.Writer) error {
+	m := &muxWriter{w: bufio.NewWriter(output)}
+	if _, err := m.w.Write(MUX_MAGIC); err != nil {
+		return err
+	}
+
+	slots := make(chan struct{}, compressWorkers())
+	var wg sync.WaitGroup
+	var statsMu sync.Mutex
+	var prev chan struct{} // closed once the previous stream is sent
+	for i, path := range paths {
+		wg.Add(1)
+		slots <- struct{}{}
+		turn, done := prev, make(chan struct{})
+		prev = done
+		go func(id uint64, path string) {
+			defer func() { <-slots; wg.Done() }()
+			// with --deterministic, streams are sent whole and in order
+			w := m
+			var frames bytes.Buffer
+			if deterministic {
+				w = &muxWriter{w: bufio.NewWriter(&frames)}
+			}
+			in, out, err := muxSendFile(w, id, path)
+			if err != nil {
+				w.frame(MUX_ERROR, id, []byte(err.Error()))
+			}
+			if deterministic {
+				w.w.Flush()
+				if turn != nil {
+					<-turn
+				}
+				m.copy(frames.Bytes())
+			}
+			close(done)
+
+			statsMu.Lock()
+			defer statsMu.Unlock()
+			if err != nil {
+				log.Println(err)
+				setError()
+				countFailed(path, err)
+				return
+			}
+			countProcessed(path, in, out)
+		}(uint64(i+1), path)
+	}
+	wg.Wait()
+
+	if m.err != nil {
+		return m.err
+	}
+	return m.w.Flush()
+}
+
+// muxSendFile sends path as stream id and returns its size before and after
+// compression.
+func muxSendFile(m *muxWriter, id uint64, path string) (int64, int64, error) {
+	acquireFds(1)
+	defer releaseFds(1)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	if err := m.frame(MUX_OPEN, id, []byte(filepath.ToSlash(path))); err != nil {
+		return 0, 0, err
+	}
+	stream := &muxStream{m: m, id: id}
+	gz, err := gzip.NewWriterLevel(stream, level)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := io.Copy(gz, f)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, 0, err
+	}
+	return n, stream.n, m.frame(MUX_CLOSE, id, nil)
+}
+
+// muxName turns a stream name into a relative path under the current
+// directory, refusing names that would escape it.
+func muxName(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) || clean == "." {
+		return "", fmt.Errorf("refusing to write stream %q outside the current directory", name)
+	}
+	return clean, nil
+}
+
+// muxReceiver is a stream being decompressed on the receiving end.
+type muxReceiver struct {
+	path string
+	pw   *io.PipeWriter
+	done chan error
+	in   int64
+	out  int64
+}
+
+func openMuxReceiver(name string) (*muxReceiver, error) {
+	path, err := muxName(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	out, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	r := &muxReceiver{path: path, pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := decompressStream(pr, out)
+		if offset, serr := out.Seek(0, io.SeekCurrent); serr == nil {
+			r.out = offset
+		}
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		// unblock the frame reader if decompression stopped early
+		pr.CloseWithError(err)
+		r.done <- err
+	}()
+	return r, nil
+}
+
+// fail stops the stream and removes its partial output.
+func (r *muxReceiver) fail(err error) {
+	r.pw.CloseWithError(err)
+	<-r.done
+	os.Remove(r.path)
+}
+
+// muxReceive demultiplexes input, decompressing every stream into a file
+// named after it.
+func muxReceive(input io.Reader) error {
+	in := bufio.NewReader(input)
+	magic := make([]byte, len(MUX_MAGIC))
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic) != string(MUX_MAGIC) {
+		return errors.New("input is not a multiplexed stream")
+	}
+
+	streams := make(map[uint64]*muxReceiver)
+	defer func() {
+		for _, r := range streams {
+			r.fail(io.ErrUnexpectedEOF)
+		}
+	}()
+
+	for {
+		typ, err := in.ReadByte()
+		if err == io.EOF {
+			if len(streams) > 0 {
+				return fmt.Errorf("multiplexed stream ended with %d stream(s) open", len(streams))
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id, err := binary.ReadUvarint(in)
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		length, err := binary.ReadUvarint(in)
+		if err != nil || length > MUX_MAX_FRAME {
+			return errors.New("corrupt multiplexed stream")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(in, payload); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		r := streams[id]
+		if typ != MUX_OPEN && r == nil {
+			continue // a stream that failed to open here
+		}
+		switch typ {
+		case MUX_OPEN:
+			if r != nil {
+				return fmt.Errorf("stream %d opened twice", id)
+			}
+			r, err := openMuxReceiver(string(payload))
+			if err != nil {
+				log.Println(err)
+				setError()
+				countFailed(string(payload), err)
+				continue
+			}
+			streams[id] = r
+		case MUX_DATA:
+			r.in += int64(len(payload))
+			if _, err := r.pw.Write(payload); err != nil {
+				// the decompression error is reported on close
+				r.pw.CloseWithError(err)
+			}
+		case MUX_CLOSE:
+			delete(streams, id)
+			r.pw.Close()
+			if err := <-r.done; err != nil {
+				log.Printf("%s: %v", r.path, err)
+				setError()
+				os.Remove(r.path)
+				countFailed(r.path, err)
+				continue
+			}
+			countProcessed(r.path, r.in, r.out)
+		case MUX_ERROR:
+			delete(streams, id)
+			err := errors.New(string(payload))
+			log.Printf("%s: sender failed: %v", r.path, err)
+			setError()
+			r.fail(err)
+			countFailed(r.path, err)
+		default:
+			return fmt.Errorf("unknown frame type %q", typ)
+		}
+	}
+}
+
+// runMux implements --mux, sending the files in paths or, with -d,
+// receiving from standard input.
+func runMux(paths []string) {
+	if format != "gzip" {
+		log.Fatal("--mux only supports the gzip format")
+	}
+	if !decompress && (level == ZOPFLI_LEVEL || rleStrategy) {
+		log.Fatal("--mux compresses at -0 to -9 and --huffman only")
+	}
+	var err error
+	if decompress {
+		err = muxReceive(os.Stdin)
+	} else {
+		err = muxSend(paths, os.Stdout)
+	}
+	if err != nil {
+		exitIfBrokenPipe(err)
+		log.Println(err)
+		setError()
+	}
+	printSummary()
+	exitRun()
+}
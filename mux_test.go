@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMuxName(t *testing.T) {
+	for _, name := range []string{"a", "dir/b", "./c", "dir/../d"} {
+		if _, err := muxName(name); err != nil {
+			t.Errorf("muxName(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"/etc/passwd", "../x", "dir/../../x", ".", ""} {
+		if _, err := muxName(name); err == nil {
+			t.Errorf("muxName(%q) accepted", name)
+		}
+	}
+}
+
+// Test sending several files, one of them missing, over one stream and
+// splitting them up again
+func TestMuxRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	files := map[string][]byte{
+		"one":       bytes.Repeat([]byte("first stream\n"), 30000),
+		"sub/two":   bytes.Repeat([]byte{0, 1, 2, 3}, 100000),
+		"three.txt": []byte("short"),
+	}
+	var paths []string
+	for name, data := range files {
+		path := filepath.Join(src, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, data, 0644)
+		paths = append(paths, name)
+	}
+	paths = append(paths, "missing")
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	defer func() { exitStatus = 0 }()
+
+	os.Chdir(src)
+	var pipe bytes.Buffer
+	if err := muxSend(paths, &pipe); err != nil {
+		t.Fatal(err)
+	}
+	if exitStatus != 1 {
+		t.Errorf("missing input not reported")
+	}
+
+	dst := t.TempDir()
+	os.Chdir(dst)
+	if err := muxReceive(bytes.NewReader(pipe.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: received %d bytes, %v", name, len(got), err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "missing")); !os.IsNotExist(err) {
+		t.Errorf("file created for a stream that failed to open")
+	}
+
+	// a truncated pipe leaves only complete files behind
+	dst = t.TempDir()
+	os.Chdir(dst)
+	if err := muxReceive(bytes.NewReader(pipe.Bytes()[:pipe.Len()/2])); err == nil {
+		t.Errorf("truncated stream accepted")
+	}
+	for name, data := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err == nil && !bytes.Equal(got, data) {
+			t.Errorf("partial file %s left behind", name)
+		}
+	}
+}
+
+// Test that streams are compressed at the level given, also with -p 0
+func TestMuxLevel(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "data"), bytes.Repeat([]byte("level me\n"), 20000), 0644)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	saved := processes
+	defer func() { processes, level = saved, flate.DefaultCompression }()
+	processes = 0
+	sizes := make(map[int]int)
+	for _, level = range []int{0, 9} {
+		var pipe bytes.Buffer
+		if err := muxSend([]string{"data"}, &pipe); err != nil {
+			t.Fatal(err)
+		}
+		sizes[level] = pipe.Len()
+	}
+	if sizes[9] >= sizes[0] {
+		t.Errorf("-9 sends %d bytes, -0 %d", sizes[9], sizes[0])
+	}
+}
+
+// Test that --deterministic gives the same bytes with any number of workers
+func TestDeterministic(t *testing.T) {
+	src := t.TempDir()
+	var paths []string
+	for i := 0; i < 12; i++ {
+		name := filepath.Join(src, string(rune('a'+i)))
+		// sizes vary so that streams finish out of order
+		ioutil.WriteFile(name, bytes.Repeat([]byte{byte(i), 'x', byte(i * 7)}, (12-i)*20000), 0644)
+		paths = append(paths, name)
+	}
+	deterministic = true
+	defer func(p int) { deterministic, processes = false, p }(processes)
+
+	var want []byte
+	for _, p := range []int{1, 3, 64} {
+		processes = p
+		var pipe bytes.Buffer
+		if err := muxSend(paths, &pipe); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadFile(paths[0])
+		var stream bytes.Buffer
+		if err := compressStream(bytes.NewReader(data), &stream); err != nil {
+			t.Fatal(err)
+		}
+		got := append(pipe.Bytes(), stream.Bytes()...)
+		if want == nil {
+			want = got
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("-p %d: output differs from -p 1", p)
+		}
+	}
+}
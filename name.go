@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+)
+
+// Original file name and time in gzip headers (-n, -N).
+//
+// When a named file is compressed to gzip, its base name goes in the FNAME
+// field of the header and its modification time in MTIME, as gzip does, so
+// that gzip -l and gunzip -N can show and restore them. FNAME is ISO 8859-1
+// and ends in a zero byte; characters outside it are written as '?'.
+// Standard input has neither, --deterministic leaves MTIME zero, and -n
+// (--no-name) leaves both out. When decompressing a file, -N (--name) gives
+// the output the time of the header; the last of -n and -N wins.
+
+// Parsing name flags
+var noName bool
+var restoreTime bool
+
+// modification time in the gzip header of the stream last decompressed,
+// zero if none
+var headerTime time.Time
+
+func init() {
+	flag.Var(nameFlag(false), "no-name", "Do not store the original file name and time in gzip headers, or restore the time")
+	flag.Var(nameFlag(false), "n", "Same as --no-name")
+	flag.Var(nameFlag(true), "name", "Give decompressed files the modification time stored in the gzip header")
+	flag.Var(nameFlag(true), "N", "Same as --name")
+}
+
+// nameFlag is a boolean flag that stores or restores the name and time, or
+// neither.
+type nameFlag bool
+
+func (nameFlag) IsBoolFlag() bool { return true }
+func (nameFlag) String() string   { return "false" }
+func (n nameFlag) Set(s string) error {
+	if s == "true" {
+		noName, restoreTime = !bool(n), bool(n)
+	}
+	return nil
+}
+
+// headerName returns the FNAME field of the stream being written, or nil for
+// none.
+func headerName() []byte {
+	if noName || inputInfo == nil {
+		return nil
+	}
+	return latin1Field(inputInfo.Name())
+}
+
+// latin1Field returns s as a zero-terminated ISO 8859-1 header field, with
+// '?' for the characters it lacks.
+func latin1Field(s string) []byte {
+	var field []byte
+	for _, r := range s {
+		if r == 0 || r > 0xff {
+			r = '?'
+		}
+		field = append(field, byte(r))
+	}
+	return append(field, 0)
+}
+
+// headerMtime returns the MTIME field of the stream being written: the
+// modification time of the input in seconds since 1970, or 0 for none.
+func headerMtime() uint32 {
+	if noName || deterministic || inputInfo == nil {
+		return 0
+	}
+	t := inputInfo.ModTime().Unix()
+	if t <= 0 || t > 0xffffffff {
+		return 0
+	}
+	return uint32(t)
+}
+
+// restoreHeaderTime gives path the time of the header last decompressed,
+// with -N.
+func restoreHeaderTime(path string) error {
+	if !restoreTime || headerTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(path, headerTime, headerTime)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that the name of the input goes in FNAME, in ISO 8859-1, and its
+// time in MTIME, unless -n is given
+func TestHeaderName(t *testing.T) {
+	data := []byte("named contents\n")
+	path := filepath.Join(t.TempDir(), "café €.txt")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2019, 8, 7, 6, 5, 4, 0, time.UTC)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if inputInfo, _ = os.Stat(path); inputInfo == nil {
+		t.Fatal("no input")
+	}
+	defer func() { inputInfo = nil }()
+
+	for _, test := range []struct {
+		noName bool
+		want   string
+	}{
+		{false, "café ?.txt"},
+		{true, ""},
+	} {
+		noName = test.noName
+		var out bytes.Buffer
+		if err := compressStream(bytes.NewReader(data), &out); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(zr)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("-n=%v: read %q: %v", test.noName, got, err)
+		}
+		if zr.Name != test.want {
+			t.Errorf("-n=%v: name %q, want %q", test.noName, zr.Name, test.want)
+		}
+		if zr.ModTime.Equal(modified) == test.noName {
+			t.Errorf("-n=%v: time %v", test.noName, zr.ModTime)
+		}
+	}
+	noName = false
+}
+
+// Test that -N gives decompressed files the time in the header, and that
+// they are left alone without it
+func TestRestoreHeaderTime(t *testing.T) {
+	defer func() { summary = runSummary{} }()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dated")
+	data := []byte("old news\n")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	compressFile(path)
+	gz, err := ioutil.ReadFile(path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { restoreTime = false }()
+
+	for _, restoreTime = range []bool{false, true} {
+		os.Remove(path)
+		if err := ioutil.WriteFile(path+".gz", gz, 0644); err != nil {
+			t.Fatal(err)
+		}
+		decompressFile(path + ".gz")
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ModTime().Equal(modified) != restoreTime {
+			t.Errorf("-N=%v: time %v", restoreTime, info.ModTime())
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"strconv"
+)
+
+// OS byte of gzip headers (--os).
+//
+// The OS field of the header names the file system the input came from,
+// which gzip uses to convert line ends and names on some systems. It is
+// that of the platform gopigz was built for, from RFC 1952's table, and
+// 255 (unknown) elsewhere. --os sets it instead, by number or name, so that
+// output made on one system matches that of another byte for byte; under
+// --deterministic it is 255 unless --os is given.
+
+// RFC 1952 operating system codes
+const (
+	OS_FAT     = 0
+	OS_UNIX    = 3
+	OS_MACOS   = 7
+	OS_NTFS    = 11
+	OS_UNKNOWN = 255
+)
+
+// the names --os takes
+var osNames = map[string]byte{
+	"fat":     OS_FAT,
+	"unix":    OS_UNIX,
+	"macos":   OS_MACOS,
+	"ntfs":    OS_NTFS,
+	"unknown": OS_UNKNOWN,
+}
+
+// Parsing os flag
+var headerOS = platformOS()
+var osSet bool
+
+func init() {
+	flag.Var((*osFlag)(&headerOS), "os", "Set the OS byte of gzip headers: 0-255, fat, unix, macos, ntfs or unknown")
+}
+
+// platformOS returns the OS byte of the platform, as gzip writes it there.
+func platformOS() byte {
+	switch runtime.GOOS {
+	case "windows":
+		return OS_NTFS
+	case "aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "linux", "netbsd", "openbsd", "solaris":
+		return OS_UNIX
+	}
+	return OS_UNKNOWN
+}
+
+// gzipOS returns the OS byte of the headers written.
+func gzipOS() byte {
+	if deterministic && !osSet {
+		return OS_UNKNOWN
+	}
+	return headerOS
+}
+
+// osFlag is the OS byte, by number or name.
+type osFlag byte
+
+func (o *osFlag) String() string { return strconv.Itoa(int(*o)) }
+
+func (o *osFlag) Set(s string) error {
+	if b, ok := osNames[s]; ok {
+		*o, osSet = osFlag(b), true
+		return nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return fmt.Errorf("unknown operating system %q", s)
+	}
+	*o, osSet = osFlag(n), true
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"testing"
+)
+
+// Test that --os takes numbers and names, and that headers carry it and the
+// XFL of the level
+func TestHeaderOSAndXFL(t *testing.T) {
+	saved, savedLevel := headerOS, level
+	defer func() { headerOS, level, osSet = saved, savedLevel, false }()
+
+	f := (*osFlag)(&headerOS)
+	for s, want := range map[string]byte{"ntfs": OS_NTFS, "19": 19, "unknown": OS_UNKNOWN} {
+		if err := f.Set(s); err != nil || headerOS != want {
+			t.Errorf("--os %s: %d, %v", s, headerOS, err)
+		}
+	}
+	for _, bad := range []string{"mars", "256", "-1"} {
+		if err := f.Set(bad); err == nil {
+			t.Errorf("--os %s accepted", bad)
+		}
+	}
+
+	headerOS = OS_NTFS
+	for _, test := range []struct {
+		level int
+		xfl   byte
+	}{
+		{flate.BestSpeed, 4},
+		{flate.DefaultCompression, 0},
+		{flate.BestCompression, 2},
+		{flate.HuffmanOnly, 4},
+	} {
+		level = test.level
+		var out bytes.Buffer
+		if err := compressStream(bytes.NewReader([]byte("system\n")), &out); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if zr.OS != OS_NTFS || out.Bytes()[8] != test.xfl {
+			t.Errorf("level %d: OS %d, XFL %d", test.level, zr.OS, out.Bytes()[8])
+		}
+	}
+}
+
+// Test that --deterministic writes 255 for the OS byte unless --os is given
+func TestDeterministicOS(t *testing.T) {
+	saved := headerOS
+	defer func() { headerOS, osSet, deterministic = saved, false, false }()
+	headerOS, deterministic = OS_NTFS, true
+
+	for _, test := range []struct {
+		set  bool
+		want byte
+	}{
+		{false, OS_UNKNOWN},
+		{true, OS_NTFS},
+	} {
+		osSet = test.set
+		var out bytes.Buffer
+		if err := compressStream(bytes.NewReader([]byte("anywhere\n")), &out); err != nil {
+			t.Fatal(err)
+		}
+		if got := out.Bytes()[9]; got != test.want {
+			t.Errorf("--os given %v: OS byte %d, want %d", test.set, got, test.want)
+		}
+	}
+}
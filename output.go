@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Output targets (--output TARGET).
+//
+// Instead of standard output, the result can be written to a local file or
+// streamed to an http:// or https:// URL with a chunked PUT (or POST), so
+// archives can be pushed straight to artifact stores and WebDAV servers
+// without a temporary file. -c is --output - : standard output, with the
+// inputs kept as for any other target.
+
+// Parsing output, stdout, method, header and user flags
+var outputTarget string
+var toStdout bool
+var outputMethod string
+var outputHeaders headerList
+var outputUser string
+
+// headerList collects repeated --header "Name: value" flags.
+type headerList []string
+
+func (h *headerList) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerList) Set(s string) error {
+	if !strings.Contains(s, ":") {
+		return fmt.Errorf("header %q is not in Name: value form", s)
+	}
+	*h = append(*h, s)
+	return nil
+}
+
+// outputSchemes maps URL schemes to the function opening such a target.
+// Storage backends add themselves in their init functions.
+var outputSchemes = map[string]func(u *url.URL) (io.WriteCloser, error){
+	"http":  openHTTPOutput,
+	"https": openHTTPOutput,
+}
+
+// STDOUT_TARGET is the --output target for standard output
+const STDOUT_TARGET = "-"
+
+// openOutput opens target for writing, dispatching on its URL scheme. A
+// scheme without a handler is an error rather than part of a file name, so
+// that a typo or a backend left out of the build does not leave a stray
+// local file behind; only targets without a scheme are local files.
+func openOutput(target string) (io.WriteCloser, error) {
+	if target == STDOUT_TARGET {
+		return stdoutOutput{os.Stdout}, nil
+	}
+	if u, err := url.Parse(target); err == nil && u.Scheme != "" && filepath.VolumeName(target) == "" {
+		open, ok := outputSchemes[u.Scheme]
+		if !ok {
+			return nil, fmt.Errorf("unsupported output scheme %q", u.Scheme)
+		}
+		return open(u)
+	}
+	// write only, so that a FIFO with no reader left breaks
+	return os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// stdoutOutput is standard output, which stays open after the run.
+type stdoutOutput struct {
+	io.Writer
+}
+
+func (stdoutOutput) Close() error { return nil }
+
+// contentType returns the media type of the data being written.
+func contentType() string {
+	switch {
+	case decompress, encryptKey != nil:
+		return "application/octet-stream"
+	case lookupCodec(format) != nil:
+		return lookupCodec(format).contentType
+	case format == "zlib":
+		return "application/zlib"
+	default:
+		return "application/gzip"
+	}
+}
+
+// httpOutput streams everything written to it as the body of a single
+// request. Close finishes the body and waits for the server's response.
+// A PUT that fails is sent again, from the spool and then on with the data
+// still to come.
+type httpOutput struct {
+	req   *http.Request // without the body
+	spool *spool        // nil unless failed requests are resent
+	retry backoff
+	pw    *io.PipeWriter
+	done  chan error
+}
+
+func openHTTPOutput(u *url.URL) (io.WriteCloser, error) {
+	method := strings.ToUpper(outputMethod)
+	if method != "PUT" && method != "POST" {
+		return nil, fmt.Errorf("unsupported upload method %q", outputMethod)
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// unknown length: the body is sent chunked
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", contentType())
+	for _, h := range outputHeaders {
+		i := strings.Index(h, ":")
+		req.Header.Set(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	if outputUser != "" {
+		i := strings.Index(outputUser, ":")
+		if i < 0 {
+			return nil, errors.New("--user must be given as name:password")
+		}
+		req.SetBasicAuth(outputUser[:i], outputUser[i+1:])
+	}
+
+	o := &httpOutput{req: req}
+	// POST is not idempotent: sending it twice could store the data twice
+	switch {
+	case method == "PUT":
+		if o.spool, err = uploadSpool("HTTP"); err != nil {
+			return nil, err
+		}
+	case retries > 0 && retriesSet:
+		return nil, errors.New("--retries cannot send POST uploads again")
+	}
+	o.start()
+	return o, nil
+}
+
+// start sends the request, its body being what is spooled and then what is
+// written to o.pw.
+func (o *httpOutput) start() {
+	pr, pw := io.Pipe()
+	req := o.req.Clone(o.req.Context())
+	req.Body = pr
+	if o.spool != nil && o.spool.size > 0 {
+		req.Body = ioutil.NopCloser(io.MultiReader(o.spool.from(0), pr))
+	}
+	o.pw = pw
+	o.done = make(chan error, 1)
+	go func() {
+		err := sendUpload(req)
+		// unblock writers if the request ended early
+		pr.CloseWithError(err)
+		o.done <- err
+	}()
+}
+
+func sendUpload(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(req.Method+" "+req.URL.Redacted(), resp)
+}
+
+// restart sends the request again after it failed with err, if it may.
+func (o *httpOutput) restart(err error) bool {
+	if o.spool == nil || !o.retry.retry("upload", err) {
+		return false
+	}
+	o.start()
+	return true
+}
+
+func (o *httpOutput) Write(p []byte) (int, error) {
+	for {
+		_, err := o.pw.Write(p)
+		if err == nil {
+			if o.spool != nil {
+				if _, err := o.spool.Write(p); err != nil {
+					return 0, err
+				}
+			}
+			return len(p), nil
+		}
+		// the request ended: find out why
+		if err = <-o.done; err == nil {
+			err = errors.New("upload finished early")
+		}
+		if !o.restart(err) {
+			return 0, err
+		}
+	}
+}
+
+func (o *httpOutput) Close() error {
+	if o.spool != nil {
+		defer o.spool.Close()
+	}
+	for {
+		o.pw.Close()
+		err := <-o.done
+		if err == nil || !o.restart(err) {
+			return err
+		}
+	}
+}
+
+// Abort fails the request instead of finishing it, so the server does not
+// store a truncated body.
+func (o *httpOutput) Abort(err error) {
+	o.pw.CloseWithError(err)
+	<-o.done
+	if o.spool != nil {
+		o.spool.Close()
+	}
+}
+
+// writeToOutput compresses or decompresses standard input, or every file in
+// paths in order, into the --output target. Like -c in gzip, the inputs are
+// kept and several compressed inputs form a multi-member stream. An input
+// that fails is reported and the rest are still written; only a failing
+// output ends the run. With -r, the files under a directory are written in
+// the order they are found.
+func writeToOutput(paths []string) {
+	out, err := openOutput(outputTarget)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sink := &outputSink{w: out}
+
+	process := compressStream
+	if decompress {
+		process = decompressStream
+	}
+
+	if len(paths) == 0 {
+		in, w, count := countStreams(os.Stdin, sink)
+		err = process(in, w)
+		count()
+	}
+	for _, path := range paths {
+		if sink.err != nil {
+			break
+		}
+		info, statErr := os.Stat(path)
+		if statErr != nil || !info.IsDir() {
+			writeInput(path, sink, process)
+			continue
+		}
+		if !recursive {
+			warnf("%s is a directory -- ignored", path)
+			continue
+		}
+		for entry := range walkTree(path) {
+			switch {
+			case sink.err != nil:
+				// drain the walk so its goroutines finish
+			case entry.err != nil:
+				log.Println(entry.err)
+				setError()
+			case !skipInRecursion(entry.path):
+				writeInput(entry.path, sink, process)
+			}
+		}
+	}
+	if sink.err != nil {
+		err = sink.err
+	}
+
+	if err != nil {
+		exitIfBrokenPipe(err)
+		log.Println(err)
+		setError()
+		if a, ok := out.(interface{ Abort(error) }); ok {
+			a.Abort(err)
+			return
+		}
+	}
+	if err := out.Close(); err != nil {
+		log.Println(err)
+		setError()
+	}
+}
+
+// writeInput appends the compressed or decompressed contents of path to
+// sink. A failure to open or read path is reported here; one writing to sink
+// is left in sink.err for writeToOutput.
+func writeInput(path string, sink *outputSink, process func(io.Reader, io.Writer) error) {
+	f, err := openInput(path)
+	if err != nil {
+		log.Println(err)
+		setError()
+		return
+	}
+	defer f.Close()
+
+	// The lock is released when f is closed.
+	if lockInputs {
+		if err := lockShared(f); err == errLocked {
+			warnf("%s: %v -- skipped", path, err)
+			return
+		} else if err != nil {
+			log.Println(err)
+			setError()
+			return
+		}
+	}
+
+	// the header names the file and carries its time, as it does when
+	// the file is compressed in place
+	inputInfo, _ = f.Stat()
+	in, w, count := countStreams(inputReader(f), sink)
+	err = process(in, w)
+	count()
+	inputInfo = nil
+	if err != nil && sink.err == nil {
+		log.Println(err)
+		setError()
+	}
+}
+
+// outputSink keeps the first error writing to the output, telling a broken
+// output from an input that could not be read.
+type outputSink struct {
+	w   io.Writer
+	err error
+}
+
+func (s *outputSink) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n, err := s.w.Write(p)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// outputFile returns the file w writes to, looking through an outputSink, so
+// that decompressing to a regular file can leave holes there.
+func outputFile(w io.Writer) (*os.File, bool) {
+	if s, ok := w.(*outputSink); ok {
+		w = s.w
+	}
+	f, ok := w.(*os.File)
+	return f, ok
+}
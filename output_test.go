@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test streaming compressed output to an HTTP server with a chunked PUT
+func TestHTTPOutput(t *testing.T) {
+	data := bytes.Repeat([]byte("upload me\n"), 50000)
+
+	var body []byte
+	var req *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	outputHeaders = headerList{"X-Archive: nightly"}
+	outputUser = "me:secret"
+	defer func() { outputHeaders, outputUser = nil, "" }()
+
+	out, err := openOutput(srv.URL + "/data.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compressStream(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Method != "PUT" || req.URL.Path != "/data.gz" {
+		t.Errorf("got %s %s", req.Method, req.URL.Path)
+	}
+	if len(req.TransferEncoding) == 0 || req.TransferEncoding[0] != "chunked" {
+		t.Errorf("body was not chunked: %v", req.TransferEncoding)
+	}
+	if req.Header.Get("X-Archive") != "nightly" || req.Header.Get("Content-Type") != "application/gzip" {
+		t.Errorf("headers %v", req.Header)
+	}
+	if user, pass, _ := req.BasicAuth(); user != "me" || pass != "secret" {
+		t.Errorf("basic auth %q:%q", user, pass)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(got, data) {
+		t.Errorf("uploaded data differs from input")
+	}
+}
+
+// Test that a rejected upload is reported as an error
+func TestHTTPOutputRejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	out, err := openOutput(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressStream(bytes.NewReader([]byte("data")), out)
+	if err := out.Close(); err == nil {
+		t.Errorf("403 response not reported")
+	}
+}
+
+// Test that a PUT failing with a server error is sent again in full with
+// --spool and fails without it, and that --retries needs --spool
+func TestHTTPOutputRetry(t *testing.T) {
+	defer func() { spoolUploads = false }()
+	data := make([]byte, 300000)
+	rand.Read(data)
+
+	var body []byte
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			io.CopyN(ioutil.Discard, r.Body, 1000)
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	out, err := openOutput(srv.URL + "/data.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressStream(bytes.NewReader(data), out)
+	if err := out.Close(); err == nil || attempts != 1 {
+		t.Errorf("%d attempts without --spool: %v", attempts, err)
+	}
+
+	// --retries given without --spool is refused, not ignored
+	retriesSet = true
+	_, err = openOutput(srv.URL + "/data.gz")
+	retriesSet = false
+	if err == nil || !strings.Contains(err.Error(), "--spool") {
+		t.Errorf("--retries without --spool: %v", err)
+	}
+
+	attempts = 0
+	spoolUploads = true
+	if out, err = openOutput(srv.URL + "/data.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressStream(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("%d attempts, want 2", attempts)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(got, data) {
+		t.Errorf("uploaded data differs from input")
+	}
+}
+
+// Test that -c writes the files as members of one stream to standard output,
+// each named in its header, and keeps them
+func TestStdoutOutput(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	ioutil.WriteFile(a, []byte("first file\n"), 0644)
+	ioutil.WriteFile(b, []byte("second file\n"), 0644)
+
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = stdout
+	outputTarget = STDOUT_TARGET
+	defer func() { os.Stdout, outputTarget = saved, "" }()
+
+	exitStatus = 0
+	writeToOutput([]string{a, b})
+	stdout.Seek(0, io.SeekStart)
+	br := bufio.NewReader(stdout)
+	r, err := gzip.NewReader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Multistream(false)
+	if r.Name != "a" {
+		t.Errorf("first member named %q", r.Name)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err == nil {
+		if err = r.Reset(br); err == nil && r.Name != "b" {
+			t.Errorf("second member named %q", r.Name)
+		}
+	}
+	if err == nil {
+		var rest []byte
+		r.Multistream(false)
+		rest, err = ioutil.ReadAll(r)
+		got = append(got, rest...)
+	}
+	if err != nil || string(got) != "first file\nsecond file\n" || exitStatus != 0 {
+		t.Errorf("got %q, %v, exit status %d", got, err, exitStatus)
+	}
+	if _, err := stdout.Write([]byte{}); err != nil {
+		t.Errorf("standard output closed: %v", err)
+	}
+	for _, path := range []string{a, b} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("input removed: %v", err)
+		}
+	}
+	stdout.Close()
+}
+
+// Test that -c goes on to the next file after one that fails, and that with
+// -r it writes the files under a directory
+func TestStdoutOutputContinues(t *testing.T) {
+	dir := t.TempDir()
+	good, bad := filepath.Join(dir, "good.gz"), filepath.Join(dir, "bad.gz")
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("good\n"))
+	zw.Close()
+	ioutil.WriteFile(good, buf.Bytes(), 0644)
+	ioutil.WriteFile(bad, []byte("not gzip data\n"), 0644)
+	tree := filepath.Join(dir, "tree")
+	os.MkdirAll(filepath.Join(tree, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(tree, "x"), []byte("x\n"), 0644)
+	ioutil.WriteFile(filepath.Join(tree, "sub", "y"), []byte("y\n"), 0644)
+
+	saved := os.Stdout
+	outputTarget = STDOUT_TARGET
+	defer func() { os.Stdout, outputTarget, decompress, recursive = saved, "", false, false }()
+	run := func(name string, paths ...string) []byte {
+		stdout, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stdout.Close()
+		os.Stdout = stdout
+		writeToOutput(paths)
+		data, err := ioutil.ReadFile(stdout.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	exitStatus, decompress = 0, true
+	if got := run("decompressed", bad, good); string(got) != "good\n" || exitStatus != 1 {
+		t.Errorf("-dc: got %q, exit status %d", got, exitStatus)
+	}
+
+	exitStatus, decompress, recursive = 0, false, true
+	zr, err := gzip.NewReader(bytes.NewReader(run("compressed", tree)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(zr)
+	if err != nil || (string(got) != "x\ny\n" && string(got) != "y\nx\n") || exitStatus != 0 {
+		t.Errorf("-cr: got %q, %v, exit status %d", got, err, exitStatus)
+	}
+}
+
+// Test that a target with a scheme nothing handles is refused rather than
+// created as a local file
+func TestOutputUnsupportedScheme(t *testing.T) {
+	dir := t.TempDir()
+	for _, target := range []string{"s4://bucket/out.gz", "ftp://host/out.gz", "mailto:root"} {
+		out, err := openOutput(target)
+		if err == nil {
+			out.Close()
+			t.Errorf("%s: opened", target)
+		} else if !strings.Contains(err.Error(), "unsupported output scheme") {
+			t.Errorf("%s: %v", target, err)
+		}
+	}
+	out, err := openOutput(filepath.Join(dir, "out.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+}
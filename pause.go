@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Job control (SIGTSTP and SIGCONT).
+//
+// On SIGTSTP the read stage stops taking new blocks, the blocks in flight
+// are compressed and written out, and only then does the process stop
+// itself, so nothing is half done while it is suspended. On SIGCONT reading
+// resumes, and the clocks the summary and the progress display measure
+// throughput with are moved forward by the time spent stopped, so that it
+// does not count against the throughput. With -v both are reported.
+
+// Longest wait for the blocks in flight before stopping anyway, for a read
+// stage blocked on its input
+const QUIESCE_TIMEOUT = 2 * time.Second
+
+var pauseMu sync.Mutex
+var pauseCond = sync.NewCond(&pauseMu)
+var paused bool
+var inFlight int // blocks read and not yet done with
+
+// pausePoint is passed by the read stage before every block; it waits while
+// paused, or while limit blocks, if not 0, are in flight.
+func pausePoint(limit int) {
+	pauseMu.Lock()
+	for paused || limit > 0 && inFlight >= limit {
+		pauseCond.Wait()
+	}
+	inFlight++
+	pauseMu.Unlock()
+}
+
+// waitIfPaused waits while paused, for readers outside the pipeline.
+func waitIfPaused() {
+	pauseMu.Lock()
+	for paused {
+		pauseCond.Wait()
+	}
+	pauseMu.Unlock()
+}
+
+// blockDone is called for every block that went past pausePoint once its
+// last stage is done with it.
+func blockDone() {
+	pauseMu.Lock()
+	inFlight--
+	pauseCond.Broadcast()
+	pauseMu.Unlock()
+}
+
+// quiesce pauses reading and waits for the blocks in flight, or for
+// QUIESCE_TIMEOUT.
+func quiesce() {
+	timer := time.AfterFunc(QUIESCE_TIMEOUT, func() {
+		pauseMu.Lock()
+		pauseCond.Broadcast()
+		pauseMu.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(QUIESCE_TIMEOUT)
+
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	paused = true
+	for inFlight > 0 && time.Now().Before(deadline) {
+		pauseCond.Wait()
+	}
+}
+
+// resume takes the time spent stopped off the clocks and lets reading go
+// on.
+func resume(stopped time.Duration) {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	startTime = startTime.Add(stopped)
+	displayStart = displayStart.Add(stopped)
+	displayShown = displayShown.Add(stopped)
+	paused = false
+	pauseCond.Broadcast()
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+const HAVE_JOB_CONTROL = false
+
+// watchJobControl does nothing where there is no job control.
+func watchJobControl() {}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Test that a pause waits for the blocks in flight and holds the read stage
+// until resumed, with the time stopped taken off the run's clock
+func TestPauseResume(t *testing.T) {
+	pausePoint(0)
+	done := make(chan struct{})
+	go func() {
+		quiesce()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("quiesced with a block in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	blockDone()
+	<-done
+
+	read := make(chan struct{})
+	go func() {
+		pausePoint(0)
+		close(read)
+	}()
+	select {
+	case <-read:
+		t.Fatal("read stage went on while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	started := startTime
+	defer func() { startTime = started }()
+	resume(time.Minute)
+	<-read
+	blockDone()
+	if startTime.Sub(started) != time.Minute {
+		t.Errorf("start time moved by %v, want a minute", startTime.Sub(started))
+	}
+}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const HAVE_JOB_CONTROL = true
+
+// watchJobControl handles SIGTSTP by quiescing before stopping.
+func watchJobControl() {
+	tstp := make(chan os.Signal, 1)
+	cont := make(chan os.Signal, 1)
+	signal.Notify(tstp, syscall.SIGTSTP)
+	signal.Notify(cont, syscall.SIGCONT)
+	go func() {
+		for range tstp {
+			quiesce()
+			verbosef("stopping")
+			// drop a SIGCONT that came before this stop
+			select {
+			case <-cont:
+			default:
+			}
+			stoppedAt := time.Now()
+			// SIGSTOP rather than raising SIGTSTP again: it cannot be
+			// ignored, so a SIGCONT is sure to follow
+			syscall.Kill(os.Getpid(), syscall.SIGSTOP)
+			<-cont
+			verbosef("continuing")
+			resume(time.Since(stoppedAt))
+		}
+	}()
+}
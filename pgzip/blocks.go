@@ -0,0 +1,121 @@
+package pgzip
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// The pieces of a gzip stream, for hosts that schedule the work themselves,
+// such as a browser spreading blocks over Web Workers: every block is
+// compressed on its own, and the stream is the header, the blocks in order
+// and the trailer, whose CRC-32 is combined from those of the blocks.
+
+// Header returns the gzip header gopigz writes: no flags, no time, Unix.
+func Header() []byte {
+	return []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 3}
+}
+
+// CompressBlock compresses data into a piece of a deflate stream. Pieces
+// other than the last end in a sync flush, so that they can be
+// concatenated.
+func CompressBlock(data []byte, level int, last bool) ([]byte, error) {
+	return DeflateBlock(nil, data, nil, level, last)
+}
+
+// DeflateBlock appends to dst the piece of a deflate stream that data
+// compresses to at level, its matches reaching back into window, the input
+// before it, if not nil. A piece that is not last ends in a sync flush, on
+// a byte boundary, so that the next one can follow it.
+func DeflateBlock(dst, data, window []byte, level int, last bool) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	var fw *flate.Writer
+	var err error
+	if window != nil {
+		fw, err = flate.NewWriterDict(buf, level, window)
+	} else {
+		fw, err = flate.NewWriter(buf, level)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fw.Write(data)
+	if last {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+	return buf.Bytes(), err
+}
+
+// Trailer returns the gzip trailer for uncompressed data of the given
+// CRC-32 and size.
+func Trailer(crc uint32, size int64) []byte {
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer, crc)
+	binary.LittleEndian.PutUint32(trailer[4:], uint32(size))
+	return trailer
+}
+
+// CombineCRC32 returns the CRC-32 (IEEE) of the concatenation of two
+// sequences given their CRCs and the length of the second one, using the
+// GF(2) matrix method of zlib's crc32_combine.
+func CombineCRC32(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+
+	var even, odd [32]uint32
+
+	// operator for one zero bit in odd
+	odd[0] = crc32.IEEE
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+
+	gf2MatrixSquare(even[:], odd[:]) // two zero bits
+	gf2MatrixSquare(odd[:], even[:]) // four zero bits
+
+	// apply len2 zeros to crc1 (the first squaring puts the operator for one
+	// zero byte, eight zero bits, in even)
+	for {
+		gf2MatrixSquare(even[:], odd[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(even[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+
+		gf2MatrixSquare(odd[:], even[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(odd[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat []uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat []uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
@@ -0,0 +1,90 @@
+package pgzip
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func testData() []byte {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 10000)
+	random := make([]byte, BLOCK_SIZE+100)
+	rand.Read(random)
+	return append(append(text, random...), text...)
+}
+
+func gunzip(t *testing.T, data []byte) []byte {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// Test that blocks compressed apart make a gzip stream with the CRCs
+// combined, as a host spreading them over workers would
+func TestBlocks(t *testing.T) {
+	data := testData()
+	out := Header()
+	crc := uint32(0)
+	for start := 0; start < len(data); start += BLOCK_SIZE {
+		end := start + BLOCK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		piece, err := CompressBlock(data[start:end], flate.BestSpeed, end == len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, piece...)
+		crc = CombineCRC32(crc, crc32.ChecksumIEEE(data[start:end]), int64(end-start))
+	}
+	if crc != crc32.ChecksumIEEE(data) {
+		t.Fatalf("combined CRC %08x, want %08x", crc, crc32.ChecksumIEEE(data))
+	}
+	out = append(out, Trailer(crc, int64(len(data)))...)
+	if !bytes.Equal(gunzip(t, out), data) {
+		t.Errorf("decompressed output differs from input")
+	}
+	if _, err := CompressBlock(nil, 42, true); err == nil {
+		t.Errorf("expected an error for level 42")
+	}
+}
+
+// Test that a stream pushed in chunks of any size decompresses whole
+func TestCompressor(t *testing.T) {
+	data := testData()
+	c, err := NewCompressor(flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	for rest := data; len(rest) > 0; {
+		n := rand.Intn(100000)
+		if n > len(rest) {
+			n = len(rest)
+		}
+		piece, err := c.Push(rest[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, piece...)
+		rest = rest[n:]
+	}
+	piece, err := c.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = append(out, piece...)
+	if !bytes.Equal(gunzip(t, out), data) {
+		t.Errorf("decompressed output differs from input")
+	}
+}
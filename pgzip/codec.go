@@ -0,0 +1,101 @@
+package pgzip
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"sort"
+	"sync"
+)
+
+// Codecs: the formats the writers can produce. A stream is the codec's
+// header, the blocks compressed by the workers in input order, and the
+// trailer, which gets the checksum and size of all the data. gzip is built
+// in; other formats, including ones defined outside this package, are added
+// with RegisterCodec and picked with NewWriterCodec. The gopigz command
+// registers its formats here too, so that it has the one registry.
+
+// Codec is a compressed format written by the pipeline.
+type Codec interface {
+	// Header returns the start of a stream.
+	Header() []byte
+	// NewBlockWriter returns the compressor of a worker at the given level,
+	// or an error if the level is not valid.
+	NewBlockWriter(level int) (BlockWriter, error)
+	// NewChecksum returns the checksum of the uncompressed data that is
+	// passed to Trailer.
+	NewChecksum() hash.Hash32
+	// Trailer returns the end of a stream of size bytes with checksum sum.
+	Trailer(sum uint32, size int64) []byte
+}
+
+// BlockWriter compresses blocks for a worker, one at a time. The outputs of
+// the blocks of a stream are written one after the other, so each must be
+// able to follow the one before.
+type BlockWriter interface {
+	// CompressBlock compresses b, whose matches may refer back into its
+	// Window. The result must not be reused by the next call.
+	CompressBlock(b *Block) []byte
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{"gzip": gzipCodec{}}
+)
+
+// RegisterCodec makes c available under name. It panics if c is nil or the
+// name is taken, as is usual from an init function.
+func RegisterCodec(name string, c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c == nil {
+		panic("pgzip: RegisterCodec with a nil codec")
+	}
+	if _, ok := codecs[name]; ok {
+		panic(fmt.Sprintf("pgzip: codec %q registered twice", name))
+	}
+	codecs[name] = c
+}
+
+// LookupCodec returns the codec registered under name.
+func LookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Codecs returns the names of the registered codecs, sorted.
+func Codecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gzipCodec writes a single gzip member, as the writers always have.
+type gzipCodec struct{}
+
+func (gzipCodec) Header() []byte { return Header() }
+
+func (gzipCodec) NewBlockWriter(level int) (BlockWriter, error) {
+	return flateBlockWriter{level}, checkLevel(level)
+}
+
+func (gzipCodec) NewChecksum() hash.Hash32 { return crc32.NewIEEE() }
+
+func (gzipCodec) Trailer(sum uint32, size int64) []byte { return Trailer(sum, size) }
+
+// flateBlockWriter compresses blocks into pieces of a deflate stream.
+type flateBlockWriter struct {
+	level int
+}
+
+func (w flateBlockWriter) CompressBlock(b *Block) []byte {
+	out, _ := DeflateBlock(nil, b.Data, b.Window, w.level, b.Last)
+	return out
+}
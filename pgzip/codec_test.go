@@ -0,0 +1,85 @@
+package pgzip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/adler32"
+	"testing"
+)
+
+// storeCodec writes the data as it is, framed by a magic number and a
+// trailer of its Adler-32 and size.
+type storeCodec struct{}
+
+type storeBlockWriter struct{}
+
+func (storeCodec) Header() []byte { return []byte("STOR") }
+
+func (storeCodec) NewBlockWriter(level int) (BlockWriter, error) {
+	if level != 0 {
+		return nil, errors.New("store: level must be 0")
+	}
+	return storeBlockWriter{}, nil
+}
+
+func (storeCodec) NewChecksum() hash.Hash32 { return adler32.New() }
+
+func (storeCodec) Trailer(sum uint32, size int64) []byte {
+	trailer := make([]byte, 12)
+	binary.BigEndian.PutUint32(trailer, sum)
+	binary.BigEndian.PutUint64(trailer[4:], uint64(size))
+	return trailer
+}
+
+func (storeBlockWriter) CompressBlock(b *Block) []byte {
+	return append([]byte(nil), b.Data...)
+}
+
+func TestCodec(t *testing.T) {
+	RegisterCodec("store", storeCodec{})
+	defer func() {
+		codecsMu.Lock()
+		delete(codecs, "store")
+		codecsMu.Unlock()
+	}()
+	if names := Codecs(); len(names) != 2 || names[0] != "gzip" || names[1] != "store" {
+		t.Errorf("codecs %q", names)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("registering a name twice did not panic")
+			}
+		}()
+		RegisterCodec("store", storeCodec{})
+	}()
+
+	codec, ok := LookupCodec("store")
+	if !ok {
+		t.Fatal("store codec not found")
+	}
+	var out bytes.Buffer
+	if _, err := NewWriterCodec(&out, codec, 9); err == nil {
+		t.Error("invalid level accepted")
+	}
+	z, err := NewWriterCodec(&out, codec, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testData()
+	z.Write(data)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte("STOR"), data...)
+	want = append(want, storeCodec{}.Trailer(adler32.Checksum(data), int64(len(data)))...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("stream of %d bytes, want %d", out.Len(), len(want))
+	}
+
+	if _, ok := LookupCodec("gzip"); !ok {
+		t.Error("gzip codec not found")
+	}
+}
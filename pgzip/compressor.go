@@ -0,0 +1,64 @@
+package pgzip
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Compressor compresses a stream handed over in chunks, for hosts that
+// cannot pass an io.Writer in, such as JavaScript through syscall/js. Push
+// and Finish return the compressed output that is ready, so it can be
+// enqueued on a Web Stream as it comes.
+type Compressor struct {
+	out syncBuffer
+	w   *ConcurrentWriter
+}
+
+// NewCompressor returns a Compressor at the given flate level.
+func NewCompressor(level int) (*Compressor, error) {
+	c := &Compressor{}
+	w, err := NewConcurrentWriter(&c.out, level)
+	if err != nil {
+		return nil, err
+	}
+	c.w = w
+	return c, nil
+}
+
+// Push adds chunk to the stream and returns the output compressed so far.
+// Blocks are compressed in the background, so it may return nothing.
+func (c *Compressor) Push(chunk []byte) ([]byte, error) {
+	if _, err := c.w.Write(chunk); err != nil {
+		return nil, err
+	}
+	return c.out.take(), nil
+}
+
+// Finish ends the stream and returns the rest of the output.
+func (c *Compressor) Finish() ([]byte, error) {
+	if err := c.w.Close(); err != nil {
+		return nil, err
+	}
+	return c.out.take(), nil
+}
+
+// syncBuffer collects the output of the pipeline's writer.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// take returns what was written since the last call.
+func (b *syncBuffer) take() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := append([]byte(nil), b.buf.Bytes()...)
+	b.buf.Reset()
+	return out
+}
@@ -0,0 +1,60 @@
+package pgzip
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrClosed is returned by writes to a closed writer.
+var ErrClosed = errors.New("pgzip: write to closed writer")
+
+// ConcurrentWriter is a gzip writer that many goroutines may write to at
+// once, such as the handlers of a server sharing one log. The data of every
+// Write call lands in the stream in one piece, in the order the calls took
+// the lock. Full blocks are compressed in parallel outside of the lock, but
+// a Write that fills a block holds it while handing the block to the
+// pipeline, so when the pipeline is full and waiting on the underlying
+// writer, every writer waits with it.
+type ConcurrentWriter struct {
+	mu sync.Mutex
+	z  *Writer
+}
+
+// NewConcurrentWriter returns a ConcurrentWriter compressing to w at the
+// given flate level. Close must be called to finish the stream.
+func NewConcurrentWriter(w io.Writer, level int) (*ConcurrentWriter, error) {
+	z, err := NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &ConcurrentWriter{z: z}, nil
+}
+
+func (z *ConcurrentWriter) Write(data []byte) (int, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.z.Write(data)
+}
+
+// Flush sends the data written so far as a block, and returns once it is
+// written to the underlying writer.
+func (z *ConcurrentWriter) Flush() error {
+	z.mu.Lock()
+	b, err := z.z.flush()
+	z.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	<-b.written
+	return z.z.p.error()
+}
+
+// Close writes the rest of the data and the gzip trailer. It does not close
+// the underlying writer.
+func (z *ConcurrentWriter) Close() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.z.Close()
+}
@@ -0,0 +1,86 @@
+package pgzip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Test that records written from many goroutines at once come out whole
+func TestConcurrentWriter(t *testing.T) {
+	var out bytes.Buffer
+	z, err := NewConcurrentWriter(&out, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const producers, records = 8, 5000
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				fmt.Fprintf(z, "producer %d record %d %s\n", p, i, strings.Repeat("x", i%100+1))
+			}
+		}(p)
+	}
+	wg.Wait()
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := z.Write([]byte("late")); err != ErrClosed {
+		t.Errorf("write after close: %v", err)
+	}
+
+	r, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := make([]int, producers)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		var p, i int
+		var pad string
+		if _, err := fmt.Sscanf(s.Text(), "producer %d record %d %s", &p, &i, &pad); err != nil {
+			t.Fatalf("torn record %q", s.Text())
+		}
+		if i != next[p] || len(pad) != i%100+1 {
+			t.Fatalf("producer %d: got record %q, want number %d", p, s.Text(), next[p])
+		}
+		next[p]++
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for p, n := range next {
+		if n != records {
+			t.Errorf("producer %d: %d records, want %d", p, n, records)
+		}
+	}
+}
+
+// Test that Flush makes the data so far readable
+func TestConcurrentWriterFlush(t *testing.T) {
+	var out bytes.Buffer
+	z, _ := NewConcurrentWriter(&out, flate.BestSpeed)
+	z.Write([]byte("flushed"))
+	if err := z.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	if string(got) != "flushed" {
+		t.Errorf("read %q after Flush", got)
+	}
+	z.Close()
+}
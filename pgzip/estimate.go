@@ -0,0 +1,83 @@
+// Package pgzip is the library side of gopigz: gzip compression in
+// parallel blocks, each primed with the input before it, for use from Go
+// programs. The gopigz command compresses through its pipeline and codecs.
+package pgzip
+
+import (
+	"bytes"
+	"io"
+)
+
+const (
+	BLOCK_SIZE = 128 * 1024 // 128 KiB, as in the gopigz pipeline
+
+	// gzip header and trailer around the deflate stream
+	GZIP_OVERHEAD = 10 + 8
+
+	// Blocks compressed to estimate the size of a larger input
+	ESTIMATE_SAMPLES = 16
+)
+
+// EstimateCompressedSize predicts the size of the gzip stream gopigz would
+// make of the size bytes in r at the given flate level, without compressing
+// all of it. Up to ESTIMATE_SAMPLES blocks spread evenly over the input are
+// compressed the way the pipeline compresses them, and their ratio is
+// applied to the whole. Inputs of up to ESTIMATE_SAMPLES blocks are
+// compressed in full and come out within a few bytes; for larger ones the
+// estimate is within a few percent unless the content varies in ways the
+// samples miss.
+func EstimateCompressedSize(r io.ReaderAt, size int64, level int) (int64, error) {
+	if err := checkLevel(level); err != nil {
+		return 0, err
+	}
+
+	blocks := (size + BLOCK_SIZE - 1) / BLOCK_SIZE
+	samples := blocks
+	if samples > ESTIMATE_SAMPLES {
+		samples = ESTIMATE_SAMPLES
+	}
+	buf := make([]byte, DICT_SIZE+BLOCK_SIZE)
+	var compressed []byte
+	var in, out int64
+	for i := int64(0); i < samples; i++ {
+		// every block is its own piece of the stream, primed with the input
+		// before it and ending in a sync flush
+		offset := i * blocks / samples * BLOCK_SIZE
+		start := offset - DICT_SIZE
+		if start < 0 {
+			start = 0
+		}
+		n, err := r.ReadAt(buf[:offset-start+BLOCK_SIZE], start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if n <= int(offset-start) {
+			break
+		}
+		window, data := buf[:offset-start], buf[offset-start:n]
+		if offset == 0 {
+			window = nil
+		}
+		if compressed, err = DeflateBlock(compressed[:0], data, window, level, false); err != nil {
+			return 0, err
+		}
+		in += int64(len(data))
+		out += int64(len(compressed))
+	}
+
+	// the empty final block that closes the stream
+	estimate := int64(GZIP_OVERHEAD + 2)
+	if in > 0 {
+		if in == size {
+			estimate += out
+		} else {
+			estimate += int64(float64(out) / float64(in) * float64(size))
+		}
+	}
+	return estimate, nil
+}
+
+// EstimateCompressedSizeBytes is EstimateCompressedSize for data in memory.
+func EstimateCompressedSizeBytes(data []byte, level int) (int64, error) {
+	return EstimateCompressedSize(bytes.NewReader(data), int64(len(data)), level)
+}
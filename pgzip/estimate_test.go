@@ -0,0 +1,70 @@
+package pgzip
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// gzipSize compresses data in BLOCK_SIZE pieces the way gopigz does and
+// returns the size of the stream.
+func gzipSize(data []byte, level int) int64 {
+	var out bytes.Buffer
+	fw, _ := flate.NewWriter(&out, level)
+	if len(data) == 0 {
+		fw.Close()
+	}
+	for i := 0; i < len(data); i += BLOCK_SIZE {
+		end := i + BLOCK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		fw.Reset(&out)
+		fw.Write(data[i:end])
+		if end < len(data) {
+			fw.Flush()
+		} else {
+			fw.Close()
+		}
+	}
+	return int64(out.Len()) + GZIP_OVERHEAD
+}
+
+func TestEstimateCompressedSize(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var text bytes.Buffer
+	for text.Len() < 6<<20 {
+		fmt.Fprintf(&text, "%d,%s,%f\n", rng.Intn(100000), []string{"alpha", "beta", "gamma"}[rng.Intn(3)], rng.Float64())
+	}
+	random := make([]byte, 3<<20)
+	rng.Read(random)
+	mixed := append(append([]byte{}, text.Bytes()[:2<<20]...), random[:1<<20]...)
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"text", text.Bytes()},
+		{"random", random},
+		{"mixed", mixed},
+		{"small", text.Bytes()[:50000]},
+		{"empty", nil},
+	} {
+		for _, level := range []int{flate.BestSpeed, flate.DefaultCompression, flate.BestCompression} {
+			got, err := EstimateCompressedSizeBytes(test.data, level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := gzipSize(test.data, level)
+			if diff := float64(got-want) / float64(want); diff > 0.03 || diff < -0.03 {
+				t.Errorf("%s at level %d: estimated %d bytes, compressed to %d", test.name, level, got, want)
+			}
+		}
+	}
+
+	if _, err := EstimateCompressedSizeBytes([]byte("x"), 42); err == nil {
+		t.Errorf("expected an error for level 42")
+	}
+}
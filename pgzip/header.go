@@ -0,0 +1,107 @@
+package pgzip
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Headers with fields. NewWriterHeader writes the fields of a gzip.Header,
+// the type compress/gzip and Reader use, so that metadata read from one
+// stream can be written to another. Application data goes in subfields of
+// Extra, each tagged with the two bytes SI1 and SI2 of RFC 1952 so that
+// readers can pick theirs and skip the others.
+
+// Largest Extra field, its length being 16 bits
+const MAX_EXTRA_SIZE = 0xFFFF
+
+var (
+	errExtraSize = errors.New("pgzip: header Extra field too long")
+	errLatin1    = errors.New("pgzip: header Name or Comment not in Latin-1")
+)
+
+// gzip header flags
+const (
+	flagExtra   = 1 << 2
+	flagName    = 1 << 3
+	flagComment = 1 << 4
+)
+
+// NewWriterHeader is like NewWriterLevel but writes the Extra, Name,
+// Comment, ModTime and, if not zero, OS of h in the header. Name and Comment
+// must be Latin-1 and Extra no longer than MAX_EXTRA_SIZE.
+func NewWriterHeader(w io.Writer, h gzip.Header, level int) (*Writer, error) {
+	header, err := encodeHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterCodec(w, headerCodec{header: header}, level)
+}
+
+// headerCodec is the gzip codec with a given header.
+type headerCodec struct {
+	gzipCodec
+	header []byte
+}
+
+func (c headerCodec) Header() []byte { return c.header }
+
+// encodeHeader returns the gzip header holding the fields of h.
+func encodeHeader(h gzip.Header) ([]byte, error) {
+	header := Header()
+	if !h.ModTime.IsZero() && h.ModTime.Unix() > 0 {
+		binary.LittleEndian.PutUint32(header[4:8], uint32(h.ModTime.Unix()))
+	}
+	if h.OS != 0 {
+		header[9] = h.OS
+	}
+	if h.Extra != nil {
+		if len(h.Extra) > MAX_EXTRA_SIZE {
+			return nil, errExtraSize
+		}
+		header[3] |= flagExtra
+		header = append(header, byte(len(h.Extra)), byte(len(h.Extra)>>8))
+		header = append(header, h.Extra...)
+	}
+	for _, field := range []struct {
+		flag  byte
+		value string
+	}{{flagName, h.Name}, {flagComment, h.Comment}} {
+		if field.value == "" {
+			continue
+		}
+		header[3] |= field.flag
+		for _, r := range field.value {
+			if r == 0 || r > 0xff {
+				return nil, errLatin1
+			}
+			header = append(header, byte(r))
+		}
+		header = append(header, 0)
+	}
+	return header, nil
+}
+
+// AppendSubfield appends the Extra subfield si1, si2 holding data, of at
+// most MAX_EXTRA_SIZE-4 bytes, to extra.
+func AppendSubfield(extra []byte, si1, si2 byte, data []byte) []byte {
+	extra = append(extra, si1, si2, byte(len(data)), byte(len(data)>>8))
+	return append(extra, data...)
+}
+
+// FindSubfield returns the data of the first Extra subfield si1, si2, or
+// nil if there is none.
+func FindSubfield(extra []byte, si1, si2 byte) []byte {
+	for len(extra) >= 4 {
+		n := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+n {
+			return nil
+		}
+		if extra[0] == si1 && extra[1] == si2 {
+			return extra[4 : 4+n]
+		}
+		extra = extra[4+n:]
+	}
+	return nil
+}
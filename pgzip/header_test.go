@@ -0,0 +1,61 @@
+package pgzip
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Test that the fields given to NewWriterHeader read back with
+// compress/gzip, and that subfields are found in Extra
+func TestWriterHeader(t *testing.T) {
+	extra := AppendSubfield(nil, 'A', 'p', []byte("app data"))
+	extra = AppendSubfield(extra, 'S', 'z', []byte{1, 2, 3, 4})
+	h := gzip.Header{
+		Extra:   extra,
+		Name:    "café.txt",
+		Comment: "built by CI",
+		ModTime: time.Unix(1600000000, 0),
+		OS:      11,
+	}
+	data := bytes.Repeat([]byte("with a header\n"), 20000)
+
+	var out bytes.Buffer
+	z, err := NewWriterHeader(&out, h, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.Write(data)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes: %v", len(got), err)
+	}
+	if r.Name != h.Name || r.Comment != h.Comment || !r.ModTime.Equal(h.ModTime) || r.OS != h.OS || !bytes.Equal(r.Extra, extra) {
+		t.Errorf("header %+v", r.Header)
+	}
+	if sz := FindSubfield(r.Extra, 'S', 'z'); !bytes.Equal(sz, []byte{1, 2, 3, 4}) {
+		t.Errorf("subfield Sz = %v", sz)
+	}
+	if FindSubfield(r.Extra, 'N', 'o') != nil {
+		t.Errorf("found a missing subfield")
+	}
+
+	for _, bad := range []gzip.Header{
+		{Name: "snowman ☃"},
+		{Extra: make([]byte, MAX_EXTRA_SIZE+1)},
+	} {
+		if _, err := NewWriterHeader(ioutil.Discard, bad, flate.DefaultCompression); err == nil {
+			t.Errorf("header %.20q accepted", bad.Name)
+		}
+	}
+}
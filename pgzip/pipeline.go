@@ -0,0 +1,210 @@
+package pgzip
+
+import (
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+)
+
+// The compression pipeline, behind the writers here and the gopigz command
+// alike. Blocks are compressed by a pool of workers and come out in the
+// order they went in to a single goroutine that writes them, keeping the
+// checksum and the size for the trailer. Every block is compressed with the
+// DICT_SIZE bytes of input before it at hand, so that its matches reach back
+// across the cut as they would in a single stream.
+
+const (
+	// Blocks queued per worker before producers have to wait
+	QUEUE_DEPTH = 2
+
+	// the deflate window, the input before a block that it may refer to
+	DICT_SIZE = 32 * 1024
+)
+
+// Block is a piece of the input as a codec compresses it.
+type Block struct {
+	Index  int    // of the block in the stream, from 1
+	Data   []byte // the input
+	Window []byte // the input before Data, at most DICT_SIZE bytes
+	Last   bool   // Data ends the stream
+}
+
+// Job is a piece of work for Ordered.
+type Job interface {
+	// Run does the work, on one of the workers.
+	Run()
+}
+
+// Ordered runs the jobs from in on workers goroutines and passes them on
+// in the order they came in, on a channel holding depth of them. Every job
+// gets a slot in a queue of as many slots as workers as it is handed to a
+// worker, and the slots are emptied in order, so at most that many jobs
+// wait for the ones before them. The channel is closed once in is.
+func Ordered(in <-chan Job, workers, depth int) <-chan Job {
+	if workers < 1 {
+		workers = 1
+	}
+	out := make(chan Job, depth)
+
+	type slot struct {
+		job  Job
+		done chan Job
+	}
+	jobs := make(chan slot)
+	order := make(chan chan Job, workers)
+	go func() {
+		for j := range in {
+			done := make(chan Job, 1)
+			order <- done
+			jobs <- slot{j, done}
+		}
+		close(jobs)
+		close(order)
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for s := range jobs {
+				s.job.Run()
+				s.done <- s.job
+			}
+		}()
+	}
+
+	go func() {
+		for done := range order {
+			out <- <-done
+		}
+		close(out)
+	}()
+	return out
+}
+
+// AppendWindow returns the last DICT_SIZE bytes of window followed by
+// data, the window of the block after data.
+func AppendWindow(window, data []byte) []byte {
+	if len(data) >= DICT_SIZE {
+		return data[len(data)-DICT_SIZE:]
+	}
+	joined := append(append([]byte{}, window...), data...)
+	if len(joined) > DICT_SIZE {
+		joined = joined[len(joined)-DICT_SIZE:]
+	}
+	return joined
+}
+
+// block is a Block on its way through a pipeline.
+type block struct {
+	Block
+	p       *pipeline
+	out     []byte
+	written chan struct{} // closed once written
+}
+
+func (b *block) Run() {
+	bw := b.p.writers.Get().(BlockWriter)
+	b.out = bw.CompressBlock(&b.Block)
+	b.p.writers.Put(bw)
+}
+
+type pipeline struct {
+	w       io.Writer
+	codec   Codec
+	in      chan Job
+	writers sync.Pool // the BlockWriters of the codec
+	index   int       // of the last block submitted
+	window  []byte    // the end of the input submitted
+	ended   chan struct{}
+
+	mu  sync.Mutex
+	err error // first write error
+}
+
+// newPipeline starts the workers and the writer for a stream of codec to w
+// at the given level, which must be valid for it.
+func newPipeline(w io.Writer, codec Codec, level int) *pipeline {
+	workers := runtime.GOMAXPROCS(0)
+	p := &pipeline{
+		w:     w,
+		codec: codec,
+		in:    make(chan Job, QUEUE_DEPTH*workers),
+		ended: make(chan struct{}),
+	}
+	p.writers.New = func() interface{} {
+		bw, _ := codec.NewBlockWriter(level)
+		return bw
+	}
+	go p.write(Ordered(p.in, workers, QUEUE_DEPTH*workers))
+	return p
+}
+
+// checkLevel returns the error flate gives for an invalid level.
+func checkLevel(level int) error {
+	_, err := flate.NewWriter(ioutil.Discard, level)
+	return err
+}
+
+// checkCodecLevel returns the error codec gives for an invalid level.
+func checkCodecLevel(codec Codec, level int) error {
+	_, err := codec.NewBlockWriter(level)
+	return err
+}
+
+// submit queues data as the next block, and returns it. It waits while the
+// queue is full, and must be called in input order.
+func (p *pipeline) submit(data []byte, last bool) *block {
+	p.index++
+	b := &block{
+		Block:   Block{Index: p.index, Data: data, Window: p.window, Last: last},
+		p:       p,
+		written: make(chan struct{}),
+	}
+	p.window = AppendWindow(p.window, data)
+	p.in <- b
+	return b
+}
+
+func (p *pipeline) write(blocks <-chan Job) {
+	defer close(p.ended)
+	p.put(p.codec.Header())
+	sum, size := p.codec.NewChecksum(), int64(0)
+	for j := range blocks {
+		b := j.(*block)
+		p.put(b.out)
+		sum.Write(b.Data)
+		size += int64(len(b.Data))
+		close(b.written)
+		if b.Last {
+			p.put(p.codec.Trailer(sum.Sum32(), size))
+		}
+	}
+}
+
+// put writes data unless an earlier write failed.
+func (p *pipeline) put(data []byte) {
+	if p.error() != nil {
+		return
+	}
+	if _, err := p.w.Write(data); err != nil {
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+	}
+}
+
+func (p *pipeline) error() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// close submits the last block, data, and waits for the stream to be
+// written.
+func (p *pipeline) close(data []byte) error {
+	p.submit(data, true)
+	close(p.in)
+	<-p.ended
+	return p.error()
+}
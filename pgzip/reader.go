@@ -0,0 +1,128 @@
+package pgzip
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrReaderClosed is returned by reads from a closed Reader.
+var ErrReaderClosed = errors.New("pgzip: read from closed reader")
+
+// Blocks read ahead of the inflater, and inflated ahead of the reader
+const READ_AHEAD = 4
+
+// Reader decompresses a gzip stream with read-ahead, a drop-in for
+// compress/gzip's Reader. Inflating cannot be split between CPUs the way
+// compressing is, since every block may refer back to the ones before, so
+// the work is pipelined instead: one goroutine reads the input, another
+// inflates it and checks the CRC-32 and size of every member, and Read hands
+// out what they have done, each stage READ_AHEAD blocks ahead of the next.
+// Concatenated members are read as one stream, as gzip does.
+type Reader struct {
+	gzip.Header // of the first member
+
+	stream *chunkReader // the decompressed data
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// chunk is a piece of a stream passed between the stages.
+type chunk struct {
+	data []byte
+	err  error
+}
+
+// NewReader returns a Reader decompressing r. The header of the first member
+// is read before it returns, so that input which is not gzip is reported
+// right away.
+func NewReader(r io.Reader) (*Reader, error) {
+	z := &Reader{stream: newChunkReader(), done: make(chan struct{})}
+	input := newChunkReader()
+	go z.produce(input.chunks, r)
+
+	zr, err := gzip.NewReader(input)
+	if err != nil {
+		z.Close()
+		return nil, err
+	}
+	z.Header = zr.Header
+	go z.produce(z.stream.chunks, zr)
+	return z, nil
+}
+
+// produce sends the blocks read from r to out until it fails or the Reader
+// is closed.
+func (z *Reader) produce(out chan<- chunk, r io.Reader) {
+	defer close(out)
+	for {
+		buf := make([]byte, BLOCK_SIZE)
+		n, err := fill(r, buf)
+		select {
+		case out <- chunk{buf[:n], err}:
+		case <-z.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// fill reads r into buf until buf is full or r fails, and returns the error
+// of r itself: io.ReadFull would turn the io.EOF after a short last block
+// into io.ErrUnexpectedEOF, which a truncated gzip stream is reported as.
+func fill(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	return z.stream.Read(p)
+}
+
+// Close stops the read-ahead. It does not close the underlying reader, and
+// a read from it that is in progress still has to return.
+func (z *Reader) Close() error {
+	z.closeOnce.Do(func() {
+		close(z.done)
+		z.stream.cur, z.stream.err = nil, ErrReaderClosed
+	})
+	return nil
+}
+
+// chunkReader reads the chunks sent to it as a stream.
+type chunkReader struct {
+	chunks chan chunk
+	cur    []byte
+	err    error
+}
+
+func newChunkReader() *chunkReader {
+	return &chunkReader{chunks: make(chan chunk, READ_AHEAD)}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		c, ok := <-r.chunks
+		if !ok {
+			return 0, ErrReaderClosed
+		}
+		r.cur, r.err = c.data, c.err
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
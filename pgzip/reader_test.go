@@ -0,0 +1,86 @@
+package pgzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+var _ io.ReadCloser = (*Reader)(nil)
+
+func TestReader(t *testing.T) {
+	data := make([]byte, 9*BLOCK_SIZE+77)
+	for i := range data {
+		data[i] = byte(i * i >> 9)
+	}
+
+	// two members, one from gzip with a name and one from Writer
+	var stream bytes.Buffer
+	zw := gzip.NewWriter(&stream)
+	zw.Name = "data"
+	zw.Write(data[:BLOCK_SIZE+3])
+	zw.Close()
+	z := NewWriter(&stream)
+	z.Write(data[BLOCK_SIZE+3:])
+	z.Close()
+
+	r, err := NewReader(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "data" {
+		t.Errorf("name %q", r.Name)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, %v", len(got), err)
+	}
+	r.Close()
+	if _, err := r.Read(make([]byte, 1)); err != ErrReaderClosed {
+		t.Errorf("read after close: %v", err)
+	}
+
+	// a wrong CRC-32
+	corrupt := append([]byte{}, stream.Bytes()...)
+	corrupt[len(corrupt)-8] ^= 1
+	r, _ = NewReader(bytes.NewReader(corrupt))
+	if _, err := ioutil.ReadAll(r); err != gzip.ErrChecksum {
+		t.Errorf("corrupt trailer: %v", err)
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("not gzip at all"))); err != gzip.ErrHeader {
+		t.Errorf("not gzip: %v", err)
+	}
+
+	// closing early leaves no goroutine blocked
+	r, _ = NewReader(bytes.NewReader(stream.Bytes()))
+	r.Read(make([]byte, 10))
+	r.Close()
+}
+
+// Test that a truncated stream is an error, as it is from compress/gzip,
+// rather than short data
+func TestReaderTruncated(t *testing.T) {
+	data := make([]byte, 3*BLOCK_SIZE+100)
+	for i := range data {
+		data[i] = byte(i * i >> 9)
+	}
+	var stream bytes.Buffer
+	z := NewWriter(&stream)
+	z.Write(data)
+	z.Close()
+
+	for _, n := range []int{stream.Len() / 2, stream.Len() - 4} {
+		r, err := NewReader(bytes.NewReader(stream.Bytes()[:n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("cut at %d: read %d bytes, %v", n, len(got), err)
+		}
+		r.Close()
+	}
+}
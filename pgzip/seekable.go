@@ -0,0 +1,271 @@
+package pgzip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// Random access. A gzip stream can only be inflated from the start, or from
+// an access point: a deflate block boundary on a byte, along with the up to
+// 32 KiB of data before it that the following blocks may refer back to.
+// gopigz --index writes such points next to a gzip file, and ReadIndex reads
+// them. Without an index, the start of every gzip member is an access point
+// with nothing before it, and SeekableReader finds them with one pass over
+// the stream the first time it is used; that makes BGZF files, gopigz
+// --member-every output and concatenated files seekable, while a single
+// member without an index is inflated from its start on every read. Data
+// read at random is not checked against the CRC-32 of its member, which
+// only covers a whole member; the pass that builds an index checks them all.
+
+// INDEX_MAGIC starts the index files of gopigz --index.
+const INDEX_MAGIC = "GPZIDX01"
+
+var (
+	errIndex      = errors.New("pgzip: invalid index")
+	errNegative   = errors.New("pgzip: negative offset")
+	errWhence     = errors.New("pgzip: invalid whence")
+	errIndexRange = errors.New("pgzip: index points past the end of the stream")
+)
+
+// Index lists the access points of a gzip stream.
+type Index struct {
+	size   int64 // of the uncompressed data
+	points []accessPoint
+}
+
+// accessPoint is where inflating can start: a gzip member, or raw deflate
+// data that may refer back to window.
+type accessPoint struct {
+	compressed   int64
+	uncompressed int64
+	member       bool
+	window       []byte
+}
+
+// Size returns the size of the uncompressed data.
+func (ix *Index) Size() int64 { return ix.size }
+
+// ReadIndex reads an index in the format of gopigz --index.
+func ReadIndex(r io.Reader) (*Index, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(INDEX_MAGIC)+16 || string(data[:len(INDEX_MAGIC)]) != INDEX_MAGIC {
+		return nil, errIndex
+	}
+	le := binary.LittleEndian
+	data = data[len(INDEX_MAGIC):]
+	ix := &Index{size: int64(le.Uint64(data))}
+	n := le.Uint64(data[8:])
+	data = data[16:]
+	for i := uint64(0); i < n; i++ {
+		if len(data) < 20 {
+			return nil, errIndex
+		}
+		p := accessPoint{compressed: int64(le.Uint64(data)), uncompressed: int64(le.Uint64(data[8:]))}
+		length := le.Uint32(data[16:])
+		if uint64(len(data)-20) < uint64(length) {
+			return nil, errIndex
+		}
+		window, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data[20 : 20+length])))
+		if err != nil || len(window) > 32*1024 {
+			return nil, errIndex
+		}
+		p.window = window
+		if p.compressed < 0 || p.uncompressed < 0 || p.uncompressed > ix.size ||
+			len(ix.points) > 0 && p.uncompressed < ix.points[len(ix.points)-1].uncompressed {
+			return nil, errIndex
+		}
+		ix.points = append(ix.points, p)
+		data = data[20+length:]
+	}
+	if len(ix.points) == 0 || ix.points[0].uncompressed != 0 || len(data) != 0 {
+		return nil, errIndex
+	}
+	return ix, nil
+}
+
+// buildIndex returns the members of the gzip stream in r as access points,
+// checking every one.
+func buildIndex(r io.Reader) (*Index, error) {
+	// gzip.Reader takes no more than a member from an io.ByteReader, so the
+	// count gives where the next one starts
+	cr := &countingReader{r: bufio.NewReader(r)}
+	ix := &Index{}
+	zr, err := gzip.NewReader(cr)
+	for start := int64(0); ; {
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+		n, err := io.Copy(ioutil.Discard, zr)
+		if err != nil {
+			return nil, err
+		}
+		ix.points = append(ix.points, accessPoint{compressed: start, uncompressed: ix.size, member: true})
+		ix.size += n
+		start = cr.n
+		if err = zr.Reset(cr); err == io.EOF {
+			return ix, nil
+		}
+	}
+}
+
+// countingReader counts the bytes taken from it.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// SeekableReader reads the uncompressed data of a gzip stream at any
+// offset. It implements io.ReaderAt, whose calls may run in parallel, and
+// io.ReadSeeker, whose calls must not.
+type SeekableReader struct {
+	r     io.ReaderAt
+	csize int64 // of the compressed stream
+
+	indexOnce sync.Once
+	index     *Index
+	indexErr  error
+
+	offset int64 // of Read
+}
+
+// NewSeekableReader returns a SeekableReader over the gzip stream of csize
+// bytes in r, using index, or one it builds on first use if index is nil.
+func NewSeekableReader(r io.ReaderAt, csize int64, index *Index) *SeekableReader {
+	z := &SeekableReader{r: r, csize: csize}
+	if index != nil {
+		z.indexOnce.Do(func() { z.index = index })
+	}
+	return z
+}
+
+// Index returns the index in use, building it if need be.
+func (z *SeekableReader) Index() (*Index, error) {
+	z.indexOnce.Do(func() {
+		z.index, z.indexErr = buildIndex(io.NewSectionReader(z.r, 0, z.csize))
+	})
+	return z.index, z.indexErr
+}
+
+// Size returns the size of the uncompressed data.
+func (z *SeekableReader) Size() (int64, error) {
+	ix, err := z.Index()
+	if err != nil {
+		return 0, err
+	}
+	return ix.size, nil
+}
+
+// ReadAt reads len(p) bytes of uncompressed data from off, inflating from
+// the access point before it.
+func (z *SeekableReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegative
+	}
+	ix, err := z.Index()
+	if err != nil {
+		return 0, err
+	}
+	if off >= ix.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(ix.points), func(i int) bool { return ix.points[i].uncompressed > off }) - 1
+	point := ix.points[i]
+	if point.compressed > z.csize {
+		return 0, errIndexRange
+	}
+
+	section := io.NewSectionReader(z.r, point.compressed, z.csize-point.compressed)
+	var data io.Reader
+	if point.member {
+		zr, err := gzip.NewReader(section)
+		if err != nil {
+			return 0, err
+		}
+		data = zr
+	} else {
+		data = flate.NewReaderDict(bufio.NewReader(section), point.window)
+	}
+	if _, err := io.CopyN(ioutil.Discard, data, off-point.uncompressed); err != nil {
+		return 0, unexpected(err)
+	}
+
+	want := len(p)
+	if rest := ix.size - off; int64(want) > rest {
+		want = int(rest)
+	}
+	n, err := io.ReadFull(data, p[:want])
+	if err != nil {
+		return n, unexpected(err)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// unexpected turns the end of data that the index says is there into an
+// error.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Read reads from the offset of the last Read or Seek.
+func (z *SeekableReader) Read(p []byte) (int, error) {
+	n, err := z.ReadAt(p, z.offset)
+	z.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read, in the uncompressed data.
+func (z *SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += z.offset
+	case io.SeekEnd:
+		size, err := z.Size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errWhence
+	}
+	if offset < 0 {
+		return 0, errNegative
+	}
+	z.offset = offset
+	return offset, nil
+}
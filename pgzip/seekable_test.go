@@ -0,0 +1,123 @@
+package pgzip
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+var _ io.ReaderAt = (*SeekableReader)(nil)
+var _ io.ReadSeeker = (*SeekableReader)(nil)
+
+func TestSeekableReader(t *testing.T) {
+	data := make([]byte, 5*BLOCK_SIZE+123)
+	for i := range data {
+		data[i] = byte(i * i >> 11)
+	}
+
+	// one member with an access point after every flush, in the index
+	// format of gopigz --index
+	var stream bytes.Buffer
+	zw := gzip.NewWriter(&stream)
+	zw.Write(nil) // the header
+	zw.Flush()
+	index := []byte(INDEX_MAGIC)
+	index = appendUint64(index, uint64(len(data)))
+	index = appendUint64(index, 5)
+	for i := 0; i < 5; i++ {
+		start := i * BLOCK_SIZE
+		window := data[:start]
+		if len(window) > 32*1024 {
+			window = window[len(window)-32*1024:]
+		}
+		var raw bytes.Buffer
+		fw, _ := flate.NewWriter(&raw, flate.BestCompression)
+		fw.Write(window)
+		fw.Close()
+		index = appendUint64(index, uint64(stream.Len()))
+		index = appendUint64(index, uint64(start))
+		index = appendUint32(index, uint32(raw.Len()))
+		index = append(index, raw.Bytes()...)
+		end := start + BLOCK_SIZE
+		if i == 4 {
+			end = len(data)
+		}
+		zw.Write(data[start:end])
+		zw.Flush()
+	}
+	zw.Close()
+
+	ix, err := ReadIndex(bytes.NewReader(index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadIndex(bytes.NewReader(index[:len(index)-1])); err != errIndex {
+		t.Errorf("truncated index: %v", err)
+	}
+
+	// and two members with no index
+	var members bytes.Buffer
+	for _, part := range [][]byte{data[:BLOCK_SIZE+5], data[BLOCK_SIZE+5:]} {
+		zw := gzip.NewWriter(&members)
+		zw.Write(part)
+		zw.Close()
+	}
+
+	for name, z := range map[string]*SeekableReader{
+		"index":   NewSeekableReader(bytes.NewReader(stream.Bytes()), int64(stream.Len()), ix),
+		"members": NewSeekableReader(bytes.NewReader(members.Bytes()), int64(members.Len()), nil),
+	} {
+		if size, err := z.Size(); size != int64(len(data)) || err != nil {
+			t.Errorf("%s: size %d, %v", name, size, err)
+		}
+		for _, off := range []int{0, 1, BLOCK_SIZE - 3, BLOCK_SIZE + 5, 3*BLOCK_SIZE + 99, len(data) - 10} {
+			p := make([]byte, 20)
+			n, err := z.ReadAt(p, int64(off))
+			want := data[off:]
+			if len(want) > len(p) {
+				want = want[:len(p)]
+			}
+			if !bytes.Equal(p[:n], want) || n < len(p) && err != io.EOF || n == len(p) && err != nil {
+				t.Errorf("%s: read %d bytes at %d, %v", name, n, off, err)
+			}
+		}
+		if _, err := z.ReadAt(make([]byte, 1), int64(len(data))); err != io.EOF {
+			t.Errorf("%s: read at the end: %v", name, err)
+		}
+
+		if _, err := z.Seek(-BLOCK_SIZE, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(z)
+		if err != nil || !bytes.Equal(got, data[len(data)-BLOCK_SIZE:]) {
+			t.Errorf("%s: read %d bytes from the end, %v", name, len(got), err)
+		}
+		if _, err := z.Seek(-1, io.SeekStart); err != errNegative {
+			t.Errorf("%s: seek before the start: %v", name, err)
+		}
+	}
+
+	// the pass that builds an index checks the members
+	corrupt := append([]byte{}, members.Bytes()...)
+	corrupt[len(corrupt)-8] ^= 1
+	z := NewSeekableReader(bytes.NewReader(corrupt), int64(len(corrupt)), nil)
+	if _, err := z.ReadAt(make([]byte, 1), 0); err != gzip.ErrChecksum {
+		t.Errorf("corrupt member: %v", err)
+	}
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,214 @@
+package pgzip
+
+import (
+	"compress/flate"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Suffix of the compressed files CompressTree writes
+const GZIP_SUFFIX = ".gz"
+
+// TreeOptions control CompressTree. The zero value compresses every regular
+// file at the default level, as many at a time as there are CPUs, and
+// removes the originals as gopigz does without -k.
+type TreeOptions struct {
+	// Flate level; 0 means flate.DefaultCompression
+	Level int
+
+	// Files compressed at once, each by its own pipeline; 0 means
+	// runtime.GOMAXPROCS(0)
+	Concurrency int
+
+	// Include, if set, reports whether a regular file is compressed.
+	Include func(path string, d fs.DirEntry) bool
+
+	// Exclude, if set, reports whether a file is left alone, or a
+	// directory not descended into. It is asked before Include.
+	Exclude func(path string, d fs.DirEntry) bool
+
+	// Keep the original files
+	Keep bool
+
+	// Replace outputs that are newer than their files; otherwise those
+	// files are skipped as up to date
+	Force bool
+
+	// Report, if set, is called with the result of every file considered,
+	// from one goroutine at a time.
+	Report func(FileResult)
+}
+
+// FileResult is what became of one file of the tree.
+type FileResult struct {
+	Path       string
+	Output     string // empty if skipped or failed
+	Size       int64
+	Compressed int64
+	Skipped    bool // up to date, or already compressed
+	Err        error
+}
+
+// CompressTree compresses the regular files under root to files with
+// GZIP_SUFFIX added, the way gopigz -r does. Files already ending in
+// GZIP_SUFFIX are skipped. Cancelling ctx stops the walk and the files in
+// progress, whose partial outputs are removed. It returns ctx.Err() if
+// cancelled, and otherwise the first error met, every one of which is also
+// passed to Report.
+func CompressTree(ctx context.Context, root string, opts TreeOptions) error {
+	if opts.Level == 0 {
+		opts.Level = flate.DefaultCompression
+	}
+	if err := checkLevel(opts.Level); err != nil {
+		return err
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	report := func(r FileResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Err != nil && firstErr == nil {
+			firstErr = r.Err
+		}
+		if opts.Report != nil {
+			opts.Report(r)
+		}
+	}
+
+	files := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(opts.Concurrency)
+	for i := 0; i < opts.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for path := range files {
+				report(compressTreeFile(ctx, path, opts))
+			}
+		}()
+	}
+
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			report(FileResult{Path: path, Err: err})
+			return nil
+		}
+		if opts.Exclude != nil && path != root && opts.Exclude(path, d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if strings.HasSuffix(path, GZIP_SUFFIX) {
+			report(FileResult{Path: path, Skipped: true})
+			return nil
+		}
+		if opts.Include != nil && !opts.Include(path, d) {
+			return nil
+		}
+		select {
+		case files <- path:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// compressTreeFile compresses path to path+GZIP_SUFFIX, giving the output
+// the mode and modification time of path.
+func compressTreeFile(ctx context.Context, path string, opts TreeOptions) FileResult {
+	result := FileResult{Path: path}
+	in, err := os.Open(path)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Size = info.Size()
+
+	output := path + GZIP_SUFFIX
+	if out, err := os.Stat(output); err == nil && !opts.Force && !out.ModTime().Before(info.ModTime()) {
+		result.Skipped = true
+		return result
+	}
+
+	out, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	counter := &countingWriter{w: out}
+	z, _ := NewWriterLevel(counter, opts.Level)
+	_, err = io.Copy(z, contextReader{ctx, in})
+	if closeErr := z.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(output, info.ModTime(), info.ModTime())
+	}
+	if err == nil && !opts.Keep {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		os.Remove(output)
+		result.Err = err
+		return result
+	}
+	result.Output = output
+	result.Compressed = counter.n
+	return result
+}
+
+// contextReader fails reads once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,97 @@
+package pgzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCompressTree(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":          strings.Repeat("a", 3*BLOCK_SIZE+5),
+		"sub/b.txt":      "b",
+		"sub/c.log":      "c",
+		"skip/d.txt":     "d",
+		"already.txt.gz": "not really gzip",
+	}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(data), 0640)
+	}
+
+	var results []FileResult
+	err := CompressTree(context.Background(), root, TreeOptions{
+		Concurrency: 2,
+		Include:     func(path string, d fs.DirEntry) bool { return strings.HasSuffix(path, ".txt") },
+		Exclude:     func(path string, d fs.DirEntry) bool { return d.IsDir() && d.Name() == "skip" },
+		Keep:        true,
+		Report:      func(r FileResult) { results = append(results, r) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+	var got []string
+	for _, r := range results {
+		name, _ := filepath.Rel(root, r.Path)
+		if r.Skipped {
+			name += " skipped"
+		}
+		got = append(got, name)
+	}
+	if want := "a.txt already.txt.gz skipped sub/b.txt"; strings.Join(got, " ") != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	for _, name := range []string{"a.txt", "sub/b.txt"} {
+		path := filepath.Join(root, name)
+		f, err := os.Open(path + GZIP_SUFFIX)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		f.Close()
+		if err != nil || !bytes.Equal(data, []byte(files[name])) {
+			t.Errorf("%s: %v", name, err)
+		}
+		if info, _ := os.Stat(path + GZIP_SUFFIX); info.Mode().Perm() != 0640 {
+			t.Errorf("%s: mode %v", name, info.Mode())
+		}
+	}
+	if results[0].Size != int64(len(files["a.txt"])) || results[0].Compressed == 0 || results[0].Compressed >= results[0].Size {
+		t.Errorf("a.txt: %+v", results[0])
+	}
+
+	// outputs are up to date now, and the originals go without Keep
+	results = nil
+	if err := CompressTree(context.Background(), root, TreeOptions{Report: func(r FileResult) { results = append(results, r) }}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if name, _ := filepath.Rel(root, r.Path); (name == "a.txt" || name == "sub/b.txt") && !r.Skipped {
+			t.Errorf("%s recompressed", r.Path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "sub/c.log")); !os.IsNotExist(err) {
+		t.Errorf("c.log kept: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := CompressTree(ctx, root, TreeOptions{}); err != context.Canceled {
+		t.Errorf("cancelled: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package pgzip
+
+import (
+	"compress/flate"
+	"io"
+)
+
+// Writer is a gzip writer that compresses in parallel, a drop-in for
+// compress/gzip's Writer. Data is cut into blocks of BLOCK_SIZE, which a
+// worker per CPU compresses, primed with the input before them, while the
+// next ones are written. Given the same blocks, the deflate data is that of
+// the gopigz command at the same level. The stream is a single gzip member
+// that any gzip reader takes, or one of another Codec with NewWriterCodec.
+// Like gzip.Writer it is not safe for use from several goroutines at once;
+// see ConcurrentWriter.
+type Writer struct {
+	p      *pipeline
+	buf    []byte // the block being filled
+	closed bool
+}
+
+// NewWriter returns a Writer compressing to w at the default level. Close
+// must be called to finish the stream.
+func NewWriter(w io.Writer) *Writer {
+	z, _ := NewWriterLevel(w, flate.DefaultCompression)
+	return z
+}
+
+// NewWriterLevel is like NewWriter but takes a flate level, from
+// flate.HuffmanOnly to flate.BestCompression.
+func NewWriterLevel(w io.Writer, level int) (*Writer, error) {
+	return NewWriterCodec(w, gzipCodec{}, level)
+}
+
+// NewWriterCodec is like NewWriterLevel but writes the format of codec, at
+// a level that codec takes; see LookupCodec.
+func NewWriterCodec(w io.Writer, codec Codec, level int) (*Writer, error) {
+	if err := checkCodecLevel(codec, level); err != nil {
+		return nil, err
+	}
+	return &Writer{p: newPipeline(w, codec, level), buf: make([]byte, 0, BLOCK_SIZE)}, nil
+}
+
+// Write queues data for compression. Full blocks are handed to the workers
+// as they fill; Write only waits while all of them are busy.
+func (z *Writer) Write(data []byte) (int, error) {
+	if z.closed {
+		return 0, ErrClosed
+	}
+	if err := z.p.error(); err != nil {
+		return 0, err
+	}
+	n := len(data)
+	for len(data) > 0 {
+		c := copy(z.buf[len(z.buf):cap(z.buf)], data)
+		z.buf = z.buf[:len(z.buf)+c]
+		data = data[c:]
+		if len(z.buf) == cap(z.buf) {
+			z.p.submit(z.buf, false)
+			z.buf = make([]byte, 0, BLOCK_SIZE)
+		}
+	}
+	return n, nil
+}
+
+// Flush sends the data written so far as a block, and returns once it is
+// written to the underlying writer.
+func (z *Writer) Flush() error {
+	b, err := z.flush()
+	if err != nil {
+		return err
+	}
+	<-b.written
+	return z.p.error()
+}
+
+// flush submits the data written so far, returning its block to wait for.
+func (z *Writer) flush() (*block, error) {
+	if z.closed {
+		return nil, ErrClosed
+	}
+	b := z.p.submit(z.buf, false)
+	z.buf = make([]byte, 0, BLOCK_SIZE)
+	return b, nil
+}
+
+// Close writes the rest of the data and the gzip trailer. It does not close
+// the underlying writer.
+func (z *Writer) Close() error {
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+	return z.p.close(z.buf)
+}
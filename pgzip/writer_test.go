@@ -0,0 +1,96 @@
+package pgzip
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+var _ io.WriteCloser = (*Writer)(nil)
+
+func TestWriter(t *testing.T) {
+	for _, size := range []int{0, 1, BLOCK_SIZE, 5*BLOCK_SIZE + 1234} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7 / 13)
+		}
+		var out bytes.Buffer
+		z := NewWriter(&out)
+		// odd-sized writes straddle the blocks
+		for rest := data; len(rest) > 0; {
+			n := 10007
+			if n > len(rest) {
+				n = len(rest)
+			}
+			if _, err := z.Write(rest[:n]); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := z.Write([]byte("late")); err != ErrClosed {
+			t.Errorf("write after close: %v", err)
+		}
+
+		r, err := gzip.NewReader(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d: %v", size, err)
+		}
+	}
+}
+
+// Test that flushed data can be read before the stream is closed
+func TestWriterFlush(t *testing.T) {
+	var out bytes.Buffer
+	z, err := NewWriterLevel(&out, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.Write([]byte("first part\n"))
+	if err := z.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 11)
+	if _, err := io.ReadFull(r, got); err != nil || string(got) != "first part\n" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	z.Close()
+
+	if _, err := NewWriterLevel(&out, 10); err == nil {
+		t.Errorf("level 10 accepted")
+	}
+}
+
+// Test that a block is primed with the input before it: one repeating the
+// end of the block before compresses to next to nothing
+func TestWriterPrimed(t *testing.T) {
+	data := make([]byte, BLOCK_SIZE)
+	rand.Read(data)
+	data = append(data, data[BLOCK_SIZE-DICT_SIZE/2:]...)
+	var out bytes.Buffer
+	z := NewWriter(&out)
+	z.Write(data)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() > BLOCK_SIZE+DICT_SIZE/8 {
+		t.Errorf("%d bytes compressed to %d", len(data), out.Len())
+	}
+	if !bytes.Equal(gunzip(t, out.Bytes()), data) {
+		t.Errorf("decompressed output differs from input")
+	}
+}
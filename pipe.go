@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Closed outputs.
+//
+// When the reader of the output goes away, as in gopigz | head -c 1M,
+// there is nothing left to do. A closed standard output already ends the
+// process with SIGPIPE, the way the Go runtime handles it, but other
+// outputs such as a FIFO given to --output fail with EPIPE instead. The
+// write stage then stops the read stage instead of compressing the rest of
+// the input for nobody, and the run ends without a message and with the
+// status a shell reports for a process killed by SIGPIPE: whoever closed
+// the pipe wanted no more.
+
+// Exit status of a run whose output was closed: 128 + SIGPIPE
+const EXIT_BROKEN_PIPE = 128 + 13
+
+// isBrokenPipe reports whether err comes from writing to a pipe with no
+// reader.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE)
+}
+
+// exitIfBrokenPipe ends the run if err comes from a closed output.
+func exitIfBrokenPipe(err error) {
+	if isBrokenPipe(err) {
+		os.Exit(EXIT_BROKEN_PIPE)
+	}
+}
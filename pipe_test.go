@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+// brokenPipe fails every write the way a pipe with no reader does.
+type brokenPipe struct{}
+
+func (brokenPipe) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "fifo", Err: syscall.EPIPE}
+}
+
+// endless counts the bytes read from it. They hardly compress, so that
+// output is written as the blocks come.
+type endless struct{ n int64 }
+
+func (e *endless) Read(p []byte) (int, error) {
+	x := uint64(e.n) + 1
+	for i := range p {
+		x ^= x << 13
+		x ^= x >> 7
+		x ^= x << 17
+		p[i] = byte(x)
+	}
+	e.n += int64(len(p))
+	return len(p), nil
+}
+
+// Test that a closed output stops the pipeline instead of letting it
+// compress the whole input
+func TestBrokenPipe(t *testing.T) {
+	input := &endless{}
+	err := compressStream(input, brokenPipe{})
+	if !isBrokenPipe(err) {
+		t.Fatalf("got %v, want a broken pipe", err)
+	}
+	if input.n > 10*BLOCK_SIZE {
+		t.Errorf("read %d bytes after the output broke", input.n)
+	}
+}
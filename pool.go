@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Buffer pooling.
+//
+// Every block used to get a fresh input buffer from the read stage and a
+// fresh output buffer from the deflate worker, a few hundred KiB of garbage
+// per block at the default size. They now come from pools, one per power of
+// two size, and are owned by the block they went to: the read stage hands
+// the input buffer over with the block, the worker adds its output buffer,
+// and the write stage gives them back. Not as soon as a block is written,
+// though, since the window of the block after it is the end of its input;
+// a block's buffers go back when the next one has been written, or when the
+// stream ends. Stages that keep data beyond that copy it, as the long
+// distance matcher of zstd does. Pipelines whose blocks are never released,
+// as for the checksum subcommands, just leave their buffers to the garbage
+// collector.
+
+const (
+	MIN_POOL_CLASS = 12 // 4 KiB
+	MAX_POOL_CLASS = 30 // 1 GiB
+)
+
+var bufferPools [MAX_POOL_CLASS + 1]sync.Pool
+
+// poolClass returns the class of buffers of n bytes, the log of their
+// capacity, or -1 for sizes not pooled.
+func poolClass(n int) int {
+	class := bits.Len(uint(n - 1))
+	if class < MIN_POOL_CLASS {
+		class = MIN_POOL_CLASS
+	}
+	if n <= 0 || class > MAX_POOL_CLASS {
+		return -1
+	}
+	return class
+}
+
+// getBuffer returns a buffer of n bytes, with room for up to the next power
+// of two, and stale contents.
+func getBuffer(n int) []byte {
+	class := poolClass(n)
+	if class < 0 {
+		return make([]byte, n)
+	}
+	if buf, ok := bufferPools[class].Get().([]byte); ok {
+		return buf[:n]
+	}
+	return make([]byte, n, 1<<class)
+}
+
+// putBuffer gives buf, from getBuffer, back to its pool. Nothing may use it
+// after.
+func putBuffer(buf []byte) {
+	if class := poolClass(cap(buf)); class >= 0 && cap(buf) == 1<<class {
+		bufferPools[class].Put(buf[:0])
+	}
+}
+
+// releaseBlock gives the buffers b owns back to their pools.
+func releaseBlock(b *block) {
+	if b == nil {
+		return
+	}
+	for _, buf := range b.pooled {
+		putBuffer(buf)
+	}
+	b.pooled = nil
+}
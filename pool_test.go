@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// Test that buffers come in power of two classes and that only those go
+// back to the pools
+func TestBufferClasses(t *testing.T) {
+	for _, test := range []struct{ n, class int }{
+		{0, -1},
+		{1, MIN_POOL_CLASS},
+		{4096, 12},
+		{4097, 13},
+		{BLOCK_SIZE, 17},
+		{1 << MAX_POOL_CLASS, MAX_POOL_CLASS},
+		{1<<MAX_POOL_CLASS + 1, -1},
+	} {
+		if class := poolClass(test.n); class != test.class {
+			t.Errorf("class of %d: %d, want %d", test.n, class, test.class)
+		}
+	}
+	buf := getBuffer(5000)
+	if len(buf) != 5000 || cap(buf) != 8192 {
+		t.Errorf("buffer of %d bytes, capacity %d", len(buf), cap(buf))
+	}
+	putBuffer(buf)
+	putBuffer(make([]byte, 5000)) // not from a pool, left alone
+}
+
+// Test that streams compressed one after another with reused buffers, stale
+// contents and all, each decompress to their own data
+func TestPooledBlocks(t *testing.T) {
+	saved := processes
+	defer func() { processes = saved }()
+	processes = 4
+
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 4; i++ {
+		// repeats reach back across blocks into the window
+		data := make([]byte, 6*BLOCK_SIZE+rng.Intn(BLOCK_SIZE))
+		rng.Read(data[:DICT_SIZE])
+		for j := DICT_SIZE; j < len(data); j++ {
+			data[j] = data[j-DICT_SIZE+rng.Intn(16)] + byte(i)
+		}
+		var out bytes.Buffer
+		if err := compressStream(bytes.NewReader(data), &out); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("stream %d: read %d bytes: %v", i, len(got), err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// Machine-readable progress events (--progress-fd N).
+//
+// Events are written as newline-delimited JSON to a descriptor provided by
+// the caller, so wrappers can follow a run without parsing stderr.
+
+// Parsing progress-fd flag
+var progressFd int
+
+var progressOut *json.Encoder
+
+type progressEvent struct {
+	Event    string `json:"event"` // started, progress, finished, skipped or error
+	File     string `json:"file,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Bytes    int64  `json:"bytes,omitempty"`
+	Percent  int    `json:"percent,omitempty"`
+	BytesIn  int64  `json:"bytes_in,omitempty"`
+	BytesOut int64  `json:"bytes_out,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func openProgress() {
+	if progressFd > 0 {
+		progressOut = json.NewEncoder(os.NewFile(uintptr(progressFd), "progress"))
+	}
+}
+
+func emitProgress(e progressEvent) {
+	if progressOut != nil {
+		progressOut.Encode(e)
+	}
+}
+
+// The file being processed, for progress events from the pipeline
+var progressFile string
+var progressSize int64
+var progressBytes int64
+var progressPercent int
+
+func startProgress(path string, size int64) {
+	progressFile, progressSize, progressBytes, progressPercent = path, size, 0, 0
+	emitProgress(progressEvent{Event: "started", File: path, Size: size})
+	startDisplay()
+}
+
+// advanceProgress accounts for n more input bytes, emitting an event each
+// time another whole percent is done.
+func advanceProgress(n int64) {
+	progressBytes += n
+	updateDisplay(false)
+	if progressOut == nil || progressSize <= 0 {
+		return
+	}
+	percent := int(progressBytes * 100 / progressSize)
+	if percent > 100 {
+		percent = 100
+	}
+	if percent > progressPercent {
+		progressPercent = percent
+		emitProgress(progressEvent{Event: "progress", File: progressFile, Bytes: progressBytes, Percent: percent})
+	}
+}
+
+// progressReader reports the bytes read through it to advanceProgress, and
+// holds reads back while paused for a stop.
+type progressReader struct {
+	r io.Reader
+}
+
+func (p progressReader) Read(b []byte) (int, error) {
+	waitIfPaused()
+	n, err := p.r.Read(b)
+	advanceProgress(int64(n))
+	return n, err
+}
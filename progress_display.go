@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Progress display on stderr (--progress).
+//
+// On a terminal the file being processed gets a colored bar, redrawn in
+// place. Logs of automated runs would collect every redraw as control
+// characters, so when stderr is not a terminal, or CI is set as CI services
+// do, a plain line is printed every --progress-interval instead, and one
+// when a file that took that long is done.
+
+// Parsing progress and progress-interval flags
+var showProgress bool
+var progressInterval time.Duration
+
+const (
+	PROGRESS_INTERVAL  = 10 * time.Second       // default between plain lines
+	PROGRESS_REDRAW    = 100 * time.Millisecond // between redraws of the bar
+	PROGRESS_BAR_WIDTH = 30
+)
+
+// Where the display goes, and whether it is drawn as a bar
+var displayOut io.Writer = os.Stderr
+var displayBar bool
+
+// When the current file started and was last shown
+var displayStart, displayShown time.Time
+var displayed bool
+
+func openDisplay() {
+	displayBar = isTerminal(os.Stderr) && !inCI()
+}
+
+// isTerminal reports whether f is a character device such as a terminal,
+// other than the null device.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// inCI reports whether the CI environment variable is set to a true value.
+func inCI() bool {
+	switch strings.ToLower(os.Getenv("CI")) {
+	case "", "0", "false", "no":
+		return false
+	}
+	return true
+}
+
+func startDisplay() {
+	displayStart = time.Now()
+	displayShown = displayStart
+	displayed = false
+	if displayBar {
+		updateDisplay(true)
+	}
+}
+
+// updateDisplay shows the progress of the current file if it is time to, or
+// if force is set.
+func updateDisplay(force bool) {
+	if !showProgress || progressFile == "" {
+		return
+	}
+	now := time.Now()
+	every := progressInterval
+	if displayBar {
+		every = PROGRESS_REDRAW
+	}
+	if !force && now.Sub(displayShown) < every {
+		return
+	}
+	displayShown = now
+	displayed = true
+
+	done := ""
+	if progressSize > 0 {
+		percent := progressBytes * 100 / progressSize
+		if percent > 100 {
+			percent = 100
+		}
+		done = fmt.Sprintf("%d%% (%s of %s)", percent, formatSize(progressBytes), formatSize(progressSize))
+		if displayBar {
+			filled := int(percent) * PROGRESS_BAR_WIDTH / 100
+			done = fmt.Sprintf("\x1b[32m%s\x1b[0m%s %s", strings.Repeat("#", filled),
+				strings.Repeat(".", PROGRESS_BAR_WIDTH-filled), done)
+		}
+	} else {
+		done = formatSize(progressBytes)
+	}
+	rate := ""
+	if elapsed := now.Sub(displayStart).Seconds(); elapsed > 0 {
+		rate = fmt.Sprintf(", %s/s", formatSize(int64(float64(progressBytes)/elapsed)))
+	}
+
+	if displayBar {
+		// redraw the line in place, clearing what is left of the last one
+		fmt.Fprintf(displayOut, "\r%s %s%s\x1b[K", progressFile, done, rate)
+	} else {
+		fmt.Fprintf(displayOut, "%s: %s%s\n", progressFile, done, rate)
+	}
+}
+
+// endDisplay shows the final state of a file that was shown at all, and
+// ends the line of the bar.
+func endDisplay() {
+	if !showProgress || !displayed {
+		return
+	}
+	updateDisplay(true)
+	if displayBar {
+		fmt.Fprintln(displayOut)
+	}
+	displayed = false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Test that progress events are emitted once per whole percent
+func TestAdvanceProgress(t *testing.T) {
+	var buf bytes.Buffer
+	progressOut = json.NewEncoder(&buf)
+	defer func() { progressOut = nil }()
+
+	startProgress("f", 1000)
+	advanceProgress(4)
+	advanceProgress(6)
+	advanceProgress(5)
+	advanceProgress(985)
+
+	var events []progressEvent
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e progressEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3: %+v", len(events), events)
+	}
+	if events[0].Event != "started" || events[0].Size != 1000 {
+		t.Errorf("first event %+v", events[0])
+	}
+	if events[1].Percent != 1 || events[2].Percent != 100 || events[2].Bytes != 1000 {
+		t.Errorf("progress events %+v", events[1:])
+	}
+}
+
+// Test that without a terminal progress is shown as plain lines
+func TestPlainProgressLines(t *testing.T) {
+	var buf bytes.Buffer
+	displayOut, displayBar = &buf, false
+	showProgress, progressInterval = true, 0
+	defer func() {
+		displayOut = os.Stderr
+		showProgress, progressInterval = false, PROGRESS_INTERVAL
+	}()
+
+	startProgress("f", 2048)
+	advanceProgress(1024)
+	advanceProgress(1024)
+	endDisplay()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "f: 100% (2K of 2K)") {
+		t.Errorf("got lines %q", lines)
+	}
+	if strings.Contains(buf.String(), "\x1b") || strings.Contains(buf.String(), "\r") {
+		t.Errorf("control characters in %q", buf.String())
+	}
+}
+
+func TestInCI(t *testing.T) {
+	defer os.Setenv("CI", os.Getenv("CI"))
+	for v, want := range map[string]bool{"": false, "false": false, "0": false, "true": true, "1": true} {
+		os.Setenv("CI", v)
+		if got := inCI(); got != want {
+			t.Errorf("CI=%q: inCI() = %v", v, got)
+		}
+	}
+}
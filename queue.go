@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Pipeline queue depth (--queue-depth N).
+//
+// The read stage hands blocks to the compress stage and the compress stage
+// to the write stage over channels that hold no block by default, so a
+// stage that falls behind for a moment stalls the one before it at once: a
+// write waiting on a slow disk leaves compressed blocks with nowhere to go
+// and the workers idle. --queue-depth gives both channels room for N
+// blocks, so short stalls of either end are absorbed, at the price of N
+// more blocks in flight on each side and as much more latency before
+// backpressure reaches the input. --memory still holds the total.
+
+// Parsing queue-depth flag
+var queueDepth int
+
+// Deepest queue accepted
+const MAX_QUEUE_DEPTH = 1024
+
+func init() {
+	flag.IntVar(&queueDepth, "queue-depth", 0, "Let N blocks wait between the read, compress and write stages")
+	optionChecks = append(optionChecks, func() error {
+		if queueDepth < 0 || queueDepth > MAX_QUEUE_DEPTH {
+			return fmt.Errorf("--queue-depth must be from 0 to %d", MAX_QUEUE_DEPTH)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// Test that --queue-depth lets blocks pile up ahead of a slow output, and
+// that the stream is whole either way
+func TestQueueDepth(t *testing.T) {
+	saved := processes
+	defer func() { processes, queueDepth = saved, 0 }()
+	processes = 2
+
+	data := make([]byte, 40*BLOCK_SIZE)
+	rand.New(rand.NewSource(4)).Read(data)
+	var most []int
+	for _, queueDepth = range []int{0, 8} {
+		out := &slowWriter{}
+		if err := compressStream(bytes.NewReader(data), out); err != nil {
+			t.Fatal(err)
+		}
+		most = append(most, out.most)
+		zr, err := gzip.NewReader(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("depth %d: read %d bytes: %v", queueDepth, len(got), err)
+		}
+	}
+	if most[1] < most[0]+8 {
+		t.Errorf("most blocks in flight %v, with depths 0 and 8", most)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"compress/flate"
+	"flag"
+	"io"
+)
+
+// Raw deflate output (--format deflate, or --raw).
+//
+// The deflate stream of the pipeline with no header or trailer, for
+// protocols and containers that supply their own framing: HTTP's deflate
+// content coding as most servers send it, PNG tools, custom containers.
+// Nothing checks the data, so corruption is only found where the stream
+// itself breaks. --dict primes the stream as it does for zlib, and the
+// reader must be given the same dictionary. The codec is too small to be
+// worth a build tag.
+
+func init() {
+	registerCodec("deflate", &codec{
+		suffix:      ".deflate",
+		contentType: "application/octet-stream",
+		newChecksum: newCRCCombiner,
+		header:      func() []byte { return nil },
+		block:       deflateBlock,
+		trailer:     func(sum uint32) []byte { return nil },
+		dictionary:  true,
+		decompress: func(input io.Reader, output io.Writer) error {
+			r := flate.NewReaderDict(input, dictionary)
+			if _, err := io.Copy(output, r); err != nil {
+				return err
+			}
+			return r.Close()
+		},
+	})
+	flag.Var(rawFlag{}, "raw", "Write a raw deflate stream with no header or trailer (--format deflate)")
+}
+
+// rawFlag is a boolean flag that selects the raw deflate format.
+type rawFlag struct{}
+
+func (rawFlag) IsBoolFlag() bool { return true }
+func (rawFlag) String() string   { return "false" }
+func (rawFlag) Set(s string) error {
+	if s == "true" {
+		format = "deflate"
+	}
+	return nil
+}
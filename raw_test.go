@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"testing"
+)
+
+// Test that raw deflate output is a bare deflate stream, primed with the
+// dictionary if any
+func TestRawDeflate(t *testing.T) {
+	format = "deflate"
+	defer func() { format = "gzip"; dictionary = nil }()
+
+	data := bytes.Repeat([]byte("Content-Encoding: deflate\r\n"), 2*BLOCK_SIZE/27+3)
+	for _, dict := range [][]byte{nil, []byte("Content-Encoding: ")} {
+		dictionary = dict
+		var out bytes.Buffer
+		if err := compressStream(bytes.NewReader(data), &out); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(flate.NewReaderDict(&out, dict))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("dictionary %q: %v", dict, err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Parsing recursive, walkers, skip-ext and compress-anyway flags
+var recursive bool
+var walkers int
+var skipExtensions string
+var compressAnyway bool
+
+// replaceStale is set while compressing a file found walking a directory,
+// whose existing output, if any, is older than it and replaced.
+var replaceStale bool
+
+// Extensions of files that are already compressed, which recursive
+// compression skips instead of wasting CPU on them
+const DEFAULT_SKIP_EXTENSIONS = ".gz,.tgz,.zz,.xz,.txz,.zst,.bz2,.tbz2,.lz4,.lzma,.br,.z," +
+	".zip,.7z,.rar,.jar,.apk,.jpg,.jpeg,.png,.gif,.webp,.heic," +
+	".mp3,.aac,.ogg,.opus,.flac,.mp4,.m4a,.m4v,.mkv,.mov,.avi,.webm"
+
+// processPath compresses or decompresses path, descending into it with -r
+// if it is a directory.
+func processPath(path string) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		mirrorRoot = filepath.Dir(path)
+		processFile(path, false)
+		return
+	}
+	if !recursive {
+		warnf("%s is a directory -- ignored", path)
+		countSkipped(path)
+		return
+	}
+
+	mirrorRoot = path
+	for entry := range walkTree(path) {
+		if entry.err != nil {
+			log.Println(entry.err)
+			setError()
+			countFailed("", entry.err)
+			continue
+		}
+		if strings.HasSuffix(entry.path, suffix()) != decompress {
+			countIgnored(entry.path)
+			continue
+		}
+		if skipInRecursion(entry.path) {
+			countSkipped(entry.path)
+			continue
+		}
+		processFile(entry.path, true)
+	}
+}
+
+// processFile compresses or decompresses a single file. Files that --state
+// or, while walking a directory, an up-to-date output show to be already
+// compressed are skipped quietly.
+func processFile(path string, walking bool) {
+	if decompress {
+		decompressFile(path)
+		return
+	}
+
+	if info, err := os.Lstat(path); err == nil {
+		if state != nil && unchangedSinceState(path, info) {
+			countSkipped(path)
+			return
+		}
+		if walking && !force && upToDate(path, info) {
+			countSkipped(path)
+			return
+		}
+	}
+	replaceStale = walking
+	compressFile(path)
+	replaceStale = false
+}
+
+// upToDate reports whether the compressed output of path already exists and
+// is at least as new as path, so that re-running over a tree only compresses
+// new or changed files. A stale output is left for createOutput to replace.
+func upToDate(path string, info os.FileInfo) bool {
+	out, err := os.Stat(mirrorPath(path) + suffix())
+	return err == nil && !out.ModTime().Before(info.ModTime())
+}
+
+// staleOutput reports whether outPath exists and is older than the file
+// being compressed.
+func staleOutput(outPath string) bool {
+	out, err := os.Stat(outPath)
+	return err == nil && inputInfo != nil && out.ModTime().Before(inputInfo.ModTime())
+}
+
+// skipInRecursion reports whether a file found while walking a directory is
+// left alone: when decompressing, everything without our suffix; when
+// compressing, files whose extension is in the skip list, unless
+// --compress-anyway is given.
+func skipInRecursion(path string) bool {
+	if decompress {
+		return !strings.HasSuffix(path, suffix())
+	}
+	if strings.HasSuffix(path, suffix()) {
+		return true
+	}
+	if compressAnyway {
+		return false
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == "" {
+		return false
+	}
+	for _, skip := range strings.Split(skipExtensions, ",") {
+		if strings.ToLower(strings.TrimSpace(skip)) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of directory entries fetched per ReadDir (getdents) call
+const READDIR_BATCH = 1024
+
+// walkEntry is a regular file found by walkTree, or an error reading a
+// directory.
+type walkEntry struct {
+	path string
+	err  error
+}
+
+// walkTree lists every regular file under root. Directories are read by
+// walkers goroutines sharing a queue, so scanning trees with millions of
+// entries keeps up with the compressors. Files come out in no particular
+// order.
+func walkTree(root string) <-chan walkEntry {
+	out := make(chan walkEntry, READDIR_BATCH)
+
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	queue := []string{root}
+	pending := 1 // directories queued or being read
+
+	n := walkers
+	if n < 1 {
+		n = 1
+	}
+	// every walker keeps a directory open; leave the rest of the budget to
+	// the files being processed
+	if max := fdBudget() / 2; n > max {
+		n = max
+	}
+	acquireFds(n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				for len(queue) == 0 && pending > 0 {
+					cond.Wait()
+				}
+				if pending == 0 {
+					mu.Unlock()
+					return
+				}
+				dir := queue[len(queue)-1]
+				queue = queue[:len(queue)-1]
+				mu.Unlock()
+
+				subdirs := readDir(dir, out)
+
+				mu.Lock()
+				queue = append(queue, subdirs...)
+				pending += len(subdirs) - 1
+				cond.Broadcast()
+				mu.Unlock()
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		releaseFds(n)
+		close(out)
+	}()
+
+	return out
+}
+
+// readDir sends the regular files of dir to out in batches and returns its
+// subdirectories.
+func readDir(dir string, out chan<- walkEntry) []string {
+	f, err := os.Open(dir)
+	if err != nil {
+		out <- walkEntry{err: err}
+		return nil
+	}
+	defer f.Close()
+
+	var subdirs []string
+	for {
+		entries, err := f.ReadDir(READDIR_BATCH)
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			switch {
+			case e.IsDir():
+				subdirs = append(subdirs, path)
+			case e.Type().IsRegular():
+				out <- walkEntry{path: path}
+			}
+		}
+		if err == io.EOF {
+			return subdirs
+		}
+		if err != nil {
+			out <- walkEntry{err: err}
+			return subdirs
+		}
+	}
+}
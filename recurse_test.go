@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSkipInRecursion(t *testing.T) {
+	defer func() { compressAnyway = false }()
+	tests := []struct {
+		path           string
+		compressAnyway bool
+		want           bool
+	}{
+		{"dir/notes.txt", false, false},
+		{"dir/Makefile", false, false},
+		{"dir/photo.JPG", false, true},
+		{"dir/archive.tar.gz", false, true},
+		{"dir/photo.jpg", true, false},
+		{"dir/archive.tar.gz", true, true},
+	}
+	for _, test := range tests {
+		compressAnyway = test.compressAnyway
+		if got := skipInRecursion(test.path); got != test.want {
+			t.Errorf("skipInRecursion(%q) with --compress-anyway=%v = %v, want %v", test.path, test.compressAnyway, got, test.want)
+		}
+	}
+}
+
+func TestUpToDate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.txt")
+	ioutil.WriteFile(path, []byte("data"), 0644)
+	info, _ := os.Stat(path)
+
+	if upToDate(path, info) {
+		t.Errorf("file without output reported as up to date")
+	}
+
+	ioutil.WriteFile(path+".gz", nil, 0644)
+	newer := info.ModTime().Add(time.Second)
+	os.Chtimes(path+".gz", newer, newer)
+	if !upToDate(path, info) {
+		t.Errorf("file with newer output not reported as up to date")
+	}
+
+	older := info.ModTime().Add(-time.Second)
+	os.Chtimes(path+".gz", older, older)
+	if upToDate(path, info) {
+		t.Errorf("file with stale output reported as up to date")
+	}
+	if _, err := os.Stat(path + ".gz"); err != nil {
+		t.Errorf("stale output removed by upToDate: %v", err)
+	}
+
+	// replaced when compressing the file found walking, but not otherwise
+	keep = true
+	defer func() { keep, exitStatus = false, 0 }()
+	processFile(path, false)
+	if info, _ := os.Stat(path + ".gz"); info == nil || info.Size() != 0 {
+		t.Errorf("stale output replaced outside a walk")
+	}
+	if exitStatus != 1 {
+		t.Errorf("exit status %d, want 1", exitStatus)
+	}
+	exitStatus = 0
+	processFile(path, true)
+	if info, _ := os.Stat(path + ".gz"); info == nil || info.Size() == 0 {
+		t.Errorf("stale output not replaced")
+	}
+}
+
+func TestWalkTree(t *testing.T) {
+	dir := t.TempDir()
+	want := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		sub := filepath.Join(dir, strings.Repeat("d", i%4+1), "sub"+strconv.Itoa(i))
+		os.MkdirAll(sub, 0755)
+		path := filepath.Join(sub, "file"+strconv.Itoa(i))
+		ioutil.WriteFile(path, nil, 0644)
+		want[path] = true
+	}
+	os.Symlink(dir, filepath.Join(dir, "loop"))
+
+	walkers = 3
+	got := make(map[string]bool)
+	for entry := range walkTree(dir) {
+		if entry.err != nil {
+			t.Fatal(entry.err)
+		}
+		if got[entry.path] {
+			t.Errorf("%s listed twice", entry.path)
+		}
+		got[entry.path] = true
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d files, want %d", len(got), len(want))
+	}
+}
+
+// Test that --output-dir mirrors the tree and leaves the sources alone
+func TestOutputDir(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "out")
+	files := []string{"top.txt", filepath.Join("a", "b", "deep.txt"), filepath.Join("c", "x.log")}
+	for _, name := range files {
+		path := filepath.Join(src, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(strings.Repeat(name, 100)), 0644)
+	}
+
+	recursive, outputDir = true, dst
+	defer func() { recursive, outputDir = false, "" }()
+	processPath(src)
+
+	for _, name := range files {
+		if _, err := os.Stat(filepath.Join(src, name)); err != nil {
+			t.Errorf("source %s: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(src, name+".gz")); err == nil {
+			t.Errorf("output %s written next to the source", name)
+		}
+		if _, err := os.Stat(filepath.Join(dst, name+".gz")); err != nil {
+			t.Errorf("output %s: %v", name, err)
+		}
+	}
+}
+
+// Test that rerunning over a compressed tree does not count the outputs of
+// the first run as skipped
+func TestRerunSummary(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"one", "two"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(strings.Repeat(name, 100)), 0644)
+	}
+	recursive = true
+	defer func() { recursive, summary, exitStatus = false, runSummary{}, 0 }()
+
+	summary = runSummary{}
+	processPath(dir)
+	if summary.Processed != 2 || summary.Skipped != 0 {
+		t.Errorf("first run: %+v", summary)
+	}
+	summary = runSummary{}
+	processPath(dir)
+	if summary.Processed != 0 || summary.Skipped != 0 || summary.Failed != 0 || exitStatus != 0 {
+		t.Errorf("rerun: %+v, exit status %d", summary, exitStatus)
+	}
+}
+
+// Test that a recursion with more walkers than descriptors to spare queues
+// instead of failing, and gives every descriptor back
+func TestFdBudget(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 30; i++ {
+		sub := filepath.Join(dir, "d"+strconv.Itoa(i%6))
+		os.MkdirAll(sub, 0755)
+		ioutil.WriteFile(filepath.Join(sub, "f"+strconv.Itoa(i)), []byte(strings.Repeat("x", i*100)), 0644)
+	}
+
+	saved := fdBudget()
+	fds.limit = MIN_FD_BUDGET
+	recursive, walkers = true, 64
+	defer func() { fds.limit, recursive, walkers = saved, false, 4 }()
+	processPath(dir)
+
+	if exitStatus != 0 {
+		t.Errorf("exit status %d", exitStatus)
+	}
+	if fds.used != 0 {
+		t.Errorf("%d descriptors still taken", fds.used)
+	}
+	n := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if strings.HasSuffix(path, ".gz") {
+			n++
+		}
+		return nil
+	})
+	if n != 30 {
+		t.Errorf("compressed %d of 30 files", n)
+	}
+}
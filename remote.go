@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Remote partial decompression (-d --range START-END URL).
+//
+// A gzip file made of many independent members can be decompressed from the
+// start of any member. Given an index of where the members start, only the
+// compressed bytes covering the requested window are fetched with HTTP Range
+// requests. The index is read from URL.gzi (the bgzip index format) or, for
+// BGZF files without one, built by walking the block headers.
+
+// Parsing range flag
+var rangeSpec string
+
+// memberOffset is the start of a gzip member in the compressed and the
+// uncompressed data.
+type memberOffset struct {
+	compressed   int64
+	uncompressed int64
+}
+
+// parseRange parses START-END or START- into uncompressed byte offsets. END
+// is inclusive, as in HTTP; an open range has end -1.
+func parseRange(s string) (start, end int64, err error) {
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	if start, err = strconv.ParseInt(s[:i], 10, 64); err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	if s[i+1:] == "" {
+		return start, -1, nil
+	}
+	if end, err = strconv.ParseInt(s[i+1:], 10, 64); err != nil || end < start {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	return start, end, nil
+}
+
+// readGzi reads an index in the bgzip .gzi format: a count followed by
+// pairs of compressed and uncompressed offsets, all little-endian uint64.
+// The first member, at offset 0, is implied.
+func readGzi(r io.Reader) ([]memberOffset, error) {
+	r = bufio.NewReader(r)
+	var n uint64
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	index := []memberOffset{{0, 0}}
+	for i := uint64(0); i < n; i++ {
+		var pair [2]uint64
+		if err := binary.Read(r, binary.LittleEndian, &pair); err != nil {
+			return nil, err
+		}
+		index = append(index, memberOffset{int64(pair[0]), int64(pair[1])})
+	}
+	return index, nil
+}
+
+// fetchRange requests bytes from through to (inclusive, or to the end if to
+// is negative) of url.
+func fetchRange(url string, from, to int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if to < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", from))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("GET %s: %s (range requests not supported?)", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// fetchIndex returns the member offsets of url, from its .gzi index if the
+// server has one. Otherwise the BGZF blocks are walked until one starting
+// past end.
+func fetchIndex(url string, end int64) ([]memberOffset, error) {
+	resp, err := http.Get(url + ".gzi")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return readGzi(resp.Body)
+	}
+	return scanBGZF(url, end)
+}
+
+// scanBGZF walks the BGZF blocks of url with one range request per block,
+// each fetching the size trailer of a block together with the header of the
+// next one.
+func scanBGZF(url string, end int64) ([]memberOffset, error) {
+	index := []memberOffset{{0, 0}}
+	var offset, uncompressed int64
+
+	header, err := fetchBytes(url, 0, BGZF_HEADER_SIZE-1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if len(header) < BGZF_HEADER_SIZE || header[0] != 0x1f || header[1] != 0x8b ||
+			header[3]&FEXTRA == 0 || header[12] != BGZF_SI1 || header[13] != BGZF_SI2 {
+			return nil, errors.New("not a BGZF file and no .gzi index found")
+		}
+		next := offset + int64(binary.LittleEndian.Uint16(header[16:])) + 1
+
+		// ISIZE of this block and the header of the next one
+		data, err := fetchBytes(url, next-4, next+BGZF_HEADER_SIZE-1)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		offset = next
+		uncompressed += int64(binary.LittleEndian.Uint32(data))
+		index = append(index, memberOffset{offset, uncompressed})
+		if len(data) == 4 || (end >= 0 && uncompressed > end) {
+			return index, nil
+		}
+		header = data[4:]
+	}
+}
+
+func fetchBytes(url string, from, to int64) ([]byte, error) {
+	body, err := fetchRange(url, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// decompressRange writes bytes start through end (inclusive, or to the end
+// if end is negative) of the uncompressed contents of url to output.
+func decompressRange(url string, start, end int64, output io.Writer) error {
+	index, err := fetchIndex(url, end)
+	if err != nil {
+		return err
+	}
+
+	// the last member starting at or before start, and the first one
+	// starting after end
+	first := sort.Search(len(index), func(i int) bool { return index[i].uncompressed > start }) - 1
+	to := int64(-1)
+	if end >= 0 {
+		if last := sort.Search(len(index), func(i int) bool { return index[i].uncompressed > end }); last < len(index) {
+			to = index[last].compressed - 1
+		}
+	}
+
+	body, err := fetchRange(url, index[first].compressed, to)
+	if err == io.EOF {
+		return nil // start is past the end of the data
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(ioutil.Discard, gz, start-index[first].uncompressed); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if end < 0 {
+		_, err = io.Copy(output, gz)
+		return err
+	}
+	if _, err := io.CopyN(output, gz, end-start+1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// runRanges implements -d --range for every URL in paths, writing to
+// standard output.
+func runRanges(paths []string) {
+	start, end, err := parseRange(rangeSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+			warnf("%s: --range needs an http:// or https:// URL -- ignored", path)
+			continue
+		}
+		if err := decompressRange(path, start, end, w); err != nil {
+			log.Printf("%s: %v", path, err)
+			setError()
+		}
+	}
+	if err := w.Flush(); err != nil {
+		log.Println(err)
+		setError()
+	}
+	os.Exit(exitStatus)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeBGZF splits data into BGZF blocks of blockSize bytes, ending with the
+// empty EOF block, and returns the file and its .gzi index.
+func makeBGZF(data []byte, blockSize int) ([]byte, []byte) {
+	var file bytes.Buffer
+	var offsets [][2]uint64
+	for pos := 0; ; {
+		if pos > 0 {
+			offsets = append(offsets, [2]uint64{uint64(file.Len()), uint64(pos)})
+		}
+		n := len(data) - pos
+		if n > blockSize {
+			n = blockSize
+		}
+		chunk := data[pos : pos+n]
+		pos += n
+
+		var member bytes.Buffer
+		w := gzip.NewWriter(&member)
+		w.Header.Extra = []byte{BGZF_SI1, BGZF_SI2, 2, 0, 0, 0}
+		w.Write(chunk)
+		w.Close()
+		b := member.Bytes()
+		binary.LittleEndian.PutUint16(b[16:], uint16(len(b)-1))
+		file.Write(b)
+
+		if n == 0 {
+			break
+		}
+	}
+
+	var gzi bytes.Buffer
+	binary.Write(&gzi, binary.LittleEndian, uint64(len(offsets)))
+	binary.Write(&gzi, binary.LittleEndian, offsets)
+	return file.Bytes(), gzi.Bytes()
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		s          string
+		start, end int64
+		ok         bool
+	}{
+		{"0-99", 0, 99, true},
+		{"100-", 100, -1, true},
+		{"5-5", 5, 5, true},
+		{"9-5", 0, 0, false},
+		{"-5", 0, 0, false},
+		{"abc", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, end, err := parseRange(test.s)
+		if (err == nil) != test.ok || start != test.start || end != test.end {
+			t.Errorf("parseRange(%q) = %d, %d, %v", test.s, start, end, err)
+		}
+	}
+}
+
+// Test fetching windows of a remote BGZF file with and without a .gzi index,
+// checking that only the covering blocks are requested
+func TestDecompressRange(t *testing.T) {
+	var data []byte
+	for i := 0; len(data) < 100000; i++ {
+		data = append(data, strings.Repeat(string(rune('a'+i%26)), i%50+1)...)
+	}
+	file, gzi := makeBGZF(data, 10000)
+
+	for _, withIndex := range []bool{true, false} {
+		var fetched int64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/data.gz":
+				cw := &countingWriter{w: w}
+				http.ServeContent(cw, r, "data.gz", time.Time{}, bytes.NewReader(file))
+				fetched += cw.n
+			case "/data.gz.gzi":
+				if withIndex {
+					w.Write(gzi)
+					return
+				}
+				http.NotFound(w, r)
+			}
+		}))
+
+		for _, r := range [][2]int64{{0, 99}, {25000, 25010}, {9990, 30005}, {99000, -1}, {200000, -1}} {
+			var out bytes.Buffer
+			if err := decompressRange(srv.URL+"/data.gz", r[0], r[1], &out); err != nil {
+				t.Fatalf("index %v, range %v: %v", withIndex, r, err)
+			}
+			want := data[min64(r[0], int64(len(data))):]
+			if r[1] >= 0 {
+				want = data[r[0] : r[1]+1]
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("index %v, range %v: got %d bytes, want %d", withIndex, r, out.Len(), len(want))
+			}
+		}
+
+		fetched = 0
+		var out bytes.Buffer
+		decompressRange(srv.URL+"/data.gz", 55000, 55100, &out)
+		if withIndex && fetched*4 > int64(len(file)) {
+			t.Errorf("fetched %d of %d compressed bytes for a small window", fetched, len(file))
+		}
+		srv.Close()
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type countingWriter struct {
+	w http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Header() http.Header { return c.w.Header() }
+func (c *countingWriter) WriteHeader(s int)   { c.w.WriteHeader(s) }
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
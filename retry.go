@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Retrying network outputs (--retries N).
+//
+// A long compression should not be lost to one 503 or a dropped ssh
+// connection. Object store uploads retry the failed part, since the parts
+// already stored stay valid, and hold no more than that part. A plain HTTP
+// PUT or an ssh stream cannot pick up where it broke off on its own: with
+// --spool they keep a copy of the whole stream in a temporary file, so a
+// failed PUT is sent again from the spool, and an ssh stream resumes after
+// the bytes the remote part file already holds. That copy is as large as
+// the output, so without --spool they are not retried, and giving --retries
+// for them is refused rather than ignored. Retries wait RETRY_DELAY, doubled
+// every time up to MAX_RETRY_DELAY.
+
+// Parsing retries and spool flags
+var retries = MAX_RETRIES
+var retriesSet bool
+var spoolUploads bool
+
+// retriesFlag is the retry count, noting that it was given.
+type retriesFlag int
+
+func (r *retriesFlag) String() string { return strconv.Itoa(int(*r)) }
+func (r *retriesFlag) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*r, retriesSet = retriesFlag(n), true
+	return nil
+}
+
+// Longest wait between two attempts
+const MAX_RETRY_DELAY = 30 * time.Second
+
+// backoff counts the retries of one operation and spaces them out.
+type backoff struct {
+	attempt int
+	delay   time.Duration
+}
+
+// retry reports whether the operation that failed with err is tried again,
+// after waiting if so.
+func (b *backoff) retry(op string, err error) bool {
+	if b.attempt >= retries || !retryable(err) {
+		return false
+	}
+	b.attempt++
+	if b.delay == 0 {
+		b.delay = RETRY_DELAY
+	}
+	log.Printf("%s: %v, retrying in %v (%d of %d)", op, err, b.delay, b.attempt, retries)
+	time.Sleep(b.delay)
+	b.delay *= 2
+	if b.delay > MAX_RETRY_DELAY {
+		b.delay = MAX_RETRY_DELAY
+	}
+	return true
+}
+
+// transientError is a failure that may not happen again, such as a broken
+// connection.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+// spool keeps a copy of the data written to an output so that it can be
+// sent again.
+type spool struct {
+	f    *os.File
+	size int64
+}
+
+// uploadSpool returns the spool of a streamed upload of the given kind, or
+// nil if it is not retried: with no retries, or without --spool, which
+// --retries then needs.
+func uploadSpool(kind string) (*spool, error) {
+	switch {
+	case retries <= 0:
+		return nil, nil
+	case !spoolUploads && retriesSet:
+		return nil, fmt.Errorf("--retries needs --spool for %s uploads", kind)
+	case !spoolUploads:
+		return nil, nil
+	}
+	return newSpool()
+}
+
+func newSpool() (*spool, error) {
+	f, err := ioutil.TempFile("", "gopigz-spool-")
+	if err != nil {
+		return nil, err
+	}
+	// nothing else needs the name, and nothing is left behind on a crash
+	os.Remove(f.Name())
+	return &spool{f: f}, nil
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	n, err := s.f.WriteAt(p, s.size)
+	s.size += int64(n)
+	return n, err
+}
+
+// from returns a reader of the data spooled after offset.
+func (s *spool) from(offset int64) io.Reader {
+	return io.NewSectionReader(s.f, offset, s.size-offset)
+}
+
+func (s *spool) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Zip recompression: gopigz rezip [--out FILE] [--level N] ZIP
+//
+// Re-deflates every deflated entry of an existing zip archive at a higher
+// level, processes entries at a time, and writes the archive back with an
+// updated central directory, replacing it unless --out is given. Entries
+// that are stored, encrypted, or do not get smaller keep their original
+// data, so the result is never larger than the input.
+
+// Zip extra field holding 64-bit sizes, which the writer adds back itself
+const ZIP64_EXTRA_ID = 0x0001
+
+type rezipEntry struct {
+	file   *zip.File
+	header zip.FileHeader
+	data   []byte // recompressed data, nil to copy the original
+	err    error
+}
+
+// runRezip implements the rezip subcommand.
+func runRezip(args []string) {
+	fs := flag.NewFlagSet("rezip", flag.ExitOnError)
+	out := fs.String("out", "", "Write the archive to this file instead of replacing it")
+	level := fs.Int("level", flate.BestCompression, "Deflate level to recompress at")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *level < flate.BestSpeed || *level > flate.BestCompression {
+		fmt.Fprintln(os.Stderr, "usage: gopigz rezip [--out FILE] [--level 1-9] ZIP")
+		os.Exit(1)
+	}
+	path := fs.Arg(0)
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dest := *out
+	if dest == "" {
+		dest = path
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".")
+	if err != nil {
+		log.Fatal(err)
+	}
+	before, after, err := rezip(&r.Reader, tmp, *level)
+	r.Close()
+	if info, statErr := os.Stat(path); err == nil && statErr == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d entries, %s -> %s\n", dest, len(r.File), formatSize(before), formatSize(after))
+	os.Exit(exitStatus)
+}
+
+// rezip writes the entries of r to w, recompressing deflated entries at
+// level, and returns the compressed size of the entries before and after.
+func rezip(r *zip.Reader, w io.Writer, level int) (before, after int64, err error) {
+	// Entries are recompressed by processes workers and written in order,
+	// with at most processes of them held in memory.
+	results := make(chan chan *rezipEntry, processes)
+	go func() {
+		for _, f := range r.File {
+			done := make(chan *rezipEntry, 1)
+			results <- done
+			go func(f *zip.File) {
+				done <- recompressEntry(f, level)
+			}(f)
+		}
+		close(results)
+	}()
+
+	zw := zip.NewWriter(w)
+	for done := range results {
+		e := <-done
+		if err != nil {
+			continue
+		}
+		if e.err != nil {
+			err = fmt.Errorf("%s: %v", e.file.Name, e.err)
+			continue
+		}
+		before += int64(e.file.CompressedSize64)
+		after += int64(e.header.CompressedSize64)
+		err = writeEntry(zw, e)
+	}
+	if err != nil {
+		return before, after, err
+	}
+	if err = zw.SetComment(r.Comment); err != nil {
+		return before, after, err
+	}
+	return before, after, zw.Close()
+}
+
+// recompressEntry deflates the contents of f at level, keeping the
+// original data unless that is smaller.
+func recompressEntry(f *zip.File, level int) *rezipEntry {
+	e := &rezipEntry{file: f, header: f.FileHeader}
+	e.header.Extra = stripZip64Extra(f.Extra)
+	if f.Method != zip.Deflate || f.Flags&0x1 != 0 {
+		return e
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		e.err = err
+		return e
+	}
+	defer rc.Close()
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, level)
+	// zip.File checks the CRC-32 and size once the entry is read to the end
+	if _, err := io.Copy(fw, rc); err != nil {
+		e.err = err
+		return e
+	}
+	fw.Close()
+	if uint64(buf.Len()) < f.CompressedSize64 {
+		e.data = buf.Bytes()
+		e.header.CompressedSize64 = uint64(buf.Len())
+	}
+	return e
+}
+
+// writeEntry writes e to zw, copying the original data of the entry if it
+// was not recompressed.
+func writeEntry(zw *zip.Writer, e *rezipEntry) error {
+	h := e.header
+	h.CompressedSize = uint32(h.CompressedSize64)
+	if h.CompressedSize64 > 0xffffffff {
+		h.CompressedSize = 0xffffffff
+	}
+	ew, err := zw.CreateRaw(&h)
+	if err != nil {
+		return err
+	}
+	if e.data != nil {
+		_, err = ew.Write(e.data)
+		return err
+	}
+	raw, err := e.file.OpenRaw()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ew, raw)
+	return err
+}
+
+// stripZip64Extra returns extra without its zip64 field, since the writer
+// adds one when the sizes need it.
+func stripZip64Extra(extra []byte) []byte {
+	var kept []byte
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		if id != ZIP64_EXTRA_ID {
+			kept = append(kept, extra[:4+size]...)
+		}
+		extra = extra[4+size:]
+	}
+	return kept
+}
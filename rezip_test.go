@@ -0,0 +1,71 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRezip(t *testing.T) {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 5000)
+	random := make([]byte, 50000)
+	rand.Read(random)
+
+	var in bytes.Buffer
+	zw := zip.NewWriter(&in)
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, flate.BestSpeed)
+	})
+	entries := []struct {
+		name   string
+		method uint16
+		data   []byte
+	}{
+		{"stored.txt", zip.Store, text},
+		{"text.txt", zip.Deflate, text},
+		{"random.bin", zip.Deflate, random},
+		{"empty", zip.Deflate, nil},
+	}
+	for _, e := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: e.method, Extra: []byte{0xfe, 0xca, 2, 0, 'h', 'i'}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.data)
+	}
+	zw.SetComment("comment")
+	zw.Close()
+
+	r, _ := zip.NewReader(bytes.NewReader(in.Bytes()), int64(in.Len()))
+	var out bytes.Buffer
+	before, after, err := rezip(r, &out, flate.BestCompression)
+	if err != nil || after >= before {
+		t.Fatalf("%d -> %d, %v", before, after, err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil || z.Comment != "comment" || len(z.File) != len(entries) {
+		t.Fatalf("%v, %+v", err, z)
+	}
+	for i, f := range z.File {
+		e := entries[i]
+		if f.Name != e.name || f.Method != e.method || !bytes.Equal(f.Extra, []byte{0xfe, 0xca, 2, 0, 'h', 'i'}) {
+			t.Errorf("entry %d: %+v", i, f.FileHeader)
+		}
+		if f.CompressedSize64 > r.File[i].CompressedSize64 {
+			t.Errorf("%s grew from %d to %d", f.Name, r.File[i].CompressedSize64, f.CompressedSize64)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		if err != nil || !bytes.Equal(data, e.data) {
+			t.Errorf("%s: %v", f.Name, err)
+		}
+	}
+}
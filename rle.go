@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+// Run-length encoding strategy (--rle, -U, as in pigz).
+//
+// zlib's Z_RLE: matches only ever copy the byte before, so runs of a
+// repeated byte are all that is found. Finding them costs next to nothing,
+// and the Huffman coding of the rest still compresses images and other
+// binary data with long runs well. compress/flate has no such strategy, so
+// the blocks are written by the deflate block writer. The run may start in
+// the input before the block, which deflateBlock primes with.
+
+// Parsing rle flag
+var rleStrategy bool
+
+func init() {
+	flag.BoolVar(&rleStrategy, "rle", false, "Only find runs of a repeated byte, like zlib's Z_RLE (deflate formats)")
+	flag.BoolVar(&rleStrategy, "U", false, "Same as --rle")
+	optionChecks = append(optionChecks, func() error {
+		if rleStrategy && !deflateFormat() {
+			return errors.New("--rle is only supported with deflate formats")
+		}
+		if rleStrategy && level == ZOPFLI_LEVEL {
+			return errors.New("--rle and -11 cannot be combined")
+		}
+		return nil
+	})
+}
+
+// rleBlock compresses a block into a piece of a deflate stream, as
+// deflateBlock does, with matches at distance 1 only. dict is what the block
+// may refer back to.
+func rleBlock(b *block, dict []byte) []byte {
+	return deflateTokens(b.RawData, rleTokens(b.RawData, dict), b.LastBlock || b.memberEnd)
+}
+
+// rleTokens returns the literals and runs of data, whose runs may continue
+// the last byte of dict.
+func rleTokens(data, dict []byte) []deflateToken {
+	tokens := make([]deflateToken, 0, len(data)/2)
+	have := len(dict) > 0
+	var prev byte
+	if have {
+		prev = dict[len(dict)-1]
+	}
+	for i := 0; i < len(data); {
+		run := 0
+		if have {
+			for i+run < len(data) && run < DEFLATE_MAX_MATCH && data[i+run] == prev {
+				run++
+			}
+		}
+		if run >= DEFLATE_MIN_MATCH {
+			tokens = append(tokens, deflateToken{length: uint16(run), distance: 1})
+			i += run
+			continue
+		}
+		tokens = append(tokens, deflateToken{literal: data[i]})
+		prev, have = data[i], true
+		i++
+	}
+	return tokens
+}
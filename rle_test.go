@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestRLETokens(t *testing.T) {
+	lit := func(c byte) deflateToken { return deflateToken{literal: c} }
+	run := func(n uint16) deflateToken { return deflateToken{length: n, distance: 1} }
+	for _, test := range []struct {
+		data, dict string
+		want       []deflateToken
+	}{
+		{"aaaaab", "", []deflateToken{lit('a'), run(4), lit('b')}},
+		{"aaab", "a", []deflateToken{run(3), lit('b')}},
+		{"abab", "b", []deflateToken{lit('a'), lit('b'), lit('a'), lit('b')}},
+		{"", "", []deflateToken{}},
+	} {
+		if got := rleTokens([]byte(test.data), []byte(test.dict)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("rleTokens(%q, %q) = %v", test.data, test.dict, got)
+		}
+	}
+
+	long := bytes.Repeat([]byte{0}, 1000)
+	tokens := rleTokens(long, nil)
+	if len(tokens) != 5 || tokens[1].length != DEFLATE_MAX_MATCH || tokens[4].length != 1000-1-3*DEFLATE_MAX_MATCH {
+		t.Errorf("runs %v", tokens)
+	}
+}
+
+// Test that -U blocks primed with the input before them inflate
+func TestRLEBlocks(t *testing.T) {
+	rleStrategy = true
+	defer func() { rleStrategy = false }()
+
+	data := append(bytes.Repeat([]byte{7}, 3*DICT_SIZE), []byte("the end")...)
+	first := &block{Index: 1, RawData: data[:DICT_SIZE]}
+	second := &block{Index: 2, LastBlock: true, RawData: data[DICT_SIZE:], window: data[:DICT_SIZE]}
+	stream := append(deflateBlock(first), deflateBlock(second)...)
+	got, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(stream)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("inflated %d bytes: %v", len(got), err)
+	}
+	if len(stream) > 300 {
+		t.Errorf("%d bytes for runs", len(stream))
+	}
+}
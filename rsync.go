@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+// Rsyncable output (--rsyncable).
+//
+// A block's output depends on nothing but its content and the DICT_SIZE
+// bytes before it. Blocks are cut every blockSize bytes though, so a byte
+// inserted near the start of a file shifts every block after it, and rsync
+// finds nothing of the old compressed file to reuse. With --rsyncable a
+// block ends where a gear hash of the last 64 bytes, as in FastCDC, has its
+// top RSYNC_BITS bits clear, once it holds at least RSYNC_MIN_BLOCK bytes,
+// or at blockSize at the latest. The cuts follow the content, so a change
+// only alters the output up to the block after the next cut. (pigz's hash of the
+// last 12 bytes never triggers on inputs of few distinct bytes, such as
+// columns of digits.)
+
+// Parsing rsyncable flag
+var rsyncable bool
+
+// Blocks average RSYNC_MIN_BLOCK + 2^RSYNC_BITS bytes, 40K
+const (
+	RSYNC_BITS      = 15
+	RSYNC_MIN_BLOCK = BLOCK_SIZE / 16
+)
+
+// RSYNC_GEAR_SEED seeds the random values the gear hash adds for every
+// byte. It must never change, or files compressed before would no longer
+// cut at the same places.
+const RSYNC_GEAR_SEED = 0x9e3779b97f4a7c15
+
+var rsyncGear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(RSYNC_GEAR_SEED)
+	for i := range rsyncGear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		rsyncGear[i] = z ^ z>>31
+	}
+
+	flag.BoolVar(&rsyncable, "rsyncable", false, "Cut blocks where the content says so, so that rsync can reuse the unchanged parts of compressed files")
+	optionChecks = append(optionChecks, func() error {
+		if rsyncable && (memberEvery > 0 || blake3Tree) {
+			return errors.New("--rsyncable cannot be combined with --member-every or --blake3, which need blocks of the same size")
+		}
+		return nil
+	})
+}
+
+// rsyncCut returns the length of the block at the start of data: up to the
+// first rsync point after RSYNC_MIN_BLOCK bytes, or all of data.
+func rsyncCut(data []byte) int {
+	hash := uint64(0)
+	for i, c := range data {
+		hash = hash<<1 + rsyncGear[c]
+		if hash>>(64-RSYNC_BITS) == 0 && i+1 >= RSYNC_MIN_BLOCK {
+			return i + 1
+		}
+	}
+	return len(data)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// Test that an insertion near the start only changes the output near it
+func TestRsyncable(t *testing.T) {
+	rsyncable = true
+	defer func() { rsyncable = false }()
+
+	var data bytes.Buffer
+	for i := 0; data.Len() < 20*BLOCK_SIZE; i++ {
+		fmt.Fprintf(&data, "%d\n", i)
+	}
+	changed := append([]byte("inserted\n"), data.Bytes()...)
+
+	compressed := make([][]byte, 2)
+	for i, input := range [][]byte{data.Bytes(), changed} {
+		var out bytes.Buffer
+		if err := compressStream(bytes.NewReader(input), &out); err != nil {
+			t.Fatal(err)
+		}
+		r, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(got, input) {
+			t.Fatalf("round trip: %v", err)
+		}
+		compressed[i] = out.Bytes()[:out.Len()-TRAILER_SIZE]
+	}
+
+	a, b := compressed[0], compressed[1]
+	same := 0
+	for same < len(a) && same < len(b) && a[len(a)-1-same] == b[len(b)-1-same] {
+		same++
+	}
+	if same < len(a)*3/4 {
+		t.Errorf("only the last %d of %d bytes are unchanged", same, len(a))
+	}
+}
+
+func TestRsyncCut(t *testing.T) {
+	data := make([]byte, BLOCK_SIZE)
+	for i := range data {
+		data[i] = byte(i * 7919 >> 3)
+	}
+	cut := rsyncCut(data)
+	if cut < RSYNC_MIN_BLOCK || cut > len(data) {
+		t.Errorf("cut at %d", cut)
+	}
+	// the cut depends on the content only
+	if again := rsyncCut(append([]byte{}, data[:cut]...)); again != cut {
+		t.Errorf("cut at %d, then %d", cut, again)
+	}
+	if short := rsyncCut(data[:100]); short != 100 {
+		t.Errorf("short input cut at %d", short)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 and Google Cloud Storage backends.
+//
+// Both speak the S3 multipart upload protocol: GCS implements it in its XML
+// API. S3 requests are signed with AWS Signature Version 4 using the usual
+// AWS_* environment variables; GCS requests carry an OAuth access token from
+// GOOGLE_OAUTH_ACCESS_TOKEN. Every part is sent with its Content-MD5, which
+// the service verifies before storing it.
+
+func init() {
+	outputSchemes["s3"] = openS3Output
+	outputSchemes["gs"] = openGCSOutput
+}
+
+// s3Upload is a multipart upload to an object URL.
+type s3Upload struct {
+	object   string
+	sign     func(req *http.Request, payload []byte)
+	uploadID string
+}
+
+func openS3Output(u *url.URL) (io.WriteCloser, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("s3 output needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	token := os.Getenv("AWS_SESSION_TOKEN")
+
+	// virtual-hosted style on AWS, path style on other endpoints
+	object := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", u.Host, region, uriEncode(strings.TrimPrefix(u.Path, "/"), false))
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		object = strings.TrimSuffix(endpoint, "/") + "/" + u.Host + "/" + uriEncode(strings.TrimPrefix(u.Path, "/"), false)
+	}
+
+	sign := func(req *http.Request, payload []byte) {
+		if token != "" {
+			req.Header.Set("X-Amz-Security-Token", token)
+		}
+		signV4(req, payload, accessKey, secretKey, region, "s3", time.Now())
+	}
+	return startS3Upload(object, sign)
+}
+
+func openGCSOutput(u *url.URL) (io.WriteCloser, error) {
+	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" {
+		return nil, errors.New("gs output needs GOOGLE_OAUTH_ACCESS_TOKEN")
+	}
+	endpoint := os.Getenv("GCS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	object := strings.TrimSuffix(endpoint, "/") + "/" + u.Host + "/" + uriEncode(strings.TrimPrefix(u.Path, "/"), false)
+
+	sign := func(req *http.Request, payload []byte) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return startS3Upload(object, sign)
+}
+
+func startS3Upload(object string, sign func(*http.Request, []byte)) (io.WriteCloser, error) {
+	s := &s3Upload{object: object, sign: sign}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err := withRetries("starting upload", func() error {
+		return s.do("POST", "?uploads", nil, nil, &result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.UploadID == "" {
+		return nil, errors.New("starting upload: no upload ID in response")
+	}
+	s.uploadID = result.UploadID
+	return newMultipartWriter(s), nil
+}
+
+func (s *s3Upload) do(method, query string, header http.Header, payload []byte, result interface{}) error {
+	_, err := s.doHeader(method, query, header, payload, result)
+	return err
+}
+
+// doHeader sends a signed request to the object URL plus query and decodes
+// an XML response into result, if given. It returns the response headers.
+func (s *s3Upload) doHeader(method, query string, header http.Header, payload []byte, result interface{}) (http.Header, error) {
+	req, err := http.NewRequest(method, s.object+query, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, payload)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	op := method + " " + req.URL.Redacted()
+	if err := checkResponse(op, resp); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// S3 may report a failed CompleteMultipartUpload with a 200 status
+	if bytes.Contains(body, []byte("<Error>")) {
+		return nil, &statusError{op, http.StatusInternalServerError, string(body)}
+	}
+	if result != nil {
+		if err := xml.Unmarshal(body, result); err != nil {
+			return nil, fmt.Errorf("%s: %v", op, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+func (s *s3Upload) UploadPart(n int, data []byte, sum []byte) (string, error) {
+	header := http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+	query := fmt.Sprintf("?partNumber=%d&uploadId=%s", n, uriEncode(s.uploadID, true))
+	h, err := s.doHeader("PUT", query, header, data, nil)
+	if err != nil {
+		return "", err
+	}
+	etag := h.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("part %d: no ETag in response", n)
+	}
+	return etag, nil
+}
+
+func (s *s3Upload) Complete(parts []string) error {
+	var body bytes.Buffer
+	body.WriteString("<CompleteMultipartUpload>")
+	for i, etag := range parts {
+		fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>", i+1)
+		xml.EscapeText(&body, []byte(etag))
+		body.WriteString("</ETag></Part>")
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+	return s.do("POST", "?uploadId="+uriEncode(s.uploadID, true), nil, body.Bytes(), nil)
+}
+
+func (s *s3Upload) Abort() error {
+	return s.do("DELETE", "?uploadId="+uriEncode(s.uploadID, true), nil, nil, nil)
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req.
+func signV4(req *http.Request, payload []byte, accessKey, secretKey, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	// headers to sign: host, content-*, and x-amz-*
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || strings.HasPrefix(lk, "content-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by name, as SigV4 requires.
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for k, vs := range query {
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters and,
+// unless encodeSlash is set, slashes.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
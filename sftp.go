@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+)
+
+// SFTP output target (--output sftp://[USER@]HOST[:PORT]/PATH).
+//
+// The output is written through the SFTP subsystem of the ssh client
+// (ssh -s HOST sftp), in version 3 of the protocol, which every server
+// speaks. Unlike ssh:// it needs no shell on the remote side, so it works
+// with internal-sftp and chrooted accounts; keys, ~/.ssh/config, /~/ paths
+// and GOPIGZ_SSH are as for ssh://. The stream goes to PATH.part with up to
+// SFTP_WINDOW writes awaiting the server's answer, and once the server
+// reports that the part file holds exactly the bytes sent it is renamed to
+// PATH: with the posix-rename@openssh.com extension when the server has it,
+// which replaces PATH in one step, or else by removing PATH first.
+//
+// With --spool, when the connection fails the session is opened again and
+// the stream resumes after the bytes PATH.part holds, as for ssh://.
+
+const (
+	SFTP_VERSION    = 3
+	SFTP_CHUNK      = 32 * 1024  // data per write request
+	SFTP_WINDOW     = 16         // write requests awaiting their status
+	SFTP_MAX_PACKET = 256 * 1024 // of a reply
+
+	SSH_FXP_INIT     = 1
+	SSH_FXP_VERSION  = 2
+	SSH_FXP_OPEN     = 3
+	SSH_FXP_CLOSE    = 4
+	SSH_FXP_WRITE    = 6
+	SSH_FXP_FSTAT    = 8
+	SSH_FXP_REMOVE   = 13
+	SSH_FXP_STAT     = 17
+	SSH_FXP_RENAME   = 18
+	SSH_FXP_STATUS   = 101
+	SSH_FXP_HANDLE   = 102
+	SSH_FXP_ATTRS    = 105
+	SSH_FXP_EXTENDED = 200
+
+	SSH_FXF_WRITE = 0x02
+	SSH_FXF_CREAT = 0x08
+	SSH_FXF_TRUNC = 0x10
+
+	SSH_FILEXFER_ATTR_SIZE = 0x01
+
+	SSH_FX_OK           = 0
+	SSH_FX_NO_SUCH_FILE = 2
+
+	SFTP_POSIX_RENAME = "posix-rename@openssh.com"
+)
+
+func init() {
+	outputSchemes["sftp"] = openSFTPOutput
+}
+
+// sftpError is a request the server answered with a failure status.
+type sftpError struct {
+	op   string
+	code uint32
+	msg  string
+}
+
+func (e *sftpError) Error() string {
+	return fmt.Sprintf("sftp: %s: %s", e.op, e.msg)
+}
+
+// sftpConn is an SFTP session over an ssh client. Writes are sent without
+// waiting for their status; every other request first collects those, then
+// waits for its own reply.
+type sftpConn struct {
+	cmd        *exec.Cmd
+	w          io.WriteCloser
+	r          *bufio.Reader
+	stderr     bytes.Buffer
+	id         uint32 // of the last request
+	pending    int    // writes awaiting their status
+	extensions map[string]bool
+	waited     bool
+	err        error
+}
+
+func appendBEUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendBEUint64(buf []byte, v uint64) []byte {
+	return appendBEUint32(appendBEUint32(buf, uint32(v>>32)), uint32(v))
+}
+
+// appendSFTPString appends s as an SFTP string, after its length.
+func appendSFTPString(buf []byte, s string) []byte {
+	return append(appendBEUint32(buf, uint32(len(s))), s...)
+}
+
+// sftpString splits the SFTP string at the start of data from the rest.
+func sftpString(data []byte) (string, []byte, bool) {
+	if len(data) < 4 || uint64(len(data)-4) < uint64(binary.BigEndian.Uint32(data)) {
+		return "", nil, false
+	}
+	n := 4 + int(binary.BigEndian.Uint32(data))
+	return string(data[4:n]), data[n:], true
+}
+
+// dialSFTP runs ssh with args, which name the sftp subsystem, and opens a
+// session with the server at its other end.
+func dialSFTP(args []string) (*sftpConn, error) {
+	c := &sftpConn{extensions: make(map[string]bool)}
+	c.cmd = exec.Command(args[0], args[1:]...)
+	c.cmd.Stderr = &c.stderr
+	var err error
+	if c.w, err = c.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.r = bufio.NewReader(stdout)
+	if err := c.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	if err := c.send(appendBEUint32([]byte{0, 0, 0, 0, SSH_FXP_INIT}, SFTP_VERSION)); err != nil {
+		return nil, err
+	}
+	typ, data, err := c.recv()
+	if err == nil && (typ != SSH_FXP_VERSION || len(data) < 4) {
+		c.kill()
+		err = errors.New("sftp: the server did not answer the session request")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// extensions come as name and data pairs after the version
+	for data = data[4:]; len(data) > 0; {
+		name, rest, ok := sftpString(data)
+		if !ok {
+			break
+		}
+		if _, data, ok = sftpString(rest); !ok {
+			break
+		}
+		c.extensions[name] = true
+	}
+	return c, nil
+}
+
+// request starts a request of type typ with a new id, leaving room for the
+// length of the packet.
+func (c *sftpConn) request(typ byte) []byte {
+	c.id++
+	return appendBEUint32([]byte{0, 0, 0, 0, typ}, c.id)
+}
+
+// send sends packet, filling in its length.
+func (c *sftpConn) send(packet []byte) error {
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	if _, err := c.w.Write(packet); err != nil {
+		return c.lost(err)
+	}
+	return nil
+}
+
+// recv reads a packet, returning its type and what follows.
+func (c *sftpConn) recv() (byte, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, c.lost(err)
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if n < 1 || n > SFTP_MAX_PACKET {
+		c.kill()
+		return 0, nil, fmt.Errorf("sftp: packet of %d bytes", n)
+	}
+	data := make([]byte, n-1)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return 0, nil, c.lost(err)
+	}
+	return head[4], data, nil
+}
+
+// call sends a request once the writes before it are answered, and returns
+// the type and content of its reply.
+func (c *sftpConn) call(packet []byte) (byte, []byte, error) {
+	if err := c.flush(); err != nil {
+		return 0, nil, err
+	}
+	if err := c.send(packet); err != nil {
+		return 0, nil, err
+	}
+	typ, data, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != c.id {
+		c.kill()
+		return 0, nil, errors.New("sftp: reply to another request")
+	}
+	return typ, data[4:], nil
+}
+
+// sftpStatus returns the error of a reply expected to be a status.
+func sftpStatus(op string, typ byte, data []byte) error {
+	if typ != SSH_FXP_STATUS || len(data) < 4 {
+		return fmt.Errorf("sftp: %s: unexpected reply %d", op, typ)
+	}
+	code := binary.BigEndian.Uint32(data)
+	if code == SSH_FX_OK {
+		return nil
+	}
+	msg, _, _ := sftpString(data[4:])
+	if msg == "" {
+		msg = fmt.Sprintf("status %d", code)
+	}
+	return &sftpError{op, code, msg}
+}
+
+// simple sends a request answered by a status.
+func (c *sftpConn) simple(op string, packet []byte) error {
+	typ, data, err := c.call(packet)
+	if err != nil {
+		return err
+	}
+	return sftpStatus(op, typ, data)
+}
+
+// open opens path for writing with the SSH_FXF flags, and returns its
+// handle.
+func (c *sftpConn) open(path string, flags uint32) (string, error) {
+	p := appendSFTPString(c.request(SSH_FXP_OPEN), path)
+	p = appendBEUint32(appendBEUint32(p, flags), 0) // no attributes
+	typ, data, err := c.call(p)
+	if err != nil {
+		return "", err
+	}
+	if typ != SSH_FXP_HANDLE {
+		return "", sftpStatus("open "+path, typ, data)
+	}
+	handle, _, ok := sftpString(data)
+	if !ok {
+		return "", errors.New("sftp: open: bad handle")
+	}
+	return handle, nil
+}
+
+// size returns the size in the attributes that a stat or fstat request
+// packet gets.
+func (c *sftpConn) size(op string, packet []byte) (int64, error) {
+	typ, data, err := c.call(packet)
+	if err != nil {
+		return 0, err
+	}
+	if typ != SSH_FXP_ATTRS {
+		return 0, sftpStatus(op, typ, data)
+	}
+	if len(data) < 12 || binary.BigEndian.Uint32(data)&SSH_FILEXFER_ATTR_SIZE == 0 {
+		return 0, fmt.Errorf("sftp: %s: no size", op)
+	}
+	return int64(binary.BigEndian.Uint64(data[4:])), nil
+}
+
+// write sends p to be written at offset of the file open as handle, in
+// requests of SFTP_CHUNK bytes at most, collecting the status of the
+// earliest ones once SFTP_WINDOW are pending.
+func (c *sftpConn) write(handle string, offset int64, p []byte) error {
+	for len(p) > 0 {
+		n := len(p)
+		if n > SFTP_CHUNK {
+			n = SFTP_CHUNK
+		}
+		packet := appendBEUint64(appendSFTPString(c.request(SSH_FXP_WRITE), handle), uint64(offset))
+		packet = append(appendBEUint32(packet, uint32(n)), p[:n]...)
+		if err := c.send(packet); err != nil {
+			return err
+		}
+		c.pending++
+		if c.pending >= SFTP_WINDOW {
+			if err := c.collect(); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+		p = p[n:]
+	}
+	return nil
+}
+
+// collect reads the status of a pending write.
+func (c *sftpConn) collect() error {
+	typ, data, err := c.recv()
+	if err != nil {
+		return err
+	}
+	c.pending--
+	if len(data) < 4 {
+		return errors.New("sftp: short reply")
+	}
+	return sftpStatus("write", typ, data[4:])
+}
+
+// flush waits for the status of all pending writes.
+func (c *sftpConn) flush() error {
+	for c.pending > 0 {
+		if err := c.collect(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rename moves from to to, replacing it.
+func (c *sftpConn) rename(from, to string) error {
+	if c.extensions[SFTP_POSIX_RENAME] {
+		p := appendSFTPString(c.request(SSH_FXP_EXTENDED), SFTP_POSIX_RENAME)
+		return c.simple("rename", appendSFTPString(appendSFTPString(p, from), to))
+	}
+	// the rename of version 3 fails if to exists
+	err := c.simple("remove "+to, appendSFTPString(c.request(SSH_FXP_REMOVE), to))
+	if e, ok := err.(*sftpError); err != nil && !(ok && e.code == SSH_FX_NO_SUCH_FILE) {
+		return err
+	}
+	p := appendSFTPString(c.request(SSH_FXP_RENAME), from)
+	return c.simple("rename", appendSFTPString(p, to))
+}
+
+// close ends the session.
+func (c *sftpConn) close() error {
+	c.w.Close()
+	return c.wait()
+}
+
+// lost returns why the session ended, from how ssh exited, after reading or
+// writing failed with err.
+func (c *sftpConn) lost(err error) error {
+	c.w.Close()
+	if werr := c.wait(); werr != nil {
+		return werr
+	}
+	return fmt.Errorf("sftp: connection closed: %v", err)
+}
+
+// kill stops ssh.
+func (c *sftpConn) kill() {
+	c.cmd.Process.Kill()
+	c.w.Close()
+	c.wait()
+}
+
+func (c *sftpConn) wait() error {
+	if !c.waited {
+		c.waited = true
+		c.err = sshExitError(c.cmd.Wait(), &c.stderr)
+	}
+	return c.err
+}
+
+type sftpOutput struct {
+	args   []string // ssh command, destination and subsystem
+	part   string
+	path   string
+	spool  *spool // nil unless broken connections are resumed
+	size   int64  // bytes sent
+	retry  backoff
+	conn   *sftpConn
+	handle string // of the part file
+}
+
+func openSFTPOutput(u *url.URL) (io.WriteCloser, error) {
+	args, path, err := sshTarget(u, "-s")
+	if err != nil {
+		return nil, err
+	}
+	o := &sftpOutput{args: append(args, "sftp"), part: path + ".part", path: path}
+	if o.spool, err = uploadSpool("sftp"); err != nil {
+		return nil, err
+	}
+	if err := o.start(false); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// start opens a session and the part file, emptied or, when resuming, as
+// it is, in which case the spool is sent from the size it has.
+func (o *sftpOutput) start(resume bool) (err error) {
+	c, err := dialSFTP(o.args)
+	if err != nil {
+		return err
+	}
+	o.conn = c
+	defer func() {
+		if err != nil {
+			c.kill()
+		}
+	}()
+
+	flags := uint32(SSH_FXF_WRITE | SSH_FXF_CREAT)
+	if !resume {
+		flags |= SSH_FXF_TRUNC
+	}
+	if o.handle, err = c.open(o.part, flags); err != nil || !resume {
+		return err
+	}
+	have, err := c.size("fstat", appendSFTPString(c.request(SSH_FXP_FSTAT), o.handle))
+	if err != nil {
+		return err
+	}
+	if have > o.spool.size {
+		return fmt.Errorf("sftp: cannot resume: remote part has %d bytes of %d", have, o.spool.size)
+	}
+	r := o.spool.from(have)
+	buf := make([]byte, SFTP_CHUNK*SFTP_WINDOW)
+	for offset := have; ; {
+		n, err := r.Read(buf)
+		if err := c.write(o.handle, offset, buf[:n]); err != nil {
+			return err
+		}
+		offset += int64(n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// restart reconnects after the connection failed with err, if it may.
+func (o *sftpOutput) restart(err error) error {
+	for o.spool != nil && o.retry.retry("upload", err) {
+		if err = o.start(true); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (o *sftpOutput) Write(p []byte) (int, error) {
+	if o.spool != nil {
+		if _, err := o.spool.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	offset := o.size
+	o.size += int64(len(p))
+	if err := o.conn.write(o.handle, offset, p); err != nil {
+		// the spool has p: a resumed stream sends it
+		if err := o.restart(err); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// finish closes the part file and renames it into place if it holds the
+// size bytes sent.
+func (o *sftpOutput) finish() error {
+	c := o.conn
+	if err := c.simple("close", appendSFTPString(c.request(SSH_FXP_CLOSE), o.handle)); err != nil {
+		return err
+	}
+	have, err := c.size("stat "+o.part, appendSFTPString(c.request(SSH_FXP_STAT), o.part))
+	if err != nil {
+		return err
+	}
+	if have != o.size {
+		return fmt.Errorf("sftp: remote part has %d bytes of %d", have, o.size)
+	}
+	if err := c.rename(o.part, o.path); err != nil {
+		return err
+	}
+	return c.close()
+}
+
+func (o *sftpOutput) Close() error {
+	if o.spool != nil {
+		defer o.spool.Close()
+	}
+	for {
+		err := o.finish()
+		if err == nil {
+			return nil
+		}
+		if err := o.restart(err); err != nil {
+			o.conn.kill()
+			return err
+		}
+	}
+}
+
+// Abort ends the session. The part file is left as it is, never renamed
+// into place.
+func (o *sftpOutput) Abort(err error) {
+	o.conn.kill()
+	if o.spool != nil {
+		o.spool.Close()
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// fakeSFTP installs a stand-in for ssh that runs TestSFTPServerHelper as the
+// server, serving dir, with the given settings in its environment.
+func fakeSFTP(t *testing.T, dir string, env ...string) {
+	fakeSSH := filepath.Join(dir, "fakessh")
+	script := "#!/bin/sh\nexec env GOPIGZ_SFTP_ROOT=" + shellQuote(dir)
+	for _, e := range env {
+		script += " " + shellQuote(e)
+	}
+	script += " " + shellQuote(os.Args[0]) + " -test.run='^TestSFTPServerHelper$'\n"
+	if err := ioutil.WriteFile(fakeSSH, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GOPIGZ_SSH", fakeSSH)
+}
+
+func readGzipFile(t *testing.T, path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	return got
+}
+
+// Test streaming to an sftp target, replacing an existing file with and
+// without the posix-rename extension
+func TestSFTPOutput(t *testing.T) {
+	dir := t.TempDir()
+	defer os.Unsetenv("GOPIGZ_SSH")
+	data := make([]byte, 3*BLOCK_SIZE)
+	rand.Read(data)
+
+	for _, env := range [][]string{nil, {"GOPIGZ_SFTP_NO_EXTENSIONS=1"}} {
+		fakeSFTP(t, dir, env...)
+		ioutil.WriteFile(filepath.Join(dir, "out.gz"), []byte("old"), 0644)
+		out, err := openOutput("sftp://me@backup.example.com/~/out.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := compressStream(bytes.NewReader(data), out); err != nil {
+			t.Fatal(err)
+		}
+		if err := out.Close(); err != nil {
+			t.Fatalf("%v: %v", env, err)
+		}
+		if got := readGzipFile(t, filepath.Join(dir, "out.gz")); !bytes.Equal(got, data) {
+			t.Errorf("%v: remote file differs from input", env)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "out.gz.part")); !os.IsNotExist(err) {
+			t.Errorf("%v: part file left behind", env)
+		}
+	}
+
+	// a failing request is reported
+	if _, err := openOutput("sftp://backup.example.com/~/missing/dir/out.gz"); err == nil {
+		t.Errorf("open in a missing directory succeeded")
+	}
+
+	// an aborted stream is never renamed into place
+	os.Remove(filepath.Join(dir, "out.gz"))
+	out, err := openOutput("sftp://backup.example.com/~/out.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(data)
+	out.(interface{ Abort(error) }).Abort(errors.New("interrupted"))
+	if _, err := os.Stat(filepath.Join(dir, "out.gz")); !os.IsNotExist(err) {
+		t.Errorf("aborted stream renamed into place: %v", err)
+	}
+}
+
+// Test that a stream whose connection drops resumes after what the remote
+// part file holds, with --spool
+func TestSFTPOutputResume(t *testing.T) {
+	spoolUploads = true
+	defer func() { spoolUploads = false }()
+	dir := t.TempDir()
+	// the first session takes 100000 bytes and drops
+	fakeSFTP(t, dir, "GOPIGZ_SFTP_DROP=100000")
+	defer os.Unsetenv("GOPIGZ_SSH")
+
+	data := make([]byte, 3*BLOCK_SIZE)
+	rand.Read(data)
+	out, err := openOutput("sftp://backup.example.com/~/out.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compressStream(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dropped")); err != nil {
+		t.Fatal("the connection never dropped")
+	}
+	if got := readGzipFile(t, filepath.Join(dir, "out.gz")); !bytes.Equal(got, data) {
+		t.Errorf("remote file differs from input")
+	}
+}
+
+// TestSFTPServerHelper serves the directory GOPIGZ_SFTP_ROOT over SFTP on
+// standard input and output, as much of it as the sftp output uses, for
+// the tests above. With GOPIGZ_SFTP_DROP, the first session exits with the
+// status of a failed ssh connection once it has written that many bytes.
+func TestSFTPServerHelper(t *testing.T) {
+	root := os.Getenv("GOPIGZ_SFTP_ROOT")
+	if root == "" {
+		t.Skip("helper process for the sftp tests")
+	}
+	drop, _ := strconv.ParseInt(os.Getenv("GOPIGZ_SFTP_DROP"), 10, 64)
+	if _, err := os.Stat(filepath.Join(root, "dropped")); err == nil {
+		drop = 0
+	}
+
+	r := bufio.NewReader(os.Stdin)
+	w := bufio.NewWriter(os.Stdout)
+	reply := func(typ byte, payload []byte) {
+		packet := appendBEUint32(nil, uint32(len(payload)+1))
+		w.Write(append(append(packet, typ), payload...))
+	}
+	status := func(id uint32, err error) {
+		code, msg := uint32(SSH_FX_OK), ""
+		if os.IsNotExist(err) {
+			code, msg = SSH_FX_NO_SUCH_FILE, err.Error()
+		} else if err != nil {
+			code, msg = 4, err.Error()
+		}
+		p := appendBEUint32(appendBEUint32(nil, id), code)
+		reply(SSH_FXP_STATUS, appendSFTPString(appendSFTPString(p, msg), ""))
+	}
+	attrs := func(id uint32, info os.FileInfo, err error) {
+		if err != nil {
+			status(id, err)
+			return
+		}
+		p := appendBEUint32(appendBEUint32(nil, id), SSH_FILEXFER_ATTR_SIZE)
+		reply(SSH_FXP_ATTRS, appendBEUint64(p, uint64(info.Size())))
+	}
+	local := func(name string) string { return filepath.Join(root, name) }
+
+	files := make(map[string]*os.File)
+	var written int64
+	for {
+		var head [5]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			os.Exit(0)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(head[:])-1)
+		io.ReadFull(r, data)
+		if head[4] == SSH_FXP_INIT {
+			p := appendBEUint32(nil, SFTP_VERSION)
+			if os.Getenv("GOPIGZ_SFTP_NO_EXTENSIONS") == "" {
+				p = appendSFTPString(appendSFTPString(p, SFTP_POSIX_RENAME), "1")
+			}
+			reply(SSH_FXP_VERSION, p)
+			w.Flush()
+			continue
+		}
+		id := binary.BigEndian.Uint32(data)
+		name, rest, _ := sftpString(data[4:])
+		switch head[4] {
+		case SSH_FXP_OPEN:
+			flags := os.O_WRONLY
+			pflags := binary.BigEndian.Uint32(rest)
+			if pflags&SSH_FXF_CREAT != 0 {
+				flags |= os.O_CREATE
+			}
+			if pflags&SSH_FXF_TRUNC != 0 {
+				flags |= os.O_TRUNC
+			}
+			f, err := os.OpenFile(local(name), flags, 0644)
+			if err != nil {
+				status(id, err)
+				break
+			}
+			handle := strconv.Itoa(len(files))
+			files[handle] = f
+			reply(SSH_FXP_HANDLE, appendSFTPString(appendBEUint32(nil, id), handle))
+		case SSH_FXP_WRITE:
+			offset := binary.BigEndian.Uint64(rest)
+			chunk, _, _ := sftpString(rest[8:])
+			if drop > 0 && written+int64(len(chunk)) > drop {
+				ioutil.WriteFile(filepath.Join(root, "dropped"), nil, 0644)
+				w.Flush()
+				os.Exit(255)
+			}
+			_, err := files[name].WriteAt([]byte(chunk), int64(offset))
+			written += int64(len(chunk))
+			status(id, err)
+		case SSH_FXP_FSTAT:
+			info, err := files[name].Stat()
+			attrs(id, info, err)
+		case SSH_FXP_STAT:
+			info, err := os.Stat(local(name))
+			attrs(id, info, err)
+		case SSH_FXP_CLOSE:
+			status(id, files[name].Close())
+		case SSH_FXP_REMOVE:
+			status(id, os.Remove(local(name)))
+		case SSH_FXP_RENAME:
+			to, _, _ := sftpString(rest)
+			if _, err := os.Stat(local(to)); err == nil {
+				status(id, errors.New("file exists"))
+				break
+			}
+			status(id, os.Rename(local(name), local(to)))
+		case SSH_FXP_EXTENDED:
+			from, rest, _ := sftpString(rest)
+			to, _, _ := sftpString(rest)
+			status(id, os.Rename(local(from), local(to)))
+		default:
+			status(id, errors.New("unsupported"))
+		}
+		w.Flush()
+	}
+}
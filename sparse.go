@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// Sparse file support.
+//
+// When a regular input has holes, the read stage does not read them from
+// disk but synthesizes the zeros, which still compress to almost nothing.
+// The hole map is recorded in an FEXTRA subfield so that decompressing to a
+// regular file can seek over the holes instead of writing zeros, recreating
+// the sparse layout. Decompressors that don't know the subfield still produce
+// the full logical content.
+
+// FEXTRA subfield ID for the hole map
+const (
+	SPARSE_SI1 = 'S'
+	SPARSE_SI2 = 'P'
+
+	// largest subfield payload that fits in FEXTRA
+	MAX_SUBFIELD_SIZE = 0xFFFF - 4
+)
+
+// extent is a byte range of a file.
+type extent struct {
+	Offset int64
+	Length int64
+}
+
+// sparseMap describes the holes of a file of logical size Size.
+type sparseMap struct {
+	Size  int64
+	Holes []extent
+}
+
+// encode serializes the map as the logical size followed by (gap, length)
+// pairs, where gap is the distance from the end of the previous hole. Holes
+// that do not fit in a subfield are left out; they are then simply written
+// out as zeros on decompression.
+func (m *sparseMap) encode() []byte {
+	buf := putVLI(nil, uint64(m.Size))
+	var end int64
+	for _, h := range m.Holes {
+		entry := putVLI(nil, uint64(h.Offset-end))
+		entry = putVLI(entry, uint64(h.Length))
+		if len(buf)+len(entry) > MAX_SUBFIELD_SIZE {
+			break
+		}
+		buf = append(buf, entry...)
+		end = h.Offset + h.Length
+	}
+	return buf
+}
+
+var errBadSparseMap = errors.New("corrupt sparse map in gzip header")
+
+func decodeSparseMap(buf []byte) (*sparseMap, error) {
+	r := bytes.NewReader(buf)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errBadSparseMap
+	}
+	m := &sparseMap{Size: int64(size)}
+	var end int64
+	for r.Len() > 0 {
+		gap, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errBadSparseMap
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errBadSparseMap
+		}
+		h := extent{Offset: end + int64(gap), Length: int64(length)}
+		if h.Offset+h.Length > m.Size {
+			return nil, errBadSparseMap
+		}
+		m.Holes = append(m.Holes, h)
+		end = h.Offset + h.Length
+	}
+	return m, nil
+}
+
+// findSubfield returns the payload of the FEXTRA subfield si1, si2.
+func findSubfield(extra []byte, si1, si2 byte) []byte {
+	for len(extra) >= 4 {
+		n := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+n {
+			return nil
+		}
+		if extra[0] == si1 && extra[1] == si2 {
+			return extra[4 : 4+n]
+		}
+		extra = extra[4+n:]
+	}
+	return nil
+}
+
+// sparseReader reads a file through its hole map, returning zeros for holes
+// without touching the disk.
+type sparseReader struct {
+	f      *os.File
+	m      *sparseMap
+	offset int64
+}
+
+func (r *sparseReader) Read(p []byte) (int, error) {
+	if r.offset >= r.m.Size {
+		return 0, io.EOF
+	}
+	if remaining := r.m.Size - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	for _, h := range r.m.Holes {
+		if r.offset >= h.Offset+h.Length {
+			continue
+		}
+		if r.offset >= h.Offset {
+			// inside a hole
+			n := h.Offset + h.Length - r.offset
+			if int64(len(p)) > n {
+				p = p[:n]
+			}
+			for i := range p {
+				p[i] = 0
+			}
+			r.offset += int64(len(p))
+			return len(p), nil
+		}
+		// data up to the next hole
+		if n := h.Offset - r.offset; int64(len(p)) > n {
+			p = p[:n]
+		}
+		break
+	}
+
+	n, err := r.f.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// sparseWriter writes to a file, seeking over all-zero data that falls in a
+// hole of the map instead of writing it.
+type sparseWriter struct {
+	f      *os.File
+	m      *sparseMap
+	offset int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk, inHole := w.next(int64(len(p)))
+		if inHole && isZero(p[:chunk]) {
+			if _, err := w.f.Seek(chunk, io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else if _, err := w.f.Write(p[:chunk]); err != nil {
+			return written, err
+		}
+		w.offset += chunk
+		written += int(chunk)
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// next returns how much of the following n bytes lie on the same side of a
+// hole boundary, and whether that range is in a hole.
+func (w *sparseWriter) next(n int64) (int64, bool) {
+	for _, h := range w.m.Holes {
+		if w.offset >= h.Offset+h.Length {
+			continue
+		}
+		if w.offset >= h.Offset {
+			if end := h.Offset + h.Length - w.offset; n > end {
+				n = end
+			}
+			return n, true
+		}
+		if gap := h.Offset - w.offset; n > gap {
+			n = gap
+		}
+		break
+	}
+	return n, false
+}
+
+// Close sets the final file size, which creates any trailing hole.
+func (w *sparseWriter) Close() error {
+	return w.f.Truncate(w.offset)
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// openSparse returns a reader over f that skips its holes together with the
+// hole map, or a nil map if f is not a sparse regular file.
+func openSparse(f *os.File) (io.Reader, *sparseMap) {
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return f, nil
+	}
+	holes := findHoles(f, info.Size())
+	if len(holes) == 0 {
+		return f, nil
+	}
+	m := &sparseMap{Size: info.Size(), Holes: holes}
+	return &sparseReader{f: f, m: m}, m
+}
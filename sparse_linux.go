@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// lseek(2) whence values for hole detection
+const (
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+)
+
+const HAVE_SPARSE = true
+
+// findHoles lists the holes of f using SEEK_DATA/SEEK_HOLE. Holes smaller
+// than a block are not worth recording and are skipped.
+func findHoles(f *os.File, size int64) []extent {
+	fd := int(f.Fd())
+	defer syscall.Seek(fd, 0, io.SeekStart)
+
+	var holes []extent
+	var offset int64
+	for offset < size {
+		hole, err := syscall.Seek(fd, offset, SEEK_HOLE)
+		if err != nil || hole >= size {
+			break
+		}
+		data, err := syscall.Seek(fd, hole, SEEK_DATA)
+		if err != nil {
+			// ENXIO: no more data, the file ends in a hole
+			data = size
+		}
+		if data-hole >= int64(blockSize) {
+			holes = append(holes, extent{Offset: hole, Length: data - hole})
+		}
+		offset = data
+	}
+	return holes
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSparseMapEncoding(t *testing.T) {
+	m := &sparseMap{
+		Size:  10 << 20,
+		Holes: []extent{{0, 1 << 20}, {3 << 20, 2 << 20}, {9 << 20, 1 << 20}},
+	}
+	got, err := decodeSparseMap(m.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("got %+v, want %+v", got, m)
+	}
+
+	if _, err := decodeSparseMap([]byte{0x01, 0x00, 0x05}); err == nil {
+		t.Errorf("expected an error for a hole past the end of the file")
+	}
+}
+
+// Test that reading through a hole map and writing it back out reproduces
+// the logical content of the file
+func TestSparseReadWrite(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 1000)
+	copy(data[100:], "data before the hole")
+	copy(data[900:], "data after the hole")
+	m := &sparseMap{Size: int64(len(data)), Holes: []extent{{0, 100}, {200, 700}, {950, 50}}}
+
+	// the reader must not look at the holes, so put garbage there on disk
+	onDisk := bytes.Repeat([]byte{0xFF}, len(data))
+	copy(onDisk[100:200], data[100:200])
+	copy(onDisk[900:950], data[900:950])
+	in, err := os.Create(filepath.Join(dir, "in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	in.Write(onDisk)
+
+	got, err := ioutil.ReadAll(&sparseReader{f: in, m: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("sparseReader returned wrong content")
+	}
+
+	out, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	w := &sparseWriter{f: out, m: m}
+	for i := 0; i < len(data); i += 64 {
+		end := i + 64
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := w.Write(data[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("sparseWriter wrote wrong content")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// SSH output target (--output ssh://[USER@]HOST[:PORT]/PATH).
+//
+// The output is streamed to the remote host through the ssh client, so keys,
+// agents and ~/.ssh/config work as usual. This is not SFTP: the remote
+// account needs a POSIX shell with cat, wc and mv, which internal-sftp and
+// other sftp-only or chrooted accounts lack. The stream is written to
+// PATH.part, and once it is complete a second command renames that to PATH
+// only if it holds exactly the bytes sent, so neither an aborted run nor a
+// remote end that lost data leaves a truncated archive in place. A failure
+// on either end is reported as an error. A path starting with /~/ is
+// relative to the remote home directory. The ssh command can be replaced
+// through GOPIGZ_SSH. Accounts without a shell can be written to over
+// sftp:// instead (see sftp.go).
+//
+// With --spool, when the connection fails (ssh exits with status 255) it is
+// opened again, the size of PATH.part is asked for, and the stream resumes
+// from there, out of a spool of what was sent.
+
+func init() {
+	outputSchemes["ssh"] = openSSHOutput
+}
+
+type sshOutput struct {
+	args   []string // ssh command and destination
+	part   string   // quoted remote names
+	path   string
+	spool  *spool // nil unless broken connections are resumed
+	size   int64  // bytes sent
+	retry  backoff
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	waited bool
+	err    error
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// sshTarget returns the ssh command reaching the host of u, with options
+// added before the destination, and the remote path, relative to the home
+// directory if it starts with /~/.
+func sshTarget(u *url.URL, options ...string) ([]string, string, error) {
+	path := u.Path
+	if strings.HasPrefix(path, "/~/") {
+		path = path[3:]
+	}
+	if path == "" || strings.HasSuffix(path, "/") {
+		return nil, "", fmt.Errorf("%s: no file name", u.Redacted())
+	}
+
+	ssh := os.Getenv("GOPIGZ_SSH")
+	if ssh == "" {
+		ssh = "ssh"
+	}
+	args := strings.Fields(ssh)
+	// never prompt: there is no terminal to answer on while streaming
+	args = append(args, "-o", "BatchMode=yes")
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	args = append(args, options...)
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	return append(args, "--", host), path, nil
+}
+
+func openSSHOutput(u *url.URL) (io.WriteCloser, error) {
+	args, path, err := sshTarget(u)
+	if err != nil {
+		return nil, err
+	}
+	o := &sshOutput{args: args, part: shellQuote(path + ".part"), path: shellQuote(path)}
+	if o.spool, err = uploadSpool("ssh"); err != nil {
+		return nil, err
+	}
+	if err := o.start(false); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// start runs the remote command writing the part file. When resuming, the
+// remote side first reports how much of the part file it has, and the spool
+// is sent from there.
+func (o *sshOutput) start(resume bool) error {
+	remote := fmt.Sprintf("cat > %s", o.part)
+	if resume {
+		remote = fmt.Sprintf("touch %s && wc -c < %s && cat >> %s", o.part, o.part, o.part)
+	}
+	if err := o.run(remote, resume); err != nil {
+		return err
+	}
+	if !resume {
+		return nil
+	}
+
+	line, err := bufio.NewReader(o.stdout).ReadString('\n')
+	if err != nil {
+		o.stdin.Close()
+		if err := o.wait(); err != nil {
+			return err
+		}
+		return errors.New("ssh: cannot resume: no size from the remote side")
+	}
+	have, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil || have > o.spool.size {
+		o.kill()
+		return fmt.Errorf("ssh: cannot resume: remote part has %q bytes of %d", strings.TrimSpace(line), o.spool.size)
+	}
+	if _, err := io.Copy(o.stdin, o.spool.from(have)); err != nil {
+		return o.wait()
+	}
+	return nil
+}
+
+// rename runs the remote command that moves the part file into place if it
+// holds the size bytes sent.
+func (o *sshOutput) rename() error {
+	remote := fmt.Sprintf(`n=$(wc -c < %s) || exit 1
+if [ "$n" -ne %d ]; then echo "remote part has $n bytes of %d" >&2; exit 1; fi
+mv -f %s %s`, o.part, o.size, o.size, o.part, o.path)
+	if err := o.run(remote, false); err != nil {
+		return err
+	}
+	o.stdin.Close()
+	return o.wait()
+}
+
+// run starts ssh with the remote command, its stdout piped if asked for.
+func (o *sshOutput) run(remote string, stdout bool) error {
+	args := append(append([]string{}, o.args...), remote)
+	o.cmd = exec.Command(args[0], args[1:]...)
+	o.stderr.Reset()
+	o.cmd.Stderr = &o.stderr
+	o.waited, o.err = false, nil
+
+	var err error
+	if o.stdin, err = o.cmd.StdinPipe(); err != nil {
+		return err
+	}
+	o.stdout = nil
+	if stdout {
+		if o.stdout, err = o.cmd.StdoutPipe(); err != nil {
+			return err
+		}
+	}
+	return o.cmd.Start()
+}
+
+// restart reconnects after the connection failed with err, if it may.
+func (o *sshOutput) restart(err error) error {
+	for o.spool != nil && o.retry.retry("upload", err) {
+		if err = o.start(true); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (o *sshOutput) Write(p []byte) (int, error) {
+	size := len(p)
+	for {
+		n, err := o.stdin.Write(p)
+		o.size += int64(n)
+		// what went into the pipe may have reached the remote file
+		if o.spool != nil {
+			if _, err := o.spool.Write(p[:n]); err != nil {
+				return 0, err
+			}
+		}
+		p = p[n:]
+		if err == nil {
+			return size, nil
+		}
+		if err = o.wait(); err == nil {
+			err = errors.New("ssh: remote command ended early")
+		}
+		if err := o.restart(err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (o *sshOutput) Close() error {
+	if o.spool != nil {
+		defer o.spool.Close()
+	}
+	for {
+		o.stdin.Close()
+		err := o.wait()
+		if err == nil {
+			break
+		}
+		if err := o.restart(err); err != nil {
+			return err
+		}
+	}
+	for {
+		err := o.rename()
+		if err == nil || !o.retry.retry("upload", err) {
+			return err
+		}
+	}
+}
+
+// Abort kills the ssh client. The part file is left as it is, never
+// renamed into place.
+func (o *sshOutput) Abort(err error) {
+	o.kill()
+	if o.spool != nil {
+		o.spool.Close()
+	}
+}
+
+// kill stops ssh. Its stdin is closed only once it is gone, so that the
+// remote command cannot finish, but its children see the end of the input.
+func (o *sshOutput) kill() {
+	o.cmd.Process.Kill()
+	o.stdin.Close()
+	o.wait()
+}
+
+// wait waits for ssh to exit.
+func (o *sshOutput) wait() error {
+	if o.waited {
+		return o.err
+	}
+	o.waited = true
+	o.err = sshExitError(o.cmd.Wait(), &o.stderr)
+	return o.err
+}
+
+// sshExitError returns the error of ssh exiting with err, with what it
+// printed to stderr. Status 255 means the connection failed, which may not
+// happen again.
+func sshExitError(err error, stderr *bytes.Buffer) error {
+	if err == nil {
+		return nil
+	}
+	failed := fmt.Errorf("ssh: %v", err)
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		failed = fmt.Errorf("ssh: %v: %s", err, msg)
+	}
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 255 {
+		return &transientError{failed}
+	}
+	return failed
+}
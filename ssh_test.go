@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test streaming to an ssh target, with a stand-in for ssh that runs the
+// remote command in a local directory
+func TestSSHOutput(t *testing.T) {
+	dir := t.TempDir()
+	fakeSSH := filepath.Join(dir, "fakessh")
+	script := "#!/bin/sh\nfor a; do last=$a; done\ncd " + shellQuote(dir) + " && exec sh -c \"$last\"\n"
+	if err := ioutil.WriteFile(fakeSSH, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GOPIGZ_SSH", fakeSSH)
+	defer os.Unsetenv("GOPIGZ_SSH")
+
+	data := bytes.Repeat([]byte("over ssh\n"), 10000)
+	out, err := openOutput("ssh://me@backup.example.com/~/it's.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compressStream(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "it's.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(got, data) {
+		t.Errorf("remote file differs from input")
+	}
+
+	// a failing remote command is reported
+	out, err = openOutput("ssh://backup.example.com/~/missing/dir/out.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(data)
+	if err := out.Close(); err == nil {
+		t.Errorf("remote failure not reported")
+	}
+}
+
+// Test that a stream whose connection drops resumes after what the remote
+// part file holds, with --spool
+func TestSSHOutputResume(t *testing.T) {
+	spoolUploads = true
+	defer func() { spoolUploads = false }()
+	dir := t.TempDir()
+	fakeSSH := filepath.Join(dir, "fakessh")
+	// the first connection takes 5000 bytes and drops
+	script := "#!/bin/sh\nfor a; do last=$a; done\ncd " + shellQuote(dir) + " || exit 1\n" +
+		"if [ ! -e dropped ]; then touch dropped; head -c 5000 > out.gz.part; exit 255; fi\n" +
+		"exec sh -c \"$last\"\n"
+	if err := ioutil.WriteFile(fakeSSH, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GOPIGZ_SSH", fakeSSH)
+	defer os.Unsetenv("GOPIGZ_SSH")
+
+	data := make([]byte, 200000)
+	rand.Read(data)
+	out, err := openOutput("ssh://backup.example.com/~/out.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compressStream(bytes.NewReader(data), out); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "dropped")); err != nil {
+		t.Fatal("the connection never dropped")
+	}
+	f, err := os.Open(filepath.Join(dir, "out.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(got, data) {
+		t.Errorf("remote file differs from input")
+	}
+}
+
+// Test that neither an aborted stream nor one the remote end lost bytes of
+// is renamed into place
+func TestSSHOutputIncomplete(t *testing.T) {
+	dir := t.TempDir()
+	fakeSSH := filepath.Join(dir, "fakessh")
+	// with lossy, the part file gets only the first 5000 bytes
+	script := "#!/bin/sh\nfor a; do last=$a; done\ncd " + shellQuote(dir) + " || exit 1\n" +
+		"case \"$last\" in 'cat > '*) if [ -e lossy ]; then head -c 5000 > out.gz.part; cat > /dev/null; exit 0; fi;; esac\n" +
+		"exec sh -c \"$last\"\n"
+	if err := ioutil.WriteFile(fakeSSH, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GOPIGZ_SSH", fakeSSH)
+	defer os.Unsetenv("GOPIGZ_SSH")
+
+	data := make([]byte, 200000)
+	rand.Read(data)
+	out, err := openOutput("ssh://backup.example.com/~/out.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(data)
+	out.(interface{ Abort(error) }).Abort(errors.New("interrupted"))
+	if _, err := os.Stat(filepath.Join(dir, "out.gz")); !os.IsNotExist(err) {
+		t.Errorf("aborted stream renamed into place: %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "lossy"), nil, 0644)
+	if out, err = openOutput("ssh://backup.example.com/~/out.gz"); err != nil {
+		t.Fatal(err)
+	}
+	out.Write(data)
+	if err := out.Close(); err == nil || !strings.Contains(err.Error(), "5000 bytes of 200000") {
+		t.Errorf("lossy remote: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.gz")); !os.IsNotExist(err) {
+		t.Errorf("short part renamed into place: %v", err)
+	}
+}
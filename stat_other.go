@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// linkCount is always 1 where link counts are not available.
+func linkCount(info os.FileInfo) uint64 {
+	return 1
+}
+
+// fileOwner reports no owner where files have none.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
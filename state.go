@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Incremental state database (--state FILE).
+//
+// The database remembers the size, modification time and CRC-32 of every
+// file compressed so far, so that repeated archival runs only process files
+// that are new or have changed, even when the outputs are kept elsewhere.
+// The CRC-32 is that of the input whatever the format, summed by the
+// workers with the blocks and combined by the write stage, so a file
+// compressed to zstd one day and checked the next compares the same.
+
+// Parsing state flag
+var statePath string
+
+type stateEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"hash"`
+}
+
+var state map[string]stateEntry
+
+func loadState() error {
+	state = make(map[string]stateEntry)
+	data, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %v", statePath, err)
+	}
+	return nil
+}
+
+// saveState writes the database to a temporary file and renames it into
+// place, so an interrupted run never leaves a truncated database behind.
+func saveState() error {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := statePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath)
+}
+
+func stateKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// unchangedSinceState reports whether path was already compressed in a
+// previous run. If only the modification time differs, the content is
+// checksummed and compared before deciding.
+func unchangedSinceState(path string, info os.FileInfo) bool {
+	entry, ok := state[stateKey(path)]
+	if !ok || entry.Size != info.Size() {
+		return false
+	}
+	if entry.ModTime.Equal(info.ModTime()) {
+		return true
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if entry.Hash != fmt.Sprintf("crc32:%08x", parallelChecksum("crc32", f)) {
+		return false
+	}
+
+	entry.ModTime = info.ModTime()
+	state[stateKey(path)] = entry
+	return true
+}
+
+func recordState(path string, result fileResult) {
+	state[stateKey(path)] = stateEntry{
+		Size:    result.inSize,
+		ModTime: result.modTime,
+		Hash:    fmt.Sprintf("crc32:%08x", result.sum),
+	}
+}
+
+// saveStateOrWarn saves the database if --state is in use.
+func saveStateOrWarn() {
+	if state == nil {
+		return
+	}
+	if err := saveState(); err != nil {
+		log.Println(err)
+		setError()
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateDatabase(t *testing.T) {
+	dir := t.TempDir()
+	statePath = filepath.Join(dir, "state.json")
+	defer func() { statePath, state = "", nil }()
+	if err := loadState(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "data.txt")
+	data := []byte("some data")
+	ioutil.WriteFile(path, data, 0644)
+	info, _ := os.Stat(path)
+
+	if unchangedSinceState(path, info) {
+		t.Errorf("unknown file reported as unchanged")
+	}
+	recordState(path, fileResult{inSize: info.Size(), modTime: info.ModTime(), sum: crc32.ChecksumIEEE(data)})
+
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+	state = nil
+	if err := loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if !unchangedSinceState(path, info) {
+		t.Errorf("recorded file reported as changed")
+	}
+
+	// touched, same content
+	later := info.ModTime().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	info, _ = os.Stat(path)
+	if !unchangedSinceState(path, info) {
+		t.Errorf("touched file with the same content reported as changed")
+	}
+
+	// same size, different content
+	ioutil.WriteFile(path, []byte("more data"), 0644)
+	later = later.Add(time.Minute)
+	os.Chtimes(path, later, later)
+	info, _ = os.Stat(path)
+	if unchangedSinceState(path, info) {
+		t.Errorf("modified file reported as unchanged")
+	}
+}
+
+// Test that the recorded hash is the CRC-32 of the input whatever the
+// format, so that files compressed to zlib are found unchanged
+func TestStateFormat(t *testing.T) {
+	dir := t.TempDir()
+	statePath = filepath.Join(dir, "state.json")
+	format = "zlib"
+	defer func() { statePath, state, format = "", nil, "gzip" }()
+	if err := loadState(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "data.txt")
+	data := make([]byte, 3*BLOCK_SIZE+100)
+	rand.Read(data)
+	ioutil.WriteFile(path, data, 0644)
+	compressFile(path)
+	if _, err := os.Stat(path + ".zz"); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("crc32:%08x", crc32.ChecksumIEEE(data))
+	if got := state[stateKey(path)].Hash; got != want {
+		t.Errorf("recorded %q, want %q", got, want)
+	}
+
+	ioutil.WriteFile(path, data, 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	info, _ := os.Stat(path)
+	if !unchangedSinceState(path, info) {
+		t.Errorf("touched file with the same content reported as changed")
+	}
+}
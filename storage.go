@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Object storage outputs (--output s3://..., gs://..., az://...).
+//
+// Object stores take large uploads in parts. A backend only implements
+// starting, sending a part, completing and aborting an upload; buffering the
+// output into parts, retrying failed requests and checking the integrity of
+// every part is shared, so new cloud targets plug in without touching the
+// pipeline.
+//
+// The size of the output is not known in advance, and an upload takes at
+// most MAX_PARTS parts. So parts start at PART_SIZE, which keeps little in
+// memory, and double every PARTS_PER_SIZE parts up to MAX_PART_SIZE: the
+// first thousand parts hold 8 GiB, and the ten thousand allowed reach past
+// the 5 TiB an object may hold.
+
+// Sizes of the parts uploads are split into
+const (
+	PART_SIZE      = 8 * 1024 * 1024 // 8 MiB, to begin with
+	MAX_PART_SIZE  = 5 << 30         // 5 GiB
+	PARTS_PER_SIZE = 1000
+	MAX_PARTS      = 10000
+)
+
+// Number of times a failed request is retried by default, and the delay
+// before the first retry (see retry.go)
+const (
+	MAX_RETRIES = 4
+	RETRY_DELAY = 500 * time.Millisecond
+)
+
+// multipartUpload is an upload in progress to an object store.
+type multipartUpload interface {
+	// UploadPart stores part number n (counting from 1) whose MD5 digest is
+	// sum, and returns the identifier Complete needs for it.
+	UploadPart(n int, data []byte, sum []byte) (string, error)
+	// Complete assembles the parts into the object.
+	Complete(parts []string) error
+	// Abort discards the parts uploaded so far.
+	Abort() error
+}
+
+// multipartWriter buffers its input into parts and uploads them.
+type multipartWriter struct {
+	upload   multipartUpload
+	partSize int
+	buf      []byte
+	parts    []string
+	err      error
+}
+
+func newMultipartWriter(upload multipartUpload) *multipartWriter {
+	return &multipartWriter{upload: upload, partSize: PART_SIZE}
+}
+
+func (w *multipartWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for size := w.partSize; len(w.buf) >= size; size = w.partSize {
+		if err := w.flushPart(w.buf[:size]); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[size:]...)
+	}
+	return len(p), nil
+}
+
+func (w *multipartWriter) flushPart(data []byte) error {
+	sum := md5.Sum(data)
+	n := len(w.parts) + 1
+	if n > MAX_PARTS {
+		w.err = fmt.Errorf("output exceeds the %d parts of an upload", MAX_PARTS)
+		return w.err
+	}
+	var id string
+	err := withRetries(fmt.Sprintf("part %d", n), func() error {
+		var err error
+		id, err = w.upload.UploadPart(n, data, sum[:])
+		return err
+	})
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.parts = append(w.parts, id)
+	if len(w.parts)%PARTS_PER_SIZE == 0 && w.partSize*2 <= MAX_PART_SIZE {
+		w.partSize *= 2
+	}
+	return nil
+}
+
+// Close uploads the last part and completes the upload. An upload that
+// failed is aborted instead.
+func (w *multipartWriter) Close() error {
+	if w.err == nil && (len(w.buf) > 0 || len(w.parts) == 0) {
+		w.flushPart(w.buf)
+	}
+	if w.err == nil {
+		w.err = withRetries("completing upload", func() error {
+			return w.upload.Complete(w.parts)
+		})
+		if w.err == nil {
+			return nil
+		}
+	}
+	w.Abort(w.err)
+	return w.err
+}
+
+// Abort discards the upload, so a failed run leaves no partial object.
+func (w *multipartWriter) Abort(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+	if err := w.upload.Abort(); err != nil {
+		log.Println("aborting upload:", err)
+	}
+}
+
+// statusError is an unexpected HTTP response from a storage service.
+type statusError struct {
+	op     string
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.op, e.status, e.msg)
+}
+
+// checkResponse returns a statusError unless resp has a 2xx status.
+func checkResponse(op string, resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &statusError{op, resp.StatusCode, http.StatusText(resp.StatusCode) + " " + string(body)}
+}
+
+// retryable reports whether a request that failed with err may succeed if
+// sent again: network errors, throttling and server errors.
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *statusError:
+		return e.status == http.StatusTooManyRequests || e.status/100 == 5
+	case *transientError, net.Error:
+		return true
+	}
+	return false
+}
+
+func withRetries(op string, f func() error) error {
+	var b backoff
+	for {
+		err := f()
+		if err == nil || !b.retry(op, err) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeStore is an object store keeping uploaded parts in memory. The first
+// attempt to upload part 2 fails, to exercise retries.
+type fakeStore struct {
+	mu      sync.Mutex
+	parts   map[string][]byte
+	object  []byte
+	failed  bool
+	aborted bool
+}
+
+func (f *fakeStore) putPart(w http.ResponseWriter, r *http.Request, key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key == "2" && !f.failed {
+		f.failed = true
+		http.Error(w, "slow down", http.StatusServiceUnavailable)
+		return false
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	sum := md5.Sum(data)
+	if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+		http.Error(w, "BadDigest", http.StatusBadRequest)
+		return false
+	}
+	if f.parts == nil {
+		f.parts = make(map[string][]byte)
+	}
+	f.parts[key] = data
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum))
+	w.Header().Set("Content-MD5", r.Header.Get("Content-MD5"))
+	return true
+}
+
+func (f *fakeStore) assemble(keys []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.object = nil
+	for _, k := range keys {
+		f.object = append(f.object, f.parts[k]...)
+	}
+}
+
+func (f *fakeStore) s3Handler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") {
+			http.Error(w, "unsigned", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/bucket/dir/out.gz" {
+			t.Errorf("request for %s", r.URL.Path)
+		}
+		q := r.URL.Query()
+		switch {
+		case r.Method == "POST" && q["uploads"] != nil:
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>up1</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == "PUT" && q.Get("uploadId") == "up1":
+			f.putPart(w, r, q.Get("partNumber"))
+		case r.Method == "POST" && q.Get("uploadId") == "up1":
+			var c struct {
+				Parts []struct {
+					PartNumber int
+				} `xml:"Part"`
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			xml.Unmarshal(body, &c)
+			var keys []string
+			for _, p := range c.Parts {
+				keys = append(keys, strconv.Itoa(p.PartNumber))
+			}
+			f.assemble(keys)
+			fmt.Fprint(w, "<CompleteMultipartUploadResult/>")
+		case r.Method == "DELETE":
+			f.aborted = true
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	})
+}
+
+func (f *fakeStore) azureHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("sig") != "secret" || r.URL.Path != "/container/dir/out.gz" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		switch q.Get("comp") {
+		case "block":
+			id, _ := base64.StdEncoding.DecodeString(q.Get("blockid"))
+			f.putPart(w, r, strconv.Itoa(int(id[len(id)-1]-'0')))
+		case "blocklist":
+			var l struct {
+				Latest []string
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			xml.Unmarshal(body, &l)
+			var keys []string
+			for _, id := range l.Latest {
+				b, _ := base64.StdEncoding.DecodeString(id)
+				keys = append(keys, strconv.Itoa(int(b[len(b)-1]-'0')))
+			}
+			f.assemble(keys)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	})
+}
+
+// Test multipart uploads to S3 and Azure, with a retried part
+func TestStorageOutput(t *testing.T) {
+	data := make([]byte, 2500)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	for _, backend := range []string{"s3", "az"} {
+		f := &fakeStore{}
+		var srv *httptest.Server
+		var target string
+		if backend == "s3" {
+			srv = httptest.NewServer(f.s3Handler(t))
+			os.Setenv("AWS_ACCESS_KEY_ID", "test")
+			os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+			os.Setenv("AWS_ENDPOINT_URL", srv.URL)
+			target = "s3://bucket/dir/out.gz"
+		} else {
+			srv = httptest.NewServer(f.azureHandler(t))
+			os.Setenv("AZURE_STORAGE_SAS_TOKEN", "?sv=1&sig=secret")
+			os.Setenv("AZURE_STORAGE_ENDPOINT", srv.URL)
+			target = "az://account/container/dir/out.gz"
+		}
+
+		out, err := openOutput(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.(*multipartWriter).partSize = 1000
+		for i := 0; i < len(data); i += 300 {
+			end := i + 300
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := out.Write(data[i:end]); err != nil {
+				t.Fatalf("%s: %v", backend, err)
+			}
+		}
+		if err := out.Close(); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+
+		if !f.failed {
+			t.Errorf("%s: failing part was not retried", backend)
+		}
+		keys := make([]string, 0, len(f.parts))
+		for k := range f.parts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if len(keys) != 3 || !bytes.Equal(f.object, data) {
+			t.Errorf("%s: uploaded parts %v, object of %d bytes", backend, keys, len(f.object))
+		}
+		srv.Close()
+	}
+	for _, v := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_ENDPOINT_URL", "AZURE_STORAGE_SAS_TOKEN", "AZURE_STORAGE_ENDPOINT"} {
+		os.Unsetenv(v)
+	}
+}
+
+// memoryUpload keeps the parts uploaded to it.
+type memoryUpload struct {
+	parts [][]byte
+}
+
+func (u *memoryUpload) UploadPart(n int, data []byte, sum []byte) (string, error) {
+	u.parts = append(u.parts, append([]byte(nil), data...))
+	return strconv.Itoa(n), nil
+}
+
+func (u *memoryUpload) Complete(parts []string) error { return nil }
+func (u *memoryUpload) Abort() error                  { return nil }
+
+// Test that parts double in size every PARTS_PER_SIZE parts, so that large
+// outputs fit in MAX_PARTS
+func TestPartSizeGrows(t *testing.T) {
+	u := &memoryUpload{}
+	w := newMultipartWriter(u)
+	w.partSize = 10
+	data := make([]byte, 10*PARTS_PER_SIZE+20*PARTS_PER_SIZE+5)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.parts) != 2*PARTS_PER_SIZE+1 || !bytes.Equal(bytes.Join(u.parts, nil), data) {
+		t.Fatalf("%d parts", len(u.parts))
+	}
+	for i, size := range map[int]int{0: 10, PARTS_PER_SIZE - 1: 10, PARTS_PER_SIZE: 20, 2*PARTS_PER_SIZE - 1: 20, 2 * PARTS_PER_SIZE: 5} {
+		if len(u.parts[i]) != size {
+			t.Errorf("part %d of %d bytes, want %d", i+1, len(u.parts[i]), size)
+		}
+	}
+
+	// the sizes add up to more than an object may hold
+	total, size := int64(0), int64(PART_SIZE)
+	for n := 1; n <= MAX_PARTS; n++ {
+		total += size
+		if n%PARTS_PER_SIZE == 0 && size*2 <= MAX_PART_SIZE {
+			size *= 2
+		}
+	}
+	if total < 5<<40 {
+		t.Errorf("%d parts hold %d bytes", MAX_PARTS, total)
+	}
+}
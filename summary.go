@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// End-of-run summary for multi-file and recursive runs.
+//
+// With --stats-line every run, a single stream included, also ends with one
+// line of key=value pairs on stderr, in a format that stays stable for log
+// based monitoring to pick up.
+
+// Parsing json and stats-line flags
+var jsonOutput bool
+var statsLine bool
+
+type runSummary struct {
+	Processed int     `json:"processed"`
+	Skipped   int     `json:"skipped"`
+	Failed    int     `json:"failed"`
+	BytesIn   int64   `json:"bytes_in"`
+	BytesOut  int64   `json:"bytes_out"`
+	Ratio     float64 `json:"ratio"`
+	Seconds   float64 `json:"seconds"`
+	MBPerSec  float64 `json:"mb_per_s"`
+}
+
+var summary runSummary
+var startTime = time.Now()
+
+// The count functions record the outcome of each file for the summary, the
+// --progress-fd event stream and the --progress display.
+
+func countProcessed(path string, bytesIn, bytesOut int64) {
+	summary.Processed++
+	summary.BytesIn += bytesIn
+	summary.BytesOut += bytesOut
+	endDisplay()
+	compressed, uncompressed := bytesOut, bytesIn
+	if decompress {
+		compressed, uncompressed = bytesIn, bytesOut
+	}
+	ratio := 0.0
+	if uncompressed > 0 {
+		ratio = 100 * float64(uncompressed-compressed) / float64(uncompressed)
+	}
+	verbosef("%s:\t%5.1f%%", path, ratio)
+	emitProgress(progressEvent{Event: "finished", File: path, BytesIn: bytesIn, BytesOut: bytesOut})
+}
+
+func countSkipped(path string) {
+	summary.Skipped++
+	endDisplay()
+	emitProgress(progressEvent{Event: "skipped", File: path})
+}
+
+// countIgnored records a file that is not an input of the run, such as the
+// output of an earlier one when compressing. It is left out of the summary,
+// so that rerunning over a tree reports nothing skipped.
+func countIgnored(path string) {
+	endDisplay()
+	emitProgress(progressEvent{Event: "skipped", File: path})
+}
+
+func countFailed(path string, err error) {
+	summary.Failed++
+	endDisplay()
+	emitProgress(progressEvent{Event: "error", File: path, Error: err.Error()})
+}
+
+// finishSummary fills in the derived fields. The ratio is the space saved
+// relative to the uncompressed size, as gzip -l reports it, and throughput
+// is measured on the uncompressed side.
+func finishSummary() {
+	summary.Seconds = time.Since(startTime).Seconds()
+
+	compressed, uncompressed := summary.BytesOut, summary.BytesIn
+	if decompress {
+		compressed, uncompressed = summary.BytesIn, summary.BytesOut
+	}
+	if uncompressed > 0 {
+		summary.Ratio = 1 - float64(compressed)/float64(uncompressed)
+	}
+	if summary.Seconds > 0 {
+		summary.MBPerSec = float64(uncompressed) / 1e6 / summary.Seconds
+	}
+}
+
+// printSummary writes the summary to stderr, as a JSON object with --json.
+// The text summary is left out with -q; the JSON object, being asked for, is
+// not.
+func printSummary() {
+	finishSummary()
+
+	if jsonOutput {
+		json.NewEncoder(os.Stderr).Encode(summary)
+		return
+	}
+	if currentVerbosity() == VERBOSITY_QUIET {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d processed, %d skipped, %d failed; %d -> %d bytes, %.1f%% saved; %.2fs, %.1f MB/s\n",
+		summary.Processed, summary.Skipped, summary.Failed,
+		summary.BytesIn, summary.BytesOut, summary.Ratio*100,
+		summary.Seconds, summary.MBPerSec)
+}
+
+// printStatsLine writes the --stats-line summary to stderr.
+func printStatsLine() {
+	finishSummary()
+	fmt.Fprintf(os.Stderr, "gopigz: bytes_in=%d bytes_out=%d ratio=%.4f seconds=%.3f mb_per_s=%.2f workers=%d\n",
+		summary.BytesIn, summary.BytesOut, summary.Ratio, summary.Seconds, summary.MBPerSec, processes)
+}
+
+// exitRun ends a run with its exit status, after the --stats-line summary.
+func exitRun() {
+	if statsLine {
+		printStatsLine()
+	}
+	os.Exit(exitStatus)
+}
+
+// countStreams wraps the input and output of a run over streams to count
+// their bytes for --stats-line. The returned function adds them to the
+// summary once the stream is done.
+func countStreams(in io.Reader, out io.Writer) (io.Reader, io.Writer, func()) {
+	if !statsLine {
+		return in, out, func() {}
+	}
+	r, w := &countReader{r: in}, &countWriter{w: out}
+	return r, w, func() {
+		summary.Processed++
+		summary.BytesIn += r.n
+		summary.BytesOut += w.n
+	}
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
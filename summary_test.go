@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestFinishSummary(t *testing.T) {
+	defer func() { summary, decompress = runSummary{}, false }()
+
+	summary = runSummary{}
+	countProcessed("a", 1000, 250)
+	countProcessed("a", 1000, 250)
+	countSkipped("b")
+	finishSummary()
+	if summary.Processed != 2 || summary.Skipped != 1 || summary.Failed != 0 {
+		t.Errorf("got %+v", summary)
+	}
+	if math.Abs(summary.Ratio-0.75) > 1e-9 {
+		t.Errorf("compression ratio %v, want 0.75", summary.Ratio)
+	}
+
+	// decompressing the same files reports the same ratio
+	summary = runSummary{}
+	decompress = true
+	countProcessed("a", 500, 2000)
+	finishSummary()
+	if math.Abs(summary.Ratio-0.75) > 1e-9 {
+		t.Errorf("decompression ratio %v, want 0.75", summary.Ratio)
+	}
+}
+
+// Test that -q leaves out the text summary but not the --json one
+func TestPrintSummaryQuiet(t *testing.T) {
+	stderr, err := ioutil.TempFile(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	saved := os.Stderr
+	os.Stderr = stderr
+	setVerbosity(VERBOSITY_QUIET)
+	defer func() { os.Stderr, jsonOutput, summary = saved, false, runSummary{} }()
+	defer setVerbosity(VERBOSITY_NORMAL)
+
+	summary = runSummary{}
+	countProcessed("a", 1000, 250)
+	printSummary()
+	if info, _ := stderr.Stat(); info.Size() != 0 {
+		t.Errorf("summary printed with -q")
+	}
+	jsonOutput = true
+	printSummary()
+	if info, _ := stderr.Stat(); info.Size() == 0 {
+		t.Errorf("--json summary left out with -q")
+	}
+}
+
+// Test that runs over streams are counted for --stats-line
+func TestCountStreams(t *testing.T) {
+	statsLine = true
+	summary = runSummary{}
+	defer func() { statsLine, summary = false, runSummary{} }()
+
+	data := bytes.Repeat([]byte("counted\n"), 10000)
+	var out bytes.Buffer
+	in, w, count := countStreams(bytes.NewReader(data), &out)
+	if err := compressStream(in, w); err != nil {
+		t.Fatal(err)
+	}
+	count()
+	if summary.Processed != 1 || summary.BytesIn != int64(len(data)) || summary.BytesOut != int64(out.Len()) {
+		t.Errorf("got %+v for %d -> %d bytes", summary, len(data), out.Len())
+	}
+}
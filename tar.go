@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// One-pass tar archives (--tar).
+//
+// gopigz --tar PATHS... archives the paths into a tar stream that is fed
+// straight into the pipeline, instead of tar cf - PATHS | gopigz, so that
+// there is a single progress display and summary for the whole archive,
+// sized by walking the trees beforehand. The archive goes to NAME.tar plus
+// the format's suffix next to the first path, NAME being its base name, or
+// to -c or --output, and the inputs are always kept. Directories, regular
+// files and symbolic links are archived with their modes, owners and times;
+// other files are skipped with a warning, and a file that shrinks while it
+// is read is padded with zeros, as GNU tar does.
+
+// Parsing tar flag
+var tarMode bool
+
+// Name of the archive when the first path has none, such as /
+const TAR_DEFAULT_NAME = "archive"
+
+func init() {
+	flag.BoolVar(&tarMode, "tar", false, "Archive the paths given into one compressed tar file, named after the first")
+}
+
+// runTar implements --tar.
+func runTar(paths []string) {
+	if len(paths) == 0 {
+		log.Fatal("--tar needs the paths to archive")
+	}
+	if decompress {
+		log.Fatal("--tar cannot be combined with -d")
+	}
+
+	var out io.WriteCloser
+	var outPath string
+	var outFile *os.File
+	var err error
+	switch {
+	case toStdout && outputTarget != "":
+		log.Fatal("-c and --output cannot be combined")
+	case toStdout:
+		if !force && isTerminal(os.Stdout) {
+			log.Fatal("compressed data not written to a terminal -- use -f to force")
+		}
+		outPath = STDOUT_TARGET
+		out, err = openOutput(STDOUT_TARGET)
+	case outputTarget != "":
+		outPath = outputTarget
+		out, err = openOutput(outputTarget)
+	default:
+		outPath = mirrorPath(tarName(paths[0])) + ".tar" + suffix()
+		outFile, err = createOutput(outPath)
+		out = outFile
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the archive must not take itself in
+	var outInfo os.FileInfo
+	if f, ok := out.(*os.File); ok {
+		outInfo, _ = f.Stat()
+	}
+
+	startProgress(outPath, tarSize(paths))
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(pw, paths, outInfo))
+	}()
+	w := &countWriter{w: out}
+	in := &countReader{r: pr}
+	err = compressStream(in, w)
+	pr.CloseWithError(err)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		exitIfBrokenPipe(err)
+		if outFile != nil {
+			os.Remove(outPath)
+		} else if a, ok := out.(interface{ Abort(error) }); ok {
+			a.Abort(err)
+		}
+		log.Println(err)
+		setError()
+		countFailed(outPath, err)
+	} else {
+		countProcessed(outPath, in.n, w.n)
+	}
+	exitRun()
+}
+
+// tarName returns the name an archive of path is given, without suffixes.
+func tarName(path string) string {
+	path = filepath.Clean(path)
+	if base := filepath.Base(path); base == "." || base == ".." {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+	if base := filepath.Base(path); base == string(filepath.Separator) || base == "." {
+		return TAR_DEFAULT_NAME
+	}
+	return path
+}
+
+// tarEntryName returns the name of path in an archive: the path as given,
+// relative, with forward slashes.
+func tarEntryName(path string) string {
+	name := filepath.ToSlash(filepath.Clean(path))
+	for strings.HasPrefix(name, "../") {
+		name = name[3:]
+	}
+	name = strings.TrimLeft(name, "/")
+	if name == ".." {
+		name = "."
+	}
+	return name
+}
+
+// tarSize estimates the size of the archive of paths, for the progress
+// display: a header for every entry and the padded data of the files.
+func tarSize(paths []string) int64 {
+	size := int64(2 * tarBlock)
+	for _, root := range paths {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			size += tarBlock
+			if d.Type().IsRegular() {
+				if info, err := d.Info(); err == nil {
+					size += (info.Size() + tarBlock - 1) / tarBlock * tarBlock
+				}
+			}
+			return nil
+		})
+	}
+	return size
+}
+
+// Size of tar headers and of the units file data is padded to
+const tarBlock = 512
+
+// writeTar writes the tar archive of paths to w, skipping the file of
+// outInfo, if not nil. Files that cannot be read are reported and left out.
+func writeTar(w io.Writer, paths []string, outInfo os.FileInfo) error {
+	tw := tar.NewWriter(w)
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				log.Println(err)
+				setError()
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				log.Println(err)
+				setError()
+				return nil
+			}
+			if outInfo != nil && os.SameFile(info, outInfo) {
+				return nil
+			}
+			return writeTarEntry(tw, path, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeTarEntry writes the header of the file at path and its data.
+func writeTarEntry(tw *tar.Writer, path string, info os.FileInfo) error {
+	var link string
+	switch mode := info.Mode(); {
+	case mode.IsRegular(), mode.IsDir():
+	case mode&os.ModeSymlink != 0:
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			log.Println(err)
+			setError()
+			return nil
+		}
+	default:
+		warnf("%s is not a regular file, directory or link -- ignored", path)
+		return nil
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = tarEntryName(path)
+	if info.IsDir() {
+		if header.Name == "." {
+			return nil
+		}
+		header.Name += "/"
+	}
+	if deterministic {
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	}
+	if !info.Mode().IsRegular() {
+		return tw.WriteHeader(header)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Println(err)
+		setError()
+		return nil
+	}
+	defer f.Close()
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	n, err := io.CopyN(tw, f, header.Size)
+	if errors.Is(err, io.EOF) {
+		warnf("%s: file shrank by %d bytes -- padding with zeros", path, header.Size-n)
+		_, err = io.CopyN(tw, zeroReader{}, header.Size-n)
+	}
+	return err
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
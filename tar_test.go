@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTarEntryName(t *testing.T) {
+	for path, want := range map[string]string{
+		"dir/file":      "dir/file",
+		"./dir//file":   "dir/file",
+		"/abs/dir":      "abs/dir",
+		"../../up/file": "up/file",
+		"dir/../file":   "file",
+		".":             ".",
+		"..":            ".",
+	} {
+		if got := tarEntryName(path); got != want {
+			t.Errorf("tarEntryName(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+// Test that a tree archived through the pipeline reads back with its files,
+// links and modes
+func TestTar(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "tree")
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 5000)
+	ioutil.WriteFile(filepath.Join(root, "sub", "data.txt"), data, 0640)
+	ioutil.WriteFile(filepath.Join(root, "empty"), nil, 0600)
+	os.Symlink("sub/data.txt", filepath.Join(root, "link"))
+
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(writeTar(pw, []string{root}, nil)) }()
+	var out bytes.Buffer
+	if err := compressStream(pr, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	var names []string
+	base := tarEntryName(root)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+		switch h.Name {
+		case base + "/sub/data.txt":
+			got, _ := ioutil.ReadAll(tr)
+			if !bytes.Equal(got, data) || h.Mode&0777 != 0640 {
+				t.Errorf("data.txt: %d bytes, mode %o", len(got), h.Mode)
+			}
+		case base + "/link":
+			if h.Typeflag != tar.TypeSymlink || h.Linkname != "sub/data.txt" {
+				t.Errorf("link: type %c to %q", h.Typeflag, h.Linkname)
+			}
+		}
+	}
+	want := []string{base + "/", base + "/empty", base + "/link", base + "/sub/", base + "/sub/data.txt"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("entries %q, want %q", names, want)
+	}
+}
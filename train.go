@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+)
+
+// Dictionary training: gopigz train --out FILE [--size N] FILES|DIRS...
+//
+// Many small, similar files (log lines, JSON records) compress poorly on
+// their own because every file starts with an empty window. A dictionary
+// holding the content they share fixes that. Training samples the corpus
+// and builds a raw content dictionary the way zstd's cover algorithm does:
+// the corpus is divided into epochs, and from each epoch the segment whose
+// DMER_SIZE-byte substrings occur in the most files is picked. Substrings
+// already covered count no more, and the best segments go last, where
+// deflate reaches them with the shortest distances. The result works with
+// --dict. With --format zstd it is written as a zstd dictionary, which has
+// an ID that zstd frames compressed with it name, and which zstd -D reads.
+
+// Length of the substrings counted, and of the segments picked
+const (
+	DMER_SIZE    = 8
+	SEGMENT_SIZE = 256
+)
+
+// Bytes read from each file, and in total
+const (
+	TRAIN_SAMPLE_SIZE = 128 * 1024
+	TRAIN_MAX_INPUT   = 128 * 1024 * 1024
+)
+
+// runTrain implements the train subcommand.
+func runTrain(args []string) {
+	fs := flag.NewFlagSet("train", flag.ExitOnError)
+	out := fs.String("out", "", "Write the dictionary to this file")
+	size := fs.Int("size", DICT_SIZE, "Dictionary size in bytes")
+	fs.Parse(args)
+	if *out == "" || fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gopigz train --out FILE [--size N] FILES|DIRS...")
+		os.Exit(1)
+	}
+
+	samples := loadSamples(fs.Args())
+	if len(samples) < 2 {
+		log.Fatal("train: need at least two sample files")
+	}
+	dict := trainDictionary(samples, *size)
+	if c := lookupCodec(format); c != nil && c.trainedDictionary != nil {
+		dict = c.trainedDictionary(dict)
+	}
+	if err := ioutil.WriteFile(*out, dict, 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "%d byte dictionary trained on %d files\n", len(dict), len(samples))
+	os.Exit(exitStatus)
+}
+
+// loadSamples reads the start of every file in paths, descending into
+// directories.
+func loadSamples(paths []string) [][]byte {
+	var samples [][]byte
+	total := 0
+	add := func(path string) {
+		if total >= TRAIN_MAX_INPUT {
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			warnf("%v", err)
+			return
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(f, TRAIN_SAMPLE_SIZE))
+		if err != nil {
+			warnf("%v", err)
+			return
+		}
+		if len(data) >= DMER_SIZE {
+			samples = append(samples, data)
+			total += len(data)
+		}
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			warnf("%v", err)
+			continue
+		}
+		if !info.IsDir() {
+			add(path)
+			continue
+		}
+		for entry := range walkTree(path) {
+			if entry.err != nil {
+				warnf("%v", entry.err)
+				continue
+			}
+			add(entry.path)
+		}
+	}
+	return samples
+}
+
+func dmerAt(data []byte, i int) uint64 {
+	return binary.LittleEndian.Uint64(data[i:])
+}
+
+// trainDictionary builds a dictionary of at most size bytes from samples.
+func trainDictionary(samples [][]byte, size int) []byte {
+	// number of samples each substring occurs in
+	freq := make(map[uint64]int)
+	for _, s := range samples {
+		seen := make(map[uint64]bool)
+		for i := 0; i+DMER_SIZE <= len(s); i++ {
+			d := dmerAt(s, i)
+			if !seen[d] {
+				seen[d] = true
+				freq[d]++
+			}
+		}
+	}
+	// substrings found in a single file are no use to the others
+	for d, n := range freq {
+		if n < 2 {
+			delete(freq, d)
+		}
+	}
+
+	type segment struct {
+		data  []byte
+		score int
+	}
+	var segments []segment
+	filled := 0
+
+	epochs := size / SEGMENT_SIZE
+	if epochs < 1 {
+		epochs = 1
+	}
+	// keep picking rounds of segments until the dictionary is full or
+	// nothing shared is left
+	for filled < size {
+		picked := false
+		for e := 0; e < epochs && filled < size; e++ {
+			seg, score := bestSegment(samples, e, epochs, freq)
+			if score == 0 {
+				continue
+			}
+			picked = true
+			segments = append(segments, segment{seg, score})
+			filled += len(seg)
+			for i := 0; i+DMER_SIZE <= len(seg); i++ {
+				delete(freq, dmerAt(seg, i))
+			}
+		}
+		if !picked {
+			break
+		}
+	}
+
+	// best segments last
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].score < segments[j].score })
+	var dict []byte
+	for _, s := range segments {
+		dict = append(dict, s.data...)
+	}
+	if len(dict) > size {
+		dict = dict[len(dict)-size:]
+	}
+	return dict
+}
+
+// bestSegment returns the highest scoring segment in epoch e of the
+// corpus, and its score: the summed frequencies of the substrings starting
+// in it. The epochs divide the samples, taken one after the other, into
+// equal ranges.
+func bestSegment(samples [][]byte, e, epochs int, freq map[uint64]int) ([]byte, int) {
+	total := 0
+	for _, s := range samples {
+		total += len(s)
+	}
+	epochSize := total / epochs
+	if epochSize < SEGMENT_SIZE {
+		epochSize = SEGMENT_SIZE
+	}
+	from, to := e*epochSize, (e+1)*epochSize
+
+	var best []byte
+	bestScore := 0
+	offset := 0
+	for _, s := range samples {
+		start, end := from-offset, to-offset
+		offset += len(s)
+		if start < 0 {
+			start = 0
+		}
+		if end > len(s) {
+			end = len(s)
+		}
+		if end-start < DMER_SIZE {
+			continue
+		}
+		data := s[start:end]
+
+		// sliding window over the substrings starting in a segment
+		window := SEGMENT_SIZE - DMER_SIZE + 1
+		score := 0
+		for i := 0; i+DMER_SIZE <= len(data); i++ {
+			score += freq[dmerAt(data, i)]
+			if i >= window {
+				score -= freq[dmerAt(data, i-window)]
+			}
+			if score > bestScore {
+				bestScore = score
+				first := i - window + 1
+				if first < 0 {
+					first = 0
+				}
+				best = data[first : i+DMER_SIZE]
+			}
+		}
+	}
+	return best, bestScore
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"testing"
+)
+
+func jsonRecord(i int) []byte {
+	return []byte(fmt.Sprintf(`{"timestamp":"2024-03-%02dT12:%02d:%02dZ","level":"info","service":"checkout-api",`+
+		`"message":"request completed","request_id":"%08x","status":%d,"duration_ms":%d}`+"\n",
+		i%28+1, i%60, (i*7)%60, i*2654435761, 200+i%3*100, i%977))
+}
+
+func deflateSize(data, dict []byte) int {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriterDict(&buf, flate.BestCompression, dict)
+	w.Write(data)
+	w.Close()
+	return buf.Len()
+}
+
+// Test that a trained dictionary improves compression of small files like
+// the ones it was trained on
+func TestTrainDictionary(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, jsonRecord(i))
+	}
+	dict := trainDictionary(samples, 4096)
+	if len(dict) == 0 || len(dict) > 4096 {
+		t.Fatalf("dictionary of %d bytes", len(dict))
+	}
+
+	plain, primed := 0, 0
+	for i := 1000; i < 1020; i++ {
+		plain += deflateSize(jsonRecord(i), nil)
+		primed += deflateSize(jsonRecord(i), dict)
+	}
+	if primed*2 > plain {
+		t.Errorf("dictionary saved too little: %d bytes without, %d with", plain, primed)
+	}
+}
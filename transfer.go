@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// TCP transfers: gopigz send --connect HOST:PORT [FILE] and
+// gopigz recv --listen ADDR [FILE].
+//
+// These replace pipelines like tar c dir | gzip | nc host 9000 on one end
+// and nc -l 9000 | gunzip | tar x on the other:
+//
+//	gopigz recv --listen :9000 | tar x
+//	tar c dir | gopigz send --connect host:9000
+//
+// The sender compresses its input onto the connection and closes its side;
+// the receiver decompresses everything up to there and answers whether it
+// succeeded, so the sender only exits 0 once the data has arrived whole,
+// which nc cannot tell. The receiver takes a single connection, like
+// nc -l. Both ends must use the same --format.
+//
+// With --tls the connection is encrypted: the receiver presents --cert and
+// --key, and the sender checks them against the system roots or --ca.
+
+// Answers from the receiver
+const (
+	TRANSFER_OK    = "OK"
+	TRANSFER_ERROR = "ERROR "
+)
+
+// transferTLS is the TLS configuration of either end.
+type transferTLS struct {
+	enabled    bool
+	ca         string
+	serverName string
+	cert       string
+	key        string
+}
+
+// clientConfig returns the configuration of the sending end, or nil
+// without --tls.
+func (t *transferTLS) clientConfig() (*tls.Config, error) {
+	if !t.enabled {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: t.serverName, MinVersion: tls.VersionTLS12}
+	if t.ca != "" {
+		pem, err := ioutil.ReadFile(t.ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", t.ca)
+		}
+	}
+	return config, nil
+}
+
+// serverConfig returns the configuration of the receiving end, or nil
+// without --tls.
+func (t *transferTLS) serverConfig() (*tls.Config, error) {
+	if !t.enabled {
+		return nil, nil
+	}
+	if t.cert == "" || t.key == "" {
+		return nil, errors.New("--tls needs --cert and --key")
+	}
+	cert, err := tls.LoadX509KeyPair(t.cert, t.key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// closeWriter is a connection that can be half closed.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// sendStream compresses input onto conn and waits for the receiver's
+// answer.
+func sendStream(conn net.Conn, input io.Reader) error {
+	if err := compressStream(input, conn); err != nil {
+		return err
+	}
+	if cw, ok := conn.(closeWriter); ok {
+		if err := cw.CloseWrite(); err != nil {
+			return err
+		}
+	}
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no answer from the receiver: %v", err)
+	}
+	answer = strings.TrimSuffix(answer, "\n")
+	if answer != TRANSFER_OK {
+		return fmt.Errorf("receiver: %s", strings.TrimPrefix(answer, TRANSFER_ERROR))
+	}
+	return nil
+}
+
+// receiveStream decompresses what arrives on conn to output and answers
+// the sender.
+func receiveStream(conn net.Conn, output io.Writer) error {
+	err := decompressStream(conn, output)
+	answer := TRANSFER_OK
+	if err != nil {
+		answer = TRANSFER_ERROR + strings.ReplaceAll(err.Error(), "\n", " ")
+	}
+	if _, werr := io.WriteString(conn, answer+"\n"); err == nil {
+		err = werr
+	}
+	return err
+}
+
+func runSend(args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	addr := fs.String("connect", "", "Receiver address, HOST:PORT")
+	var t transferTLS
+	fs.BoolVar(&t.enabled, "tls", false, "Connect with TLS")
+	fs.StringVar(&t.ca, "ca", "", "Trust the certificates in this PEM file instead of the system roots")
+	fs.StringVar(&t.serverName, "server-name", "", "Name expected in the receiver's certificate (default: the host of --connect)")
+	fs.Parse(args)
+	if *addr == "" || fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: gopigz send --connect HOST:PORT [--tls [--ca FILE]] [FILE]")
+		os.Exit(1)
+	}
+
+	input := io.Reader(os.Stdin)
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	config, err := t.clientConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var conn net.Conn
+	if config != nil {
+		conn, err = tls.Dial("tcp", *addr, config)
+	} else {
+		conn, err = net.Dial("tcp", *addr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := sendStream(conn, input); err != nil {
+		log.Fatal(err)
+	}
+	exitRun()
+}
+
+func runRecv(args []string) {
+	fs := flag.NewFlagSet("recv", flag.ExitOnError)
+	addr := fs.String("listen", "", "Address to listen on, [HOST]:PORT")
+	var t transferTLS
+	fs.BoolVar(&t.enabled, "tls", false, "Accept TLS connections")
+	fs.StringVar(&t.cert, "cert", "", "Certificate to present with --tls (PEM)")
+	fs.StringVar(&t.key, "key", "", "Private key of --cert (PEM)")
+	fs.Parse(args)
+	if *addr == "" || fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: gopigz recv --listen [HOST]:PORT [--tls --cert FILE --key FILE] [FILE]")
+		os.Exit(1)
+	}
+
+	config, err := t.serverConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	log.Println("listening on", l.Addr())
+	conn, err := l.Accept()
+	l.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	log.Println("receiving from", conn.RemoteAddr())
+
+	output := os.Stdout
+	if fs.NArg() == 1 {
+		if output, err = os.Create(fs.Arg(0)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := receiveStream(conn, output); err != nil {
+		log.Fatal(err)
+	}
+	if err := output.Close(); err != nil {
+		log.Fatal(err)
+	}
+	exitRun()
+}
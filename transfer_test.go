@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned writes a certificate for 127.0.0.1 and its key to dir.
+func selfSigned(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gopigz test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// Test sending a stream over plain TCP and TLS
+func TestTransfer(t *testing.T) {
+	data := bytes.Repeat([]byte("sent over the network\n"), 50000)
+	certFile, keyFile := selfSigned(t, t.TempDir())
+
+	for _, useTLS := range []bool{false, true} {
+		server := transferTLS{enabled: useTLS, cert: certFile, key: keyFile}
+		client := transferTLS{enabled: useTLS, ca: certFile}
+		serverConfig, err := server.serverConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig, err := client.clientConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if useTLS {
+			l = tls.NewListener(l, serverConfig)
+		}
+		var got bytes.Buffer
+		received := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				received <- err
+				return
+			}
+			defer conn.Close()
+			received <- receiveStream(conn, &got)
+		}()
+
+		var conn net.Conn
+		if useTLS {
+			conn, err = tls.Dial("tcp", l.Addr().String(), clientConfig)
+		} else {
+			conn, err = net.Dial("tcp", l.Addr().String())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sendStream(conn, bytes.NewReader(data)); err != nil {
+			t.Errorf("tls %v: %v", useTLS, err)
+		}
+		conn.Close()
+		l.Close()
+		if err := <-received; err != nil {
+			t.Errorf("tls %v: receiver: %v", useTLS, err)
+		}
+		if !bytes.Equal(got.Bytes(), data) {
+			t.Errorf("tls %v: received %d bytes, want %d", useTLS, got.Len(), len(data))
+		}
+	}
+}
+
+// Test that a stream the receiver cannot decompress fails on both ends
+func TestTransferError(t *testing.T) {
+	sender, receiver := tcpPair(t)
+	answer := make(chan string, 1)
+	go func(sender net.Conn) {
+		sender.Write([]byte("not gzip"))
+		sender.(*net.TCPConn).CloseWrite()
+		line, _ := bufio.NewReader(sender).ReadString('\n')
+		answer <- line
+		sender.Close()
+	}(sender)
+	if err := receiveStream(receiver, ioutil.Discard); err == nil {
+		t.Errorf("receiver accepted a broken stream")
+	}
+	if line := <-answer; !strings.HasPrefix(line, TRANSFER_ERROR) {
+		t.Errorf("receiver answered %q", line)
+	}
+
+	sender, receiver = tcpPair(t)
+	go func(receiver net.Conn) {
+		ioutil.ReadAll(io.LimitReader(receiver, 10))
+		receiver.Write([]byte(TRANSFER_ERROR + "disk full\n"))
+		io.Copy(ioutil.Discard, receiver)
+	}(receiver)
+	err := sendStream(sender, strings.NewReader("data"))
+	if err == nil || err.Error() != "receiver: disk full" {
+		t.Errorf("got %v, want the receiver's error", err)
+	}
+	sender.Close()
+}
+
+// tcpPair returns the two ends of a TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, accepted
+}
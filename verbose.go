@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// Verbosity (-q, -v).
+//
+// Errors and warnings are printed by default. -q leaves out the warnings,
+// as gzip -q does, -v adds a line with the ratio of every file, and -v -v
+// the progress of every block through the pipeline, which is only of use
+// when debugging it: logging every block slows it down.
+
+const (
+	VERBOSITY_QUIET = iota
+	VERBOSITY_NORMAL
+	VERBOSITY_VERBOSE
+	VERBOSITY_DEBUG
+)
+
+// Parsing quiet and verbose flags. The daemon changes the verbosity from
+// its control connections while jobs run, so it goes through
+// currentVerbosity and setVerbosity.
+var verbosity int32 = VERBOSITY_NORMAL
+
+func currentVerbosity() int32 {
+	return atomic.LoadInt32(&verbosity)
+}
+
+func setVerbosity(v int32) {
+	atomic.StoreInt32(&verbosity, v)
+}
+
+func init() {
+	flag.Var(quietFlag{}, "quiet", "Suppress all warnings")
+	flag.Var(quietFlag{}, "q", "Suppress all warnings")
+	flag.Var(verboseFlag{}, "verbose", "Print the name and ratio of every file; twice, trace every block")
+	flag.Var(verboseFlag{}, "v", "Print the name and ratio of every file; twice, trace every block")
+}
+
+// quietFlag is a boolean flag that sets the verbosity to quiet.
+type quietFlag struct{}
+
+func (quietFlag) IsBoolFlag() bool { return true }
+func (quietFlag) String() string   { return "false" }
+func (quietFlag) Set(s string) error {
+	if s == "true" {
+		setVerbosity(VERBOSITY_QUIET)
+	}
+	return nil
+}
+
+// verboseFlag is a boolean flag that raises the verbosity every time it is
+// given.
+type verboseFlag struct{}
+
+func (verboseFlag) IsBoolFlag() bool { return true }
+func (verboseFlag) String() string   { return "false" }
+func (verboseFlag) Set(s string) error {
+	if v := currentVerbosity(); s == "true" && v < VERBOSITY_DEBUG {
+		if v < VERBOSITY_NORMAL {
+			v = VERBOSITY_NORMAL
+		}
+		setVerbosity(v + 1)
+	}
+	return nil
+}
+
+// warnf prints a warning unless -q is given, and sets the exit status.
+func warnf(format string, args ...interface{}) {
+	if currentVerbosity() > VERBOSITY_QUIET {
+		log.Printf(format, args...)
+	}
+	setWarning()
+}
+
+// verbosef prints a line about a file with -v.
+func verbosef(format string, args ...interface{}) {
+	if currentVerbosity() >= VERBOSITY_VERBOSE {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+// debugln logs the progress of the pipeline with -v -v.
+func debugln(args ...interface{}) {
+	if currentVerbosity() >= VERBOSITY_DEBUG {
+		log.Println(args...)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestVerbosity(t *testing.T) {
+	defer func() { verbosity = VERBOSITY_NORMAL }()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	for _, v := range []struct {
+		flags []string
+		want  int32
+	}{
+		{[]string{"q"}, VERBOSITY_QUIET},
+		{[]string{"v"}, VERBOSITY_VERBOSE},
+		{[]string{"v", "verbose", "v"}, VERBOSITY_DEBUG},
+		{[]string{"q", "v"}, VERBOSITY_VERBOSE},
+	} {
+		verbosity = VERBOSITY_NORMAL
+		for _, name := range v.flags {
+			flag.Set(name, "true")
+		}
+		if verbosity != v.want {
+			t.Errorf("%v: verbosity %d, want %d", v.flags, verbosity, v.want)
+		}
+	}
+
+	verbosity = VERBOSITY_QUIET
+	exitStatus = 0
+	warnf("%s is a directory -- ignored", "dir")
+	debugln("read block#1")
+	if logged.Len() != 0 || exitStatus != 2 {
+		t.Errorf("quiet: logged %q, exit status %d", logged.String(), exitStatus)
+	}
+
+	verbosity = VERBOSITY_NORMAL
+	warnf("%s is a directory -- ignored", "dir")
+	debugln("read block#1")
+	if logged.String() == "" || bytes.Contains(logged.Bytes(), []byte("block")) {
+		t.Errorf("normal: logged %q", logged.String())
+	}
+	exitStatus = 0
+}
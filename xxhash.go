@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// XXH64, the checksum of zstd frames. Only the low 32 bits end up in the
+// frame, so the hash also serves as a hash.Hash32.
+
+const (
+	XXH_PRIME1 uint64 = 11400714785074694791
+	XXH_PRIME2 uint64 = 14029467366897019727
+	XXH_PRIME3 uint64 = 1609587929392839161
+	XXH_PRIME4 uint64 = 9650029242287828579
+	XXH_PRIME5 uint64 = 2870177450012600261
+)
+
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int
+}
+
+func newXXH64() *xxh64 {
+	h := &xxh64{}
+	h.Reset()
+	return h
+}
+
+func (h *xxh64) Reset() {
+	p1 := XXH_PRIME1
+	h.v = [4]uint64{p1 + XXH_PRIME2, XXH_PRIME2, 0, -p1}
+	h.total = 0
+	h.n = 0
+}
+
+func (h *xxh64) Size() int      { return 4 }
+func (h *xxh64) BlockSize() int { return 32 }
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * XXH_PRIME2
+	return bits.RotateLeft64(acc, 31) * XXH_PRIME1
+}
+
+func xxhMerge(acc, v uint64) uint64 {
+	acc ^= xxhRound(0, v)
+	return acc*XXH_PRIME1 + XXH_PRIME4
+}
+
+func (h *xxh64) stripe(b []byte) {
+	le := binary.LittleEndian
+	h.v[0] = xxhRound(h.v[0], le.Uint64(b))
+	h.v[1] = xxhRound(h.v[1], le.Uint64(b[8:]))
+	h.v[2] = xxhRound(h.v[2], le.Uint64(b[16:]))
+	h.v[3] = xxhRound(h.v[3], le.Uint64(b[24:]))
+}
+
+func (h *xxh64) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], p)
+		h.n += c
+		p = p[c:]
+		if h.n < 32 {
+			return n, nil
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		h.stripe(p)
+	}
+	h.n = copy(h.buf[:], p)
+	return n, nil
+}
+
+func (h *xxh64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		acc = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) +
+			bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			acc = xxhMerge(acc, v)
+		}
+	} else {
+		acc = h.v[2] + XXH_PRIME5
+	}
+	acc += h.total
+
+	le := binary.LittleEndian
+	p := h.buf[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		acc ^= xxhRound(0, le.Uint64(p))
+		acc = bits.RotateLeft64(acc, 27)*XXH_PRIME1 + XXH_PRIME4
+	}
+	if len(p) >= 4 {
+		acc ^= uint64(le.Uint32(p)) * XXH_PRIME1
+		acc = bits.RotateLeft64(acc, 23)*XXH_PRIME2 + XXH_PRIME3
+		p = p[4:]
+	}
+	for _, c := range p {
+		acc ^= uint64(c) * XXH_PRIME5
+		acc = bits.RotateLeft64(acc, 11) * XXH_PRIME1
+	}
+
+	acc ^= acc >> 33
+	acc *= XXH_PRIME2
+	acc ^= acc >> 29
+	acc *= XXH_PRIME3
+	acc ^= acc >> 32
+	return acc
+}
+
+// Sum32 returns the low 32 bits of the hash, as stored in zstd frames.
+func (h *xxh64) Sum32() uint32 {
+	return uint32(h.Sum64())
+}
+
+// Sum appends the 32-bit frame checksum, little-endian, to b.
+func (h *xxh64) Sum(b []byte) []byte {
+	return appendUint32(b, h.Sum32())
+}
+
+// XXH32, the checksum of lz4 frames, their blocks and their descriptors.
+
+const (
+	XXH32_PRIME1 uint32 = 2654435761
+	XXH32_PRIME2 uint32 = 2246822519
+	XXH32_PRIME3 uint32 = 3266489917
+	XXH32_PRIME4 uint32 = 668265263
+	XXH32_PRIME5 uint32 = 374761393
+)
+
+type xxh32 struct {
+	v     [4]uint32
+	total uint64
+	buf   [16]byte
+	n     int
+}
+
+func newXXH32() *xxh32 {
+	h := &xxh32{}
+	h.Reset()
+	return h
+}
+
+// xxh32Sum returns the XXH32 of data with seed 0.
+func xxh32Sum(data []byte) uint32 {
+	h := newXXH32()
+	h.Write(data)
+	return h.Sum32()
+}
+
+func (h *xxh32) Reset() {
+	p1 := XXH32_PRIME1
+	h.v = [4]uint32{p1 + XXH32_PRIME2, XXH32_PRIME2, 0, -p1}
+	h.total = 0
+	h.n = 0
+}
+
+func (h *xxh32) Size() int      { return 4 }
+func (h *xxh32) BlockSize() int { return 16 }
+
+func xxh32Round(acc, input uint32) uint32 {
+	acc += input * XXH32_PRIME2
+	return bits.RotateLeft32(acc, 13) * XXH32_PRIME1
+}
+
+func (h *xxh32) stripe(b []byte) {
+	le := binary.LittleEndian
+	h.v[0] = xxh32Round(h.v[0], le.Uint32(b))
+	h.v[1] = xxh32Round(h.v[1], le.Uint32(b[4:]))
+	h.v[2] = xxh32Round(h.v[2], le.Uint32(b[8:]))
+	h.v[3] = xxh32Round(h.v[3], le.Uint32(b[12:]))
+}
+
+func (h *xxh32) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], p)
+		h.n += c
+		p = p[c:]
+		if h.n < 16 {
+			return n, nil
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for ; len(p) >= 16; p = p[16:] {
+		h.stripe(p)
+	}
+	h.n = copy(h.buf[:], p)
+	return n, nil
+}
+
+func (h *xxh32) Sum32() uint32 {
+	var acc uint32
+	if h.total >= 16 {
+		acc = bits.RotateLeft32(h.v[0], 1) + bits.RotateLeft32(h.v[1], 7) +
+			bits.RotateLeft32(h.v[2], 12) + bits.RotateLeft32(h.v[3], 18)
+	} else {
+		acc = h.v[2] + XXH32_PRIME5
+	}
+	acc += uint32(h.total)
+
+	le := binary.LittleEndian
+	p := h.buf[:h.n]
+	for ; len(p) >= 4; p = p[4:] {
+		acc += le.Uint32(p) * XXH32_PRIME3
+		acc = bits.RotateLeft32(acc, 17) * XXH32_PRIME4
+	}
+	for _, c := range p {
+		acc += uint32(c) * XXH32_PRIME5
+		acc = bits.RotateLeft32(acc, 11) * XXH32_PRIME1
+	}
+
+	acc ^= acc >> 15
+	acc *= XXH32_PRIME2
+	acc ^= acc >> 13
+	acc *= XXH32_PRIME3
+	acc ^= acc >> 16
+	return acc
+}
+
+// Sum appends the checksum, little-endian as lz4 frames store it, to b.
+func (h *xxh32) Sum(b []byte) []byte {
+	return appendUint32(b, h.Sum32())
+}
@@ -0,0 +1,131 @@
+//go:build !noxz
+
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"hash/crc64"
+)
+
+// xz container writer, following the .xz file format specification
+// (https://tukaani.org/xz/xz-file-format.txt).
+//
+// Every input block is encoded as its own xz Block with a fresh LZMA2
+// dictionary, the same layout liblzma produces in multi-threaded mode, so the
+// blocks can be compressed independently and simply concatenated in order.
+// Build with -tags noxz to leave it out.
+
+const (
+	XZ_CHECK_CRC64  = 0x04
+	XZ_CHECK_SIZE   = 8
+	XZ_FILTER_LZMA2 = 0x21
+)
+
+var xzMagic = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+var xzFooterMagic = []byte{'Y', 'Z'}
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// xz index records, appended by the write stage in block order
+var xzRecords []xzRecord
+
+func init() {
+	registerCodec("xz", &codec{
+		suffix:      ".xz",
+		contentType: "application/x-xz",
+		newChecksum: newCRCCombiner,
+		start:       func() { xzRecords = nil },
+		header:      xzStreamHeader,
+		block: func(b *block) []byte {
+			out, record := xzBlock(b.RawData, xzLevel())
+			b.meta = record
+			return out
+		},
+		wrote: func(b *block) {
+			xzRecords = append(xzRecords, b.meta.(xzRecord))
+		},
+		trailer: func(sum uint32) []byte {
+			return xzStreamTrailer(xzRecords)
+		},
+	})
+}
+
+// xzRecord is an entry of the xz Index describing one Block.
+type xzRecord struct {
+	unpaddedSize     uint64
+	uncompressedSize uint64
+}
+
+// xzStreamHeader returns the 12-byte xz Stream Header.
+func xzStreamHeader() []byte {
+	header := make([]byte, 0, 12)
+	header = append(header, xzMagic...)
+	header = append(header, 0x00, XZ_CHECK_CRC64)
+	return appendUint32(header, crc32.ChecksumIEEE(header[6:8]))
+}
+
+// xzBlock compresses data into a complete xz Block: Block Header, LZMA2
+// data, Block Padding and a CRC64 check of the uncompressed data.
+func xzBlock(data []byte, level int) ([]byte, xzRecord) {
+	compressed := lzma2Encode(data, level)
+
+	// Block Header: size byte, flags (one filter, both sizes present),
+	// compressed and uncompressed sizes, then the LZMA2 filter flags.
+	header := []byte{0x00, 0xC0}
+	header = putVLI(header, uint64(len(compressed)))
+	header = putVLI(header, uint64(len(data)))
+	header = putVLI(header, XZ_FILTER_LZMA2)
+	header = putVLI(header, 1)
+	header = append(header, lzma2DictSizeByte(len(data)))
+	for (len(header)+4)%4 != 0 {
+		header = append(header, 0x00)
+	}
+	header[0] = byte((len(header)+4)/4 - 1)
+	header = appendUint32(header, crc32.ChecksumIEEE(header))
+
+	out := append(header, compressed...)
+	for len(out)%4 != 0 {
+		out = append(out, 0x00)
+	}
+	out = appendUint64(out, crc64.Checksum(data, crc64Table))
+
+	return out, xzRecord{
+		unpaddedSize:     uint64(len(header) + len(compressed) + XZ_CHECK_SIZE),
+		uncompressedSize: uint64(len(data)),
+	}
+}
+
+// xzStreamTrailer returns the xz Index for records followed by the Stream
+// Footer.
+func xzStreamTrailer(records []xzRecord) []byte {
+	index := []byte{0x00}
+	index = putVLI(index, uint64(len(records)))
+	for _, r := range records {
+		index = putVLI(index, r.unpaddedSize)
+		index = putVLI(index, r.uncompressedSize)
+	}
+	for len(index)%4 != 0 {
+		index = append(index, 0x00)
+	}
+	index = appendUint32(index, crc32.ChecksumIEEE(index))
+
+	footer := make([]byte, 4, 12)
+	footer = appendUint32(footer, uint32(len(index)/4-1))
+	footer = append(footer, 0x00, XZ_CHECK_CRC64)
+	binary.LittleEndian.PutUint32(footer[:4], crc32.ChecksumIEEE(footer[4:10]))
+	footer = append(footer, xzFooterMagic...)
+
+	return append(index, footer...)
+}
+
+// lzma2DictSizeByte returns the smallest LZMA2 dictionary size property that
+// covers size bytes.
+func lzma2DictSizeByte(size int) byte {
+	for bits := byte(0); bits < 40; bits++ {
+		if uint64(2|bits&1)<<(bits/2+11) >= uint64(size) {
+			return bits
+		}
+	}
+	return 40
+}
@@ -0,0 +1,61 @@
+//go:build !noxz
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+// Test that xz blocks concatenated into a stream decode with the reference xz
+func TestXZStream(t *testing.T) {
+	xzPath, err := exec.LookPath("xz")
+	if err != nil {
+		t.Skip("xz not installed")
+	}
+
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 5000)
+	random := make([]byte, BLOCK_SIZE)
+	rand.Read(random)
+
+	var stream bytes.Buffer
+	var records []xzRecord
+	stream.Write(xzStreamHeader())
+	for _, data := range [][]byte{text, random, {}} {
+		out, record := xzBlock(data, 6)
+		stream.Write(out)
+		records = append(records, record)
+	}
+	stream.Write(xzStreamTrailer(records))
+
+	cmd := exec.Command(xzPath, "-dc")
+	cmd.Stdin = &stream
+	got, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(append([]byte{}, text...), random...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("decompressed output differs from input")
+	}
+}
+
+func TestPutVLI(t *testing.T) {
+	tests := []struct {
+		x    uint64
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{0x7F, []byte{0x7F}},
+		{0x80, []byte{0x80, 0x01}},
+		{BLOCK_SIZE, []byte{0x80, 0x80, 0x08}},
+	}
+	for _, test := range tests {
+		if got := putVLI(nil, test.x); !bytes.Equal(got, test.want) {
+			t.Errorf("putVLI(%d) = %x, want %x", test.x, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+//go:build !nozip
+
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// .zip output (--zip, -K, as in pigz).
+//
+// The deflate stream of the pipeline is wrapped in a single-entry zip
+// archive: a local file header with the sizes left to a data descriptor,
+// since they are only known at the end, then the descriptor, the central
+// directory and its end record. The entry is named after the input, "-" for
+// standard input, and keeps its modification time and mode. ZIP64 records
+// are written when a size or offset does not fit in 32 bits. A file that
+// --min-ratio finds not worth compressing is stored instead, with the CRC
+// and sizes of the first compression in the local header and no data
+// descriptor. With -d, the first entry of an archive is extracted, as pigz
+// does. Build with -tags nozip to leave it out.
+
+const (
+	ZIP_LOCAL_SIG      = 0x04034b50
+	ZIP_DESCRIPTOR_SIG = 0x08074b50
+	ZIP_CENTRAL_SIG    = 0x02014b50
+	ZIP_END64_SIG      = 0x06064b50
+	ZIP_LOCATOR64_SIG  = 0x07064b50
+	ZIP_END_SIG        = 0x06054b50
+
+	ZIP_VERSION      = 20 // deflate
+	ZIP_VERSION64    = 45 // ZIP64
+	ZIP_MADE_BY_UNIX = 3 << 8
+	ZIP_DESCRIPTOR   = 1 << 3  // sizes follow the data
+	ZIP_UTF8         = 1 << 11 // the name is UTF-8
+	ZIP_STORE        = 0
+	ZIP_DEFLATE      = 8
+	ZIP_EXTTIME_ID   = 0x5455
+	ZIP_LOCAL_SIZE   = 30
+	ZIP_MAX32        = 0xffffffff
+	ZIP_STDIN_NAME   = "-"
+	ZIP_DEFAULT_MODE = 0644
+)
+
+// sizes of the entry being written, summed by the write stage
+var zipCompressed, zipSize uint64
+
+// the local header written, which the central directory repeats
+var zipLocal []byte
+
+func init() {
+	registerCodec("zip", &codec{
+		suffix:      ".zip",
+		contentType: "application/zip",
+		newChecksum: newCRCCombiner,
+		start: func() {
+			zipCompressed, zipSize = 0, 0
+		},
+		header: func() []byte {
+			zipLocal = zipLocalHeader()
+			return zipLocal
+		},
+		block: zipBlock,
+		wrote: func(b *block) {
+			zipCompressed += uint64(len(b.CompressedData))
+			zipSize += uint64(len(b.RawData))
+		},
+		trailer: func(sum uint32) []byte {
+			return zipTrailer(sum)
+		},
+		stores:     true,
+		decompress: zipDecompress,
+	})
+	flag.Var(zipFlag{}, "zip", "Write a .zip archive holding the input (--format zip)")
+	flag.Var(zipFlag{}, "K", "Same as --zip")
+	optionAliases["zip"] = "format"
+	optionAliases["K"] = "format"
+}
+
+// zipFlag is a boolean flag that selects the zip format.
+type zipFlag struct{}
+
+func (zipFlag) IsBoolFlag() bool { return true }
+func (zipFlag) String() string   { return "false" }
+func (zipFlag) Set(s string) error {
+	if s == "true" {
+		format = "zip"
+	}
+	return nil
+}
+
+// zipEntry returns the name, modification time and mode of the entry: those
+// of the file being compressed, or of standard input now, in local time as
+// zip tools expect.
+func zipEntry() (string, time.Time, os.FileMode) {
+	name, modified, mode := ZIP_STDIN_NAME, time.Now(), os.FileMode(ZIP_DEFAULT_MODE)
+	if inputInfo != nil {
+		name, modified, mode = inputInfo.Name(), inputInfo.ModTime(), inputInfo.Mode().Perm()
+	}
+	if deterministic {
+		modified, mode = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC), ZIP_DEFAULT_MODE
+	}
+	return name, modified, mode
+}
+
+// zipBlock deflates a block, or copies it when the entry is stored.
+func zipBlock(b *block) []byte {
+	if storeInput == nil {
+		return deflateBlock(b)
+	}
+	out := getBuffer(len(b.RawData))
+	b.pooled = append(b.pooled, out)
+	return append(out[:0], b.RawData...)
+}
+
+// zipLocalHeader returns the local file header of the entry, with the CRC and
+// sizes left zero for the data descriptor, or those of storeInput when the
+// entry is stored.
+func zipLocalHeader() []byte {
+	name, modified, _ := zipEntry()
+	flags, method, version := uint16(ZIP_DESCRIPTOR), uint16(ZIP_DEFLATE), uint16(ZIP_VERSION)
+	var extra []byte
+	if storeInput != nil {
+		flags, method = 0, ZIP_STORE
+		if uint64(storeInput.inSize) >= ZIP_MAX32 {
+			version = ZIP_VERSION64
+			extra = appendUint16(extra, 1) // ZIP64 extended information
+			extra = appendUint16(extra, 16)
+			extra = appendUint64(extra, uint64(storeInput.inSize))
+			extra = appendUint64(extra, uint64(storeInput.inSize))
+		}
+	}
+	if !isASCII(name) && utf8.ValidString(name) {
+		flags |= ZIP_UTF8
+	}
+	extra = append(extra, zipExtendedTime(modified)...)
+	dosTime, dosDate := zipDOSTime(modified)
+
+	le := binary.LittleEndian
+	h := make([]byte, ZIP_LOCAL_SIZE)
+	le.PutUint32(h[0:], ZIP_LOCAL_SIG)
+	le.PutUint16(h[4:], version)
+	le.PutUint16(h[6:], flags)
+	le.PutUint16(h[8:], method)
+	le.PutUint16(h[10:], dosTime)
+	le.PutUint16(h[12:], dosDate)
+	if storeInput != nil {
+		size := uint32(ZIP_MAX32)
+		if uint64(storeInput.inSize) < ZIP_MAX32 {
+			size = uint32(storeInput.inSize)
+		}
+		le.PutUint32(h[14:], storeInput.sum)
+		le.PutUint32(h[18:], size)
+		le.PutUint32(h[22:], size)
+	}
+	le.PutUint16(h[26:], uint16(len(name)))
+	le.PutUint16(h[28:], uint16(len(extra)))
+	h = append(h, name...)
+	return append(h, extra...)
+}
+
+// zipTrailer returns the data descriptor, unless the entry is stored, the
+// central directory and its end records for an entry whose data has CRC-32
+// sum.
+func zipTrailer(sum uint32) []byte {
+	le := binary.LittleEndian
+	name, modified, mode := zipEntry()
+	zip64 := zipCompressed >= ZIP_MAX32 || zipSize >= ZIP_MAX32
+
+	// data descriptor, with 64-bit sizes in ZIP64 archives
+	var out []byte
+	if storeInput == nil {
+		out = appendUint32(out, ZIP_DESCRIPTOR_SIG)
+		out = appendUint32(out, sum)
+		if zip64 {
+			out = appendUint64(out, zipCompressed)
+			out = appendUint64(out, zipSize)
+		} else {
+			out = appendUint32(out, uint32(zipCompressed))
+			out = appendUint32(out, uint32(zipSize))
+		}
+	}
+	directory := uint64(len(zipLocal)) + zipCompressed + uint64(len(out))
+	zip64 = zip64 || directory >= ZIP_MAX32
+
+	// central directory header
+	version := uint16(ZIP_VERSION)
+	var extra []byte
+	if zip64 {
+		version = ZIP_VERSION64
+		extra = appendUint16(extra, 1) // ZIP64 extended information
+		extra = appendUint16(extra, 16)
+		extra = appendUint64(extra, zipSize)
+		extra = appendUint64(extra, zipCompressed)
+	}
+	extra = append(extra, zipExtendedTime(modified)...)
+	c := make([]byte, 46)
+	le.PutUint32(c[0:], ZIP_CENTRAL_SIG)
+	le.PutUint16(c[4:], ZIP_MADE_BY_UNIX|version)
+	le.PutUint16(c[6:], version)
+	copy(c[8:16], zipLocal[6:14]) // flags, method, time and date
+	le.PutUint32(c[16:], sum)
+	if zip64 {
+		le.PutUint32(c[20:], ZIP_MAX32)
+		le.PutUint32(c[24:], ZIP_MAX32)
+	} else {
+		le.PutUint32(c[20:], uint32(zipCompressed))
+		le.PutUint32(c[24:], uint32(zipSize))
+	}
+	le.PutUint16(c[28:], uint16(len(name)))
+	le.PutUint16(c[30:], uint16(len(extra)))
+	le.PutUint32(c[38:], uint32(mode|0100000)<<16) // a regular file
+	c = append(c, name...)
+	c = append(c, extra...)
+	out = append(out, c...)
+	size := uint64(len(c))
+
+	if zip64 {
+		end64 := directory + size
+		out = appendUint32(out, ZIP_END64_SIG)
+		out = appendUint64(out, 44) // size of the rest of the record
+		out = appendUint16(out, ZIP_MADE_BY_UNIX|ZIP_VERSION64)
+		out = appendUint16(out, ZIP_VERSION64)
+		out = appendUint32(out, 0) // this disk
+		out = appendUint32(out, 0) // the disk of the directory
+		out = appendUint64(out, 1) // entries on this disk
+		out = appendUint64(out, 1) // entries
+		out = appendUint64(out, size)
+		out = appendUint64(out, directory)
+
+		out = appendUint32(out, ZIP_LOCATOR64_SIG)
+		out = appendUint32(out, 0)
+		out = appendUint64(out, end64)
+		out = appendUint32(out, 1) // disks
+		directory = ZIP_MAX32
+	}
+
+	out = appendUint32(out, ZIP_END_SIG)
+	out = appendUint32(out, 0) // this disk and the disk of the directory
+	out = appendUint16(out, 1)
+	out = appendUint16(out, 1)
+	out = appendUint32(out, uint32(size))
+	out = appendUint32(out, uint32(directory))
+	return appendUint16(out, 0) // no comment
+}
+
+// zipExtendedTime returns the extended timestamp extra field, which holds
+// the modification time in Unix seconds.
+func zipExtendedTime(t time.Time) []byte {
+	extra := appendUint16(nil, ZIP_EXTTIME_ID)
+	extra = appendUint16(extra, 5)
+	extra = append(extra, 1) // the modification time is present
+	return appendUint32(extra, uint32(t.Unix()))
+}
+
+// zipDOSTime returns t in the MS-DOS time and date format, in the location
+// of t, clamped to the years it can hold.
+func zipDOSTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, t.Location())
+	} else if t.Year() > 2107 {
+		t = time.Date(2107, 12, 31, 23, 59, 58, 0, t.Location())
+	}
+	dosTime := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	dosDate := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	return dosTime, dosDate
+}
+
+// isASCII reports whether s holds only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+var errZipFormat = errors.New("zip: not a valid zip file")
+
+// zipDecompress extracts the data of the first entry of a zip archive read
+// from input, checking its CRC-32.
+func zipDecompress(input io.Reader, output io.Writer) error {
+	le := binary.LittleEndian
+	r := bufio.NewReader(input)
+	h := make([]byte, ZIP_LOCAL_SIZE)
+	if _, err := io.ReadFull(r, h); err != nil || le.Uint32(h) != ZIP_LOCAL_SIG {
+		return errZipFormat
+	}
+	flags, method := le.Uint16(h[6:]), le.Uint16(h[8:])
+	sum, compressed := le.Uint32(h[14:]), uint64(le.Uint32(h[18:]))
+	extra := make([]byte, int(le.Uint16(h[26:]))+int(le.Uint16(h[28:])))
+	if _, err := io.ReadFull(r, extra); err != nil {
+		return errZipFormat
+	}
+	if compressed == ZIP_MAX32 {
+		compressed = zip64Compressed(extra[le.Uint16(h[26:]):], le.Uint32(h[22:]))
+	}
+
+	var data io.Reader
+	switch method {
+	case ZIP_DEFLATE:
+		data = flate.NewReader(r)
+	case ZIP_STORE:
+		if flags&ZIP_DESCRIPTOR != 0 {
+			return errors.New("zip: stored entry of unknown size")
+		}
+		data = io.LimitReader(r, int64(compressed))
+	default:
+		return fmt.Errorf("zip: unsupported compression method %d", method)
+	}
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(io.MultiWriter(output, crc), data); err != nil {
+		return err
+	}
+
+	// the CRC is in the data descriptor, after an optional signature
+	if flags&ZIP_DESCRIPTOR != 0 {
+		d := make([]byte, 8)
+		if _, err := io.ReadFull(r, d); err != nil {
+			return errZipFormat
+		}
+		sum = le.Uint32(d)
+		if sum == ZIP_DESCRIPTOR_SIG {
+			sum = le.Uint32(d[4:])
+		}
+	}
+	if crc.Sum32() != sum {
+		return errors.New("zip: checksum error")
+	}
+	return nil
+}
+
+// zip64Compressed returns the compressed size in the ZIP64 extended
+// information of the local extra fields, which comes after the uncompressed
+// size when that does not fit in 32 bits either, or ZIP_MAX32 if there is
+// none.
+func zip64Compressed(extra []byte, size uint32) uint64 {
+	le := binary.LittleEndian
+	for len(extra) >= 4 {
+		id, n := le.Uint16(extra), int(le.Uint16(extra[2:]))
+		if len(extra) < 4+n {
+			break
+		}
+		field := extra[4 : 4+n]
+		if id == 1 {
+			if size == ZIP_MAX32 {
+				if len(field) < 8 {
+					break
+				}
+				field = field[8:]
+			}
+			if len(field) >= 8 {
+				return le.Uint64(field)
+			}
+			break
+		}
+		extra = extra[4+n:]
+	}
+	return ZIP_MAX32
+}
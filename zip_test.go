@@ -0,0 +1,146 @@
+//go:build !nozip
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that --zip archives open with archive/zip, with the entry named and
+// dated after the input, and that -d extracts them
+func TestZipArchive(t *testing.T) {
+	format = "zip"
+	defer func() { format = "gzip" }()
+
+	data := bytes.Repeat([]byte("a single file for windows users\n"), 3*BLOCK_SIZE/32+5)
+	path := filepath.Join(t.TempDir(), "report.txt")
+	if err := ioutil.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2021, 6, 7, 8, 9, 10, 0, time.Local)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if inputInfo, _ = os.Stat(path); inputInfo == nil {
+		t.Fatal("no input")
+	}
+	defer func() { inputInfo = nil }()
+
+	var out bytes.Buffer
+	if err := compressStream(bytes.NewReader(data), &out); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(z.File) != 1 {
+		t.Fatalf("%d entries", len(z.File))
+	}
+	f := z.File[0]
+	if f.Name != "report.txt" || f.Mode().Perm() != 0640 || !f.Modified.Equal(modified) {
+		t.Errorf("entry %s, mode %v, modified %v", f.Name, f.Mode(), f.Modified)
+	}
+	r, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("archive/zip: %v", err)
+	}
+
+	var extracted bytes.Buffer
+	if err := zipDecompress(bytes.NewReader(out.Bytes()), &extracted); err != nil || !bytes.Equal(extracted.Bytes(), data) {
+		t.Errorf("zipDecompress: %v", err)
+	}
+	corrupt := append([]byte{}, out.Bytes()...)
+	corrupt[len(zipLocal)+out.Len()/4]++
+	if err := zipDecompress(bytes.NewReader(corrupt), ioutil.Discard); err == nil {
+		t.Errorf("corrupt archive extracted")
+	}
+}
+
+// Test that sizes past 4 GiB move to ZIP64 records
+func TestZipTrailer64(t *testing.T) {
+	zipLocal = zipLocalHeader()
+	zipCompressed, zipSize = 5<<30, 6<<30
+	defer func() { zipCompressed, zipSize = 0, 0 }()
+
+	trailer := zipTrailer(0x12345678)
+	le := binary.LittleEndian
+	if le.Uint64(trailer[8:]) != 5<<30 || le.Uint64(trailer[16:]) != 6<<30 {
+		t.Errorf("data descriptor %x", trailer[:24])
+	}
+	end := trailer[len(trailer)-22:]
+	if le.Uint32(end) != ZIP_END_SIG || le.Uint32(end[16:]) != ZIP_MAX32 {
+		t.Errorf("end record %x", end)
+	}
+	locator := trailer[len(trailer)-42:]
+	end64 := le.Uint64(locator[8:]) - uint64(len(zipLocal)) - zipCompressed
+	if le.Uint32(locator) != ZIP_LOCATOR64_SIG || le.Uint32(trailer[end64:]) != ZIP_END64_SIG {
+		t.Errorf("ZIP64 end record not found")
+	}
+}
+
+// Test that --min-ratio stores a file not worth compressing in the zip
+// archive instead of leaving it unchanged
+func TestZipStored(t *testing.T) {
+	format, minRatio = "zip", 0
+	defer func() { format, minRatio, exitStatus = "gzip", -1, 0 }()
+
+	path := filepath.Join(t.TempDir(), "random.bin")
+	data := make([]byte, 2*BLOCK_SIZE+100)
+	rand.Read(data)
+	ioutil.WriteFile(path, data, 0644)
+
+	exitStatus = 0
+	compressFile(path)
+	if exitStatus != 2 {
+		t.Errorf("exit status %d, want 2", exitStatus)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("original kept")
+	}
+	archive, err := ioutil.ReadFile(path + ".zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := z.File[0]
+	if f.Method != zip.Store || f.UncompressedSize64 != uint64(len(data)) || f.CompressedSize64 != uint64(len(data)) {
+		t.Errorf("entry method %d, sizes %d and %d", f.Method, f.CompressedSize64, f.UncompressedSize64)
+	}
+	r, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("archive/zip: %v", err)
+	}
+	var extracted bytes.Buffer
+	if err := zipDecompress(bytes.NewReader(archive), &extracted); err != nil || !bytes.Equal(extracted.Bytes(), data) {
+		t.Errorf("zipDecompress: %v", err)
+	}
+
+	// a stored entry past 4 GiB has its sizes in a ZIP64 extra field
+	storeInput = &fileResult{inSize: 5 << 30, sum: 0x12345678}
+	defer func() { storeInput = nil }()
+	h := zipLocalHeader()
+	le := binary.LittleEndian
+	extra := h[ZIP_LOCAL_SIZE+int(le.Uint16(h[26:])):]
+	if le.Uint32(h[14:]) != 0x12345678 || zip64Compressed(extra, le.Uint32(h[22:])) != 5<<30 {
+		t.Errorf("local header %x", h)
+	}
+}
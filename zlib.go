@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+)
+
+// zlib (RFC 1950) framing around the deflate stream.
+
+const (
+	ZLIB_CMF   = 0x78 // deflate with a 32 KiB window
+	ZLIB_FDICT = 0x20
+)
+
+// zlibHeader returns the zlib stream header. When dict is not nil the FDICT
+// flag is set and the Adler-32 of the dictionary follows as its ID.
+func zlibHeader(level int, dict []byte) []byte {
+	// FLEVEL, as zlib's deflate sets it
+	var flg byte
+	switch {
+	case level == flate.HuffmanOnly || level == 0 || level == 1:
+		flg = 0 << 6
+	case level >= 2 && level <= 5:
+		flg = 1 << 6
+	case level >= 7:
+		flg = 3 << 6
+	default:
+		flg = 2 << 6
+	}
+	if dict != nil {
+		flg |= ZLIB_FDICT
+	}
+	if r := (uint(ZLIB_CMF)<<8 | uint(flg)) % 31; r != 0 {
+		flg += byte(31 - r)
+	}
+
+	header := []byte{ZLIB_CMF, flg}
+	if dict != nil {
+		header = append(header, zlibTrailer(adler32.Checksum(dict))...)
+	}
+	return header
+}
+
+// zlibTrailer returns the big-endian Adler-32 of the uncompressed data.
+func zlibTrailer(sum uint32) []byte {
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, sum)
+	return trailer
+}
+
+// adlerCombiner is the Adler-32 of a zlib stream being written. The compress
+// stage sums every block in the workers and the write stage combines the
+// sums in order, so summing scales with the workers like compression does.
+type adlerCombiner struct {
+	sum uint32
+}
+
+func newAdlerCombiner() *adlerCombiner {
+	return &adlerCombiner{sum: 1}
+}
+
+// add appends a block of n bytes with Adler-32 sum to the stream.
+func (a *adlerCombiner) add(sum uint32, n int) {
+	a.sum = adler32Combine(a.sum, sum, int64(n))
+}
+
+func (a *adlerCombiner) Write(p []byte) (int, error) {
+	a.add(adler32.Checksum(p), len(p))
+	return len(p), nil
+}
+
+func (a *adlerCombiner) Sum(b []byte) []byte {
+	return append(b, zlibTrailer(a.sum)...)
+}
+
+func (a *adlerCombiner) Sum32() uint32  { return a.sum }
+func (a *adlerCombiner) Reset()         { a.sum = 1 }
+func (a *adlerCombiner) Size() int      { return adler32.Size }
+func (a *adlerCombiner) BlockSize() int { return 4 }
+
+// errDictionaryMismatch reports a zlib stream whose preset dictionary ID does
+// not match the dictionary supplied with --dict.
+var errDictionaryMismatch = errors.New("zlib: stream was compressed with a different dictionary")
+
+// newZlibReader opens a zlib stream, using dict if the stream asks for a
+// preset dictionary. It peeks at the header first so that a missing or wrong
+// dictionary is reported with the ID the stream expects.
+func newZlibReader(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(6)
+	if err != nil && len(header) < 2 {
+		return nil, err
+	}
+
+	if header[1]&ZLIB_FDICT != 0 && len(header) == 6 {
+		id := binary.BigEndian.Uint32(header[2:6])
+		if dict == nil {
+			return nil, fmt.Errorf("zlib: stream needs preset dictionary %08x, use --dict", id)
+		}
+		if adler32.Checksum(dict) != id {
+			return nil, errDictionaryMismatch
+		}
+	}
+
+	return zlib.NewReaderDict(br, dict)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"hash/adler32"
+	"io/ioutil"
+	"testing"
+)
+
+// Test that a zlib stream with a preset dictionary round-trips through
+// newZlibReader, and that a missing or wrong dictionary is reported
+func TestZlibPresetDictionary(t *testing.T) {
+	dict := []byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n")
+	data := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n"), 100)
+
+	dictionary = dict
+	defer func() { dictionary = nil }()
+
+	var stream bytes.Buffer
+	stream.Write(zlibHeader(flate.DefaultCompression, dict))
+	stream.Write(deflateBlock(&block{Index: 1, LastBlock: true, RawData: data}))
+	stream.Write(zlibTrailer(adler32.Checksum(data)))
+
+	r, err := newZlibReader(bytes.NewReader(stream.Bytes()), dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("decompressed output differs from input")
+	}
+
+	if _, err := newZlibReader(bytes.NewReader(stream.Bytes()), nil); err == nil {
+		t.Errorf("expected an error without the dictionary")
+	}
+	if _, err := newZlibReader(bytes.NewReader(stream.Bytes()), []byte("wrong")); err != errDictionaryMismatch {
+		t.Errorf("got %v, want errDictionaryMismatch", err)
+	}
+}
+
+func TestZlibHeaderCheck(t *testing.T) {
+	for _, level := range []int{-1, 0, 1, 4, 6, 9} {
+		for _, dict := range [][]byte{nil, []byte("dict")} {
+			h := zlibHeader(level, dict)
+			if (uint(h[0])<<8|uint(h[1]))%31 != 0 {
+				t.Errorf("level %d: header %x fails FCHECK", level, h[:2])
+			}
+		}
+	}
+}
+
+// Test that the Adler-32 combined from the blocks in the write stage is the
+// one of the whole stream
+func TestZlibCombinedChecksum(t *testing.T) {
+	format = "zlib"
+	defer func() { format = "gzip" }()
+
+	for _, size := range []int{0, 1, BLOCK_SIZE, 3*BLOCK_SIZE + 12345} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * i >> 7)
+		}
+		var out bytes.Buffer
+		if err := compressStream(bytes.NewReader(data), &out); err != nil {
+			t.Fatal(err)
+		}
+		if got := checksum.Sum32(); got != adler32.Checksum(data) {
+			t.Errorf("size %d: checksum %08x, want %08x", size, got, adler32.Checksum(data))
+		}
+		r, err := zlib.NewReader(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d: %v", size, err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+//go:build !nozopfli
+
+package main
+
+import (
+	"math"
+)
+
+// Level 11 (-11): exhaustive deflate, after Zopfli.
+//
+// Every match worth considering is found once per block: for each position,
+// the nearest occurrence of each longer match, from hash chains searched up
+// to ZOPFLI_CHAIN deep. The block is then parsed by a shortest path over
+// those matches, where the cost of a symbol is its length in bits under a
+// model of the codes. The first parse prices symbols as the fixed Huffman
+// codes do, and every following one with the statistics of the parse
+// before, ZOPFLI_ITERATIONS times; the parse giving the smallest output is
+// written by the deflate block writer. This is many times slower than
+// -9 and gains a few percent, which the parallel pipeline makes affordable.
+// As with any level, blocks are primed with the input before them unless
+// -i is given. Build with -tags nozopfli to leave it out.
+
+const (
+	ZOPFLI_ITERATIONS = 15
+	ZOPFLI_CHAIN      = 1024
+	ZOPFLI_HASH_LOG   = 15
+	ZOPFLI_WINDOW     = 32768
+)
+
+func init() {
+	zopfliEncoder = zopfliBlock
+}
+
+// zopfliMatch is a match of length bytes at distance.
+type zopfliMatch struct {
+	length, distance uint16
+}
+
+// zopfliBlock compresses a block into a piece of a deflate stream, as
+// deflateBlock does, parsed for the smallest output. dict is what the block
+// may refer back to.
+func zopfliBlock(b *block, dict []byte) []byte {
+	final := b.LastBlock || b.memberEnd
+	matches, starts := zopfliMatches(b.RawData, dict)
+
+	var best []byte
+	model := zopfliFixedModel()
+	for i := 0; i < ZOPFLI_ITERATIONS; i++ {
+		tokens := zopfliParse(b.RawData, matches, starts, model)
+		out := deflateTokens(b.RawData, tokens, final)
+		if best == nil || len(out) < len(best) {
+			best = out
+		}
+		model = zopfliModel(tokens)
+	}
+	return best
+}
+
+// zopfliMatches returns the matches at every position of data, which may
+// refer back into dict: those of position i are matches[starts[i]:
+// starts[i+1]], by increasing length and distance.
+func zopfliMatches(data, dict []byte) ([]zopfliMatch, []int32) {
+	if len(dict) > ZOPFLI_WINDOW {
+		dict = dict[len(dict)-ZOPFLI_WINDOW:]
+	}
+	buf := append(append(make([]byte, 0, len(dict)+len(data)), dict...), data...)
+	head := make([]int32, 1<<ZOPFLI_HASH_LOG)
+	for i := range head {
+		head[i] = -1
+	}
+	chain := make([]int32, len(buf))
+	hash := func(i int) uint32 {
+		return (uint32(buf[i]) | uint32(buf[i+1])<<8 | uint32(buf[i+2])<<16) * 2654435761 >> (32 - ZOPFLI_HASH_LOG)
+	}
+
+	var matches []zopfliMatch
+	starts := make([]int32, len(data)+1)
+	for i := 0; i < len(buf); i++ {
+		if i >= len(dict) {
+			starts[i-len(dict)] = int32(len(matches))
+		}
+		if i+DEFLATE_MIN_MATCH > len(buf) {
+			continue
+		}
+		h := hash(i)
+		if i >= len(dict) {
+			limit := len(buf) - i
+			if limit > DEFLATE_MAX_MATCH {
+				limit = DEFLATE_MAX_MATCH
+			}
+			longest := DEFLATE_MIN_MATCH - 1
+			for j, depth := head[h], 0; j >= 0 && depth < ZOPFLI_CHAIN && i-int(j) <= ZOPFLI_WINDOW; j, depth = chain[j], depth+1 {
+				if buf[int(j)+longest] != buf[i+longest] {
+					continue
+				}
+				n := 0
+				for n < limit && buf[int(j)+n] == buf[i+n] {
+					n++
+				}
+				if n > longest {
+					longest = n
+					matches = append(matches, zopfliMatch{uint16(n), uint16(i - int(j))})
+					if n == limit {
+						break
+					}
+				}
+			}
+		}
+		chain[i] = head[h]
+		head[h] = int32(i)
+	}
+	starts[len(data)] = int32(len(matches))
+	return matches, starts
+}
+
+// zopfliCosts prices symbols in bits.
+type zopfliCosts struct {
+	literal  [256]float64
+	length   [DEFLATE_MAX_MATCH + 1]float64 // with the extra bits
+	distance [DEFLATE_DISTANCES]float64     // without the extra bits
+}
+
+// zopfliFixedModel returns the costs of the fixed Huffman codes.
+func zopfliFixedModel() *zopfliCosts {
+	m := &zopfliCosts{}
+	for c := range m.literal {
+		m.literal[c] = 8
+		if c >= 144 {
+			m.literal[c] = 9
+		}
+	}
+	for l := DEFLATE_MIN_MATCH; l <= DEFLATE_MAX_MATCH; l++ {
+		code, n, _ := deflateLengthCode(l)
+		m.length[l] = 7 + float64(n)
+		if code >= 280 {
+			m.length[l]++
+		}
+	}
+	for d := range m.distance {
+		m.distance[d] = 5
+	}
+	return m
+}
+
+// zopfliModel returns the costs of symbols under the statistics of tokens:
+// the entropy of each.
+func zopfliModel(tokens []deflateToken) *zopfliCosts {
+	litFreq := make([]float64, DEFLATE_LITLENS)
+	distFreq := make([]float64, DEFLATE_DISTANCES)
+	for _, t := range tokens {
+		if t.length == 0 {
+			litFreq[t.literal]++
+			continue
+		}
+		code, _, _ := deflateLengthCode(int(t.length))
+		litFreq[code]++
+		code, _, _ = deflateDistanceCode(int(t.distance))
+		distFreq[code]++
+	}
+	litFreq[DEFLATE_END_OF_BLOCK] = 1
+	litCost, distCost := zopfliEntropy(litFreq), zopfliEntropy(distFreq)
+
+	m := &zopfliCosts{}
+	copy(m.literal[:], litCost)
+	for l := DEFLATE_MIN_MATCH; l <= DEFLATE_MAX_MATCH; l++ {
+		code, n, _ := deflateLengthCode(l)
+		m.length[l] = litCost[code] + float64(n)
+	}
+	copy(m.distance[:], distCost)
+	return m
+}
+
+// zopfliEntropy returns the bits each symbol takes at the frequencies freq.
+// Unused symbols cost a bit more than the rarest would.
+func zopfliEntropy(freq []float64) []float64 {
+	total := 0.0
+	for _, f := range freq {
+		total += f
+	}
+	cost := make([]float64, len(freq))
+	for s, f := range freq {
+		if f > 0 {
+			cost[s] = math.Log2(total / f)
+		} else {
+			cost[s] = math.Log2(total+1) + 1
+		}
+	}
+	return cost
+}
+
+// zopfliParse returns the cheapest tokens for data under the costs m.
+func zopfliParse(data []byte, matches []zopfliMatch, starts []int32, m *zopfliCosts) []deflateToken {
+	n := len(data)
+	cost := make([]float64, n+1)
+	for i := 1; i <= n; i++ {
+		cost[i] = math.Inf(1)
+	}
+	// the token reaching each position
+	length := make([]uint16, n+1)
+	distance := make([]uint16, n+1)
+	for i := 0; i < n; i++ {
+		if c := cost[i] + m.literal[data[i]]; c < cost[i+1] {
+			cost[i+1], length[i+1] = c, 0
+		}
+		from := DEFLATE_MIN_MATCH
+		for _, match := range matches[starts[i]:starts[i+1]] {
+			code, extra, _ := deflateDistanceCode(int(match.distance))
+			base := cost[i] + m.distance[code] + float64(extra)
+			for l := from; l <= int(match.length); l++ {
+				if c := base + m.length[l]; c < cost[i+l] {
+					cost[i+l], length[i+l], distance[i+l] = c, uint16(l), match.distance
+				}
+			}
+			from = int(match.length) + 1
+		}
+	}
+
+	var count int
+	for i := n; i > 0; count++ {
+		if length[i] == 0 {
+			i--
+		} else {
+			i -= int(length[i])
+		}
+	}
+	tokens := make([]deflateToken, count)
+	for i := n; i > 0; {
+		count--
+		if length[i] == 0 {
+			tokens[count] = deflateToken{literal: data[i-1]}
+			i--
+		} else {
+			tokens[count] = deflateToken{length: length[i], distance: distance[i]}
+			i -= int(length[i])
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,52 @@
+//go:build !nozopfli
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestZopfliMatches(t *testing.T) {
+	matches, starts := zopfliMatches([]byte("abcdabcdeabcde"), []byte("xabc"))
+	at := func(i int) []zopfliMatch { return matches[starts[i]:starts[i+1]] }
+	if got := fmt.Sprint(at(0)); got != "[{3 3}]" {
+		t.Errorf("matches at 0 = %s", got)
+	}
+	if got := fmt.Sprint(at(9)); got != "[{5 5}]" {
+		t.Errorf("matches at 9 = %s", got)
+	}
+	if len(at(12)) != 0 || len(starts) != 15 {
+		t.Errorf("matches near the end %v, %d starts", at(12), len(starts))
+	}
+}
+
+// Test that -11 blocks primed with the input before them inflate, and are
+// no larger than -9 ones
+func TestZopfliBlocks(t *testing.T) {
+	var text bytes.Buffer
+	for i := 0; text.Len() < 3*DICT_SIZE; i++ {
+		fmt.Fprintf(&text, "line %d of %d: the quick brown fox %x\n", i, i*i%97, i*31%1024)
+	}
+	data := text.Bytes()
+
+	sizes := map[int]int{}
+	saved := level
+	defer func() { level = saved }()
+	for _, level = range []int{flate.BestCompression, ZOPFLI_LEVEL} {
+		first := &block{Index: 1, RawData: data[:DICT_SIZE]}
+		second := &block{Index: 2, LastBlock: true, RawData: data[DICT_SIZE:], window: data[:DICT_SIZE]}
+		stream := append(deflateBlock(first), deflateBlock(second)...)
+		got, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(stream)))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("level %d: inflated %d bytes: %v", level, len(got), err)
+		}
+		sizes[level] = len(stream)
+	}
+	if sizes[ZOPFLI_LEVEL] > sizes[flate.BestCompression] {
+		t.Errorf("-11 gave %d bytes, -9 %d", sizes[ZOPFLI_LEVEL], sizes[flate.BestCompression])
+	}
+}
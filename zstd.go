@@ -0,0 +1,516 @@
+//go:build !nozstd
+
+package main
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+)
+
+// zstd (RFC 8878) output.
+//
+// Every block of the pipeline becomes one compressed zstd block of its own,
+// so blocks can still be compressed independently. Matches are found with a
+// hash chain and the sequences are coded with the predefined distributions;
+// literals are stored raw. The level sets how deep the chains are searched
+// and, from -4 on, whether a match is put off for a longer one at the next
+// byte; the default is 3, as in zstd. Offsets are always sent in full rather than as
+// repeat offsets, which would tie each block to the ones before it.
+//
+// With --dict the first block may copy from the dictionary content, and the
+// frame names the dictionary by its ID when it is a zstd dictionary (as
+// written by gopigz --format zstd train), so zstd -D can read the output too.
+// Build with -tags nozstd to leave it out.
+
+const (
+	ZSTD_MAGIC      = 0xFD2FB528
+	ZSTD_DICT_MAGIC = 0xEC30A437
+	// IDs below this are reserved for a registry of public dictionaries
+	ZSTD_MIN_DICT_ID = 32768
+
+	ZSTD_MAX_BLOCK  = 128 * 1024
+	ZSTD_MIN_MATCH  = 4
+	ZSTD_MAX_MATCH  = 131074
+	ZSTD_MIN_WINDOW = 17
+	ZSTD_MAX_WINDOW = 27 // largest window accepted when decompressing
+	ZSTD_HASH_LOG   = 15
+
+	ZSTD_DEFAULT_LEVEL = 3
+)
+
+// Block types
+const (
+	ZSTD_BLOCK_RAW        = 0
+	ZSTD_BLOCK_RLE        = 1
+	ZSTD_BLOCK_COMPRESSED = 2
+)
+
+// Predefined distributions of the literal length, match length and offset
+// codes, and their accuracy logs
+var (
+	zstdLLDefault = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}
+	zstdMLDefault = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+	zstdOFDefault = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+
+	// the predefined offset codes stop at 28; blocks with longer offsets
+	// send this distribution instead
+	zstdOFLong = []int16{2, 2, 2, 2, 2, 2, 4, 4, 4, 2, 2, 2, 2, 2, 2, 2,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1}
+)
+
+const (
+	ZSTD_LL_LOG = 6
+	ZSTD_ML_LOG = 6
+	ZSTD_OF_LOG = 5
+
+	ZSTD_OF_LONG_LOG = 6
+)
+
+// Baselines and extra bits of the literal length and match length codes
+var (
+	zstdLLBase = []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536}
+	zstdLLBits = []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	zstdMLBase = []uint32{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539}
+	zstdMLBits = []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+var (
+	zstdLLEncoder = newFSEEncoder(zstdLLDefault, ZSTD_LL_LOG)
+	zstdMLEncoder = newFSEEncoder(zstdMLDefault, ZSTD_ML_LOG)
+	zstdOFEncoder = newFSEEncoder(zstdOFDefault, ZSTD_OF_LOG)
+
+	zstdOFLongEncoder = newFSEEncoder(zstdOFLong, ZSTD_OF_LONG_LOG)
+)
+
+// zstd dictionary loaded with --dict
+var zdict *zstdDict
+
+func init() {
+	registerCodec("zstd", &codec{
+		suffix:      ".zst",
+		contentType: "application/zstd",
+		newChecksum: func() hash.Hash32 { return newXXH64() },
+		start: func() {
+			ldm = nil
+			if longWindow > 0 {
+				ldm = newZstdLDM(zstdWindowLog())
+			}
+		},
+		header: zstdFrameHeader,
+		block:  zstdBlock,
+		// long-range matching keeps the input so far
+		sequential: func() bool { return ldm != nil },
+		trailer:    zstdFrameTrailer,
+		memory:     zstdMemory,
+		dictionary: true,
+		loadDictionary: func(data []byte) ([]byte, error) {
+			d, err := parseDictionary(data)
+			if err != nil {
+				return nil, err
+			}
+			zdict = d
+			return d.content, nil
+		},
+		trainedDictionary: func(content []byte) []byte {
+			return zstdDictionary(dictionaryID(content), content)
+		},
+		decompress: func(input io.Reader, output io.Writer) error {
+			return zstdDecompress(input, output, zdict)
+		},
+	})
+	optionChecks = append(optionChecks, func() error {
+		if format == "zstd" && blockSize > ZSTD_MAX_BLOCK {
+			return fmt.Errorf("zstd blocks hold at most %d KiB", ZSTD_MAX_BLOCK/1024)
+		}
+		return nil
+	})
+}
+
+// zstdMemory estimates the memory the match finders need.
+func zstdMemory() int64 {
+	// hash chains over the block and the dictionary
+	need := 4*int64(blockSize+len(dictionary)) + 4<<ZSTD_HASH_LOG
+	if longWindow > 0 {
+		need += ldmMemory(zstdWindowLog())
+	}
+	return need
+}
+
+// zstdDict is a dictionary: either a zstd dictionary, with an ID, entropy
+// tables and repeat offsets, or raw content of any other kind.
+type zstdDict struct {
+	id      uint32
+	content []byte
+	huf     *huffTable
+	ll      *fseTable
+	of      *fseTable
+	ml      *fseTable
+	rep     [3]int
+}
+
+// parseDictionary reads a dictionary file. Files without the zstd
+// dictionary magic are taken as raw content.
+func parseDictionary(data []byte) (*zstdDict, error) {
+	d := &zstdDict{content: data, rep: [3]int{1, 4, 8}}
+	if len(data) < 8 || binary.LittleEndian.Uint32(data) != ZSTD_DICT_MAGIC {
+		return d, nil
+	}
+	d.id = binary.LittleEndian.Uint32(data[4:])
+	b := data[8:]
+	var n int
+	var err error
+	if d.huf, n, err = readHuffTable(b); err != nil {
+		return nil, fmt.Errorf("zstd dictionary: %v", err)
+	}
+	b = b[n:]
+	for _, t := range []struct {
+		table     **fseTable
+		maxSymbol int
+		maxLog    uint
+	}{{&d.of, 31, 8}, {&d.ml, 52, 9}, {&d.ll, 35, 9}} {
+		norm, log, n, err := readFSETable(b, t.maxSymbol, t.maxLog)
+		if err != nil {
+			return nil, fmt.Errorf("zstd dictionary: %v", err)
+		}
+		*t.table = newFSETable(norm, log)
+		b = b[n:]
+	}
+	if len(b) < 12 {
+		return nil, fmt.Errorf("zstd dictionary: %v", errZstdCorrupt)
+	}
+	for i := range d.rep {
+		d.rep[i] = int(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	d.content = b[12:]
+	for _, r := range d.rep {
+		if r == 0 || r > len(d.content) {
+			return nil, fmt.Errorf("zstd dictionary: invalid repeat offset %d", r)
+		}
+	}
+	return d, nil
+}
+
+// zstdDictionary wraps trained content into a zstd dictionary with the
+// given ID. The entropy tables are generic ones: the predefined sequence
+// distributions, and 7-bit codes for the ASCII literals.
+func zstdDictionary(id uint32, content []byte) []byte {
+	out := appendUint32(nil, ZSTD_DICT_MAGIC)
+	out = appendUint32(out, id)
+	// 127 weights of 1 given directly, the 128th is implied
+	out = append(out, 127+127)
+	for i := 0; i < 63; i++ {
+		out = append(out, 0x11)
+	}
+	out = append(out, 0x10)
+	out = writeFSETable(out, zstdOFDefault, ZSTD_OF_LOG)
+	out = writeFSETable(out, zstdMLDefault, ZSTD_ML_LOG)
+	out = writeFSETable(out, zstdLLDefault, ZSTD_LL_LOG)
+	for _, r := range []uint32{1, 4, 8} {
+		out = appendUint32(out, r)
+	}
+	return append(out, content...)
+}
+
+// dictionaryID derives the ID of a zstd dictionary from its content, in
+// the range zstd leaves open for private use.
+func dictionaryID(content []byte) uint32 {
+	h := newXXH64()
+	h.Write(content)
+	return ZSTD_MIN_DICT_ID + uint32(h.Sum64()%(1<<31-ZSTD_MIN_DICT_ID))
+}
+
+// zstdWindowLog returns the window log of the frames written: large enough
+// for a whole block plus the dictionary behind it, or the --long window.
+func zstdWindowLog() uint {
+	log := uint(ZSTD_MIN_WINDOW)
+	for 1<<log < blockSize+len(dictionary) {
+		log++
+	}
+	if uint(longWindow) > log {
+		log = uint(longWindow)
+	}
+	return log
+}
+
+// zstdFrameHeader returns the frame header. The content size is not known
+// up front; the frame carries a checksum, and the dictionary ID if any.
+func zstdFrameHeader() []byte {
+	header := appendUint32(nil, ZSTD_MAGIC)
+	var id uint32
+	if zdict != nil {
+		id = zdict.id
+	}
+	fhd := byte(1 << 2) // Content_Checksum_flag
+	var idBytes int
+	switch {
+	case id == 0:
+	case id < 1<<8:
+		fhd |= 1
+		idBytes = 1
+	case id < 1<<16:
+		fhd |= 2
+		idBytes = 2
+	default:
+		fhd |= 3
+		idBytes = 4
+	}
+	header = append(header, fhd, byte(zstdWindowLog()-10)<<3)
+	for i := 0; i < idBytes; i++ {
+		header = append(header, byte(id>>(8*uint(i))))
+	}
+	return header
+}
+
+// zstdFrameTrailer returns the content checksum ending the frame.
+func zstdFrameTrailer(sum uint32) []byte {
+	return appendUint32(nil, sum)
+}
+
+// zstdBlockHeader appends the 3-byte header of a block.
+func zstdBlockHeader(out []byte, last bool, typ int, size int) []byte {
+	h := uint32(size)<<3 | uint32(typ)<<1
+	if last {
+		h |= 1
+	}
+	return append(out, byte(h), byte(h>>8), byte(h>>16))
+}
+
+type zstdSequence struct {
+	litLen   uint32
+	matchLen uint32
+	offset   uint32
+}
+
+// zstdLevel returns the level for the zstd encoder.
+func zstdLevel() int {
+	if level == flate.DefaultCompression {
+		return ZSTD_DEFAULT_LEVEL
+	}
+	return level
+}
+
+// zstdMatchParams maps a compression level to hash chain depth and whether
+// matches are chosen lazily.
+func zstdMatchParams(level int) (depth int, lazy bool) {
+	switch {
+	case level <= 1:
+		return 4, false
+	case level <= 2:
+		return 8, false
+	case level <= 3:
+		return 16, false
+	case level <= 5:
+		return 16 << (level - 4), true
+	case level <= 7:
+		return 64 << (level - 6), true
+	default:
+		return 256 << (level - 8), true
+	}
+}
+
+func zstdHash(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b) * 2654435761 >> (32 - ZSTD_HASH_LOG)
+}
+
+// zstdMatches finds the sequences of data, which may copy from prefix as
+// well, around the long matches given, searching as level has it. It returns
+// them and the literals.
+func zstdMatches(data, prefix []byte, long []zstdLongMatch, level int) ([]zstdSequence, []byte) {
+	depth, lazy := zstdMatchParams(level)
+	buf := data
+	if len(prefix) > 0 {
+		buf = append(append(make([]byte, 0, len(prefix)+len(data)), prefix...), data...)
+	}
+	start := len(prefix)
+	head := make([]int32, 1<<ZSTD_HASH_LOG)
+	for i := range head {
+		head[i] = -1
+	}
+	chain := make([]int32, len(buf))
+	insert := func(i int) {
+		h := zstdHash(buf[i:])
+		chain[i] = head[h]
+		head[h] = int32(i)
+	}
+	for i := 0; i+4 <= start; i++ {
+		insert(i)
+	}
+	// longest match at i ending before limit
+	find := func(i, limit int) (bestLen, bestPos int) {
+		for j, d := head[zstdHash(buf[i:])], 0; j >= 0 && d < depth; j, d = chain[j], d+1 {
+			n := 0
+			for i+n < limit && n < ZSTD_MAX_MATCH && buf[int(j)+n] == buf[i+n] {
+				n++
+			}
+			if n > bestLen {
+				bestLen, bestPos = n, int(j)
+			}
+		}
+		return bestLen, bestPos
+	}
+
+	var seqs []zstdSequence
+	var lits []byte
+	anchor := start
+	for i := start; i < len(buf); {
+		limit := len(buf)
+		if len(long) > 0 {
+			limit = start + long[0].pos
+		}
+		if i == limit {
+			m := long[0]
+			long = long[1:]
+			lits = append(lits, buf[anchor:i]...)
+			seqs = append(seqs, zstdSequence{uint32(i - anchor), uint32(m.length), uint32(m.offset)})
+			i += m.length
+			anchor = i
+			continue
+		}
+		if i+4 > limit {
+			i = limit
+			continue
+		}
+
+		bestLen, bestPos := find(i, limit)
+		insert(i)
+		if bestLen < ZSTD_MIN_MATCH {
+			i++
+			continue
+		}
+		// leave the byte as a literal if the next one starts a longer match
+		if lazy && bestLen < ZSTD_MAX_MATCH && i+5 <= limit {
+			if n, _ := find(i+1, limit); n > bestLen {
+				i++
+				continue
+			}
+		}
+		lits = append(lits, buf[anchor:i]...)
+		seqs = append(seqs, zstdSequence{uint32(i - anchor), uint32(bestLen), uint32(i - bestPos)})
+		for k := i + 1; k < i+bestLen && k+4 <= len(buf); k++ {
+			insert(k)
+		}
+		i += bestLen
+		anchor = i
+	}
+	lits = append(lits, buf[anchor:]...)
+	return seqs, lits
+}
+
+// zstdCode returns the code of value among the baselines.
+func zstdCode(base []uint32, value uint32) uint8 {
+	code := len(base) - 1
+	for base[code] > value {
+		code--
+	}
+	return uint8(code)
+}
+
+// zstdSequences encodes the sequences section with the predefined
+// distributions, but for offsets beyond their reach.
+func zstdSequences(out []byte, seqs []zstdSequence) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		out = append(out, 0xFF, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	if n == 0 {
+		return out
+	}
+
+	ll := make([]uint8, n)
+	ml := make([]uint8, n)
+	of := make([]uint8, n)
+	ofEncoder := zstdOFEncoder
+	for i, s := range seqs {
+		ll[i] = zstdCode(zstdLLBase, s.litLen)
+		ml[i] = zstdCode(zstdMLBase, s.matchLen)
+		of[i] = uint8(bits.Len32(s.offset+3) - 1)
+		if int(of[i]) >= len(zstdOFDefault) {
+			ofEncoder = zstdOFLongEncoder
+		}
+	}
+	if ofEncoder == zstdOFLongEncoder {
+		out = append(out, 2<<4) // offsets FSE compressed, the rest predefined
+		out = writeFSETable(out, zstdOFLong, ZSTD_OF_LONG_LOG)
+	} else {
+		out = append(out, 0) // predefined modes
+	}
+
+	var w bitWriter
+	extra := func(i int) {
+		s := seqs[i]
+		w.addBits(uint64(s.litLen-zstdLLBase[ll[i]]), uint(zstdLLBits[ll[i]]))
+		w.addBits(uint64(s.matchLen-zstdMLBase[ml[i]]), uint(zstdMLBits[ml[i]]))
+		w.addBits(uint64(s.offset+3), uint(of[i]))
+	}
+	var llState, mlState, ofState fseState
+	mlState.init(zstdMLEncoder, ml[n-1])
+	ofState.init(ofEncoder, of[n-1])
+	llState.init(zstdLLEncoder, ll[n-1])
+	extra(n - 1)
+	for i := n - 2; i >= 0; i-- {
+		ofState.encode(&w, of[i])
+		mlState.encode(&w, ml[i])
+		llState.encode(&w, ll[i])
+		extra(i)
+	}
+	mlState.flush(&w)
+	ofState.flush(&w)
+	llState.flush(&w)
+	return append(out, w.close()...)
+}
+
+// zstdBlock compresses the data of a pipeline block into a zstd block. The
+// first block may copy from the dictionary, and with --long every block from
+// the window before it.
+func zstdBlock(b *block) []byte {
+	var prefix []byte
+	if b.Index == 1 {
+		prefix = dictionary
+	}
+	var long []zstdLongMatch
+	if ldm != nil {
+		long = ldm.matches(b.RawData)
+	}
+	seqs, lits := zstdMatches(b.RawData, prefix, long, zstdLevel())
+
+	// raw literals section
+	var body []byte
+	switch n := len(lits); {
+	case n < 32:
+		body = append(body, byte(n<<3))
+	case n < 4096:
+		body = append(body, byte(n<<4|1<<2), byte(n>>4))
+	default:
+		body = append(body, byte(n<<4|3<<2), byte(n>>4), byte(n>>12))
+	}
+	body = append(body, lits...)
+	body = zstdSequences(body, seqs)
+
+	if len(body) >= len(b.RawData) {
+		out := zstdBlockHeader(nil, b.LastBlock, ZSTD_BLOCK_RAW, len(b.RawData))
+		return append(out, b.RawData...)
+	}
+	out := zstdBlockHeader(nil, b.LastBlock, ZSTD_BLOCK_COMPRESSED, len(body))
+	return append(out, body...)
+}
@@ -0,0 +1,528 @@
+//go:build !nozstd
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// zstd decompression. Any conforming frame is accepted, not only the ones
+// gopigz writes, as long as its window is within zstdMaxWindow(). Skippable
+// frames are skipped.
+
+var (
+	zstdLLPredefined = newFSETable(zstdLLDefault, ZSTD_LL_LOG)
+	zstdMLPredefined = newFSETable(zstdMLDefault, ZSTD_ML_LOG)
+	zstdOFPredefined = newFSETable(zstdOFDefault, ZSTD_OF_LOG)
+)
+
+// zstdDecoder holds the state carried from block to block of a frame.
+type zstdDecoder struct {
+	window int
+	hist   []byte // the window, preceded by the dictionary at first
+	huf    *huffTable
+	ll     *fseTable
+	of     *fseTable
+	ml     *fseTable
+	rep    [3]int
+}
+
+// zstdMaxWindow returns the largest zstd window decompression accepts:
+// --memory if given, else the --long window if larger than the default.
+func zstdMaxWindow() int64 {
+	if memoryLimit > 0 {
+		return int64(memoryLimit)
+	}
+	if longWindow > ZSTD_MAX_WINDOW {
+		return 1 << uint(longWindow)
+	}
+	return 1 << ZSTD_MAX_WINDOW
+}
+
+// zstdDecompress decompresses the zstd frames of input to output.
+func zstdDecompress(input io.Reader, output io.Writer, dict *zstdDict) error {
+	r := bufio.NewReader(input)
+	w := bufio.NewWriter(output)
+	for frames := 0; ; frames++ {
+		var magic [4]byte
+		if _, err := io.ReadFull(r, magic[:]); err != nil {
+			if err == io.EOF && frames > 0 {
+				break
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return errors.New("zstd: unexpected end of input")
+			}
+			return err
+		}
+		m := binary.LittleEndian.Uint32(magic[:])
+		if m&0xFFFFFFF0 == 0x184D2A50 {
+			var size [4]byte
+			if _, err := io.ReadFull(r, size[:]); err != nil {
+				return errors.New("zstd: unexpected end of input")
+			}
+			if _, err := io.CopyN(ioutil.Discard, r, int64(binary.LittleEndian.Uint32(size[:]))); err != nil {
+				return errors.New("zstd: unexpected end of input")
+			}
+			continue
+		}
+		if m != ZSTD_MAGIC {
+			if frames == 0 {
+				return errors.New("zstd: not in zstd format")
+			}
+			return errors.New("zstd: trailing garbage after frame")
+		}
+		if err := decodeZstdFrame(r, w, dict); err != nil {
+			w.Flush()
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func decodeZstdFrame(r *bufio.Reader, w io.Writer, dict *zstdDict) error {
+	unexpected := func(err error) error {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New("zstd: unexpected end of input")
+		}
+		return err
+	}
+	fhd, err := r.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	if fhd&(1<<3) != 0 {
+		return errZstdCorrupt
+	}
+	single := fhd&(1<<5) != 0
+	hasChecksum := fhd&(1<<2) != 0
+
+	var window uint64
+	if !single {
+		wd, err := r.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		log := uint(wd>>3) + 10
+		if log > 41 {
+			return errZstdCorrupt
+		}
+		window = 1<<log + (1<<log)/8*uint64(wd&7)
+	}
+
+	readLE := func(n int) (uint64, error) {
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:n]); err != nil {
+			return 0, unexpected(err)
+		}
+		return binary.LittleEndian.Uint64(b[:]), nil
+	}
+	id, err := readLE([]int{0, 1, 2, 4}[fhd&3])
+	if err != nil {
+		return err
+	}
+	fcsBytes := []int{0, 2, 4, 8}[fhd>>6]
+	if fhd>>6 == 0 && single {
+		fcsBytes = 1
+	}
+	size, err := readLE(fcsBytes)
+	if err != nil {
+		return err
+	}
+	if fcsBytes == 2 {
+		size += 256
+	}
+	if single {
+		window = size
+	}
+	if max := zstdMaxWindow(); window > uint64(max) {
+		return fmt.Errorf("zstd: frame needs a window of %s, more than the %s allowed; use --long or --memory",
+			formatSize(int64(window)), formatSize(max))
+	}
+
+	if id != 0 {
+		if dict == nil {
+			return fmt.Errorf("zstd: frame needs dictionary %d, use --dict", id)
+		}
+		if uint64(dict.id) != id {
+			return fmt.Errorf("zstd: frame needs dictionary %d, not %d", id, dict.id)
+		}
+	}
+
+	d := &zstdDecoder{window: int(window), rep: [3]int{1, 4, 8}}
+	if dict != nil {
+		d.hist = append(d.hist, dict.content...)
+		d.huf, d.ll, d.of, d.ml, d.rep = dict.huf, dict.ll, dict.of, dict.ml, dict.rep
+	}
+	sum := newXXH64()
+	var total uint64
+
+	maxBlock := ZSTD_MAX_BLOCK
+	if d.window < maxBlock {
+		maxBlock = d.window
+	}
+	for {
+		h, err := readLE(3)
+		if err != nil {
+			return err
+		}
+		last := h&1 != 0
+		typ := int(h>>1) & 3
+		n := int(h >> 3)
+		if n > maxBlock {
+			return errZstdCorrupt
+		}
+
+		from := len(d.hist)
+		switch typ {
+		case ZSTD_BLOCK_RAW:
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return unexpected(err)
+			}
+			d.hist = append(d.hist, buf...)
+		case ZSTD_BLOCK_RLE:
+			c, err := r.ReadByte()
+			if err != nil {
+				return unexpected(err)
+			}
+			for i := 0; i < n; i++ {
+				d.hist = append(d.hist, c)
+			}
+		case ZSTD_BLOCK_COMPRESSED:
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return unexpected(err)
+			}
+			if err := d.decodeBlock(buf, maxBlock); err != nil {
+				return err
+			}
+		default:
+			return errZstdCorrupt
+		}
+
+		out := d.hist[from:]
+		sum.Write(out)
+		total += uint64(len(out))
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+		// keep the window; the dictionary goes once it is out of reach
+		if len(d.hist) > 2*d.window+ZSTD_MAX_BLOCK {
+			keep := d.window
+			d.hist = append(d.hist[:0], d.hist[len(d.hist)-keep:]...)
+		}
+		if last {
+			break
+		}
+	}
+
+	if fcsBytes > 0 && total != size {
+		return fmt.Errorf("zstd: frame holds %d bytes, header says %d", total, size)
+	}
+	if hasChecksum {
+		want, err := readLE(4)
+		if err != nil {
+			return err
+		}
+		if uint32(want) != sum.Sum32() {
+			return errors.New("zstd: checksum mismatch")
+		}
+	}
+	return nil
+}
+
+// decodeBlock decodes a compressed block onto d.hist.
+func (d *zstdDecoder) decodeBlock(b []byte, maxBlock int) error {
+	lits, n, err := d.decodeLiterals(b, maxBlock)
+	if err != nil {
+		return err
+	}
+	seqs, err := d.decodeSequences(b[n:])
+	if err != nil {
+		return err
+	}
+
+	produced := 0
+	for _, s := range seqs {
+		ll, ml := int(s.litLen), int(s.matchLen)
+		if ll > len(lits) {
+			return errZstdCorrupt
+		}
+		d.hist = append(d.hist, lits[:ll]...)
+		lits = lits[ll:]
+
+		offset := int(s.offset)
+		if offset > 3 {
+			offset -= 3
+			d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+		} else {
+			idx := offset - 1
+			if ll == 0 {
+				idx++
+			}
+			switch idx {
+			case 0:
+				offset = d.rep[0]
+			case 1:
+				offset = d.rep[1]
+				d.rep = [3]int{offset, d.rep[0], d.rep[2]}
+			case 2:
+				offset = d.rep[2]
+				d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+			default:
+				offset = d.rep[0] - 1
+				d.rep = [3]int{offset, d.rep[0], d.rep[1]}
+			}
+		}
+		if offset <= 0 || offset > len(d.hist) {
+			return errZstdCorrupt
+		}
+		produced += ll + ml
+		if produced > maxBlock {
+			return errZstdCorrupt
+		}
+		from := len(d.hist) - offset
+		if offset >= ml {
+			d.hist = append(d.hist, d.hist[from:from+ml]...)
+			continue
+		}
+		for i := 0; i < ml; i++ {
+			d.hist = append(d.hist, d.hist[from+i])
+		}
+	}
+	if produced+len(lits) > maxBlock {
+		return errZstdCorrupt
+	}
+	d.hist = append(d.hist, lits...)
+	return nil
+}
+
+// decodeLiterals decodes the literals section and returns the literals and
+// the length of the section.
+func (d *zstdDecoder) decodeLiterals(b []byte, maxBlock int) ([]byte, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	typ := b[0] & 3
+	sizeFormat := b[0] >> 2 & 3
+	le := func(n int) (int, bool) {
+		if len(b) < n {
+			return 0, false
+		}
+		v := 0
+		for i := n - 1; i >= 0; i-- {
+			v = v<<8 | int(b[i])
+		}
+		return v, true
+	}
+
+	if typ < 2 {
+		var size, hs int
+		switch sizeFormat {
+		case 0, 2:
+			size, hs = int(b[0]>>3), 1
+		case 1:
+			v, ok := le(2)
+			if !ok {
+				return nil, 0, errZstdCorrupt
+			}
+			size, hs = v>>4, 2
+		default:
+			v, ok := le(3)
+			if !ok {
+				return nil, 0, errZstdCorrupt
+			}
+			size, hs = v>>4, 3
+		}
+		if size > maxBlock {
+			return nil, 0, errZstdCorrupt
+		}
+		if typ == 0 {
+			if hs+size > len(b) {
+				return nil, 0, errZstdCorrupt
+			}
+			return b[hs : hs+size], hs + size, nil
+		}
+		if hs >= len(b) {
+			return nil, 0, errZstdCorrupt
+		}
+		lits := make([]byte, size)
+		for i := range lits {
+			lits[i] = b[hs]
+		}
+		return lits, hs + 1, nil
+	}
+
+	hs, sizeBits, streams := 3, uint(10), 4
+	switch sizeFormat {
+	case 0:
+		streams = 1
+	case 2:
+		hs, sizeBits = 4, 14
+	case 3:
+		hs, sizeBits = 5, 18
+	}
+	v, ok := le(hs)
+	if !ok {
+		return nil, 0, errZstdCorrupt
+	}
+	mask := 1<<sizeBits - 1
+	regen := v >> 4 & mask
+	comp := v >> (4 + sizeBits) & mask
+	if regen > maxBlock || hs+comp > len(b) {
+		return nil, 0, errZstdCorrupt
+	}
+	data := b[hs : hs+comp]
+	if typ == 2 {
+		t, n, err := readHuffTable(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		d.huf = t
+		data = data[n:]
+	} else if d.huf == nil {
+		return nil, 0, errZstdCorrupt
+	}
+
+	lits := make([]byte, 0, regen)
+	var err error
+	if streams == 1 {
+		if lits, err = d.huf.decodeStream(lits, data, regen); err != nil {
+			return nil, 0, err
+		}
+		return lits, hs + comp, nil
+	}
+	if len(data) < 6 {
+		return nil, 0, errZstdCorrupt
+	}
+	sizes := [4]int{
+		int(binary.LittleEndian.Uint16(data)),
+		int(binary.LittleEndian.Uint16(data[2:])),
+		int(binary.LittleEndian.Uint16(data[4:])),
+	}
+	sizes[3] = len(data) - 6 - sizes[0] - sizes[1] - sizes[2]
+	if sizes[3] < 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	seg := (regen + 3) / 4
+	pos := 6
+	for i, n := range sizes {
+		count := seg
+		if i == 3 {
+			count = regen - 3*seg
+		}
+		if count < 0 {
+			return nil, 0, errZstdCorrupt
+		}
+		if lits, err = d.huf.decodeStream(lits, data[pos:pos+n], count); err != nil {
+			return nil, 0, err
+		}
+		pos += n
+	}
+	return lits, hs + comp, nil
+}
+
+// decodeSequences decodes the sequences section. Offsets are returned as
+// coded, before repeat offsets are resolved.
+func (d *zstdDecoder) decodeSequences(b []byte) ([]zstdSequence, error) {
+	if len(b) == 0 {
+		return nil, errZstdCorrupt
+	}
+	n := int(b[0])
+	pos := 1
+	switch {
+	case n == 0:
+		return nil, nil
+	case n == 255:
+		if len(b) < 3 {
+			return nil, errZstdCorrupt
+		}
+		n = int(b[1]) + int(b[2])<<8 + 0x7F00
+		pos = 3
+	case n >= 128:
+		if len(b) < 2 {
+			return nil, errZstdCorrupt
+		}
+		n = (n-128)<<8 + int(b[1])
+		pos = 2
+	}
+	if pos >= len(b) {
+		return nil, errZstdCorrupt
+	}
+	modes := b[pos]
+	pos++
+	if modes&3 != 0 {
+		return nil, errZstdCorrupt
+	}
+
+	for _, t := range []struct {
+		table      **fseTable
+		mode       byte
+		predefined *fseTable
+		maxSymbol  int
+		maxLog     uint
+	}{
+		{&d.ll, modes >> 6, zstdLLPredefined, 35, 9},
+		{&d.of, modes >> 4 & 3, zstdOFPredefined, 31, 8},
+		{&d.ml, modes >> 2 & 3, zstdMLPredefined, 52, 9},
+	} {
+		switch t.mode {
+		case 0:
+			*t.table = t.predefined
+		case 1:
+			if pos >= len(b) || int(b[pos]) > t.maxSymbol {
+				return nil, errZstdCorrupt
+			}
+			*t.table = rleTable(b[pos])
+			pos++
+		case 2:
+			norm, log, used, err := readFSETable(b[pos:], t.maxSymbol, t.maxLog)
+			if err != nil {
+				return nil, err
+			}
+			*t.table = newFSETable(norm, log)
+			pos += used
+		case 3:
+			if *t.table == nil {
+				return nil, errZstdCorrupt
+			}
+		}
+	}
+
+	r, err := newReverseBits(b[pos:])
+	if err != nil {
+		return nil, err
+	}
+	ll, of, ml := d.ll, d.of, d.ml
+	llState := uint(r.read(ll.log))
+	ofState := uint(r.read(of.log))
+	mlState := uint(r.read(ml.log))
+	seqs := make([]zstdSequence, n)
+	for i := range seqs {
+		ofCode := of.symbol[ofState]
+		mlCode := ml.symbol[mlState]
+		llCode := ll.symbol[llState]
+		if ofCode > 31 || int(mlCode) >= len(zstdMLBase) || int(llCode) >= len(zstdLLBase) {
+			return nil, errZstdCorrupt
+		}
+		s := &seqs[i]
+		s.offset = uint32(1)<<ofCode + uint32(r.read(uint(ofCode)))
+		s.matchLen = zstdMLBase[mlCode] + uint32(r.read(uint(zstdMLBits[mlCode])))
+		s.litLen = zstdLLBase[llCode] + uint32(r.read(uint(zstdLLBits[llCode])))
+		if i == n-1 {
+			break
+		}
+		llState = uint(ll.base[llState]) + uint(r.read(uint(ll.nbits[llState])))
+		mlState = uint(ml.base[mlState]) + uint(r.read(uint(ml.nbits[mlState])))
+		ofState = uint(of.base[ofState]) + uint(r.read(uint(of.nbits[ofState])))
+	}
+	if r.pos != 0 {
+		return nil, errZstdCorrupt
+	}
+	return seqs, nil
+}
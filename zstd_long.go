@@ -0,0 +1,172 @@
+//go:build !nozstd
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+// Long-range matching for zstd (--long[=N]).
+//
+// Blocks are normally matched only against themselves, which misses
+// repetitions further apart than a block, such as the copies of a file in a
+// VM image or the repeated rows of a database dump. With --long the frame
+// gets a window of 2^N bytes (2^27 by default) and the compress stage keeps
+// that much of the input. A rolling hash samples it at positions picked by
+// content, so that repeated data is sampled at the same places wherever it
+// occurs, and matches of at least LDM_MIN_MATCH bytes found through it are
+// sent as sequences reaching back up to the whole window. The rest of every
+// block is matched as usual.
+//
+// The window costs memory on both ends: zstd needs --long=N (or --memory)
+// to decompress windows over 2^27 bytes, and so does gopigz -d.
+
+// Parsing long flag: the window log, 0 when off
+var longWindow longFlag
+
+const (
+	LDM_DEFAULT_WINDOW = 27
+	LDM_MAX_WINDOW     = 31
+	LDM_MIN_MATCH      = 64
+	LDM_HASH_LOG       = 20
+	LDM_RATE_LOG       = 7 // one position in 2^LDM_RATE_LOG is sampled
+)
+
+func init() {
+	flag.Var(&longWindow, "long", "Match zstd input up to 2^N bytes back (default 27); with -d, accept such windows")
+	optionChecks = append(optionChecks, func() error {
+		if longWindow > 0 && format != "zstd" {
+			return errors.New("--long is only supported with the zstd format")
+		}
+		return nil
+	})
+}
+
+// longFlag is a window log that may be given without a value.
+type longFlag int
+
+func (l *longFlag) IsBoolFlag() bool { return true }
+
+func (l *longFlag) String() string {
+	if l == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*l))
+}
+
+func (l *longFlag) Set(v string) error {
+	switch v {
+	case "true":
+		*l = LDM_DEFAULT_WINDOW
+		return nil
+	case "false":
+		*l = 0
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < ZSTD_MIN_WINDOW || n > LDM_MAX_WINDOW {
+		return fmt.Errorf("window log must be between %d and %d", ZSTD_MIN_WINDOW, LDM_MAX_WINDOW)
+	}
+	*l = longFlag(n)
+	return nil
+}
+
+// gear holds the random values the rolling hash adds up.
+var gear [256]uint64
+
+func init() {
+	// splitmix64, so the table is the same in every build
+	x := uint64(0x9E3779B97F4A7C15)
+	for i := range gear {
+		x += 0x9E3779B97F4A7C15
+		z := x
+		z = (z ^ z>>30) * 0xBF58476D1CE4E5B9
+		z = (z ^ z>>27) * 0x94D049BB133111EB
+		gear[i] = z ^ z>>31
+	}
+}
+
+// zstdLongMatch is a match found through the long-range hash, at pos in the
+// block.
+type zstdLongMatch struct {
+	pos    int
+	length int
+	offset int
+}
+
+// zstdLDM is the long-range matching state of the stream being compressed.
+type zstdLDM struct {
+	window int
+	hist   []byte  // the input so far, at least the last window of it
+	base   int64   // stream offset of hist[0]
+	table  []int64 // stream offset + 1 of the sampled positions, by hash
+	hash   uint64
+}
+
+// long-range matching state, nil unless --long is given
+var ldm *zstdLDM
+
+func newZstdLDM(windowLog uint) *zstdLDM {
+	return &zstdLDM{window: 1 << windowLog, table: make([]int64, 1<<LDM_HASH_LOG)}
+}
+
+// ldmMemory returns the memory long-range matching needs with a window of
+// 2^windowLog bytes: up to two windows of input, and the hash table.
+func ldmMemory(windowLog uint) int64 {
+	return 2<<windowLog + 8<<LDM_HASH_LOG
+}
+
+// matches adds data to the history and returns the long matches in it, in
+// order and not overlapping.
+func (l *zstdLDM) matches(data []byte) []zstdLongMatch {
+	if len(l.hist) >= 2*l.window {
+		drop := len(l.hist) - l.window
+		l.hist = append(l.hist[:0], l.hist[drop:]...)
+		l.base += int64(drop)
+	}
+	start := len(l.hist)
+	l.hist = append(l.hist, data...)
+	hist := l.hist
+
+	var found []zstdLongMatch
+	next := start // where the next match may begin
+	for i := start; i < len(hist); i++ {
+		l.hash = l.hash<<1 + gear[hist[i]]
+		if l.base+int64(i) < LDM_MIN_MATCH-1 || l.hash>>(64-LDM_HASH_LOG-LDM_RATE_LOG)&(1<<LDM_RATE_LOG-1) != 0 {
+			continue
+		}
+		// the hash covers the LDM_MIN_MATCH bytes ending at i
+		slot := &l.table[l.hash>>(64-LDM_HASH_LOG)]
+		cand := int(*slot - 1 - l.base)
+		*slot = l.base + int64(i) + 1
+
+		from := i + 1 - LDM_MIN_MATCH
+		if cand < LDM_MIN_MATCH-1 || cand >= i || from < next {
+			continue
+		}
+		offset := i - cand
+		if offset > l.window {
+			continue
+		}
+		n := 0
+		for n < LDM_MIN_MATCH && hist[from+n] == hist[from-offset+n] {
+			n++
+		}
+		if n < LDM_MIN_MATCH {
+			continue
+		}
+		for from+n < len(hist) && n < ZSTD_MAX_MATCH && hist[from+n] == hist[from-offset+n] {
+			n++
+		}
+		for from > next && from-offset > 0 && n < ZSTD_MAX_MATCH && hist[from-1] == hist[from-offset-1] {
+			from--
+			n++
+		}
+		found = append(found, zstdLongMatch{pos: from - start, length: n, offset: offset})
+		next = from + n
+	}
+	return found
+}
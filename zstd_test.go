@@ -0,0 +1,262 @@
+//go:build !nozstd
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+func TestXXH64(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint64
+	}{
+		{"", 0xEF46DB3751D8E999},
+		{"a", 0xD24EC4F1A98C6E5B},
+		{"abc", 0x44BC2CF5AD770999},
+		{"Nobody inspects the spammish repetition", 0xFBCEA83C8A378BF1},
+	}
+	for _, test := range tests {
+		h := newXXH64()
+		// split writes must not change the result
+		for i := 0; i < len(test.data); i += 5 {
+			end := i + 5
+			if end > len(test.data) {
+				end = len(test.data)
+			}
+			h.Write([]byte(test.data[i:end]))
+		}
+		if got := h.Sum64(); got != test.want {
+			t.Errorf("xxh64(%q) = %x, want %x", test.data, got, test.want)
+		}
+	}
+}
+
+func TestFSETableDescription(t *testing.T) {
+	for _, test := range []struct {
+		norm      []int16
+		log       uint
+		maxSymbol int
+	}{
+		{zstdLLDefault, ZSTD_LL_LOG, 35},
+		{zstdMLDefault, ZSTD_ML_LOG, 52},
+		{zstdOFDefault, ZSTD_OF_LOG, 31},
+		{[]int16{20, 0, 0, 0, 0, 0, 0, 0, 10, -1, 1}, 5, 31},
+	} {
+		b := writeFSETable(nil, test.norm, test.log)
+		norm, log, n, err := readFSETable(b, test.maxSymbol, 9)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if log != test.log || n != len(b) {
+			t.Errorf("read log %d from %d bytes, want %d from %d", log, n, test.log, len(b))
+		}
+		for s := range norm {
+			want := int16(0)
+			if s < len(test.norm) {
+				want = test.norm[s]
+			}
+			if norm[s] != want {
+				t.Errorf("symbol %d: count %d, want %d", s, norm[s], want)
+			}
+		}
+	}
+}
+
+// zstdCompress compresses data as a zstd frame through the pipeline.
+func zstdCompress(t *testing.T, data []byte) []byte {
+	format = "zstd"
+	defer func() { format = "gzip" }()
+	var out bytes.Buffer
+	if err := compressStream(bytes.NewReader(data), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// Test that zstd frames round-trip, and decode with the reference zstd
+func TestZstdStream(t *testing.T) {
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 5000)
+	random := make([]byte, BLOCK_SIZE+100)
+	rand.Read(random)
+	data := append(append(append([]byte{}, text...), random...), text...)
+
+	for _, input := range [][]byte{data, {}} {
+		frame := zstdCompress(t, input)
+		var got bytes.Buffer
+		if err := zstdDecompress(bytes.NewReader(frame), &got, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), input) {
+			t.Errorf("decompressed output differs from input")
+		}
+
+		if zstd, err := exec.LookPath("zstd"); err == nil {
+			cmd := exec.Command(zstd, "-dc")
+			cmd.Stdin = bytes.NewReader(frame)
+			got, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, input) {
+				t.Errorf("zstd: decompressed output differs from input")
+			}
+		}
+	}
+
+	frame := zstdCompress(t, data)
+	frame[len(frame)-1] ^= 1
+	if err := zstdDecompress(bytes.NewReader(frame), &bytes.Buffer{}, nil); err == nil {
+		t.Errorf("expected a checksum error")
+	}
+}
+
+// Test that higher levels search harder and compress better
+func TestZstdLevels(t *testing.T) {
+	var data []byte
+	for _, name := range []string{"zstd.go", "zstd_decode.go", "lzma.go"} {
+		src, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, src...)
+	}
+	defer func() { level = flate.DefaultCompression }()
+	sizes := make(map[int]int)
+	for _, level = range []int{1, 9} {
+		frame := zstdCompress(t, data)
+		var got bytes.Buffer
+		if err := zstdDecompress(bytes.NewReader(frame), &got, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), data) {
+			t.Errorf("-%d: decompressed output differs from input", level)
+		}
+		sizes[level] = len(frame)
+	}
+	if sizes[9] >= sizes[1] {
+		t.Errorf("-9 gives %d bytes, -1 %d", sizes[9], sizes[1])
+	}
+}
+
+// Test that frames compressed with a trained zstd dictionary carry its ID,
+// and only decompress with it
+func TestZstdDictionary(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, jsonRecord(i))
+	}
+	content := trainDictionary(samples, 4096)
+	data := zstdDictionary(dictionaryID(content), content)
+
+	var err error
+	if zdict, err = parseDictionary(data); err != nil {
+		t.Fatal(err)
+	}
+	dictionary = zdict.content
+	defer func() { zdict, dictionary = nil, nil }()
+	if zdict.id < ZSTD_MIN_DICT_ID || !bytes.Equal(zdict.content, content) {
+		t.Fatalf("parsed dictionary %d with %d bytes of content", zdict.id, len(zdict.content))
+	}
+
+	record := jsonRecord(1000)
+	frame := zstdCompress(t, record)
+	// magic, descriptor, window and a 4-byte ID
+	if frame[4]&3 != 3 || binary.LittleEndian.Uint32(frame[6:]) != zdict.id {
+		t.Errorf("frame header %x does not name dictionary %d", frame[:10], zdict.id)
+	}
+	if len(frame) >= len(zstdCompressPlain(t, record)) {
+		t.Errorf("dictionary did not help: %d bytes", len(frame))
+	}
+
+	var got bytes.Buffer
+	if err := zstdDecompress(bytes.NewReader(frame), &got, zdict); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), record) {
+		t.Errorf("decompressed output differs from input")
+	}
+	if err := zstdDecompress(bytes.NewReader(frame), &bytes.Buffer{}, nil); err == nil {
+		t.Errorf("expected an error without the dictionary")
+	}
+}
+
+func zstdCompressPlain(t *testing.T, data []byte) []byte {
+	saved, savedContent := zdict, dictionary
+	zdict, dictionary = nil, nil
+	defer func() { zdict, dictionary = saved, savedContent }()
+	return zstdCompress(t, data)
+}
+
+// Test that --long finds repetitions further apart than a block
+func TestZstdLong(t *testing.T) {
+	blob := make([]byte, 3*BLOCK_SIZE)
+	rand.Read(blob)
+	gap := make([]byte, 2*BLOCK_SIZE+1234)
+	rand.Read(gap)
+	data := append(append(append([]byte{}, blob...), gap...), blob...)
+
+	plain := zstdCompress(t, data)
+	longWindow = 20
+	defer func() { longWindow = 0 }()
+	frame := zstdCompress(t, data)
+	if len(frame) > len(plain)-len(blob)+len(blob)/100 {
+		t.Errorf("long matching saved %d of the %d repeated bytes", len(plain)-len(frame), len(blob))
+	}
+	if frame[5]>>3 != 20-10 {
+		t.Errorf("window descriptor %#x, want a 2^20 window", frame[5])
+	}
+
+	var got bytes.Buffer
+	if err := zstdDecompress(bytes.NewReader(frame), &got, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("decompressed output differs from input")
+	}
+}
+
+// Test that offsets past the predefined codes are sent with their own table
+func TestZstdLongOffsets(t *testing.T) {
+	seqs := []zstdSequence{
+		{litLen: 5, matchLen: 100, offset: 1<<30 + 12345},
+		{litLen: 0, matchLen: 4, offset: 7},
+		{litLen: 70000, matchLen: 70000, offset: 1<<29 - 1},
+	}
+	b := zstdSequences(nil, seqs)
+	if b[1]>>4&3 != 2 {
+		t.Errorf("offset mode %d, want FSE compressed", b[1]>>4&3)
+	}
+	d := &zstdDecoder{}
+	got, err := d.decodeSequences(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range seqs {
+		want := seqs[i]
+		want.offset += 3
+		if got[i] != want {
+			t.Errorf("sequence %d: got %+v, want %+v", i, got[i], want)
+		}
+	}
+}
+
+func TestCheckMemory(t *testing.T) {
+	format = "zstd"
+	longWindow = 27
+	memoryLimit = 64 << 20
+	defer func() { format, longWindow, memoryLimit = "gzip", 0, 0 }()
+	if err := checkMemory(); err == nil {
+		t.Errorf("a 128M window fit in 64M")
+	}
+	longWindow = 20
+	if err := checkMemory(); err != nil {
+		t.Error(err)
+	}
+}